@@ -39,6 +39,19 @@ func (b *arccache) DeleteBlock(k key.Key) error {
 	}
 }
 
+func (b *arccache) DeleteBlocks(ks []key.Key) error {
+	for _, k := range ks {
+		b.arc.Remove(k) // Invalidate cache before deleting.
+	}
+	err := deleteBlocks(b.blockstore, ks)
+	if err == nil {
+		for _, k := range ks {
+			b.arc.Add(k, false)
+		}
+	}
+	return err
+}
+
 // if ok == false has is inconclusive
 // if ok == true then has respons to question: is it contained
 func (b *arccache) hasCached(k key.Key) (has bool, ok bool) {
@@ -116,6 +129,14 @@ func (b *arccache) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
 	return b.blockstore.AllKeysChan(ctx)
 }
 
+func (b *arccache) AllKeysChanErr(ctx context.Context) (<-chan key.Key, func() error, error) {
+	return AllKeysChanErr(ctx, b.blockstore)
+}
+
+func (b *arccache) AllKeysChanPrefix(ctx context.Context, prefix string) (<-chan key.Key, func() error, error) {
+	return AllKeysChanPrefix(ctx, b.blockstore, prefix)
+}
+
 func (b *arccache) GCLock() Unlocker {
 	return b.blockstore.(GCBlockstore).GCLock()
 }
@@ -4,8 +4,10 @@ package blockstore
 
 import (
 	"errors"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	blocks "github.com/ipfs/go-ipfs/blocks"
 	logging "gx/ipfs/QmSpJByNKFX1sCsHBEp3R73FL4NF6FnQTEGyNAXHm2GS52/go-log"
@@ -38,6 +40,69 @@ type Blockstore interface {
 	AllKeysChan(ctx context.Context) (<-chan key.Key, error)
 }
 
+// BatchDeleter is implemented by blockstores that can delete several blocks
+// at once more efficiently than one at a time.
+type BatchDeleter interface {
+	// DeleteBlocks deletes all the given blocks. If an error is returned,
+	// some of them may have been deleted nonetheless.
+	DeleteBlocks([]key.Key) error
+}
+
+// Sizer is implemented by blockstores that can report the size of a block
+// cheaply, without reading the whole block.
+type Sizer interface {
+	// GetSize returns the size in bytes of the given block
+	GetSize(key.Key) (int, error)
+}
+
+// BlockCounter is implemented by blockstores that can count their blocks
+// without listing them.
+type BlockCounter interface {
+	// BlockCount returns the number of blocks in the blockstore
+	BlockCount() (int, error)
+}
+
+// Timestamper is implemented by blockstores that record when each block was
+// written.
+type Timestamper interface {
+	// WriteTime returns the time the given block was last written
+	WriteTime(key.Key) (time.Time, error)
+}
+
+// SpaceReporter is implemented by blockstores that know how much space they
+// take and how much they may take.
+type SpaceReporter interface {
+	// SpaceUsage returns the bytes used by the blockstore and the bytes it
+	// may use in total
+	SpaceUsage() (used, total uint64, err error)
+}
+
+// KeyLister is implemented by blockstores that can tell a listing of their
+// keys that completed from one that was cut short by an error.
+type KeyLister interface {
+	// AllKeysChanErr is like AllKeysChan. Once the returned channel is
+	// closed, the returned function gives the error that ended the listing
+	// early, or nil if the listing completed or the context was cancelled.
+	AllKeysChanErr(ctx context.Context) (<-chan key.Key, func() error, error)
+}
+
+// PrefixKeyLister is implemented by blockstores that can list only the keys
+// under a prefix without going through all the others.
+type PrefixKeyLister interface {
+	// AllKeysChanPrefix is like AllKeysChanErr, listing only the keys whose
+	// datastore key, as given by key.Key.DsKey, starts with prefix.
+	AllKeysChanPrefix(ctx context.Context, prefix string) (<-chan key.Key, func() error, error)
+}
+
+// CursorKeyLister is implemented by blockstores that list their keys in the
+// order of their datastore keys, and can start such a listing part way.
+type CursorKeyLister interface {
+	// AllKeysChanAfter is like AllKeysChanErr, listing in order only the
+	// keys whose datastore key, as given by key.Key.DsKey, sorts after
+	// cursor. An empty cursor lists every key.
+	AllKeysChanAfter(ctx context.Context, cursor string) (<-chan key.Key, func() error, error)
+}
+
 type GCBlockstore interface {
 	Blockstore
 
@@ -148,21 +213,119 @@ func (s *blockstore) DeleteBlock(k key.Key) error {
 	return s.datastore.Delete(k.DsKey())
 }
 
+func (s *blockstore) DeleteBlocks(ks []key.Key) error {
+	t, err := s.datastore.Batch()
+	if err != nil {
+		return err
+	}
+	for _, k := range ks {
+		err = t.Delete(k.DsKey())
+		if err != nil {
+			return err
+		}
+	}
+	return t.Commit()
+}
+
+// AllKeysChanErr lists the keys of bs like KeyLister.AllKeysChanErr. When bs
+// doesn't implement KeyLister the returned function always gives nil, as
+// errors can't be told apart from the end of the listing.
+func AllKeysChanErr(ctx context.Context, bs Blockstore) (<-chan key.Key, func() error, error) {
+	if kl, ok := bs.(KeyLister); ok {
+		return kl.AllKeysChanErr(ctx)
+	}
+	keys, err := bs.AllKeysChan(ctx)
+	return keys, func() error { return nil }, err
+}
+
+// AllKeysChanPrefix lists the keys of bs under prefix like
+// PrefixKeyLister.AllKeysChanPrefix, filtering the whole listing if bs can't
+// list a prefix by itself. An empty prefix lists every key.
+func AllKeysChanPrefix(ctx context.Context, bs Blockstore, prefix string) (<-chan key.Key, func() error, error) {
+	if prefix == "" {
+		return AllKeysChanErr(ctx, bs)
+	}
+	if pl, ok := bs.(PrefixKeyLister); ok {
+		return pl.AllKeysChanPrefix(ctx, prefix)
+	}
+	keys, keysErr, err := AllKeysChanErr(ctx, bs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return FilterPrefix(ctx, keys, prefix), keysErr, nil
+}
+
+// FilterPrefix passes on the keys whose datastore key starts with prefix.
+// Once ctx is done, what is left of keys is read and dropped in the
+// background, so a listing that doesn't watch ctx isn't left blocked.
+func FilterPrefix(ctx context.Context, keys <-chan key.Key, prefix string) <-chan key.Key {
+	output := make(chan key.Key, dsq.KeysOnlyBufSize)
+	go func() {
+		defer close(output)
+		defer func() {
+			go func() {
+				for range keys {
+				}
+			}()
+		}()
+		for k := range keys {
+			if !strings.HasPrefix(k.DsKey().String(), prefix) {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case output <- k:
+			}
+		}
+	}()
+	return output
+}
+
+// deleteBlocks deletes ks from bs, in a single batch if bs supports it
+func deleteBlocks(bs Blockstore, ks []key.Key) error {
+	if bd, ok := bs.(BatchDeleter); ok {
+		return bd.DeleteBlocks(ks)
+	}
+	for _, k := range ks {
+		if err := bs.DeleteBlock(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // AllKeysChan runs a query for keys from the blockstore.
 // this is very simplistic, in the future, take dsq.Query as a param?
 //
 // AllKeysChan respects context
 func (bs *blockstore) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
+	keys, _, err := bs.AllKeysChanErr(ctx)
+	return keys, err
+}
+
+// AllKeysChanErr is like AllKeysChan, and also reports a datastore error that
+// ended the listing early.
+func (bs *blockstore) AllKeysChanErr(ctx context.Context) (<-chan key.Key, func() error, error) {
+	return bs.AllKeysChanPrefix(ctx, "")
+}
+
+// AllKeysChanPrefix is like AllKeysChanErr, listing only the keys under
+// prefix.
+func (bs *blockstore) AllKeysChanPrefix(ctx context.Context, prefix string) (<-chan key.Key, func() error, error) {
 
 	// KeysOnly, because that would be _a lot_ of data.
 	q := dsq.Query{KeysOnly: true}
 	// datastore/namespace does *NOT* fix up Query.Prefix
-	q.Prefix = BlockPrefix.String()
+	q.Prefix = BlockPrefix.String() + prefix
 	res, err := bs.datastore.Query(q)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	var errlk sync.Mutex
+	var qerr error
+
 	// this function is here to compartmentalize
 	get := func() (key.Key, bool) {
 		select {
@@ -174,6 +337,9 @@ func (bs *blockstore) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
 			}
 			if e.Error != nil {
 				log.Debug("blockstore.AllKeysChan got err:", e.Error)
+				errlk.Lock()
+				qerr = e.Error
+				errlk.Unlock()
 				return "", false
 			}
 
@@ -183,6 +349,10 @@ func (bs *blockstore) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
 				log.Warningf("error parsing key from DsKey: ", err)
 				return "", true
 			}
+			// the prefix may not have been applied by the datastore
+			if !strings.HasPrefix(k.DsKey().String(), prefix) {
+				return "", true
+			}
 			log.Debug("blockstore: query got key", k)
 
 			// key must be a multihash. else ignore it.
@@ -220,7 +390,11 @@ func (bs *blockstore) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
 		}
 	}()
 
-	return output, nil
+	return output, func() error {
+		errlk.Lock()
+		defer errlk.Unlock()
+		return qerr
+	}, nil
 }
 
 type Unlocker interface {
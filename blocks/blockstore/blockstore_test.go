@@ -3,6 +3,7 @@ package blockstore
 import (
 	"bytes"
 	"fmt"
+	"strings"
 	"testing"
 
 	u "gx/ipfs/QmZNVWh8LLjAavuQ2JXuFmuYH3C11xo988vSgp7UQrTRj1/go-ipfs-util"
@@ -53,6 +54,33 @@ func TestPutThenGetBlock(t *testing.T) {
 	}
 }
 
+func TestDeleteBlocks(t *testing.T) {
+	bs := NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+
+	var keys []key.Key
+	for i := 0; i < 10; i++ {
+		block := blocks.NewBlock([]byte(fmt.Sprintf("some data %d", i)))
+		if err := bs.Put(block); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, block.Key())
+	}
+
+	if err := bs.DeleteBlocks(keys[:5]); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, k := range keys {
+		has, err := bs.Has(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if has != (i >= 5) {
+			t.Fatalf("block %d: expected has to be %v", i, i >= 5)
+		}
+	}
+}
+
 func TestHashOnRead(t *testing.T) {
 	orginalDebug := u.Debug
 	defer (func() {
@@ -184,6 +212,77 @@ func TestAllKeysRespectsContext(t *testing.T) {
 
 }
 
+func TestAllKeysReportsListingError(t *testing.T) {
+	d := &queryTestDS{ds: ds.NewMapDatastore()}
+	bs, _ := newBlockStoreWithKeys(t, d, 10)
+
+	qerr := fmt.Errorf("listing failed")
+	d.SetFunc(func(q dsq.Query) (dsq.Results, error) {
+		res, err := d.ds.Query(q)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			return nil, err
+		}
+		resultChan := make(chan dsq.Result, 3)
+		for _, e := range entries[:2] {
+			resultChan <- dsq.Result{Entry: e}
+		}
+		resultChan <- dsq.Result{Error: qerr}
+		close(resultChan)
+		return dsq.ResultsWithChan(q, resultChan), nil
+	})
+
+	ch, keysErr, err := bs.(KeyLister).AllKeysChanErr(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(collect(ch)); n != 2 {
+		t.Fatalf("expected 2 keys before the error, got %d", n)
+	}
+	if err := keysErr(); err != qerr {
+		t.Fatalf("expected the listing error, got %v", err)
+	}
+
+	d.SetFunc(nil)
+	ch, keysErr, err = bs.(KeyLister).AllKeysChanErr(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(collect(ch)); n != 10 {
+		t.Fatalf("expected 10 keys, got %d", n)
+	}
+	if err := keysErr(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestAllKeysPrefix(t *testing.T) {
+	bs, keys := newBlockStoreWithKeys(t, nil, 100)
+
+	prefix := keys[0].DsKey().String()[:5]
+	var expect []key.Key
+	for _, k := range keys {
+		if strings.HasPrefix(k.DsKey().String(), prefix) {
+			expect = append(expect, k)
+		}
+	}
+	if len(expect) < 2 || len(expect) == len(keys) {
+		t.Fatalf("prefix %s should match some of the keys, matched %d", prefix, len(expect))
+	}
+
+	ch, keysErr, err := bs.(PrefixKeyLister).AllKeysChanPrefix(context.Background(), prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, expect, collect(ch))
+	if err := keysErr(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestValueTypeMismatch(t *testing.T) {
 	block := blocks.NewBlock([]byte("some data"))
 
@@ -81,6 +81,10 @@ func (b *bloomcache) DeleteBlock(k key.Key) error {
 	return b.blockstore.DeleteBlock(k)
 }
 
+func (b *bloomcache) DeleteBlocks(ks []key.Key) error {
+	return deleteBlocks(b.blockstore, ks)
+}
+
 // if ok == false has is inconclusive
 // if ok == true then has respons to question: is it contained
 func (b *bloomcache) hasCached(k key.Key) (has bool, ok bool) {
@@ -145,6 +149,14 @@ func (b *bloomcache) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
 	return b.blockstore.AllKeysChan(ctx)
 }
 
+func (b *bloomcache) AllKeysChanErr(ctx context.Context) (<-chan key.Key, func() error, error) {
+	return AllKeysChanErr(ctx, b.blockstore)
+}
+
+func (b *bloomcache) AllKeysChanPrefix(ctx context.Context, prefix string) (<-chan key.Key, func() error, error) {
+	return AllKeysChanPrefix(ctx, b.blockstore, prefix)
+}
+
 func (b *bloomcache) GCLock() Unlocker {
 	return b.blockstore.(GCBlockstore).GCLock()
 }
@@ -2,6 +2,7 @@ package commands
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -92,6 +93,9 @@ order to reclaim hard disk space.
 				if !ok {
 					return nil, u.ErrCast()
 				}
+				if obj.Error != "" {
+					return nil, errors.New(obj.Error)
+				}
 
 				buf := new(bytes.Buffer)
 				if quiet {
@@ -20,8 +20,11 @@ var log = logging.Logger("corerepo")
 
 var ErrMaxStorageExceeded = errors.New("Maximum storage limit exceeded. Maybe unpin some files?")
 
+// KeyRemoved is sent for every block GarbageCollectAsync removes. The last
+// one sent has Error set instead if the collection failed.
 type KeyRemoved struct {
-	Key key.Key
+	Key   key.Key
+	Error string `json:",omitempty"`
 }
 
 type GC struct {
@@ -90,7 +93,7 @@ func GarbageCollect(n *core.IpfsNode, ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	rmed, err := gc.GC(ctx, n.Blockstore, n.Pinning, roots)
+	rmed, results, err := gc.GCWithResult(ctx, n.Blockstore, n.Pinning, roots, gc.ContinueOnError())
 	if err != nil {
 		return err
 	}
@@ -99,7 +102,7 @@ func GarbageCollect(n *core.IpfsNode, ctx context.Context) error {
 		select {
 		case _, ok := <-rmed:
 			if !ok {
-				return nil
+				return (<-results).Err()
 			}
 		case <-ctx.Done():
 			return ctx.Err()
@@ -113,7 +116,7 @@ func GarbageCollectAsync(n *core.IpfsNode, ctx context.Context) (<-chan *KeyRemo
 	if err != nil {
 		return nil, err
 	}
-	rmed, err := gc.GC(ctx, n.Blockstore, n.Pinning, roots)
+	rmed, results, err := gc.GCWithResult(ctx, n.Blockstore, n.Pinning, roots, gc.ContinueOnError())
 	if err != nil {
 		return nil, err
 	}
@@ -123,11 +126,17 @@ func GarbageCollectAsync(n *core.IpfsNode, ctx context.Context) (<-chan *KeyRemo
 		defer close(out)
 		for k := range rmed {
 			select {
-			case out <- &KeyRemoved{k}:
+			case out <- &KeyRemoved{Key: k}:
 			case <-ctx.Done():
 				return
 			}
 		}
+		if err := (<-results).Err(); err != nil {
+			select {
+			case out <- &KeyRemoved{Error: err.Error()}:
+			case <-ctx.Done():
+			}
+		}
 	}()
 	return out, nil
 }
@@ -387,6 +387,57 @@ func EnumerateChildren(ctx context.Context, ds DAGService, root *Node, visit fun
 	return nil
 }
 
+// EnumerateChildrenDepth is like EnumerateChildren, but also passes visit the
+// depth of each node below root, starting at 1 for the direct children.
+func EnumerateChildrenDepth(ctx context.Context, ds DAGService, root *Node, visit func(c *cid.Cid, depth int) bool, bestEffort bool) error {
+	return enumerateChildrenDepth(ctx, ds, root, 1, visit, bestEffort)
+}
+
+func enumerateChildrenDepth(ctx context.Context, ds DAGService, root *Node, depth int, visit func(*cid.Cid, int) bool, bestEffort bool) error {
+	for _, lnk := range root.Links {
+		c := legacyCidFromLink(lnk)
+		if visit(c, depth) {
+			child, err := ds.Get(ctx, c)
+			if err != nil {
+				if bestEffort && err == ErrNotFound {
+					continue
+				} else {
+					return err
+				}
+			}
+			err = enumerateChildrenDepth(ctx, ds, child, depth+1, visit, bestEffort)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// EnumerateChildrenParents is like EnumerateChildren, but also passes visit
+// the node that links to each child, so the path to a node can be rebuilt.
+func EnumerateChildrenParents(ctx context.Context, ds DAGService, root *Node, visit func(parent, c *cid.Cid) bool, bestEffort bool) error {
+	parent := root.Cid()
+	for _, lnk := range root.Links {
+		c := legacyCidFromLink(lnk)
+		if visit(parent, c) {
+			child, err := ds.Get(ctx, c)
+			if err != nil {
+				if bestEffort && err == ErrNotFound {
+					continue
+				} else {
+					return err
+				}
+			}
+			err = EnumerateChildrenParents(ctx, ds, child, visit, bestEffort)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func EnumerateChildrenAsync(ctx context.Context, ds DAGService, root *Node, visit func(*cid.Cid) bool) error {
 	toprocess := make(chan []*cid.Cid, 8)
 	nodes := make(chan *NodeOption, 8)
@@ -0,0 +1,98 @@
+package gc
+
+import (
+	"errors"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+
+	bloom "gx/ipfs/QmWQ2SJisXwcCLsUXLwYCKSfyExXjFRW2WbBH5sqCUnwX5/bbloom"
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// bloomKeySet is a KeySet backed by a bloom filter
+type bloomKeySet struct {
+	filter *bloom.Bloom
+}
+
+// NewBloomKeySet returns a KeySet backed by a bloom filter sized to hold n
+// keys with the given false positive rate. Its memory usage is fixed when it
+// is created, no matter how many keys are added.
+//
+// Has may report keys that were never added, but never misses one that
+// was. Used as the marked set, a false positive only means that a garbage
+// block survives the run; a marked block is never deleted. The marked
+// count reported for a run may be slightly low for the same reason.
+//
+// Bloom filters cannot forget or enumerate their keys: Remove is a no-op
+// and Keys always returns nil.
+func NewBloomKeySet(n int, falsePositiveRate float64) (key.KeySet, error) {
+	if n <= 0 {
+		return nil, errors.New("bloom key set size must be positive")
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return nil, errors.New("bloom key set false positive rate must be between 0 and 1")
+	}
+
+	filter, err := bloom.New(float64(n), falsePositiveRate)
+	if err != nil {
+		return nil, err
+	}
+	return &bloomKeySet{filter: filter}, nil
+}
+
+func (s *bloomKeySet) Add(k key.Key) {
+	s.filter.AddTS([]byte(k))
+}
+
+func (s *bloomKeySet) Has(k key.Key) bool {
+	return s.filter.HasTS([]byte(k))
+}
+
+func (s *bloomKeySet) Remove(k key.Key) {}
+
+func (s *bloomKeySet) Keys() []key.Key {
+	return nil
+}
+
+func (s *bloomKeySet) probabilistic() bool {
+	return true
+}
+
+// probabilisticSet is implemented by KeySets whose Has may return true for
+// keys that were never added
+type probabilisticSet interface {
+	probabilistic() bool
+}
+
+func isProbabilistic(set key.KeySet) bool {
+	ps, ok := set.(probabilisticSet)
+	return ok && ps.probabilistic()
+}
+
+// walkedSet is a DAGService that remembers which of the nodes fetched
+// through it have links. While marking into a probabilistic set, it gives an
+// exact answer to "was this subgraph walked already?" for the nodes where
+// the answer matters, while leaves (the vast majority of blocks) are not
+// tracked.
+type walkedSet struct {
+	dag.DAGService
+	walked key.KeySet
+}
+
+func newWalkedSet(ds dag.DAGService) *walkedSet {
+	return &walkedSet{DAGService: ds, walked: key.NewKeySet()}
+}
+
+func (w *walkedSet) Get(ctx context.Context, c *cid.Cid) (*dag.Node, error) {
+	nd, err := w.DAGService.Get(ctx, c)
+	if err == nil && len(nd.Links) > 0 {
+		w.walked.Add(key.Key(c.Hash()))
+	}
+	return nd, err
+}
+
+func (w *walkedSet) Has(k key.Key) bool {
+	return w.walked.Has(k)
+}
@@ -0,0 +1,123 @@
+package gc
+
+import (
+	"fmt"
+	"testing"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+)
+
+func TestBloomKeySetNoFalseNegatives(t *testing.T) {
+	set, err := NewBloomKeySet(100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []key.Key
+	for i := 0; i < 1000; i++ {
+		k := dag.NodeWithData([]byte(fmt.Sprint(i))).Key()
+		keys = append(keys, k)
+		set.Add(k)
+	}
+	for _, k := range keys {
+		if !set.Has(k) {
+			t.Fatalf("bloom key set lost key %s", k)
+		}
+	}
+}
+
+func TestNewBloomKeySetRejectsBadParams(t *testing.T) {
+	if _, err := NewBloomKeySet(0, 0.01); err == nil {
+		t.Fatal("expected error for zero size")
+	}
+	if _, err := NewBloomKeySet(10, 1); err == nil {
+		t.Fatal("expected error for false positive rate of 1")
+	}
+}
+
+// falsePositiveSet is a probabilistic KeySet that claims to hold a fixed set
+// of keys in addition to the ones actually added to it
+type falsePositiveSet struct {
+	key.KeySet
+	fp map[key.Key]bool
+}
+
+func (s *falsePositiveSet) Has(k key.Key) bool {
+	return s.fp[k] || s.KeySet.Has(k)
+}
+
+func (s *falsePositiveSet) probabilistic() bool {
+	return true
+}
+
+func TestGCKeepsPinnedUnderFalsePositives(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	root, pinned := buildTree(t, e, "pinned", 3, 3)
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+	_, garbage := buildTree(t, e, "garbage", 2, 3)
+
+	// report every child of the root as present before it is marked, so a
+	// walk that prunes on Has would skip everything below them
+	fp := make(map[key.Key]bool)
+	for _, lnk := range root.Links {
+		fp[key.Key(lnk.Hash)] = true
+	}
+	keySet := func() (key.KeySet, error) {
+		return &falsePositiveSet{KeySet: key.NewKeySet(), fp: fp}, nil
+	}
+
+	out, err := GCWith(ctx, e.bs, e.pn, nil, WithKeySetFactory(keySet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+
+	for _, nd := range pinned {
+		if !e.has(t, nd) {
+			t.Fatalf("pinned block %s was removed", nd.Key())
+		}
+	}
+	for _, nd := range garbage {
+		if e.has(t, nd) {
+			t.Fatalf("garbage block %s was not removed", nd.Key())
+		}
+	}
+}
+
+func TestGCBloomKeySet(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	root, pinned := buildTree(t, e, "pinned", 3, 3)
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+	_, garbage := buildTree(t, e, "garbage", 2, 3)
+
+	keySet := func() (key.KeySet, error) {
+		return NewBloomKeySet(1000, 0.0001)
+	}
+	out, err := GCWith(ctx, e.bs, e.pn, nil, WithKeySetFactory(keySet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+
+	for _, nd := range pinned {
+		if !e.has(t, nd) {
+			t.Fatalf("pinned block %s was removed", nd.Key())
+		}
+	}
+	for _, nd := range garbage {
+		if e.has(t, nd) {
+			t.Fatalf("garbage block %s was not removed", nd.Key())
+		}
+	}
+}
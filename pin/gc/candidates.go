@@ -0,0 +1,103 @@
+package gc
+
+import (
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+)
+
+// Candidates lists the blocks of bs that are not in marked, the ones Sweep
+// would remove, without removing any. Like GCDryRun it only holds the pin
+// lock, so adds go on meanwhile. WithProtectFunc and WithMinBlockAge are
+// honoured, WithApprove is left to the caller, who decides which candidates
+// go to DeleteKeys. marked is left for the caller to close.
+//
+// The candidates are all listed before the first is sent, so the pin lock is
+// given up by then and the channel can be passed on to DeleteKeys as it is.
+func Candidates(ctx context.Context, bs bstore.GCBlockstore, marked key.KeySet, opts ...GCOption) (<-chan key.Key, error) {
+	o := newGCOptions(opts)
+	o.dryRun = true
+	o.checkpoint = nil
+	o.yieldEvery = 0
+	m := &MarkedSet{set: &countingKeySet{KeySet: marked}}
+	deletions, _, err := sweepLocked(ctx, bs, pinLock(bs, o), m, false, o, newProgressReporter(o), nil)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan key.Key)
+	go func() {
+		defer close(out)
+		var keys []key.Key
+		for d := range deletions {
+			keys = append(keys, d.Key)
+		}
+		for _, k := range keys {
+			select {
+			case out <- k:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// DeleteKeys takes the GC lock and removes the blocks of keys as they come,
+// until the channel is closed or ctx is done, sending the removed keys on
+// the returned channel. The lock is released once the sweep is over. The
+// sweep options apply to the keys as they would to those listed by GC, so
+// that WithApprove, WithDeletionRate, WithOnDelete and the others work the
+// same.
+//
+// The keys are trusted: they are removed whether pinned or not. They would
+// usually come from Candidates, with no pins added since its marked set was
+// built. Giving that set with WithMarkedSet makes DeleteKeys skip the keys
+// in it. A key that isn't in bs ends the sweep with a *SweepError unless
+// ContinueOnError or WithPhantomKeys is given.
+func DeleteKeys(ctx context.Context, bs bstore.GCBlockstore, keys <-chan key.Key, opts ...GCOption) (<-chan key.Key, <-chan GCResult, error) {
+	o := newGCOptions(opts)
+	o.keySource = keys
+	// the blockstore is not listed, it says nothing about the keys to come
+	o.checkpoint = nil
+	o.yieldEvery = 0
+	o.skipSweepIfClean = false
+	o.progressPreCount = false
+
+	m, owned := o.marked, false
+	if m == nil {
+		m, owned = &MarkedSet{set: &countingKeySet{KeySet: key.NewKeySet()}}, true
+	}
+	unlocker, err := gcLock(bs, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	deletions, results, err := sweepLocked(ctx, bs, unlocker, m, owned, o, newProgressReporter(o), nil)
+	return keysOf(ctx, deletions, results, err)
+}
+
+// streamKeys forwards keys until the channel is closed or ctx is done. The
+// sweep drains what it doesn't read of its listing, which must not consume
+// the caller's channel.
+func streamKeys(ctx context.Context, keys <-chan key.Key) <-chan key.Key {
+	out := make(chan key.Key)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case k, ok := <-keys:
+				if !ok {
+					return
+				}
+				select {
+				case out <- k:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,138 @@
+package gc
+
+import (
+	"testing"
+	"time"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+)
+
+func TestCandidatesDeleteKeys(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	pinned := e.addNode(t, "pinned")
+	if err := e.pn.Pin(ctx, pinned, true); err != nil {
+		t.Fatal(err)
+	}
+	keep := e.addNode(t, "keep")
+	remove := e.addNode(t, "remove")
+
+	marked, err := BuildMarkedSet(ctx, e.pn, e.dserv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer marked.Close()
+
+	out, err := Candidates(ctx, e.bs, marked.set.KeySet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates := drain(out)
+	if len(candidates) != 2 {
+		t.Fatalf("expected 2 candidates, got %v", candidates)
+	}
+	if !e.has(t, keep) || !e.has(t, remove) {
+		t.Fatal("listing the candidates removed blocks")
+	}
+
+	// the caller approves one candidate, and a pinned key sneaks in
+	approved := make(chan key.Key)
+	go func() {
+		defer close(approved)
+		for _, k := range candidates {
+			if k == remove.Key() {
+				approved <- k
+			}
+		}
+		approved <- pinned.Key()
+	}()
+	out, results, err := DeleteKeys(ctx, e.bs, approved, WithMarkedSet(marked))
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := drain(out)
+	if len(removed) != 1 || removed[0] != remove.Key() {
+		t.Fatalf("expected only the approved block to go, got %v", removed)
+	}
+	if res := <-results; res.Err() != nil || res.BlocksRemoved != 1 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if e.has(t, remove) || !e.has(t, keep) || !e.has(t, pinned) {
+		t.Fatal("the wrong blocks were removed")
+	}
+	assertUnlocked(t, e)
+}
+
+func TestCandidatesIntoDeleteKeys(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	pinned := e.addNode(t, "pinned")
+	if err := e.pn.Pin(ctx, pinned, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"a", "b", "c"} {
+		e.addNode(t, s)
+	}
+
+	marked, err := BuildMarkedSet(ctx, e.pn, e.dserv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer marked.Close()
+
+	candidates, err := Candidates(ctx, e.bs, marked.set.KeySet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan GCResult, 1)
+	go func() {
+		out, results, err := DeleteKeys(ctx, e.bs, candidates, WithMarkedSet(marked))
+		if err != nil {
+			done <- GCResult{Errors: []error{err}}
+			return
+		}
+		drain(out)
+		done <- <-results
+	}()
+	select {
+	case res := <-done:
+		if res.Err() != nil || res.BlocksRemoved != 3 {
+			t.Fatalf("unexpected result %+v", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("DeleteKeys is stuck behind the lock held by Candidates")
+	}
+	if !e.has(t, pinned) {
+		t.Fatal("pinned block removed")
+	}
+	assertUnlocked(t, e)
+}
+
+func TestDeleteKeysCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	e := newTestEnv()
+	garbage := e.addNode(t, "garbage")
+
+	keys := make(chan key.Key, 2)
+	keys <- garbage.Key()
+	// without batching the key is removed before the channel is closed
+	out, _, err := DeleteKeys(ctx, e.bs, keys, WithDeleteBatchSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k := <-out; k != garbage.Key() {
+		t.Fatalf("expected %s to be removed, got %s", garbage.Key(), k)
+	}
+	cancel()
+	drain(out)
+
+	// the caller's channel is not read once the sweep is over
+	keys <- "left"
+	if len(keys) != 1 {
+		t.Fatal("the sweep kept reading the keys after it was cancelled")
+	}
+	assertUnlocked(t, e)
+}
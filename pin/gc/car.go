@@ -0,0 +1,221 @@
+package gc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// maxCARHeaderSize bounds the header read from a CAR file, so that a
+// corrupt length prefix can't make the run allocate without limit
+const maxCARHeaderSize = 32 << 20
+
+// cborTagCid is the CBOR tag of a CID in DAG-CBOR
+const cborTagCid = 42
+
+var errCARHeader = errors.New("malformed header")
+
+// readCARRoots returns the roots in the header of the CAR file read from r.
+// Only the header is read, the blocks that follow it are left alone.
+func readCARRoots(r io.Reader) ([]*cid.Cid, error) {
+	br := bufio.NewReader(r)
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("gc: reading CAR roots: %s", err)
+	}
+	if n == 0 || n > maxCARHeaderSize {
+		return nil, fmt.Errorf("gc: reading CAR roots: header of %d bytes", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return nil, fmt.Errorf("gc: reading CAR roots: %s", err)
+	}
+
+	roots, err := parseCARHeader(&cborReader{b: buf})
+	if err != nil {
+		return nil, fmt.Errorf("gc: reading CAR roots: %s", err)
+	}
+	return roots, nil
+}
+
+// parseCARHeader decodes the DAG-CBOR map of a version 1 CAR header
+func parseCARHeader(cr *cborReader) ([]*cid.Cid, error) {
+	major, entries, err := cr.head()
+	if err != nil {
+		return nil, err
+	}
+	if major != cborMap {
+		return nil, errCARHeader
+	}
+
+	var roots []*cid.Cid
+	var version uint64
+	for i := uint64(0); i < entries; i++ {
+		name, err := cr.text()
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "version":
+			major, v, err := cr.head()
+			if err != nil {
+				return nil, err
+			}
+			if major != cborUint {
+				return nil, errCARHeader
+			}
+			version = v
+		case "roots":
+			roots, err = cr.cids()
+			if err != nil {
+				return nil, err
+			}
+		default:
+			if err := cr.skip(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if version != 1 {
+		return nil, fmt.Errorf("unsupported CAR version %d", version)
+	}
+	return roots, nil
+}
+
+// the CBOR major types
+const (
+	cborUint = iota
+	cborNegInt
+	cborBytes
+	cborText
+	cborArray
+	cborMap
+	cborTag
+	cborSimple
+)
+
+// cborReader decodes the few CBOR items a CAR header is made of
+type cborReader struct {
+	b   []byte
+	off int
+}
+
+// head reads the major type and argument of the next item. Items of
+// indefinite length are not allowed in DAG-CBOR and are rejected.
+func (cr *cborReader) head() (byte, uint64, error) {
+	if cr.off >= len(cr.b) {
+		return 0, 0, errCARHeader
+	}
+	major, info := cr.b[cr.off]>>5, cr.b[cr.off]&0x1f
+	cr.off++
+	if info < 24 {
+		return major, uint64(info), nil
+	}
+	if info > 27 {
+		return 0, 0, errCARHeader
+	}
+	size := 1 << (info - 24)
+	if len(cr.b)-cr.off < size {
+		return 0, 0, errCARHeader
+	}
+	var arg uint64
+	for _, c := range cr.b[cr.off : cr.off+size] {
+		arg = arg<<8 | uint64(c)
+	}
+	cr.off += size
+	return major, arg, nil
+}
+
+// bytes reads n bytes of the content of a string
+func (cr *cborReader) bytes(n uint64) ([]byte, error) {
+	if uint64(len(cr.b)-cr.off) < n {
+		return nil, errCARHeader
+	}
+	b := cr.b[cr.off : cr.off+int(n)]
+	cr.off += int(n)
+	return b, nil
+}
+
+func (cr *cborReader) text() (string, error) {
+	major, n, err := cr.head()
+	if err != nil {
+		return "", err
+	}
+	if major != cborText {
+		return "", errCARHeader
+	}
+	b, err := cr.bytes(n)
+	return string(b), err
+}
+
+// cids reads an array of CIDs, each a byte string under tag 42 holding a
+// zero byte and the binary CID
+func (cr *cborReader) cids() ([]*cid.Cid, error) {
+	major, n, err := cr.head()
+	if err != nil {
+		return nil, err
+	}
+	if major != cborArray {
+		return nil, errCARHeader
+	}
+	var out []*cid.Cid
+	for i := uint64(0); i < n; i++ {
+		major, tag, err := cr.head()
+		if err != nil {
+			return nil, err
+		}
+		if major != cborTag || tag != cborTagCid {
+			return nil, errCARHeader
+		}
+		major, size, err := cr.head()
+		if err != nil {
+			return nil, err
+		}
+		if major != cborBytes {
+			return nil, errCARHeader
+		}
+		b, err := cr.bytes(size)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) == 0 || b[0] != 0 {
+			return nil, errCARHeader
+		}
+		c, err := cid.Cast(b[1:])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// skip reads past the next item and everything nested in it
+func (cr *cborReader) skip() error {
+	major, arg, err := cr.head()
+	if err != nil {
+		return err
+	}
+	switch major {
+	case cborBytes, cborText:
+		_, err = cr.bytes(arg)
+		return err
+	case cborArray, cborMap:
+		items := arg
+		if major == cborMap {
+			items *= 2
+		}
+		for i := uint64(0); i < items; i++ {
+			if err := cr.skip(); err != nil {
+				return err
+			}
+		}
+	case cborTag:
+		return cr.skip()
+	}
+	return nil
+}
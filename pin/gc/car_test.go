@@ -0,0 +1,100 @@
+package gc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// carFile encodes a version 1 CAR header listing roots, followed by data
+// standing in for the blocks
+func carFile(roots []*cid.Cid, extra bool, data []byte) []byte {
+	var hdr bytes.Buffer
+	entries := byte(2)
+	if extra {
+		entries++
+	}
+	hdr.WriteByte(0xa0 | entries)
+	if extra {
+		// an unknown key, with a nested value to skip
+		hdr.WriteString("\x65extra\xa1\x61k\x82\x01\x42ab")
+	}
+	hdr.WriteString("\x65roots")
+	hdr.WriteByte(0x80 | byte(len(roots)))
+	for _, c := range roots {
+		b := append([]byte{0}, c.Bytes()...)
+		hdr.Write([]byte{0xd8, cborTagCid, 0x58, byte(len(b))})
+		hdr.Write(b)
+	}
+	hdr.WriteString("\x67version\x01")
+
+	var out bytes.Buffer
+	n := make([]byte, binary.MaxVarintLen64)
+	out.Write(n[:binary.PutUvarint(n, uint64(hdr.Len()))])
+	out.Write(hdr.Bytes())
+	out.Write(data)
+	return out.Bytes()
+}
+
+func TestReadCARRoots(t *testing.T) {
+	e := newTestEnv()
+	a := e.addNode(t, "a")
+	b := e.addNode(t, "b")
+
+	for _, extra := range []bool{false, true} {
+		roots, err := readCARRoots(bytes.NewReader(carFile([]*cid.Cid{a.Cid(), b.Cid()}, extra, []byte("blocks"))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(roots) != 2 || !roots[0].Equals(a.Cid()) || !roots[1].Equals(b.Cid()) {
+			t.Fatalf("unexpected roots %v", roots)
+		}
+	}
+
+	good := carFile([]*cid.Cid{a.Cid()}, false, nil)
+	for name, data := range map[string][]byte{
+		"empty":     nil,
+		"truncated": good[:len(good)-3],
+		"not a map": {2, 0x82, 0x01},
+		"version 2": bytes.Replace(good, []byte("version\x01"), []byte("version\x02"), 1),
+	} {
+		if _, err := readCARRoots(bytes.NewReader(data)); err == nil {
+			t.Fatalf("%s header: expected an error", name)
+		}
+	}
+}
+
+func TestGCWithRootsFromCAR(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	child := e.addNode(t, "child")
+	root := e.addNode(t, "root", child)
+	garbage := e.addNode(t, "garbage")
+
+	car := carFile([]*cid.Cid{root.Cid()}, false, []byte("blocks"))
+	res, err := RunGC(ctx, e.bs, e.pn, nil, WithRootsFromCAR(bytes.NewReader(car)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.BlocksRemoved != 1 || e.has(t, garbage) {
+		t.Fatalf("expected only the garbage removed, got %d blocks", res.BlocksRemoved)
+	}
+	if !e.has(t, root) || !e.has(t, child) {
+		t.Fatal("a block below a CAR root was removed")
+	}
+	if len(res.MarkRoots.Extra) != 1 || !res.MarkRoots.Extra[0].Equals(root.Cid()) {
+		t.Fatalf("expected the CAR root among the extra roots, got %v", res.MarkRoots.Extra)
+	}
+
+	// an unreadable header fails the run before anything is removed
+	other := e.addNode(t, "other garbage")
+	if _, err := RunGC(ctx, e.bs, e.pn, nil, WithRootsFromCAR(bytes.NewReader(car[:5]))); err == nil {
+		t.Fatal("expected the run to fail")
+	}
+	if !e.has(t, other) {
+		t.Fatal("a block was removed by the failed run")
+	}
+}
@@ -0,0 +1,259 @@
+package gc
+
+import (
+	"errors"
+	"strings"
+
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+	pin "github.com/ipfs/go-ipfs/pin"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	ds "gx/ipfs/QmbzuUusHqaLLoNTDEVLcSF6vZDHZDLPC7p4bztRvvkXxU/go-datastore"
+	dsq "gx/ipfs/QmbzuUusHqaLLoNTDEVLcSF6vZDHZDLPC7p4bztRvvkXxU/go-datastore/query"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+var (
+	// ErrNoCheckpoint is returned by ResumeGC when the store holds no
+	// complete checkpoint
+	ErrNoCheckpoint = errors.New("gc: no checkpoint to resume from")
+
+	// ErrStaleCheckpoint is returned by ResumeGC when the pins changed since
+	// the checkpoint was saved
+	ErrStaleCheckpoint = errors.New("gc: pins changed since the checkpoint was saved")
+
+	// ErrCheckpointUnsupported is returned when the marked set can't list
+	// its keys, as with the bloom filter set, and so can't be saved
+	ErrCheckpointUnsupported = errors.New("gc: the marked set can't be checkpointed")
+)
+
+var (
+	checkpointPrefix    = ds.NewKey("/gc/checkpoint")
+	checkpointPinsKey   = ds.NewKey("/gc/checkpoint/pins")
+	checkpointCursorKey = ds.NewKey("/gc/checkpoint/cursor")
+	checkpointMarked    = "/gc/checkpoint/marked"
+)
+
+// cursorInterval is the number of removed blocks between two saves of the
+// listing cursor
+const cursorInterval = 1024
+
+// ResumeGC continues a garbage collection that was started with
+// WithCheckpoint and didn't finish, sweeping with the marked set saved in
+// store instead of marking again. Blocks removed before the interruption are
+// no longer listed by the blockstore, so none of that work is repeated.
+// When the blockstore is a CursorKeyLister, the listing also starts after
+// the cursor saved every cursorInterval removed blocks, unless one is given
+// with WithStartCursor, so the keys the interrupted sweep went through are
+// not read again. Garbage it listed but had not removed by then is left for
+// the next collection.
+//
+// The checkpoint records the pins it was made from. If they have changed
+// since, ResumeGC returns ErrStaleCheckpoint and removes nothing, since
+// blocks pinned in the meantime are not in the saved set. ErrNoCheckpoint is
+// returned when there is nothing to resume. The checkpoint is kept until a
+// sweep completes without errors.
+//
+// The roots that don't come from the pins, bestEffortRoots and those given
+// with WithExtraRoots, WithRootsFromCAR, WithMFSRoot and WithRetainList,
+// are marked again on top of the saved set, as they may have changed too.
+// They should be passed as they were to the interrupted run.
+func ResumeGC(ctx context.Context, bs bstore.GCBlockstore, pn pin.Pinner, bestEffortRoots []*cid.Cid, store ds.Datastore, opts ...GCOption) (<-chan key.Key, <-chan GCResult, error) {
+	o := newGCOptions(opts)
+	pn = o.pinsFor(pn)
+	o.checkpoint = store
+
+	unlocker, err := gcLock(bs, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := loadCheckpoint(store, pn, o)
+	if err != nil {
+		unlocker.Unlock()
+		return nil, nil, err
+	}
+	if o.startCursor == "" {
+		o.startCursor = loadCursor(store)
+	}
+
+	dserv := markDAGService(bs, o)
+	mds := newNodeCache(newGetTimeout(dserv, o.markGetTimeout, o.log), o.nodeCacheSize)
+	var res markResult
+	if err := markOtherRoots(ctx, mds, m.set, bestEffortRoots, make(map[key.Key]bool), o, &res); err != nil {
+		m.Close()
+		unlocker.Unlock()
+		return nil, nil, err
+	}
+	m.incomplete = res.incomplete
+	m.roots = res.roots
+
+	var recheck *pinRecheck
+	if o.pinRecheck || o.yield != nil {
+		recheck = newPinRecheck(pn, dserv, o.log)
+	}
+	deletions, results, err := sweepLocked(ctx, bs, unlocker, m, true, o, newProgressReporter(o), recheck)
+	return keysOf(ctx, deletions, results, err)
+}
+
+// saveCheckpoint replaces the checkpoint in store with the marked set m. The
+// pins are written last, so that a checkpoint cut short is never complete.
+// The keys are streamed, so that a set kept on disk isn't read into memory.
+func saveCheckpoint(ctx context.Context, store ds.Datastore, m *MarkedSet) error {
+	keys, keysErr, err := KeysChan(ctx, m.set.KeySet)
+	if err == ErrProbabilisticSet {
+		return ErrCheckpointUnsupported
+	}
+	if err != nil {
+		return err
+	}
+	defer drainKeys(keys)
+	if err := clearCheckpoint(store); err != nil {
+		return err
+	}
+
+	b, err := checkpointBatch(store)
+	if err != nil {
+		return err
+	}
+	for k := range keys {
+		if err := b.Put(markedKey(k), []byte{}); err != nil {
+			return err
+		}
+	}
+	if err := keysErr(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := b.Commit(); err != nil {
+		return err
+	}
+	return store.Put(checkpointPinsKey, []byte(m.pins))
+}
+
+// loadCheckpoint reads the marked set saved in store, checking that it was
+// made from the current pins of pn
+func loadCheckpoint(store ds.Datastore, pn pin.Pinner, o *gcOptions) (*MarkedSet, error) {
+	v, err := store.Get(checkpointPinsKey)
+	if err == ds.ErrNotFound {
+		return nil, ErrNoCheckpoint
+	}
+	if err != nil {
+		return nil, err
+	}
+	pins, ok := v.([]byte)
+	if !ok {
+		return nil, ErrNoCheckpoint
+	}
+	if string(pins) != pinsDigest(pn) {
+		return nil, ErrStaleCheckpoint
+	}
+
+	set, err := o.newKeySet()
+	if err != nil {
+		return nil, err
+	}
+	m := &MarkedSet{set: &countingKeySet{KeySet: set}, pins: string(pins)}
+	if err := loadMarked(store, m.set); err != nil {
+		closeKeySet(set)
+		return nil, err
+	}
+	if err := keySetErr(set); err != nil {
+		closeKeySet(set)
+		return nil, err
+	}
+	return m, nil
+}
+
+func loadMarked(store ds.Datastore, set key.KeySet) error {
+	res, err := store.Query(dsq.Query{Prefix: checkpointMarked, KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	defer res.Process().Close()
+
+	for e := range res.Next() {
+		if e.Error != nil {
+			return e.Error
+		}
+		k, err := key.KeyFromDsKey(ds.NewKey(strings.TrimPrefix(e.Key, checkpointMarked)))
+		if err != nil {
+			return err
+		}
+		set.Add(k)
+	}
+	return nil
+}
+
+// saveCursor records cursor as where the listing of the sweep got to
+func saveCursor(store ds.Datastore, cursor string, l *runLogger) {
+	if cursor == "" {
+		return
+	}
+	if err := store.Put(checkpointCursorKey, []byte(cursor)); err != nil {
+		l.Warningf("error saving sweep cursor: %s", err)
+	}
+}
+
+// loadCursor returns the listing cursor saved in store, empty if there is
+// none
+func loadCursor(store ds.Datastore) string {
+	v, err := store.Get(checkpointCursorKey)
+	if err != nil {
+		return ""
+	}
+	cursor, _ := v.([]byte)
+	return string(cursor)
+}
+
+// finishCheckpoint removes the checkpoint once a sweep has gone through
+// without errors, and keeps it to resume from otherwise
+func finishCheckpoint(ctx context.Context, store ds.Datastore, res *GCResult, l *runLogger) {
+	if ctx.Err() != nil || len(res.Errors) > 0 {
+		l.Infof("sweep incomplete, keeping checkpoint")
+		return
+	}
+	if err := clearCheckpoint(store); err != nil {
+		l.Warningf("error removing checkpoint: %s", err)
+	}
+}
+
+// clearCheckpoint removes any checkpoint from store, the pins first
+func clearCheckpoint(store ds.Datastore) error {
+	if err := store.Delete(checkpointPinsKey); err != nil && err != ds.ErrNotFound {
+		return err
+	}
+
+	res, err := store.Query(dsq.Query{Prefix: checkpointPrefix.String(), KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return err
+	}
+
+	b, err := checkpointBatch(store)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := b.Delete(ds.NewKey(e.Key)); err != nil {
+			return err
+		}
+	}
+	return b.Commit()
+}
+
+func checkpointBatch(store ds.Datastore) (ds.Batch, error) {
+	if bds, ok := store.(ds.Batching); ok {
+		return bds.Batch()
+	}
+	return ds.NewBasicBatch(store), nil
+}
+
+func markedKey(k key.Key) ds.Key {
+	return ds.NewKey(checkpointMarked + k.DsKey().String())
+}
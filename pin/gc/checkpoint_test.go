@@ -0,0 +1,237 @@
+package gc
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	ds "gx/ipfs/QmbzuUusHqaLLoNTDEVLcSF6vZDHZDLPC7p4bztRvvkXxU/go-datastore"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// interruptedGC starts a checkpointed GC and cancels it after the first
+// removed block
+func interruptedGC(t *testing.T, e *testEnv, store ds.Datastore) {
+	ctx, cancel := context.WithCancel(context.Background())
+	out, err := GCWith(ctx, e.bs, e.pn, nil, WithCheckpoint(store), WithDeleteBatchSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-out
+	cancel()
+	drain(out)
+
+	if has, _ := store.Has(checkpointPinsKey); !has {
+		t.Fatal("interrupted run left no checkpoint")
+	}
+}
+
+func TestResumeGC(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	store := ds.NewMapDatastore()
+
+	root, tree := buildTree(t, e, "pinned", 2, 2)
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+	var garbage []*dag.Node
+	for i := 0; i < 10; i++ {
+		garbage = append(garbage, e.addNode(t, fmt.Sprintf("garbage %d", i)))
+	}
+
+	interruptedGC(t, e, store)
+
+	out, results, err := ResumeGC(ctx, e.bs, e.pn, nil, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	res := <-results
+	if err := res.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if res.MarkedCount != len(tree) {
+		t.Fatalf("expected %d marked blocks from the checkpoint, got %d", len(tree), res.MarkedCount)
+	}
+
+	for _, nd := range tree {
+		if !e.has(t, nd) {
+			t.Fatal("pinned block was removed")
+		}
+	}
+	for _, nd := range garbage {
+		if e.has(t, nd) {
+			t.Fatal("garbage block survived the resumed run")
+		}
+	}
+
+	if _, _, err := ResumeGC(ctx, e.bs, e.pn, nil, store); err != ErrNoCheckpoint {
+		t.Fatalf("expected the finished run to remove its checkpoint, got %v", err)
+	}
+}
+
+func TestResumeGCRejectsStaleCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	store := ds.NewMapDatastore()
+
+	for i := 0; i < 10; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+	interruptedGC(t, e, store)
+
+	// pinned after the checkpoint, so it isn't in the saved marked set
+	late := e.addNode(t, "pinned later")
+	if err := e.pn.Pin(ctx, late, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := ResumeGC(ctx, e.bs, e.pn, nil, store); err != ErrStaleCheckpoint {
+		t.Fatalf("expected ErrStaleCheckpoint, got %v", err)
+	}
+	if !e.has(t, late) {
+		t.Fatal("block pinned after the checkpoint was removed")
+	}
+	assertUnlocked(t, e)
+}
+
+func TestResumeGCMarksOtherRoots(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	store := ds.NewMapDatastore()
+
+	var garbage []*dag.Node
+	for i := 0; i < 10; i++ {
+		garbage = append(garbage, e.addNode(t, fmt.Sprintf("garbage %d", i)))
+	}
+	interruptedGC(t, e, store)
+
+	// written after the checkpoint, so they aren't in the saved marked set
+	mfs, mfsTree := buildTree(t, e, "mfs", 1, 2)
+	bestEffort, bestEffortTree := buildTree(t, e, "best effort", 1, 2)
+	retained := e.addNode(t, "retained")
+
+	out, results, err := ResumeGC(ctx, e.bs, e.pn, []*cid.Cid{bestEffort.Cid()}, store,
+		WithMFSRoot(mfs.Cid()), WithRetainList([]*cid.Cid{retained.Cid()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	if err := (<-results).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	kept := append(append(mfsTree, bestEffortTree...), retained)
+	for _, nd := range kept {
+		if !e.has(t, nd) {
+			t.Fatalf("block %s added after the checkpoint was removed", nd.Key())
+		}
+	}
+	for _, nd := range garbage {
+		if e.has(t, nd) {
+			t.Fatal("garbage block survived the resumed run")
+		}
+	}
+}
+
+func TestResumeGCDiskKeySet(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	store := ds.NewMapDatastore()
+
+	root, tree := buildTree(t, e, "pinned", 2, 2)
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+
+	// the set spills to disk past two keys, and is saved from there
+	keySet := func() (key.KeySet, error) {
+		return NewDiskKeySet("", 2)
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	out, err := GCWith(cctx, e.bs, e.pn, nil, WithCheckpoint(store), WithDeleteBatchSize(1), WithKeySetFactory(keySet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-out
+	cancel()
+	drain(out)
+
+	out, results, err := ResumeGC(ctx, e.bs, e.pn, nil, store, WithKeySetFactory(keySet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	res := <-results
+	if err := res.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if res.MarkedCount != len(tree) {
+		t.Fatalf("expected %d marked blocks from the checkpoint, got %d", len(tree), res.MarkedCount)
+	}
+	for _, nd := range tree {
+		if !e.has(t, nd) {
+			t.Fatal("pinned block was removed")
+		}
+	}
+}
+
+func TestResumeGCFromCursor(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	store := ds.NewMapDatastore()
+
+	root, _ := buildTree(t, e, "pinned", 2, 2)
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+	interruptedGC(t, e, store)
+
+	// the interrupted sweep got halfway through the remaining garbage
+	var left []string
+	keys, err := e.bs.AllKeysChan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := range keys {
+		left = append(left, k.DsKey().String())
+	}
+	sort.Strings(left)
+	cursor := left[len(left)/2]
+	saveCursor(store, cursor, newGCOptions(nil).log)
+
+	bs := &cursorBlockstore{e.bs}
+	out, results, err := ResumeGC(ctx, bs, e.pn, nil, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := drain(out)
+	if len(removed) == 0 {
+		t.Fatal("resumed sweep removed nothing after the cursor")
+	}
+	for _, k := range removed {
+		if k.DsKey().String() <= cursor {
+			t.Fatalf("resumed sweep listed %s, before the saved cursor %s", k, cursor)
+		}
+	}
+	if err := (<-results).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !e.has(t, root) {
+		t.Fatal("pinned root removed")
+	}
+	if has, _ := store.Has(checkpointCursorKey); has {
+		t.Fatal("completed sweep kept its cursor")
+	}
+}
@@ -0,0 +1,137 @@
+package gc
+
+import (
+	"sync"
+)
+
+// GCControl is a signal sent to a running sweep on the channel given to
+// WithControl
+type GCControl int
+
+const (
+	// Pause makes the sweep stop removing blocks until Resume is sent
+	Pause GCControl = iota
+	// Resume makes a paused sweep go on from where it stopped
+	Resume
+)
+
+func (c GCControl) String() string {
+	switch c {
+	case Pause:
+		return "pause"
+	case Resume:
+		return "resume"
+	default:
+		return "unknown"
+	}
+}
+
+// pauseGate follows the signals sent on a control channel for the duration
+// of a sweep, and holds the sweepers back while it is paused
+type pauseGate struct {
+	mu sync.Mutex
+	// resumed is closed on resume, and nil while the sweep isn't paused
+	resumed chan struct{}
+
+	done chan struct{}
+}
+
+// newPauseGate reads the signals sent on control until the gate is stopped.
+// A closed channel resumes the sweep for good. It returns nil for a nil
+// channel, which never pauses.
+func newPauseGate(control <-chan GCControl) *pauseGate {
+	if control == nil {
+		return nil
+	}
+	g := &pauseGate{done: make(chan struct{})}
+	go func() {
+		for {
+			select {
+			case c, ok := <-control:
+				if !ok {
+					g.set(false)
+					return
+				}
+				g.set(c == Pause)
+			case <-g.done:
+				return
+			}
+		}
+	}()
+	return g
+}
+
+func (g *pauseGate) set(paused bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch {
+	case paused && g.resumed == nil:
+		g.resumed = make(chan struct{})
+	case !paused && g.resumed != nil:
+		close(g.resumed)
+		g.resumed = nil
+	}
+}
+
+// paused returns a channel closed once the sweep is resumed if it is
+// paused, and nil otherwise
+func (g *pauseGate) paused() <-chan struct{} {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resumed
+}
+
+// stop ends the reading of the control channel, leaving its signals to the
+// next run
+func (g *pauseGate) stop() {
+	if g != nil {
+		close(g.done)
+	}
+}
+
+// waitWhilePaused holds the sweeper back while the sweep is paused. A run
+// that yields the GC lock deletes its queued blocks and gives the lock up
+// for the pause, marking the pins made in the meantime once it has it back;
+// otherwise the lock is kept. It returns false if the sweep should stop.
+func (s *sweeper) waitWhilePaused() bool {
+	resumed := s.gate.paused()
+	if resumed == nil {
+		return true
+	}
+	wait := func() {
+		select {
+		case <-resumed:
+		case <-s.stopped:
+		case <-s.ctx.Done():
+		}
+	}
+
+	s.o.log.Debug("sweep paused")
+	if s.o.yield == nil {
+		wait()
+	} else {
+		if !s.flush() {
+			return false
+		}
+		s.o.yield.yieldUntil(wait)
+		if err := s.recheck.run(s.ctx, s.gcs); err != nil {
+			s.fail(err)
+			s.stop()
+			return false
+		}
+	}
+
+	select {
+	case <-s.stopped:
+		return false
+	default:
+	}
+	if s.ctx.Err() != nil {
+		return false
+	}
+	s.o.log.Debug("sweep resumed")
+	return true
+}
@@ -0,0 +1,126 @@
+package gc
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+)
+
+// pausingBlockstore sends Pause on control at the first delete
+type pausingBlockstore struct {
+	bstore.GCBlockstore
+	control chan GCControl
+
+	mu      sync.Mutex
+	deleted int
+}
+
+func (bs *pausingBlockstore) DeleteBlock(k key.Key) error {
+	bs.mu.Lock()
+	bs.deleted++
+	first := bs.deleted == 1
+	bs.mu.Unlock()
+	if first {
+		bs.control <- Pause
+	}
+	return bs.GCBlockstore.DeleteBlock(k)
+}
+
+func (bs *pausingBlockstore) deletes() int {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.deleted
+}
+
+// waitPaused waits for the deletes of bs to stop, and checks that they stay
+// stopped and the run doesn't finish
+func waitPaused(t *testing.T, bs *pausingBlockstore, results <-chan GCResult) int {
+	time.Sleep(50 * time.Millisecond)
+	n := bs.deletes()
+	select {
+	case res := <-results:
+		t.Fatalf("the run finished while paused: %+v", res)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if m := bs.deletes(); m != n || n == 20 {
+		t.Fatalf("blocks were removed while paused, %d then %d", n, m)
+	}
+	return n
+}
+
+func TestGCControlPauseResume(t *testing.T) {
+	ctx := context.Background()
+	for _, c := range []struct {
+		opts   []GCOption
+		yields bool
+	}{
+		{nil, false},
+		{[]GCOption{WithSweepConcurrency(4)}, false},
+		{[]GCOption{WithCooperativeYield(1000)}, true},
+	} {
+		e := newTestEnv()
+		for i := 0; i < 20; i++ {
+			e.addNode(t, fmt.Sprintf("garbage %d", i))
+		}
+		control := make(chan GCControl)
+		bs := &pausingBlockstore{GCBlockstore: e.bs, control: control}
+
+		out, results, err := GCWithResult(ctx, bs, e.pn, nil, append(c.opts, WithControl(control))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go drain(out)
+		waitPaused(t, bs, results)
+
+		// a run that yields gives the lock up for the pause
+		if c.yields {
+			locked := make(chan bstore.Unlocker)
+			go func() { locked <- e.bs.PinLock() }()
+			select {
+			case unlocker := <-locked:
+				unlocker.Unlock()
+			case <-time.After(time.Second):
+				t.Fatal("the GC lock was kept while paused")
+			}
+		}
+
+		control <- Resume
+		res := <-results
+		if res.BlocksRemoved != 20 || res.Reason != ReasonCompleted {
+			t.Fatalf("expected the resumed run to remove every block, got %+v", res)
+		}
+	}
+}
+
+func TestGCControlCancelWhilePaused(t *testing.T) {
+	e := newTestEnv()
+	for i := 0; i < 20; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	control := make(chan GCControl)
+	bs := &pausingBlockstore{GCBlockstore: e.bs, control: control}
+
+	out, results, err := GCWithResult(ctx, bs, e.pn, nil, WithControl(control))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go drain(out)
+	waitPaused(t, bs, results)
+
+	cancel()
+	select {
+	case res := <-results:
+		if res.Reason != ReasonCancelled {
+			t.Fatalf("expected the run to be cancelled, got %s", res.Reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the paused run didn't end on cancel")
+	}
+}
@@ -0,0 +1,96 @@
+package gc
+
+import (
+	"sync"
+
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+)
+
+// noCursorWarning is given once per process, as a scheduler passes the
+// cursor to every run
+var noCursorWarning sync.Once
+
+// listKeysFrom lists the keys of bs under prefix like
+// blockstore.AllKeysChanPrefix, starting after cursor when bs implements
+// blockstore.CursorKeyLister. The returned listCursor follows the listing,
+// and is nil when bs doesn't take cursors.
+func listKeysFrom(ctx context.Context, bs bstore.Blockstore, prefix, cursor string, l *runLogger) (<-chan key.Key, func() error, *listCursor, error) {
+	cl, ok := bs.(bstore.CursorKeyLister)
+	if !ok {
+		if cursor != "" {
+			noCursorWarning.Do(func() {
+				l.Warning("the blockstore can't start its listing at a cursor, sweeping every key")
+			})
+		}
+		keys, keysErr, err := bstore.AllKeysChanPrefix(ctx, bs, prefix)
+		return keys, keysErr, nil, err
+	}
+
+	keys, keysErr, err := cl.AllKeysChanAfter(ctx, cursor)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if prefix != "" {
+		keys = bstore.FilterPrefix(ctx, keys, prefix)
+	}
+	return keys, keysErr, &listCursor{last: cursor}, nil
+}
+
+// listCursor records how far the sweepers got through a key listing. Its
+// methods do nothing on a nil listCursor.
+type listCursor struct {
+	mu   sync.Mutex
+	last string
+	done bool
+}
+
+// took records that a sweeper took k from the listing
+func (c *listCursor) took(k key.Key) {
+	if c == nil {
+		return
+	}
+	// concurrent sweepers may record their keys out of order
+	ks := k.DsKey().String()
+	c.mu.Lock()
+	if ks > c.last {
+		c.last = ks
+	}
+	c.mu.Unlock()
+}
+
+// ended records that the listing went through to its end
+func (c *listCursor) ended() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.done = true
+	c.mu.Unlock()
+}
+
+// cutShort undoes ended, for a listing closed by an error
+func (c *listCursor) cutShort() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.done = false
+	c.mu.Unlock()
+}
+
+// String gives the cursor to start the next listing at, empty if this one
+// went through to its end
+func (c *listCursor) String() string {
+	if c == nil {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return ""
+	}
+	return c.last
+}
@@ -0,0 +1,105 @@
+package gc
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+	dag "github.com/ipfs/go-ipfs/merkledag"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	ds "gx/ipfs/QmbzuUusHqaLLoNTDEVLcSF6vZDHZDLPC7p4bztRvvkXxU/go-datastore"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+)
+
+// cursorBlockstore lists its keys in order, starting after a cursor
+type cursorBlockstore struct {
+	bstore.GCBlockstore
+}
+
+func (bs *cursorBlockstore) AllKeysChanAfter(ctx context.Context, cursor string) (<-chan key.Key, func() error, error) {
+	keys, err := bs.GCBlockstore.AllKeysChan(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	var after []string
+	for k := range keys {
+		if ks := k.DsKey().String(); ks > cursor {
+			after = append(after, ks)
+		}
+	}
+	sort.Strings(after)
+
+	out := make(chan key.Key)
+	go func() {
+		defer close(out)
+		for _, ks := range after {
+			k, err := key.KeyFromDsKey(ds.NewKey(ks))
+			if err != nil {
+				panic(err)
+			}
+			select {
+			case out <- k:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, func() error { return nil }, nil
+}
+
+func TestGCStartCursor(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	pinned := e.addNode(t, "pinned")
+	if err := e.pn.Pin(ctx, pinned, true); err != nil {
+		t.Fatal(err)
+	}
+	var garbage []*dag.Node
+	for i := 0; i < 10; i++ {
+		garbage = append(garbage, e.addNode(t, fmt.Sprintf("garbage %d", i)))
+	}
+	bs := &cursorBlockstore{GCBlockstore: e.bs}
+
+	// each run takes on the part of the store after the last one
+	var cursor string
+	var runs []int
+	for len(runs) < 5 {
+		res, err := RunGC(ctx, bs, e.pn, nil, WithMaxDeletions(3), WithStartCursor(cursor))
+		if err != nil {
+			t.Fatal(err)
+		}
+		runs = append(runs, res.BlocksRemoved)
+		if res.Cursor == "" {
+			break
+		}
+		if res.Cursor <= cursor {
+			t.Fatalf("cursor went back from %q to %q", cursor, res.Cursor)
+		}
+		cursor = res.Cursor
+	}
+	if fmt.Sprint(runs) != "[3 3 3 1]" {
+		t.Fatalf("expected four runs removing 3, 3, 3 and 1 blocks, got %v", runs)
+	}
+	for _, nd := range garbage {
+		if e.has(t, nd) {
+			t.Fatalf("garbage block %s was not removed", nd.Key())
+		}
+	}
+	if !e.has(t, pinned) {
+		t.Fatal("pinned block was removed")
+	}
+
+	// a blockstore without cursors is swept whole
+	for i := 0; i < 3; i++ {
+		e.addNode(t, fmt.Sprintf("more garbage %d", i))
+	}
+	res, err := RunGC(ctx, e.bs, e.pn, nil, WithStartCursor(cursor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.BlocksRemoved != 3 || res.Cursor != "" {
+		t.Fatalf("expected a full sweep with no cursor, got %d removed and cursor %q", res.BlocksRemoved, res.Cursor)
+	}
+}
@@ -0,0 +1,232 @@
+package gc
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+
+	levelds "gx/ipfs/QmUHmMGmcwCrjHQHcYhBnqGCSWs5pBSMbGZmfwavETR1gg/go-ds-leveldb"
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	ldbopts "gx/ipfs/QmbBhyDKsY4mbY6xsKt3qu9Y7FPvMJ6qbD8AMjYYvPRw1g/goleveldb/leveldb/opt"
+	ds "gx/ipfs/QmbzuUusHqaLLoNTDEVLcSF6vZDHZDLPC7p4bztRvvkXxU/go-datastore"
+	dsq "gx/ipfs/QmbzuUusHqaLLoNTDEVLcSF6vZDHZDLPC7p4bztRvvkXxU/go-datastore/query"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+)
+
+// diskStore is the datastore keys are spilled to
+type diskStore interface {
+	ds.Datastore
+	io.Closer
+}
+
+// diskKeySet is a KeySet that holds up to memLimit keys in memory and
+// spills any further keys to a leveldb store in a temporary directory
+type diskKeySet struct {
+	mem      map[key.Key]struct{}
+	memLimit int
+
+	parent string
+	dir    string
+	disk   diskStore
+
+	// err is the first error hit talking to the disk store
+	err error
+}
+
+// NewDiskKeySet returns a KeySet that keeps up to memLimit keys in memory.
+// Once that many keys have been added, further keys are written to a
+// leveldb store in a temporary directory created under dir (or the default
+// temporary directory if dir is empty).
+//
+// The returned set implements io.Closer; Close removes the temporary store.
+// GC closes sets created through WithKeySetFactory once a run is over.
+//
+// KeySet methods can't return errors, so a failure to read or write the
+// store is remembered and returned by Err. Such a failure makes Has report
+// true, so that a block is never deleted because its key could not be
+// looked up.
+func NewDiskKeySet(dir string, memLimit int) (key.KeySet, error) {
+	if memLimit < 0 {
+		return nil, errors.New("disk key set memory limit must not be negative")
+	}
+	return &diskKeySet{
+		mem:      make(map[key.Key]struct{}),
+		memLimit: memLimit,
+		parent:   dir,
+	}, nil
+}
+
+func (s *diskKeySet) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// open lazily creates the disk store on first spill
+func (s *diskKeySet) open() error {
+	if s.disk != nil {
+		return nil
+	}
+
+	dir, err := ioutil.TempDir(s.parent, "ipfs-gc-keyset")
+	if err != nil {
+		return err
+	}
+
+	disk, err := levelds.NewDatastore(dir, &levelds.Options{
+		Compression: ldbopts.NoCompression,
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	s.dir = dir
+	s.disk = disk
+	return nil
+}
+
+func (s *diskKeySet) Add(k key.Key) {
+	if _, ok := s.mem[k]; ok {
+		return
+	}
+	if s.disk == nil && len(s.mem) < s.memLimit {
+		s.mem[k] = struct{}{}
+		return
+	}
+
+	if err := s.open(); err != nil {
+		s.fail(err)
+		return
+	}
+	if err := s.disk.Put(k.DsKey(), []byte{}); err != nil {
+		s.fail(err)
+	}
+}
+
+func (s *diskKeySet) Has(k key.Key) bool {
+	if _, ok := s.mem[k]; ok {
+		return true
+	}
+	if s.disk == nil {
+		return s.err != nil
+	}
+
+	has, err := s.disk.Has(k.DsKey())
+	if err != nil {
+		s.fail(err)
+		return true
+	}
+	return has || s.err != nil
+}
+
+func (s *diskKeySet) Remove(k key.Key) {
+	delete(s.mem, k)
+	if s.disk == nil {
+		return
+	}
+	if err := s.disk.Delete(k.DsKey()); err != nil && err != ds.ErrNotFound {
+		s.fail(err)
+	}
+}
+
+func (s *diskKeySet) Keys() []key.Key {
+	var out []key.Key
+	for k := range s.keysChan(context.Background()) {
+		out = append(out, k)
+	}
+	return out
+}
+
+// keysChan sends the keys held in memory and then the ones on disk, without
+// gathering them first. Errors reading the disk store are recorded for Err.
+func (s *diskKeySet) keysChan(ctx context.Context) <-chan key.Key {
+	out := make(chan key.Key)
+	go func() {
+		defer close(out)
+		send := func(k key.Key) bool {
+			select {
+			case out <- k:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for k := range s.mem {
+			if !send(k) {
+				return
+			}
+		}
+		if s.disk == nil {
+			return
+		}
+
+		res, err := s.disk.Query(dsq.Query{KeysOnly: true})
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		defer res.Process().Close()
+
+		for e := range res.Next() {
+			if e.Error != nil {
+				s.fail(e.Error)
+				return
+			}
+			k, err := key.KeyFromDsKey(ds.NewKey(e.Key))
+			if err != nil {
+				s.fail(err)
+				continue
+			}
+			if !send(k) {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Err returns the first error encountered while using the disk store
+func (s *diskKeySet) Err() error {
+	return s.err
+}
+
+// Close releases the disk store and removes its temporary directory
+func (s *diskKeySet) Close() error {
+	s.mem = make(map[key.Key]struct{})
+	if s.disk == nil {
+		return nil
+	}
+
+	err := s.disk.Close()
+	if rerr := os.RemoveAll(s.dir); err == nil {
+		err = rerr
+	}
+	s.disk = nil
+	s.dir = ""
+	return err
+}
+
+// keySetErr returns the error recorded by sets that can fail, like the disk
+// backed set
+func keySetErr(set key.KeySet) error {
+	if es, ok := set.(interface {
+		Err() error
+	}); ok {
+		return es.Err()
+	}
+	return nil
+}
+
+// closeKeySet releases any resources held by set
+func closeKeySet(set key.KeySet) {
+	c, ok := set.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := c.Close(); err != nil {
+		log.Warningf("error closing marked set: %s", err)
+	}
+}
@@ -0,0 +1,199 @@
+package gc
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+
+	u "gx/ipfs/QmZNVWh8LLjAavuQ2JXuFmuYH3C11xo988vSgp7UQrTRj1/go-ipfs-util"
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+)
+
+func assertEmptyDir(t *testing.T, dir string) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected %s to be empty, found %d entries", dir, len(entries))
+	}
+}
+
+func TestDiskKeySetSpills(t *testing.T) {
+	parent, err := ioutil.TempDir("", "gc-diskset-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+
+	set, err := NewDiskKeySet(parent, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []key.Key
+	for i := 0; i < 100; i++ {
+		k := dag.NodeWithData([]byte(fmt.Sprint(i))).Key()
+		keys = append(keys, k)
+		set.Add(k)
+	}
+
+	entries, err := ioutil.ReadDir(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected keys to be spilled to a single temp dir, found %d entries", len(entries))
+	}
+
+	for _, k := range keys {
+		if !set.Has(k) {
+			t.Fatalf("disk key set lost key %s", k)
+		}
+	}
+	if n := len(set.Keys()); n != len(keys) {
+		t.Fatalf("expected %d keys, got %d", len(keys), n)
+	}
+
+	set.Remove(keys[0])
+	set.Remove(keys[99])
+	if set.Has(keys[0]) || set.Has(keys[99]) {
+		t.Fatal("removed keys are still in the set")
+	}
+
+	if err := keySetErr(set); err != nil {
+		t.Fatal(err)
+	}
+	if err := set.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	assertEmptyDir(t, parent)
+}
+
+func TestGCDiskKeySetCleansUp(t *testing.T) {
+	parent, err := ioutil.TempDir("", "gc-diskset-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+
+	e := newTestEnv()
+	root, pinned := buildTree(t, e, "pinned", 2, 3)
+	if err := e.pn.Pin(context.Background(), root, true); err != nil {
+		t.Fatal(err)
+	}
+	_, garbage := buildTree(t, e, "garbage", 2, 3)
+
+	keySet := func() (key.KeySet, error) {
+		return NewDiskKeySet(parent, 2)
+	}
+
+	// cancel before consuming anything, the set must still be removed
+	ctx, cancel := context.WithCancel(context.Background())
+	out, err := GCWith(ctx, e.bs, e.pn, nil, WithKeySetFactory(keySet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	drain(out)
+	assertEmptyDir(t, parent)
+
+	out, err = GCWith(context.Background(), e.bs, e.pn, nil, WithKeySetFactory(keySet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	assertEmptyDir(t, parent)
+
+	for _, nd := range pinned {
+		if !e.has(t, nd) {
+			t.Fatalf("pinned block %s was removed", nd.Key())
+		}
+	}
+	for _, nd := range garbage {
+		if e.has(t, nd) {
+			t.Fatalf("garbage block %s was not removed", nd.Key())
+		}
+	}
+}
+
+func TestGCDuplicateKeysDiskKeySet(t *testing.T) {
+	parent, err := ioutil.TempDir("", "gc-diskset-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+
+	e := newTestEnv()
+	for i := 0; i < 20; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+	bs := &duplicatingBlockstore{GCBlockstore: e.bs, deletes: make(map[key.Key]int)}
+	keySet := func() (key.KeySet, error) {
+		return NewDiskKeySet(parent, 2)
+	}
+
+	// the swept keys spill to disk along with the marked ones
+	seen := newSeenSet(&countingKeySet{KeySet: &diskKeySet{memLimit: 2, parent: parent}})
+	if _, ok := seen.(*diskKeySet); !ok {
+		t.Fatalf("expected a disk backed set of swept keys, got %T", seen)
+	}
+	closeKeySet(seen)
+
+	res, err := RunGC(context.Background(), bs, e.pn, nil, WithKeySetFactory(keySet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.BlocksRemoved != 20 {
+		t.Fatalf("expected 20 removed blocks, got %d", res.BlocksRemoved)
+	}
+	for k, d := range bs.deletes {
+		if d != 1 {
+			t.Fatalf("%s was deleted %d times", k, d)
+		}
+	}
+	assertEmptyDir(t, parent)
+}
+
+// benchmarkKeySet adds b.N synthetic keys to a set and logs the heap in use
+// afterwards. Use -benchtime to reach large key counts, e.g. 5M keys for a
+// synthetic DAG of that size.
+func benchmarkKeySet(b *testing.B, newSet func() (key.KeySet, error)) {
+	set, err := newSet()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer closeKeySet(set)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		set.Add(key.Key(u.Hash([]byte(fmt.Sprint(i)))))
+	}
+	b.StopTimer()
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.Logf("%d keys: %d KiB heap in use", b.N, (int64(after.HeapInuse)-int64(before.HeapInuse))/1024)
+}
+
+func BenchmarkMemKeySet(b *testing.B) {
+	benchmarkKeySet(b, func() (key.KeySet, error) {
+		return key.NewKeySet(), nil
+	})
+}
+
+func BenchmarkDiskKeySet(b *testing.B) {
+	benchmarkKeySet(b, func() (key.KeySet, error) {
+		return NewDiskKeySet("", 1<<16)
+	})
+}
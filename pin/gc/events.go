@@ -0,0 +1,75 @@
+package gc
+
+import (
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+)
+
+// GCEvent is sent on the channel given to WithEventSink as a run goes on. It
+// is one of MarkStarted, MarkFinished, SweepStarted, BlockDeleted, Error and
+// Finished.
+type GCEvent interface {
+	gcEvent()
+}
+
+// MarkStarted is sent when the mark phase starts
+type MarkStarted struct{}
+
+// MarkFinished is sent when the mark phase is over
+type MarkFinished struct {
+	// Count is the number of blocks marked
+	Count int
+}
+
+// SweepStarted is sent when the sweep starts
+type SweepStarted struct{}
+
+// BlockDeleted is sent for every block removed. Dry runs remove nothing and
+// send none.
+type BlockDeleted struct {
+	Key key.Key
+	// Size is the size of the block in bytes, or -1 if unknown
+	Size int64
+}
+
+// Error is sent for every error hit while sweeping
+type Error struct {
+	// Key is the block the error is about, or empty if it is not about a
+	// single block
+	Key key.Key
+	Err error
+}
+
+// Finished is sent once the sweep is over, right before the GCResult is
+// delivered
+type Finished struct {
+	Result GCResult
+}
+
+func (MarkStarted) gcEvent()  {}
+func (MarkFinished) gcEvent() {}
+func (SweepStarted) gcEvent() {}
+func (BlockDeleted) gcEvent() {}
+func (Error) gcEvent()        {}
+func (Finished) gcEvent()     {}
+
+// sendEvent sends ev to the event sink of o, if there is one, giving up if
+// ctx is done first
+func sendEvent(ctx context.Context, o *gcOptions, ev GCEvent) {
+	if o.events == nil {
+		return
+	}
+	select {
+	case o.events <- ev:
+	case <-ctx.Done():
+	}
+}
+
+// errorEvent returns the event reporting err
+func errorEvent(err error) Error {
+	ev := Error{Err: err}
+	if se, ok := err.(*SweepError); ok {
+		ev.Key = se.Key
+	}
+	return ev
+}
@@ -0,0 +1,68 @@
+package gc
+
+import (
+	"testing"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+)
+
+func TestGCEventSink(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	pinned := e.addNode(t, "pinned", e.addNode(t, "child"))
+	if err := e.pn.Pin(ctx, pinned, true); err != nil {
+		t.Fatal(err)
+	}
+	garbage := e.addNode(t, "garbage")
+	bad := e.addNode(t, "bad")
+	bs := &failingBlockstore{GCBlockstore: e.bs, fail: map[key.Key]bool{bad.Key(): true}}
+
+	events := make(chan GCEvent, 16)
+	out, results, err := GCWithResult(ctx, bs, e.pn, nil, WithEventSink(events), ContinueOnError())
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	res := <-results
+	close(events)
+
+	var got []GCEvent
+	for ev := range events {
+		got = append(got, ev)
+	}
+	if len(got) != 6 {
+		t.Fatalf("expected 6 events, got %v", got)
+	}
+	if _, ok := got[0].(MarkStarted); !ok {
+		t.Fatalf("expected MarkStarted first, got %#v", got[0])
+	}
+	if ev, ok := got[1].(MarkFinished); !ok || ev.Count != 2 {
+		t.Fatalf("expected MarkFinished with 2 blocks, got %#v", got[1])
+	}
+	if _, ok := got[2].(SweepStarted); !ok {
+		t.Fatalf("expected SweepStarted, got %#v", got[2])
+	}
+
+	var deleted, failed bool
+	for _, ev := range got[3:5] {
+		switch ev := ev.(type) {
+		case BlockDeleted:
+			deleted = ev.Key == garbage.Key() && ev.Size == int64(len(garbage.RawData()))
+		case Error:
+			failed = ev.Key == bad.Key() && ev.Err != nil
+		}
+	}
+	if !deleted || !failed {
+		t.Fatalf("expected a deletion and an error, got %#v", got[3:5])
+	}
+
+	fin, ok := got[5].(Finished)
+	if !ok {
+		t.Fatalf("expected Finished last, got %#v", got[5])
+	}
+	if fin.Result.BlocksRemoved != res.BlocksRemoved || len(fin.Result.Errors) != len(res.Errors) {
+		t.Fatalf("Finished carries %+v, the result is %+v", fin.Result, res)
+	}
+}
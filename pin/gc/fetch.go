@@ -0,0 +1,138 @@
+package gc
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// fetchTimeout is a DAGService that gives up on a node after timeout,
+// reporting it as not found so that the walk treats it like any other
+// missing block
+type fetchTimeout struct {
+	dag.DAGService
+	timeout time.Duration
+	log     *runLogger
+}
+
+// newFetchTimeout wraps ds so that no fetch takes longer than timeout. A
+// timeout of zero or less returns ds unchanged.
+func newFetchTimeout(ds dag.DAGService, timeout time.Duration, l *runLogger) dag.DAGService {
+	if timeout <= 0 {
+		return ds
+	}
+	return &fetchTimeout{DAGService: ds, timeout: timeout, log: l}
+}
+
+func (f *fetchTimeout) Get(ctx context.Context, c *cid.Cid) (*dag.Node, error) {
+	tctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	nd, err := f.DAGService.Get(tctx, c)
+	if err != nil && ctx.Err() == nil && tctx.Err() == context.DeadlineExceeded {
+		f.log.Warningf("gave up fetching %s after %s", c, f.timeout)
+		return nil, dag.ErrNotFound
+	}
+	return nd, err
+}
+
+// ErrMarkTimeout is returned by the mark phase when a block below a pin took
+// longer than the WithMarkGetTimeout limit to read
+var ErrMarkTimeout = errors.New("gc: timed out reading a block while marking")
+
+// getTimeout is a DAGService that fails with ErrMarkTimeout on a node that
+// takes longer than timeout to get. The Get runs apart so that a datastore
+// that doesn't watch the context can't hold up the walk; it is left to
+// finish in the background.
+type getTimeout struct {
+	dag.DAGService
+	timeout time.Duration
+	log     *runLogger
+}
+
+// newGetTimeout wraps ds so that no Get waits longer than timeout. A timeout
+// of zero or less returns ds unchanged.
+func newGetTimeout(ds dag.DAGService, timeout time.Duration, l *runLogger) dag.DAGService {
+	if timeout <= 0 {
+		return ds
+	}
+	return &getTimeout{DAGService: ds, timeout: timeout, log: l}
+}
+
+type getResult struct {
+	nd  *dag.Node
+	err error
+}
+
+func (g *getTimeout) Get(ctx context.Context, c *cid.Cid) (*dag.Node, error) {
+	tctx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+
+	done := make(chan getResult, 1)
+	go func() {
+		nd, err := g.DAGService.Get(tctx, c)
+		done <- getResult{nd, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil && ctx.Err() == nil && tctx.Err() == context.DeadlineExceeded {
+			return nil, ErrMarkTimeout
+		}
+		return r.nd, r.err
+	case <-tctx.Done():
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		g.log.Warningf("gave up reading %s after %s", c, g.timeout)
+		return nil, ErrMarkTimeout
+	}
+}
+
+// timeoutAsMissing is a DAGService that reports the nodes that timed out as
+// not found, so that a best-effort walk skips them
+type timeoutAsMissing struct {
+	dag.DAGService
+}
+
+func (t timeoutAsMissing) Get(ctx context.Context, c *cid.Cid) (*dag.Node, error) {
+	nd, err := t.DAGService.Get(ctx, c)
+	if err == ErrMarkTimeout {
+		return nil, dag.ErrNotFound
+	}
+	return nd, err
+}
+
+// ErrTraversalLimit is returned by the mark phase when it reads more nodes
+// than the WithMaxVisitedNodes limit, as a DAG crafted to be huge would
+// otherwise exhaust memory and CPU
+var ErrTraversalLimit = errors.New("gc: visited more nodes than allowed while marking")
+
+// visitLimit is a DAGService that fails with ErrTraversalLimit once more than
+// max nodes have been read through it
+type visitLimit struct {
+	dag.DAGService
+	max     int64
+	visited int64
+}
+
+// newVisitLimit wraps ds so that at most max nodes are read. A max of zero or
+// less returns ds unchanged.
+func newVisitLimit(ds dag.DAGService, max int) dag.DAGService {
+	if max <= 0 {
+		return ds
+	}
+	return &visitLimit{DAGService: ds, max: int64(max)}
+}
+
+func (v *visitLimit) Get(ctx context.Context, c *cid.Cid) (*dag.Node, error) {
+	if atomic.AddInt64(&v.visited, 1) > v.max {
+		return nil, ErrTraversalLimit
+	}
+	return v.DAGService.Get(ctx, c)
+}
@@ -0,0 +1,157 @@
+package gc
+
+import (
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-ipfs/blocks"
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+	dag "github.com/ipfs/go-ipfs/merkledag"
+	gctest "github.com/ipfs/go-ipfs/pin/gc/gctest"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// remoteExchange serves the blocks of another blockstore. If hang is set,
+// it never answers.
+type remoteExchange struct {
+	remote bstore.Blockstore
+	hang   bool
+}
+
+func (ex *remoteExchange) GetBlock(ctx context.Context, k key.Key) (blocks.Block, error) {
+	if ex.hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return ex.remote.Get(k)
+}
+
+func (ex *remoteExchange) GetBlocks(ctx context.Context, ks []key.Key) (<-chan blocks.Block, error) {
+	out := make(chan blocks.Block, len(ks))
+	defer close(out)
+	for _, k := range ks {
+		if b, err := ex.GetBlock(ctx, k); err == nil {
+			out <- b
+		}
+	}
+	return out, nil
+}
+
+func (ex *remoteExchange) HasBlock(blocks.Block) error { return nil }
+func (ex *remoteExchange) Close() error                { return nil }
+
+func TestGCFetchMissing(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	root, tree := buildTree(t, e, "pinned", 2, 2)
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// move an inner node to the remote store, its children stay local
+	inner := tree[2]
+	remote := gctest.NewMemBlockstore()
+	blk, err := e.bs.Get(inner.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Put(blk); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.bs.DeleteBlock(inner.Key()); err != nil {
+		t.Fatal(err)
+	}
+	garbage := e.addNode(t, "garbage")
+
+	if _, err := GC(ctx, e.bs, e.pn, nil); err == nil {
+		t.Fatal("expected GC to fail without fetching")
+	}
+
+	start := time.Now()
+	_, err = GCWith(ctx, e.bs, e.pn, nil, WithFetchMissing(&remoteExchange{remote: remote, hang: true}, 20*time.Millisecond))
+	if _, ok := err.(*ErrPinIncomplete); !ok {
+		t.Fatalf("expected an incomplete pin after the fetch timed out, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("GC took %s to give up on the fetch", d)
+	}
+
+	out, err := GCWith(ctx, e.bs, e.pn, nil, WithFetchMissing(&remoteExchange{remote: remote}, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(drain(out)); n != 1 {
+		t.Fatalf("expected 1 removed block, got %d", n)
+	}
+	if e.has(t, garbage) {
+		t.Fatal("garbage block was not removed")
+	}
+	for _, nd := range tree {
+		if nd != inner && !e.has(t, nd) {
+			t.Fatal("pinned block was removed")
+		}
+	}
+}
+
+// stallingDAGService never answers for the nodes in stall, whatever the
+// context, until release is closed
+type stallingDAGService struct {
+	dag.DAGService
+	stall   map[key.Key]bool
+	release chan struct{}
+}
+
+func (ds *stallingDAGService) Get(ctx context.Context, c *cid.Cid) (*dag.Node, error) {
+	if ds.stall[key.Key(c.Hash())] {
+		<-ds.release
+	}
+	return ds.DAGService.Get(ctx, c)
+}
+
+func TestMarkGetTimeout(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	stalled := e.addNode(t, "stalled")
+	root := e.addNode(t, "root", stalled)
+	ds := &stallingDAGService{
+		DAGService: e.dserv,
+		stall:      map[key.Key]bool{stalled.Key(): true},
+		release:    make(chan struct{}),
+	}
+	defer close(ds.release)
+
+	// under a best-effort root the stalled node is skipped
+	set, incomplete, err := ColoredSet(ctx, e.pn, ds, []*cid.Cid{root.Cid()}, WithMarkGetTimeout(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(incomplete) != 1 || !incomplete[0].Cid.Equals(root.Cid()) {
+		t.Fatalf("expected the best-effort root to be incomplete, got %v", incomplete)
+	}
+	if !set.Has(root.Key()) {
+		t.Fatal("best-effort root was not marked")
+	}
+
+	// under a pin it fails the mark phase
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := ColoredSet(ctx, e.pn, ds, nil, WithMarkGetTimeout(20*time.Millisecond))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != ErrMarkTimeout {
+			t.Fatalf("expected ErrMarkTimeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("marking hung on the stalled node")
+	}
+}
@@ -1,6 +1,10 @@
 package gc
 
 import (
+	"fmt"
+	"sync"
+	"time"
+
 	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
 	bserv "github.com/ipfs/go-ipfs/blockservice"
 	offline "github.com/ipfs/go-ipfs/exchange/offline"
@@ -15,6 +19,155 @@ import (
 
 var log = logging.Logger("gc")
 
+// GCResult summarizes a single garbage collection run. When the run is
+// interrupted (e.g. the context is cancelled) the totals reflect the work done
+// up to that point.
+type GCResult struct {
+	// BlocksRemoved is the number of blocks deleted from the blockstore
+	BlocksRemoved int
+	// BytesFreed is the combined size of all removed blocks
+	BytesFreed uint64
+	// MarkedCount is the number of keys in the marked set
+	MarkedCount int
+	// IncompleteRoots lists the best-effort roots, and the internal pins
+	// under WithBestEffortInternalPins, that could not be walked completely
+	IncompleteRoots []IncompleteRoot
+	// MarkRoots are the roots the marked set was built from, for auditing
+	// what kept blocks alive during the run
+	MarkRoots MarkRoots
+	// Errors holds the errors encountered while sweeping
+	Errors []error
+	// DeleteBatchSize is the number of blocks the sweep removed and
+	// committed at once, as set with WithDeleteBatchSize or WithCommitEvery
+	// and bounded by the blockstore and the deletion rate. It is zero for dry
+	// runs and sweeps that didn't start.
+	DeleteBatchSize int
+	// RemainingBlocks is the number of unmarked blocks left once
+	// WithMaxDeletions stopped the sweep, zero otherwise
+	RemainingBlocks int
+	// RetainedByPolicy is the number of unmarked blocks kept because the
+	// WithApprove callback refused their deletion
+	RetainedByPolicy int
+	// Reason tells whether the run went through, was cancelled or hit errors
+	Reason CompletionReason
+	// SweepSkipped is set when WithSkipSweepIfClean found nothing to sweep
+	SweepSkipped bool
+	// SizeHistogram counts the removed blocks by size when asked to with
+	// WithSizeHistogram, and is nil otherwise
+	SizeHistogram *SizeHistogram
+	// SharedBlocks describes the marked blocks reachable from more than one
+	// root when the marked set was built with WithProtectorIndex, and is nil
+	// otherwise
+	SharedBlocks *SharedBlockStats
+	// PhantomKeys are the keys the blockstore listed but had no block for,
+	// as recorded with WithPhantomKeys
+	PhantomKeys []key.Key
+	// Cursor is where the key listing stopped, to pass to WithStartCursor
+	// for the next run to go on from there. It is empty once the listing
+	// has gone through the end of the store, and when the blockstore
+	// doesn't take cursors or the blocks are removed largest first. A key
+	// the run was cut short on before looking at it may be passed over
+	// until the next time round.
+	Cursor string
+	// UnrepairedPins lists the pins RepairAndGC could not complete, whose
+	// stored blocks were kept as those of best-effort roots
+	UnrepairedPins []DanglingPin
+
+	// LockWaitDuration is the time spent waiting for the blockstore lock
+	LockWaitDuration time.Duration
+	// MarkDuration is the time the mark phase took, including the count of
+	// WithMarkPreCount, zero if a marked set was passed in
+	MarkDuration time.Duration
+	// SweepDuration is the time the sweep took, up to when it ended or was
+	// cancelled
+	SweepDuration time.Duration
+}
+
+// CompletionReason is how a garbage collection run ended
+type CompletionReason int
+
+const (
+	// ReasonCompleted is a run that swept every block it set out to, or
+	// freed the bytes it was asked to
+	ReasonCompleted CompletionReason = iota
+	// ReasonCancelled is a run cut short by cancelling its context,
+	// leaving garbage behind
+	ReasonCancelled
+	// ReasonError is a run that hit errors, listed in GCResult.Errors. With
+	// ContinueOnError the sweep may still have gone through every block.
+	ReasonError
+	// ReasonLimited is a run that stopped at the limit set with
+	// WithMaxDeletions, leaving GCResult.RemainingBlocks behind
+	ReasonLimited
+	// ReasonDeadline is a run whose context deadline passed. One that got
+	// to the sweep stopped it cleanly, removing the blocks it had queued,
+	// and the totals are those reached so far; with WithStartCursor the next
+	// run can go on from there.
+	ReasonDeadline
+)
+
+func (r CompletionReason) String() string {
+	switch r {
+	case ReasonCompleted:
+		return "completed"
+	case ReasonCancelled:
+		return "cancelled"
+	case ReasonError:
+		return "error"
+	case ReasonLimited:
+		return "limited"
+	case ReasonDeadline:
+		return "deadline"
+	default:
+		return "unknown"
+	}
+}
+
+// completionReason returns how a run with the given result and context
+// ended
+func completionReason(ctx context.Context, res GCResult) CompletionReason {
+	switch {
+	case len(res.Errors) > 0:
+		return ReasonError
+	case ctx.Err() != nil:
+		return cancelReason(ctx)
+	case res.RemainingBlocks > 0:
+		return ReasonLimited
+	default:
+		return ReasonCompleted
+	}
+}
+
+// cancelReason tells a run whose context deadline passed from one that was
+// cancelled
+func cancelReason(ctx context.Context) CompletionReason {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ReasonDeadline
+	}
+	return ReasonCancelled
+}
+
+// GCDeletion is a block removed by GC
+type GCDeletion struct {
+	Key key.Key
+	// Size is the size of the block in bytes, or -1 if it could not be
+	// found out
+	Size int64
+}
+
+// Err returns nil if the run hit no errors, the error itself if it hit one,
+// and an error summarizing all of them otherwise
+func (res GCResult) Err() error {
+	switch len(res.Errors) {
+	case 0:
+		return nil
+	case 1:
+		return res.Errors[0]
+	default:
+		return fmt.Errorf("%d errors during garbage collection, first: %s", len(res.Errors), res.Errors[0])
+	}
+}
+
 // GC performs a mark and sweep garbage collection of the blocks in the blockstore
 // first, it creates a 'marked' set and adds to it the following:
 // - all recursively pinned blocks, plus all of their descendants (recursively)
@@ -24,101 +177,917 @@ var log = logging.Logger("gc")
 //
 // The routine then iterates over every block in the blockstore and
 // deletes any block that is not found in the marked set.
+//
+// pn may be nil, for a blockstore used as a cache that pins nothing: then
+// only the best-effort roots and the roots given through options, like
+// WithExtraRoots, keep blocks. The same holds for every function of the
+// package that takes a Pinner.
+//
+// Before marking, GC looks up the block of every recursive and direct pin,
+// and fails with an *ErrMissingRoots listing all the missing ones. Blocks
+// missing further down a pin make it fail with an *ErrPinIncomplete instead.
+// Neither check removes anything. The lookup is skipped when
+// WithDAGService or WithFetchMissing may find the blocks elsewhere.
+//
+// Only one collection runs on a blockstore at a time: while one is in
+// progress, GC and the other functions that remove blocks return
+// ErrGCInProgress rather than waiting for it. IsGCRunning tells whether one
+// is.
+//
+// A block that fails to be removed ends the sweep and the key channel is
+// closed early. The error, a *SweepError naming the block, is not seen on
+// the channel: GCWithResult reports it in the GCResult.
 func GC(ctx context.Context, bs bstore.GCBlockstore, pn pin.Pinner, bestEffortRoots []*cid.Cid) (<-chan key.Key, error) {
-	unlocker := bs.GCLock()
-
-	bsrv := bserv.New(bs, offline.Exchange(bs))
-	ds := dag.NewDAGService(bsrv)
+	return GCWith(ctx, bs, pn, bestEffortRoots)
+}
 
-	gcs, err := ColoredSet(ctx, pn, ds, bestEffortRoots)
+// GCWith is GC configured by opts. With no options it is the same as GC.
+// With ContinueOnError a block that fails to be removed no longer ends the
+// sweep, and WithErrorSink sees every such error as it happens. As only the
+// keys are returned, removed blocks are not read for their size unless an
+// option uses it or the blockstore is a Sizer.
+func GCWith(ctx context.Context, bs bstore.GCBlockstore, pn pin.Pinner, bestEffortRoots []*cid.Cid, opts ...GCOption) (<-chan key.Key, error) {
+	o := newGCOptions(opts)
+	o.sizesUnused = true
+	unlocker, err := gcLock(bs, o)
 	if err != nil {
 		return nil, err
 	}
+	deletions, results, err := runGC(ctx, bs, unlocker, pn, bestEffortRoots, o)
+	output, _, err := keysOf(ctx, deletions, results, err)
+	return output, err
+}
+
+// Mark returns the set of blocks that must survive garbage collection, as
+// computed by the mark phase of GC. It is the way to ask what is live without
+// collecting anything: it never touches the blockstore or its locks, so it
+// runs alongside adds and other collections. The caller closes the set if it
+// is an io.Closer.
+//
+// As it takes no lock, blocks added and pinned after Mark starts are not in
+// the set, and a later Sweep would remove them. Callers have to make sure no
+// pins are added in between, GC itself holds the GC lock across both phases
+// for that reason.
+func Mark(ctx context.Context, pn pin.Pinner, ds dag.DAGService, bestEffortRoots []*cid.Cid, opts ...GCOption) (key.KeySet, error) {
+	set, _, err := ColoredSet(ctx, pn, ds, bestEffortRoots, opts...)
+	return set, err
+}
 
-	keychan, err := bs.AllKeysChan(ctx)
+// GCCollectMarkedOnly builds the marked set of a collection and returns it,
+// for tools that want to know what is live and don't collect: it takes
+// neither the GC lock nor the pin lock and removes nothing, so it can run
+// while a collection holds the blockstore. The set is what Mark returns,
+// and the caller closes it if it is an io.Closer.
+func GCCollectMarkedOnly(ctx context.Context, pn pin.Pinner, ds dag.DAGService, bestEffortRoots []*cid.Cid, opts ...GCOption) (key.KeySet, error) {
+	return Mark(ctx, pn, ds, bestEffortRoots, opts...)
+}
+
+// Sweep takes the GC lock and removes every block that is not in marked,
+// sending the removed keys on the returned channel. The lock is released
+// once the sweep is over. marked is left for the caller to close. Options
+// about the mark phase, WithPinRecheck and WithCooperativeYield have no
+// effect here.
+func Sweep(ctx context.Context, bs bstore.GCBlockstore, marked key.KeySet, opts ...GCOption) (<-chan key.Key, error) {
+	o := newGCOptions(opts)
+	// there is no mark phase to checkpoint, and no pinner to mark the pins
+	// made while the lock is given up
+	o.checkpoint = nil
+	o.yieldEvery = 0
+	m := &MarkedSet{set: &countingKeySet{KeySet: marked}}
+	unlocker, err := gcLock(bs, o)
 	if err != nil {
 		return nil, err
 	}
+	deletions, results, err := sweepLocked(ctx, bs, unlocker, m, false, o, newProgressReporter(o), nil)
+	output, _, err := keysOf(ctx, deletions, results, err)
+	return output, err
+}
+
+// GCWithSizes is like GCWithResult, but sends the size of every removed
+// block along with its key
+func GCWithSizes(ctx context.Context, bs bstore.GCBlockstore, pn pin.Pinner, bestEffortRoots []*cid.Cid, opts ...GCOption) (<-chan GCDeletion, <-chan GCResult, error) {
+	o := newGCOptions(opts)
+	unlocker, err := gcLock(bs, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	return runGC(ctx, bs, unlocker, pn, bestEffortRoots, o)
+}
+
+// GCWithResult works like GC, but additionally returns a channel on which a
+// single GCResult is delivered once the sweep is over. The result is sent
+// before the key channel is closed, and the result channel is buffered, so
+// callers not interested in it may simply ignore it.
+func GCWithResult(ctx context.Context, bs bstore.GCBlockstore, pn pin.Pinner, bestEffortRoots []*cid.Cid, opts ...GCOption) (<-chan key.Key, <-chan GCResult, error) {
+	o := newGCOptions(opts)
+	unlocker, err := gcLock(bs, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	deletions, results, err := runGC(ctx, bs, unlocker, pn, bestEffortRoots, o)
+	return keysOf(ctx, deletions, results, err)
+}
+
+// RunGC runs a garbage collection like GCWithResult and waits for it to
+// finish, for callers that only want the totals. The error is the one that
+// kept the collection from starting, or else GCResult.Err, or the context's
+// error if the sweep was cut short by it, but for a deadline passing during
+// the sweep, which ends the run with ReasonDeadline and no error. A
+// collection that failed to start, marking included, gets a result with
+// only its Reason set.
+func RunGC(ctx context.Context, bs bstore.GCBlockstore, pn pin.Pinner, bestEffortRoots []*cid.Cid, opts ...GCOption) (GCResult, error) {
+	deletions, results, err := GCWithSizes(ctx, bs, pn, bestEffortRoots, opts...)
+	if err != nil {
+		reason := ReasonError
+		if ctx.Err() != nil {
+			reason = cancelReason(ctx)
+		}
+		return GCResult{Reason: reason}, err
+	}
+	for range deletions {
+	}
+	res := <-results
+	if err := res.Err(); err != nil {
+		return res, err
+	}
+	if res.Reason == ReasonDeadline {
+		return res, nil
+	}
+	return res, ctx.Err()
+}
+
+// GCToTarget runs a garbage collection that stops once targetBytes have been
+// freed, releasing the GC lock early. If the blockstore implements
+// blockstore.Sizer the largest unmarked blocks are removed first, otherwise
+// blocks are removed in the order the blockstore lists them. The bytes that
+// were actually freed, which may fall short of the target if the garbage runs
+// out, are reported in the GCResult.
+func GCToTarget(ctx context.Context, bs bstore.GCBlockstore, pn pin.Pinner, bestEffortRoots []*cid.Cid, targetBytes uint64, opts ...GCOption) (<-chan key.Key, <-chan GCResult, error) {
+	o := newGCOptions(opts)
+	o.targetBytes = targetBytes
+	unlocker, err := gcLock(bs, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	deletions, results, err := runGC(ctx, bs, unlocker, pn, bestEffortRoots, o)
+	return keysOf(ctx, deletions, results, err)
+}
+
+// GCPrefix works like GCWithResult, but only sweeps the blocks whose
+// datastore key, as given by key.Key.DsKey, starts with prefix. Every pin is
+// still marked, so a block under the prefix is kept if anything pinned links
+// to it. If the blockstore implements blockstore.PrefixKeyLister only the
+// keys under the prefix are listed, otherwise all keys are listed and
+// filtered.
+func GCPrefix(ctx context.Context, bs bstore.GCBlockstore, pn pin.Pinner, bestEffortRoots []*cid.Cid, prefix string, opts ...GCOption) (<-chan key.Key, <-chan GCResult, error) {
+	o := newGCOptions(opts)
+	o.keyPrefix = prefix
+	unlocker, err := gcLock(bs, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	deletions, results, err := runGC(ctx, bs, unlocker, pn, bestEffortRoots, o)
+	return keysOf(ctx, deletions, results, err)
+}
+
+// GCDryRun performs the same mark phase as GC and walks the blockstore in the
+// same way, but only reports the keys that GC would remove; nothing is
+// deleted.
+//
+// Since no blocks are removed, the exclusive GCLock is not needed. The pin
+// lock is held instead, which keeps a real GC from running concurrently
+// while still allowing adds to proceed. Blocks added during the dry run may
+// therefore show up as candidates even though they would be pinned by the
+// time a real GC runs.
+func GCDryRun(ctx context.Context, bs bstore.GCBlockstore, pn pin.Pinner, bestEffortRoots []*cid.Cid, opts ...GCOption) (<-chan key.Key, error) {
+	o := newGCOptions(opts)
+	o.dryRun = true
+	deletions, results, err := runGC(ctx, bs, pinLock(bs, o), pn, bestEffortRoots, o)
+	output, _, err := keysOf(ctx, deletions, results, err)
+	return output, err
+}
+
+// EstimateReclaimable returns the number and combined size of the blocks a
+// garbage collection would remove right now, without removing anything. It
+// only takes the pin lock, like GCDryRun, so blocks can be added and pinned
+// while it runs and it doesn't hold up adds for long. The estimate is stale
+// as soon as it is returned: the GC that follows takes the exclusive lock
+// only then, and may free more or less depending on what was added, pinned
+// or unpinned in between.
+func EstimateReclaimable(ctx context.Context, bs bstore.GCBlockstore, pn pin.Pinner, bestEffortRoots []*cid.Cid, opts ...GCOption) (blocks int64, bytes int64, err error) {
+	o := newGCOptions(opts)
+	o.dryRun = true
+	o.sizeDryRun = true
+	deletions, _, err := runGC(ctx, bs, pinLock(bs, o), pn, bestEffortRoots, o)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for d := range deletions {
+		blocks++
+		if d.Size > 0 {
+			bytes += d.Size
+		}
+	}
+	return blocks, bytes, ctx.Err()
+}
+
+// runGC marks the live set and sweeps the blockstore while holding the given
+// lock. The lock is released once the sweep is done.
+func runGC(ctx context.Context, bs bstore.GCBlockstore, unlocker bstore.Unlocker, pn pin.Pinner, bestEffortRoots []*cid.Cid, o *gcOptions) (_ <-chan GCDeletion, _ <-chan GCResult, err error) {
+	pn = o.pinsFor(pn)
+	// a run that fails before sweeping gets its summary line here
+	defer func() {
+		if err != nil {
+			o.log.failed(ctx, err, GCResult{LockWaitDuration: o.lockWait, MarkDuration: o.markDuration})
+		}
+	}()
+	// sweepLocked takes over the lock once marking is done, until then it
+	// has to be released on every way out, panics included
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			unlocker.Unlock()
+		}
+	}()
+
+	ds := markDAGService(bs, o)
+	p := newProgressReporter(o)
+	m := o.marked
+	if m != nil {
+		if err := m.current(pn); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// the pins are recorded before marking, so that anything pinned while
+	// marking is picked up by the recheck as well
+	var recheck *pinRecheck
+	if (o.pinRecheck || o.yield != nil) && !o.dryRun {
+		recheck = newPinRecheck(pn, ds, o.log)
+	}
 
-	output := make(chan key.Key)
+	// a DAG service or an exchange may find the roots elsewhere
+	if m == nil && o.dagService == nil && o.fetchMissing == nil {
+		if err := checkPinnedRoots(bs, pn, o.log); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if m == nil {
+		sendEvent(ctx, o, MarkStarted{})
+		start := time.Now()
+		var err error
+		m, err = buildMarkedSet(ctx, pn, ds, bestEffortRoots, o, p)
+		if err != nil {
+			return nil, nil, err
+		}
+		o.markDuration = time.Since(start)
+		o.metrics.PhaseFinished(PhaseMark, o.markDuration)
+		sendEvent(ctx, o, MarkFinished{Count: m.Len()})
+	}
+
+	if o.staleCheck && o.marked == nil {
+		if err := m.covers(pn, o.log); err != nil {
+			m.Close()
+			return nil, nil, err
+		}
+	}
+
+	if o.checkpoint != nil && !o.dryRun {
+		if err := saveCheckpoint(ctx, o.checkpoint, m); err != nil {
+			if o.marked == nil {
+				m.Close()
+			}
+			return nil, nil, err
+		}
+	}
+
+	// sets passed in through WithMarkedSet belong to the caller
+	handedOff = true
+	return sweepLocked(ctx, bs, unlocker, m, o.marked == nil, o, p, recheck)
+}
+
+// markDAGService returns the DAG service the mark phase reads nodes from:
+// the one given with WithDAGService, or else one on bs that fetches missing
+// blocks if WithFetchMissing is set.
+func markDAGService(bs bstore.Blockstore, o *gcOptions) dag.DAGService {
+	if o.dagService != nil {
+		if o.fetchMissing != nil {
+			o.log.Warning("a DAG service was given, not fetching missing blocks through the exchange")
+		}
+		return o.dagService
+	}
+
+	ex := offline.Exchange(bs)
+	if o.fetchMissing != nil {
+		ex = o.fetchMissing
+	}
+	var ds dag.DAGService = dag.NewDAGService(bserv.New(bs, ex))
+	if o.fetchMissing != nil {
+		ds = newFetchTimeout(ds, o.fetchTimeout, o.log)
+	}
+	return ds
+}
+
+// sweepLocked sweeps the blockstore against m while holding the given lock,
+// and releases the lock once the sweep is over or fails to start. m is
+// closed at the end if owned is set.
+func sweepLocked(ctx context.Context, bs bstore.GCBlockstore, unlocker bstore.Unlocker, m *MarkedSet, owned bool, o *gcOptions, p *progressReporter, recheck *pinRecheck) (<-chan GCDeletion, <-chan GCResult, error) {
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			unlocker.Unlock()
+		}
+	}()
+
+	gcs := m.set
+	release := func() {
+		if owned {
+			closeKeySet(gcs.KeySet)
+		}
+	}
+
+	// the sweep may stop before reading every key, so the key listing gets
+	// its own context to end it
+	keyctx, cancelKeys := context.WithCancel(ctx)
+	skipped := o.skipSweepIfClean && nothingToSweep(bs, gcs.Len(), o.log)
+	if len(o.unrepaired) > 0 {
+		o.log.Warningf("%d pins could not be repaired, keeping their stored blocks", len(o.unrepaired))
+	}
+	var keychan <-chan key.Key
+	keysErr := func() error { return nil }
+	var cursor *listCursor
+	if skipped {
+		keys := make(chan key.Key)
+		close(keys)
+		keychan = keys
+	} else {
+		var err error
+		switch {
+		case o.subtree != nil:
+			keychan, keysErr, err = listSubtree(keyctx, bs, gcs, o.subtree)
+		case o.keySource != nil:
+			keychan = streamKeys(keyctx, o.keySource)
+		default:
+			keychan, keysErr, cursor, err = listKeysFrom(keyctx, bs, o.keyPrefix, o.startCursor, o.log)
+		}
+		if err != nil {
+			cancelKeys()
+			release()
+			return nil, nil, err
+		}
+	}
+
+	output := make(chan GCDeletion, o.outputBuffer)
+	results := make(chan GCResult, 1)
+	handedOff = true
 	go func() {
+		res := GCResult{
+			MarkedCount:      gcs.Len(),
+			IncompleteRoots:  m.IncompleteRoots(),
+			MarkRoots:        m.Roots(),
+			UnrepairedPins:   o.unrepaired,
+			SweepSkipped:     skipped,
+			LockWaitDuration: o.lockWait,
+			MarkDuration:     o.markDuration,
+		}
+		if o.histogramBounds != nil {
+			res.SizeHistogram = newSizeHistogram(o.histogramBounds)
+		}
+		if m.protectors != nil {
+			res.SharedBlocks = m.protectors.sharedStats(bs, o.log)
+		}
+		_, span := startSpan(ctx, "gc.sweep")
+		start := time.Now()
 		defer close(output)
 		defer unlocker.Unlock()
-		for {
+		defer func() {
+			cancelKeys()
+			drainKeys(keychan)
+		}()
+		defer func() {
+			// a panic outside the sweepers, from listing or sizing the
+			// keys, ends up here
+			if r := recover(); r != nil {
+				recordError(ctx, o, &res, newPanicError(r, o.log))
+			}
+			if err := m.Err(); err != nil {
+				res.Errors = append(res.Errors, err)
+			}
+			release()
+			res.Reason = completionReason(ctx, res)
+			res.SweepDuration = time.Since(start)
+			o.log.finished(ctx, res)
+			span.SetTag("blocks_deleted", res.BlocksRemoved)
+			span.SetTag("bytes_freed", res.BytesFreed)
+			span.SetTag("errors", len(res.Errors))
+			span.Finish()
+			o.metrics.PhaseFinished(PhaseSweep, res.SweepDuration)
+			o.metrics.RunFinished(res.LockWaitDuration+res.MarkDuration+res.SweepDuration, res)
+			sendEvent(ctx, o, Finished{Result: res})
+			results <- res
+			close(results)
+		}()
+		defer p.finish()
+
+		o.log.setPhase(PhaseSweep)
+		p.startSweep(ctx, bs, o.keyPrefix, o.progressPreCount)
+		sendEvent(ctx, o, SweepStarted{})
+		env := newSweepEnv(ctx, bs, gcs, output, o, p, recheck)
+		env.cursor = cursor
+		sweep(env, keychan, &res)
+		env.closeSeen()
+
+		if err := keysErr(); err != nil {
+			err = &KeyListError{Err: err}
+			o.log.Errorf("%s", err)
+			recordError(ctx, o, &res, err)
+			env.cursor.cutShort()
+		}
+		res.Cursor = env.cursor.String()
+
+		if o.checkpoint != nil && !o.dryRun && m.Err() == nil {
+			finishCheckpoint(ctx, o.checkpoint, &res, o.log)
+		}
+	}()
+
+	return output, results, nil
+}
+
+// recordError adds an error of the run to res, and hands it to the error
+// sink and the event sink
+func recordError(ctx context.Context, o *gcOptions, res *GCResult, err error) {
+	res.Errors = append(res.Errors, err)
+	if o.errorSink != nil {
+		o.errorSink(err)
+	}
+	sendEvent(ctx, o, errorEvent(err))
+}
+
+// nothingToSweep reports whether bs can count its blocks and holds no more
+// than marked of them
+func nothingToSweep(bs bstore.Blockstore, marked int, l *runLogger) bool {
+	bc, ok := bs.(bstore.BlockCounter)
+	if !ok {
+		l.Debug("the blockstore can't count its blocks, sweeping")
+		return false
+	}
+	n, err := bc.BlockCount()
+	if err != nil {
+		l.Warningf("error counting blocks, sweeping: %s", err)
+		return false
+	}
+	if n > marked {
+		return false
+	}
+	l.Infof("%d blocks and %d marked, skipping the sweep", n, marked)
+	return true
+}
+
+// KeyListError is reported when listing the keys of the blockstore failed
+// part way. The sweep did not look at the keys that were left, so some
+// garbage may remain.
+type KeyListError struct {
+	Err error
+}
+
+func (e *KeyListError) Error() string {
+	return fmt.Sprintf("listing blockstore keys failed, the sweep is incomplete: %s", e.Err)
+}
+
+// drainKeys reads what is left of keys in the background. A listing that
+// doesn't watch its context would otherwise block forever on a key that
+// nobody reads once the sweep has stopped early.
+func drainKeys(keys <-chan key.Key) {
+	go func() {
+		for range keys {
+		}
+	}()
+}
+
+// keysOf passes on the keys of the deletions sent by runGC
+func keysOf(ctx context.Context, deletions <-chan GCDeletion, results <-chan GCResult, err error) (<-chan key.Key, <-chan GCResult, error) {
+	if err != nil {
+		return nil, nil, err
+	}
+	out := make(chan key.Key)
+	go func() {
+		defer close(out)
+		for d := range deletions {
 			select {
-			case k, ok := <-keychan:
-				if !ok {
-					return
-				}
-				if !gcs.Has(k) {
-					err := bs.DeleteBlock(k)
-					if err != nil {
-						log.Debugf("Error removing key from blockstore: %s", err)
-						return
-					}
-					select {
-					case output <- k:
-					case <-ctx.Done():
-						return
-					}
-				}
+			case out <- d.Key:
 			case <-ctx.Done():
-				return
 			}
 		}
 	}()
+	return out, results, nil
+}
 
-	return output, nil
+// blockSize returns the size of the raw data of the block stored under k
+func blockSize(bs bstore.Blockstore, k key.Key) (uint64, error) {
+	if sz, ok := bs.(bstore.Sizer); ok {
+		n, err := sz.GetSize(k)
+		return uint64(n), err
+	}
+	blk, err := bs.Get(k)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(len(blk.RawData())), nil
 }
 
+// Descendants adds roots and every node below them to set. Roots that share
+// a multihash are walked once.
+//
+// A node is marked before its children are read, and is not walked again
+// once marked, so a corrupt block linking back to one of its ancestors ends
+// the walk rather than looping. With a probabilistic set, the nodes with
+// links are recorded exactly for the same purpose.
 func Descendants(ctx context.Context, ds dag.DAGService, set key.KeySet, roots []*cid.Cid, bestEffort bool) error {
-	for _, c := range roots {
-		set.Add(key.Key(c.Hash()))
-		nd, err := ds.Get(ctx, c)
-		if err != nil {
+	seen := set.Has
+	if isProbabilistic(set) {
+		// a hit may be a false positive, and pruning the walk on one would
+		// leave a live subgraph unmarked. Only prune on nodes that are known
+		// to have been walked already.
+		walked := newWalkedSet(ds)
+		ds = walked
+		seen = walked.Has
+	}
+
+	for _, c := range uniqueRoots(roots, make(map[key.Key]bool)) {
+		if err := descendRoot(ctx, ds, set, seen, c, bestEffort); err != nil {
 			return err
 		}
+	}
 
-		// EnumerateChildren recursively walks the dag and adds the keys to the given set
-		err = dag.EnumerateChildren(ctx, ds, nd, func(c *cid.Cid) bool {
-			k := key.Key(c.Hash())
-			seen := set.Has(k)
-			if seen {
-				return false
-			}
-			set.Add(k)
-			return true
-		}, bestEffort)
+	return nil
+}
+
+// descendRoot marks c and the nodes below it that seen doesn't report as
+// walked already
+func descendRoot(ctx context.Context, ds dag.DAGService, set key.KeySet, seen func(key.Key) bool, c *cid.Cid, bestEffort bool) error {
+	ctx, span := startSpan(ctx, "gc.descendants")
+	defer span.Finish()
+	span.SetTag("root", c.String())
+
+	rds, rec := recordMissing(ds, bestEffort)
+	set.Add(key.Key(c.Hash()))
+	nd, err := rds.Get(ctx, c)
+	if err != nil {
+		return pinIncomplete(c, rec, err)
+	}
+
+	// EnumerateChildren recursively walks the dag and adds the keys to the given set
+	err = dag.EnumerateChildren(ctx, rds, nd, func(c *cid.Cid) bool {
+		k := key.Key(c.Hash())
+		if seen(k) {
+			return false
+		}
+		set.Add(k)
+		return true
+	}, bestEffort)
+	if err != nil {
+		return pinIncomplete(c, rec, err)
+	}
+	return nil
+}
+
+// DescendantsDepth is like Descendants, but only marks the nodes at most
+// maxDepth links below a root. The roots are at depth 0. A maxDepth of zero
+// or less walks the whole DAG, like Descendants.
+func DescendantsDepth(ctx context.Context, ds dag.DAGService, set key.KeySet, roots []*cid.Cid, bestEffort bool, maxDepth int) error {
+	if maxDepth <= 0 {
+		return Descendants(ctx, ds, set, roots, bestEffort)
+	}
+
+	// a node first reached deep in the DAG has to be walked again if it is
+	// found closer to a root later on, as more of its descendants are then
+	// within reach. Keep the shallowest depth each node was reached at.
+	depths := make(map[key.Key]int)
+	visit := func(c *cid.Cid, depth int) bool {
+		k := key.Key(c.Hash())
+		if d, ok := depths[k]; ok && d <= depth {
+			return false
+		}
+		depths[k] = depth
+		set.Add(k)
+		return depth < maxDepth
+	}
+
+	for _, c := range roots {
+		if !visit(c, 0) {
+			continue
+		}
+		rctx, span := startSpan(ctx, "gc.descendants")
+		span.SetTag("root", c.String())
+		rds, rec := recordMissing(ds, bestEffort)
+		nd, err := rds.Get(rctx, c)
+		if err == nil {
+			err = dag.EnumerateChildrenDepth(rctx, rds, nd, visit, bestEffort)
+		}
+		span.Finish()
 		if err != nil {
-			return err
+			return pinIncomplete(c, rec, err)
 		}
 	}
 
 	return nil
 }
 
-func ColoredSet(ctx context.Context, pn pin.Pinner, ds dag.DAGService, bestEffortRoots []*cid.Cid) (key.KeySet, error) {
-	// KeySet currently implemented in memory, in the future, may be bloom filter or
-	// disk backed to conserve memory.
-	gcs := key.NewKeySet()
-	err := Descendants(ctx, ds, gcs, pn.RecursiveKeys(), false)
+// ColoredSet runs the mark phase and returns the marked keys, along with the
+// best-effort roots that could not be walked completely.
+//
+// The keys are the multihashes of the blocks, which is what the blockstore
+// stores and lists them under, so the sweep compares like with like. The
+// hash function is part of the multihash: the same content stored under two
+// hash functions is two blocks, and each is kept only if a pin reaches it
+// under its own hash. The version and codec of a CID are not part of the
+// key, so a block is kept whichever CID it is pinned or linked with.
+func ColoredSet(ctx context.Context, pn pin.Pinner, ds dag.DAGService, bestEffortRoots []*cid.Cid, opts ...GCOption) (key.KeySet, []IncompleteRoot, error) {
+	// KeySet defaults to being implemented in memory, WithKeySetFactory
+	// allows a bloom filter or disk backed set to conserve memory.
+	o := newGCOptions(opts)
+	gcs, err := o.newKeySet()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	res, err := colorSet(ctx, pn, ds, gcs, bestEffortRoots, o)
+	if err == nil {
+		err = keySetErr(gcs)
+	}
+	if err != nil {
+		closeKeySet(gcs)
+		return nil, nil, err
+	}
+
+	return gcs, res.incomplete, nil
+}
+
+// markResult is what colorSet found besides the marked keys
+type markResult struct {
+	// incomplete lists the best-effort roots that had missing blocks
+	incomplete []IncompleteRoot
+	// extraRoots are the roots given by the WithExtraRoots provider and
+	// WithMFSRoot
+	extraRoots []*cid.Cid
+	// roots are all the roots marked from
+	roots MarkRoots
+}
+
+// colorSet adds every key that must survive garbage collection to gcs, and
+// returns the best-effort roots that could not be walked completely
+func colorSet(ctx context.Context, pn pin.Pinner, ds dag.DAGService, gcs key.KeySet, bestEffortRoots []*cid.Cid, o *gcOptions) (markResult, error) {
+	pn = o.pinsFor(pn)
+	if skipped := o.pinTypes.skipped(); skipped != "" {
+		o.log.Warningf("not marking %s pins: the blocks only they protect will be removed", skipped)
 	}
+	ctx, span := startSpan(ctx, "gc.mark")
+	defer span.Finish()
+
+	ds = newGetTimeout(ds, o.markGetTimeout, o.log)
+
+	// the pins and the best-effort roots often share large subgraphs, the
+	// cache saves fetching them again for every walk
+	ds = newNodeCache(ds, o.nodeCacheSize)
+
+	if o.onMark != nil {
+		gcs = &onMarkKeySet{KeySet: gcs, onMark: o.onMark}
+	}
+
+	// the prefetches run until marking is over
+	pctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ds = newPrefetcher(pctx, ds, o.prefetchWindow)
+
+	// every node the walks read counts towards the limit, whether it was
+	// prefetched or cached or not
+	ds = newVisitLimit(ds, o.maxVisitedNodes)
 
-	err = Descendants(ctx, ds, gcs, bestEffortRoots, true)
+	// a root given more than once, or both pinned and given as an extra or
+	// best-effort root, is only walked the first time
+	walked := make(map[key.Key]bool)
+
+	var res markResult
+	res.roots.Recursive = pn.RecursiveKeys()
+	err := markRoots(ctx, ds, gcs, uniqueRoots(res.roots.Recursive, walked), o)
 	if err != nil {
-		return nil, err
+		return res, err
+	}
+
+	if err := markOtherRoots(ctx, ds, gcs, bestEffortRoots, walked, o, &res); err != nil {
+		return res, err
 	}
 
-	for _, k := range pn.DirectKeys() {
+	res.roots.Direct = pn.DirectKeys()
+	for _, k := range res.roots.Direct {
 		gcs.Add(key.Key(k.Hash()))
 	}
 
-	err = Descendants(ctx, ds, gcs, pn.InternalPins(), false)
+	res.roots.Internal = pn.InternalPins()
+	if o.bestEffortInternal {
+		incomplete, err := bestEffortDescendants(ctx, ds, gcs, uniqueRoots(res.roots.Internal, walked), o.markConcurrency, o.markQueueSize, "internal pin", o.log)
+		if err != nil {
+			return res, err
+		}
+		res.incomplete = append(res.incomplete, incomplete...)
+		return res, nil
+	}
+	err = markRoots(ctx, ds, gcs, uniqueRoots(res.roots.Internal, walked), o)
 	if err != nil {
-		return nil, err
+		return res, err
 	}
+	return res, nil
+}
+
+// uniqueRoots returns the roots that are not in walked and adds them to it,
+// keeping only the first of roots that share a multihash. CIDs that differ
+// only in their version or codec name the same block, so it is walked once.
+func uniqueRoots(roots []*cid.Cid, walked map[key.Key]bool) []*cid.Cid {
+	var out []*cid.Cid
+	for _, c := range roots {
+		k := key.Key(c.Hash())
+		if walked[k] {
+			continue
+		}
+		walked[k] = true
+		out = append(out, c)
+	}
+	return out
+}
+
+// markOtherRoots marks the roots that don't come from the pinner: the extra,
+// CAR and MFS roots, the best-effort roots and the retained blocks
+func markOtherRoots(ctx context.Context, ds dag.DAGService, gcs key.KeySet, bestEffortRoots []*cid.Cid, walked map[key.Key]bool, o *gcOptions, res *markResult) error {
+	var err error
+	if o.extraRoots != nil {
+		res.extraRoots, err = o.extraRoots(ctx)
+		if err != nil {
+			return fmt.Errorf("gc: getting extra roots: %s", err)
+		}
+		res.roots.Extra = res.extraRoots
+	}
+	if o.carRoots != nil {
+		carRoots, err := readCARRoots(o.carRoots)
+		if err != nil {
+			return err
+		}
+		res.extraRoots = append(res.extraRoots, carRoots...)
+		res.roots.Extra = res.extraRoots
+	}
+	if o.mfsRoot != nil {
+		res.roots.MFS = o.mfsRoot
+		res.extraRoots = append(res.extraRoots, o.mfsRoot)
+	}
+	err = markRoots(ctx, ds, gcs, uniqueRoots(res.extraRoots, walked), o)
+	if err != nil {
+		return err
+	}
+
+	res.roots.BestEffort = bestEffortRoots
+	res.incomplete, err = bestEffortDescendants(ctx, ds, gcs, uniqueRoots(bestEffortRoots, walked), o.markConcurrency, o.markQueueSize, "best-effort root", o.log)
+	if err != nil {
+		return err
+	}
+
+	res.roots.Retained = o.retain
+	for _, k := range res.roots.Retained {
+		gcs.Add(key.Key(k.Hash()))
+	}
+	return nil
+}
+
+// IncompleteRoot is a best-effort root, or an internal pin under
+// WithBestEffortInternalPins, whose DAG could not be walked completely. The
+// blocks below the missing ones are not marked, so they may be removed.
+type IncompleteRoot struct {
+	Cid *cid.Cid
+	Err error
+}
+
+// missingRecorder is a DAGService that remembers the nodes it couldn't find
+type missingRecorder struct {
+	dag.DAGService
+
+	mu      sync.Mutex
+	missing []*cid.Cid
+}
+
+func (r *missingRecorder) Get(ctx context.Context, c *cid.Cid) (*dag.Node, error) {
+	nd, err := r.DAGService.Get(ctx, c)
+	if err == dag.ErrNotFound {
+		r.mu.Lock()
+		r.missing = append(r.missing, c)
+		r.mu.Unlock()
+	}
+	return nd, err
+}
+
+// ErrPinIncomplete is returned by the mark phase when a block below a root
+// that isn't best-effort, like a recursive pin, is missing. Keeping going
+// would delete the rest of that DAG, so marking stops; fetching the missing
+// block or repairing the pin lets GC run again. Other errors fetching blocks
+// are returned as they are.
+type ErrPinIncomplete struct {
+	// Root is the pinned root the walk started from
+	Root *cid.Cid
+	// Missing is the block that was not found. It is Root itself if the
+	// root is missing.
+	Missing *cid.Cid
+}
+
+func (e *ErrPinIncomplete) Error() string {
+	return fmt.Sprintf("pin %s is incomplete: block %s not found", e.Root, e.Missing)
+}
+
+// recordMissing wraps ds to find out which block was missing if a walk that
+// isn't best-effort fails with dag.ErrNotFound
+func recordMissing(ds dag.DAGService, bestEffort bool) (dag.DAGService, *missingRecorder) {
+	if bestEffort {
+		return ds, nil
+	}
+	rec := &missingRecorder{DAGService: ds}
+	return rec, rec
+}
+
+// pinIncomplete turns a dag.ErrNotFound ending the walk of root into an
+// *ErrPinIncomplete naming the missing block
+func pinIncomplete(root *cid.Cid, rec *missingRecorder, err error) error {
+	if err != dag.ErrNotFound || rec == nil || len(rec.missing) == 0 {
+		return err
+	}
+	return &ErrPinIncomplete{Root: root, Missing: rec.missing[0]}
+}
+
+// bestEffortDescendants marks the descendants of roots, skipping missing
+// blocks and blocks that timed out, and returns the roots that had some. A
+// missing block under a subgraph shared by several roots is only reported
+// for the first of them. what names the roots in the warnings.
+func bestEffortDescendants(ctx context.Context, ds dag.DAGService, set key.KeySet, roots []*cid.Cid, concurrency, queueSize int, what string, l *runLogger) ([]IncompleteRoot, error) {
+	var incomplete []IncompleteRoot
+	for _, c := range roots {
+		rec := &missingRecorder{DAGService: timeoutAsMissing{ds}}
+		err := markDescendants(ctx, rec, set, []*cid.Cid{c}, true, concurrency, queueSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(rec.missing) > 0 {
+			err := fmt.Errorf("%d blocks not found, first: %s", len(rec.missing), rec.missing[0])
+			l.Warningf("%s %s is incomplete: %s", what, c, err)
+			incomplete = append(incomplete, IncompleteRoot{Cid: c, Err: err})
+		}
+	}
+	return incomplete, nil
+}
+
+// countingKeySet wraps a KeySet and keeps track of how many distinct keys
+// it holds, so callers don't have to enumerate the whole set to find out.
+type countingKeySet struct {
+	key.KeySet
+	n int
+
+	progress *progressReporter
+}
+
+func (s *countingKeySet) Add(k key.Key) {
+	if !s.KeySet.Has(k) {
+		s.n++
+		s.progress.marked()
+	}
+	s.KeySet.Add(k)
+}
+
+func (s *countingKeySet) Remove(k key.Key) {
+	if s.KeySet.Has(k) {
+		s.n--
+	}
+	s.KeySet.Remove(k)
+}
+
+// Len returns the number of keys in the set
+func (s *countingKeySet) Len() int {
+	return s.n
+}
+
+func (s *countingKeySet) probabilistic() bool {
+	return isProbabilistic(s.KeySet)
+}
+
+// onMarkKeySet calls onMark with every key added to the set for the first
+// time
+type onMarkKeySet struct {
+	key.KeySet
+	onMark func(key.Key)
+}
+
+func (s *onMarkKeySet) Add(k key.Key) {
+	if s.KeySet.Has(k) {
+		return
+	}
+	s.KeySet.Add(k)
+	s.onMark(k)
+}
 
-	return gcs, nil
+func (s *onMarkKeySet) probabilistic() bool {
+	return isProbabilistic(s.KeySet)
 }
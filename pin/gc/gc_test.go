@@ -0,0 +1,2268 @@
+package gc
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-ipfs/blocks"
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+	bserv "github.com/ipfs/go-ipfs/blockservice"
+	offline "github.com/ipfs/go-ipfs/exchange/offline"
+	dag "github.com/ipfs/go-ipfs/merkledag"
+	pin "github.com/ipfs/go-ipfs/pin"
+
+	mh "gx/ipfs/QmYf7ng2hG5XBtJA3tN34DQ2GUN5HNksEw1rLDkmr6vGku/go-multihash"
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	ds "gx/ipfs/QmbzuUusHqaLLoNTDEVLcSF6vZDHZDLPC7p4bztRvvkXxU/go-datastore"
+	dssync "gx/ipfs/QmbzuUusHqaLLoNTDEVLcSF6vZDHZDLPC7p4bztRvvkXxU/go-datastore/sync"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+type testEnv struct {
+	bs    bstore.GCBlockstore
+	dserv dag.DAGService
+	pn    pin.Pinner
+}
+
+func newTestEnv() *testEnv {
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	bs := bstore.NewBlockstore(dstore)
+	dserv := dag.NewDAGService(bserv.New(bs, offline.Exchange(bs)))
+	return &testEnv{
+		bs:    bs,
+		dserv: dserv,
+		pn:    pin.NewPinner(dstore, dserv, dserv),
+	}
+}
+
+// addNode stores a node with the given data and links to children
+func (e *testEnv) addNode(t testing.TB, data string, children ...*dag.Node) *dag.Node {
+	nd := dag.NodeWithData([]byte(data))
+	for i, c := range children {
+		if err := nd.AddNodeLink(string('a'+rune(i)), c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := e.dserv.Add(nd); err != nil {
+		t.Fatal(err)
+	}
+	return nd
+}
+
+func (e *testEnv) has(t testing.TB, nd *dag.Node) bool {
+	has, err := e.bs.Has(nd.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return has
+}
+
+// buildTree stores a tree of the given depth and fan-out and returns its
+// root along with every node in it
+func buildTree(t testing.TB, e *testEnv, prefix string, depth, fanout int) (*dag.Node, []*dag.Node) {
+	if depth == 0 {
+		nd := e.addNode(t, prefix)
+		return nd, []*dag.Node{nd}
+	}
+
+	var children, all []*dag.Node
+	for i := 0; i < fanout; i++ {
+		c, sub := buildTree(t, e, fmt.Sprintf("%s-%d", prefix, i), depth-1, fanout)
+		children = append(children, c)
+		all = append(all, sub...)
+	}
+	nd := e.addNode(t, prefix, children...)
+	return nd, append(all, nd)
+}
+
+func drain(keys <-chan key.Key) []key.Key {
+	var out []key.Key
+	for k := range keys {
+		out = append(out, k)
+	}
+	return out
+}
+
+func TestGCResult(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	leaf := e.addNode(t, "leaf")
+	root := e.addNode(t, "root", leaf)
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+
+	garbage := e.addNode(t, "garbage")
+	garbageParent := e.addNode(t, "garbage parent", garbage)
+
+	out, results, err := GCWithResult(ctx, e.bs, e.pn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed := drain(out)
+	if len(removed) != 2 {
+		t.Fatalf("expected 2 removed blocks, got %d", len(removed))
+	}
+
+	res := <-results
+	if res.BlocksRemoved != 2 {
+		t.Fatalf("expected BlocksRemoved to be 2, got %d", res.BlocksRemoved)
+	}
+	expSize := uint64(len(garbage.RawData()) + len(garbageParent.RawData()))
+	if res.BytesFreed != expSize {
+		t.Fatalf("expected %d bytes freed, got %d", expSize, res.BytesFreed)
+	}
+	if res.MarkedCount != 2 {
+		t.Fatalf("expected 2 marked keys, got %d", res.MarkedCount)
+	}
+	if len(res.Errors) != 0 {
+		t.Fatalf("unexpected errors: %v", res.Errors)
+	}
+
+	if !e.has(t, root) || !e.has(t, leaf) {
+		t.Fatal("pinned blocks were removed")
+	}
+	if e.has(t, garbage) || e.has(t, garbageParent) {
+		t.Fatal("unpinned blocks were not removed")
+	}
+}
+
+func TestGCDryRun(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	pinned := e.addNode(t, "pinned")
+	if err := e.pn.Pin(ctx, pinned, true); err != nil {
+		t.Fatal(err)
+	}
+	garbage := e.addNode(t, "garbage")
+
+	out, err := GCDryRun(ctx, e.bs, e.pn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	candidates := drain(out)
+	if len(candidates) != 1 || candidates[0] != garbage.Key() {
+		t.Fatalf("expected only the garbage block as candidate, got %v", candidates)
+	}
+	if !e.has(t, garbage) {
+		t.Fatal("dry run removed a block")
+	}
+}
+
+// batchCountingBlockstore records the batches passed to DeleteBlocks
+type batchCountingBlockstore struct {
+	bstore.GCBlockstore
+	batches []int
+}
+
+func (bs *batchCountingBlockstore) DeleteBlocks(ks []key.Key) error {
+	bs.batches = append(bs.batches, len(ks))
+	return bs.GCBlockstore.(bstore.BatchDeleter).DeleteBlocks(ks)
+}
+
+func TestGCBatchesDeletes(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	pinned := e.addNode(t, "pinned")
+	if err := e.pn.Pin(ctx, pinned, true); err != nil {
+		t.Fatal(err)
+	}
+	var garbage []*dag.Node
+	for i := 0; i < 300; i++ {
+		garbage = append(garbage, e.addNode(t, fmt.Sprintf("garbage %d", i)))
+	}
+
+	bs := &batchCountingBlockstore{GCBlockstore: e.bs}
+	out, results, err := GCWithResult(ctx, bs, e.pn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := drain(out)
+	res := <-results
+
+	if len(removed) != len(garbage) || res.BlocksRemoved != len(garbage) {
+		t.Fatalf("expected %d removed blocks, got %d emitted and %d counted",
+			len(garbage), len(removed), res.BlocksRemoved)
+	}
+	exp := []int{DefaultDeleteBatchSize, DefaultDeleteBatchSize, len(garbage) - 2*DefaultDeleteBatchSize}
+	if fmt.Sprint(bs.batches) != fmt.Sprint(exp) {
+		t.Fatalf("expected batches %v, got %v", exp, bs.batches)
+	}
+	if res.DeleteBatchSize != DefaultDeleteBatchSize {
+		t.Fatalf("expected a batch size of %d in the result, got %d", DefaultDeleteBatchSize, res.DeleteBatchSize)
+	}
+	if !e.has(t, pinned) {
+		t.Fatal("pinned block was removed")
+	}
+	for _, nd := range garbage {
+		if e.has(t, nd) {
+			t.Fatal("unpinned block was not removed")
+		}
+	}
+}
+
+func TestGCBatchFlushedOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	e := newTestEnv()
+
+	for i := 0; i < 10; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+
+	bs := &batchCountingBlockstore{GCBlockstore: e.bs}
+	out, results, err := GCWithResult(ctx, bs, e.pn, nil, WithDeleteBatchSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-out
+	cancel()
+	drain(out)
+	res := <-results
+
+	var deleted int
+	for _, n := range bs.batches {
+		deleted += n
+	}
+	if res.BlocksRemoved != deleted {
+		t.Fatalf("%d blocks deleted but %d counted", deleted, res.BlocksRemoved)
+	}
+	keys, err := e.bs.AllKeysChan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left := len(drain(keys)); left != 10-deleted {
+		t.Fatalf("expected %d blocks left, got %d", 10-deleted, left)
+	}
+}
+
+func TestGCSweepConcurrency(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	root, tree := buildTree(t, e, "pinned", 3, 3)
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+	garbage := make(map[key.Key]bool)
+	for i := 0; i < 200; i++ {
+		garbage[e.addNode(t, fmt.Sprintf("garbage %d", i)).Key()] = true
+	}
+
+	out, results, err := GCWithResult(ctx, e.bs, e.pn, nil,
+		WithSweepConcurrency(8), WithDeleteBatchSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := drain(out)
+	res := <-results
+
+	if len(removed) != len(garbage) || res.BlocksRemoved != len(garbage) {
+		t.Fatalf("expected %d removed blocks, got %d emitted and %d counted",
+			len(garbage), len(removed), res.BlocksRemoved)
+	}
+	for _, k := range removed {
+		if !garbage[k] {
+			t.Fatalf("removed unexpected key %s", k)
+		}
+		delete(garbage, k)
+	}
+	for _, nd := range tree {
+		if !e.has(t, nd) {
+			t.Fatal("pinned block was removed")
+		}
+	}
+}
+
+func BenchmarkSweepConcurrency(b *testing.B) {
+	for _, n := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				e := newTestEnv()
+				for j := 0; j < 2000; j++ {
+					e.addNode(b, fmt.Sprintf("garbage %d", j))
+				}
+				b.StartTimer()
+
+				out, err := GCWith(context.Background(), e.bs, e.pn, nil, WithSweepConcurrency(n))
+				if err != nil {
+					b.Fatal(err)
+				}
+				drain(out)
+			}
+		})
+	}
+}
+
+// failingBlockstore fails to delete the blocks in fail
+type failingBlockstore struct {
+	bstore.GCBlockstore
+	fail map[key.Key]bool
+}
+
+var errDeleteFailed = errors.New("delete failed")
+
+func (bs *failingBlockstore) DeleteBlock(k key.Key) error {
+	if bs.fail[k] {
+		return errDeleteFailed
+	}
+	return bs.GCBlockstore.DeleteBlock(k)
+}
+
+func TestGCSweepErrors(t *testing.T) {
+	ctx := context.Background()
+
+	for _, cont := range []bool{false, true} {
+		e := newTestEnv()
+		bad := e.addNode(t, "bad")
+		e.addNode(t, "garbage 1")
+		e.addNode(t, "garbage 2")
+
+		var sunk []error
+		opts := []GCOption{WithErrorSink(func(err error) {
+			sunk = append(sunk, err)
+		})}
+		if cont {
+			opts = append(opts, ContinueOnError())
+		}
+
+		bs := &failingBlockstore{GCBlockstore: e.bs, fail: map[key.Key]bool{bad.Key(): true}}
+		out, results, err := GCWithResult(ctx, bs, e.pn, nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		drain(out)
+		res := <-results
+
+		if len(res.Errors) != 1 || len(sunk) != 1 || sunk[0] != res.Errors[0] {
+			t.Fatalf("expected one error in the result and the sink, got %v and %v", res.Errors, sunk)
+		}
+		serr, ok := res.Errors[0].(*SweepError)
+		if !ok || serr.Key != bad.Key() || serr.Err != errDeleteFailed {
+			t.Fatalf("unexpected sweep error: %v", res.Errors[0])
+		}
+		if cont && res.BlocksRemoved != 2 {
+			t.Fatalf("expected the other blocks to be removed, got %d", res.BlocksRemoved)
+		}
+		if !e.has(t, bad) {
+			t.Fatal("failed block is missing")
+		}
+	}
+}
+
+// failingBatchBlockstore deletes batches in part, failing on the blocks in
+// fail
+type failingBatchBlockstore struct {
+	*failingBlockstore
+}
+
+func (bs failingBatchBlockstore) DeleteBlocks(ks []key.Key) error {
+	var err error
+	for _, k := range ks {
+		if derr := bs.DeleteBlock(k); derr != nil {
+			err = derr
+		}
+	}
+	return err
+}
+
+func TestGCBatchDeleteErrorNamesBlock(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	fbs := &failingBlockstore{GCBlockstore: e.bs, fail: make(map[key.Key]bool)}
+	bad := e.addNode(t, "bad")
+	fbs.fail[bad.Key()] = true
+	for i := 0; i < 20; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+
+	out, results, err := GCWithResult(ctx, failingBatchBlockstore{fbs}, e.pn, nil, WithDeleteBatchSize(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := drain(out)
+	res := <-results
+
+	if len(res.Errors) != 1 {
+		t.Fatalf("expected one error, got %v", res.Errors)
+	}
+	serr, ok := res.Errors[0].(*SweepError)
+	if !ok || serr.Key != bad.Key() || serr.Err != errDeleteFailed {
+		t.Fatalf("expected a sweep error naming the failed block, got %v", res.Errors[0])
+	}
+	// the rest of the batch was removed before it failed
+	if res.BlocksRemoved != 20 || len(removed) != 20 {
+		t.Fatalf("expected 20 removed blocks, got %d counted and %d emitted", res.BlocksRemoved, len(removed))
+	}
+	if !e.has(t, bad) {
+		t.Fatal("failed block is missing")
+	}
+}
+
+func TestGCContinuesAfterDeleteFailures(t *testing.T) {
+	ctx := context.Background()
+
+	for _, batch := range []bool{false, true} {
+		e := newTestEnv()
+		pinned := e.addNode(t, "pinned")
+		if err := e.pn.Pin(ctx, pinned, true); err != nil {
+			t.Fatal(err)
+		}
+
+		fbs := &failingBlockstore{GCBlockstore: e.bs, fail: make(map[key.Key]bool)}
+		var garbage []*dag.Node
+		for i := 0; i < 50; i++ {
+			nd := e.addNode(t, fmt.Sprintf("garbage %d", i))
+			if i%10 == 0 {
+				fbs.fail[nd.Key()] = true
+			}
+			garbage = append(garbage, nd)
+		}
+
+		var bs bstore.GCBlockstore = fbs
+		if batch {
+			bs = failingBatchBlockstore{fbs}
+		}
+		out, results, err := GCWithResult(ctx, bs, e.pn, nil,
+			ContinueOnError(), WithDeleteBatchSize(8))
+		if err != nil {
+			t.Fatal(err)
+		}
+		removed := drain(out)
+		res := <-results
+
+		if len(res.Errors) != len(fbs.fail) {
+			t.Fatalf("expected %d errors, got %v", len(fbs.fail), res.Errors)
+		}
+		for _, err := range res.Errors {
+			if serr, ok := err.(*SweepError); !ok || !fbs.fail[serr.Key] {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if res.Err() == nil {
+			t.Fatal("expected an aggregate error")
+		}
+
+		exp := len(garbage) - len(fbs.fail)
+		if len(removed) != exp || res.BlocksRemoved != exp {
+			t.Fatalf("expected %d removed blocks, got %d emitted and %d counted",
+				exp, len(removed), res.BlocksRemoved)
+		}
+		for _, nd := range garbage {
+			if e.has(t, nd) != fbs.fail[nd.Key()] {
+				t.Fatalf("block %s was not handled as expected", nd.Key())
+			}
+		}
+		if !e.has(t, pinned) {
+			t.Fatal("pinned block was removed")
+		}
+	}
+}
+
+// sizerBlockstore reports block sizes through blockstore.Sizer
+type sizerBlockstore struct {
+	bstore.GCBlockstore
+}
+
+func (bs sizerBlockstore) GetSize(k key.Key) (int, error) {
+	blk, err := bs.Get(k)
+	if err != nil {
+		return 0, err
+	}
+	return len(blk.RawData()), nil
+}
+
+func TestGCDeletionOrder(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	sizes := make(map[key.Key]int)
+	for _, i := range []int{3, 9, 1, 7, 5, 2, 8, 4, 10, 6} {
+		nd := e.addNode(t, strings.Repeat("x", i*100))
+		sizes[nd.Key()] = len(nd.RawData())
+	}
+
+	out, err := GCWith(ctx, sizerBlockstore{e.bs}, e.pn, nil, WithDeletionOrder(LargestFirst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := drain(out)
+	if len(removed) != len(sizes) {
+		t.Fatalf("expected %d removed blocks, got %d", len(sizes), len(removed))
+	}
+	for i := 1; i < len(removed); i++ {
+		if sizes[removed[i]] > sizes[removed[i-1]] {
+			t.Fatalf("block %d is larger than the one removed before it", i)
+		}
+	}
+}
+
+// readCountingBlockstore counts the blocks read from it
+type readCountingBlockstore struct {
+	bstore.GCBlockstore
+	reads *int32
+}
+
+func (bs readCountingBlockstore) Get(k key.Key) (blocks.Block, error) {
+	atomic.AddInt32(bs.reads, 1)
+	return bs.GCBlockstore.Get(k)
+}
+
+func TestGCSkipsUnusedSizes(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	for i := 0; i < 10; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+
+	var reads int32
+	out, err := GC(ctx, readCountingBlockstore{e.bs, &reads}, e.pn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed := drain(out); len(removed) != 10 {
+		t.Fatalf("expected 10 removed blocks, got %d", len(removed))
+	}
+	if reads != 0 {
+		t.Fatalf("expected no block reads for sizes nobody uses, got %d", reads)
+	}
+
+	for i := 0; i < 10; i++ {
+		e.addNode(t, fmt.Sprintf("more garbage %d", i))
+	}
+	res, err := RunGC(ctx, readCountingBlockstore{e.bs, &reads}, e.pn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.BlocksRemoved != 10 || res.BytesFreed == 0 {
+		t.Fatalf("expected the freed bytes of 10 blocks, got %+v", res)
+	}
+}
+
+func TestGCToTarget(t *testing.T) {
+	ctx := context.Background()
+
+	for _, sized := range []bool{false, true} {
+		e := newTestEnv()
+		var garbage []*dag.Node
+		for i := 1; i <= 10; i++ {
+			garbage = append(garbage, e.addNode(t, strings.Repeat("x", i*100)))
+		}
+		largest := garbage[len(garbage)-1]
+
+		var bs bstore.GCBlockstore = e.bs
+		if sized {
+			bs = sizerBlockstore{e.bs}
+		}
+		target := uint64(len(largest.RawData()))
+		out, results, err := GCToTarget(ctx, bs, e.pn, nil, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		removed := drain(out)
+		res := <-results
+
+		if res.BytesFreed < target {
+			t.Fatalf("freed %d bytes, below the target of %d", res.BytesFreed, target)
+		}
+		if len(removed) == len(garbage) {
+			t.Fatal("expected the sweep to stop early")
+		}
+		if sized && (len(removed) != 1 || removed[0] != largest.Key()) {
+			t.Fatalf("expected only the largest block to be removed, got %v", removed)
+		}
+	}
+
+	// the garbage runs out before the target is reached
+	e := newTestEnv()
+	nd := e.addNode(t, "garbage")
+	out, results, err := GCToTarget(ctx, e.bs, e.pn, nil, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	if res := <-results; res.BytesFreed != uint64(len(nd.RawData())) {
+		t.Fatalf("expected %d bytes freed, got %d", len(nd.RawData()), res.BytesFreed)
+	}
+}
+
+func TestGCProtectFunc(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	pinned := e.addNode(t, "pinned")
+	if err := e.pn.Pin(ctx, pinned, true); err != nil {
+		t.Fatal(err)
+	}
+	protected := e.addNode(t, "protected")
+	garbage := e.addNode(t, "garbage")
+
+	var asked []key.Key
+	protect := func(k key.Key) bool {
+		asked = append(asked, k)
+		return k == protected.Key()
+	}
+	out, err := GCWith(ctx, e.bs, e.pn, nil, WithProtectFunc(protect))
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := drain(out)
+
+	if len(removed) != 1 || removed[0] != garbage.Key() {
+		t.Fatalf("expected only the garbage block to be removed, got %v", removed)
+	}
+	if !e.has(t, protected) {
+		t.Fatal("protected block was removed")
+	}
+	for _, k := range asked {
+		if k == pinned.Key() {
+			t.Fatal("predicate was called for a marked block")
+		}
+	}
+}
+
+func TestGCRetainList(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	pinned := e.addNode(t, "pinned")
+	if err := e.pn.Pin(ctx, pinned, true); err != nil {
+		t.Fatal(err)
+	}
+	child := e.addNode(t, "child")
+	retained := e.addNode(t, "retained", child)
+	garbage := e.addNode(t, "garbage")
+
+	// the pinned block is retained as well, and only counted once
+	list := []*cid.Cid{retained.Cid(), pinned.Cid()}
+	res, err := RunGC(ctx, e.bs, e.pn, nil, WithRetainList(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.MarkedCount != 2 {
+		t.Fatalf("expected 2 marked blocks, got %d", res.MarkedCount)
+	}
+	if !sameCids(res.MarkRoots.Retained, list) {
+		t.Fatalf("expected the list in the mark roots, got %v", res.MarkRoots.Retained)
+	}
+	if !e.has(t, retained) || !e.has(t, pinned) {
+		t.Fatal("retained block was removed")
+	}
+	// the list doesn't reach below its blocks
+	if e.has(t, child) || e.has(t, garbage) {
+		t.Fatal("unmarked blocks were kept")
+	}
+}
+
+// phantomBlockstore lists and claims to have a key it holds no block for
+type phantomBlockstore struct {
+	bstore.GCBlockstore
+	phantom key.Key
+}
+
+func (bs *phantomBlockstore) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
+	keys, err := bs.GCBlockstore.AllKeysChan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan key.Key)
+	go func() {
+		defer close(out)
+		out <- bs.phantom
+		for k := range keys {
+			out <- k
+		}
+	}()
+	return out, nil
+}
+
+func (bs *phantomBlockstore) Has(k key.Key) (bool, error) {
+	if k == bs.phantom {
+		return true, nil
+	}
+	return bs.GCBlockstore.Has(k)
+}
+
+func TestGCPhantomKeys(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	phantom := dag.NodeWithData([]byte("phantom")).Key()
+	bs := &phantomBlockstore{GCBlockstore: e.bs, phantom: phantom}
+
+	res, err := RunGC(ctx, bs, e.pn, nil)
+	if serr, ok := err.(*SweepError); !ok || serr.Key != phantom || res.PhantomKeys != nil {
+		t.Fatalf("expected the phantom to fail its deletion, got %v and %v", err, res.PhantomKeys)
+	}
+
+	for _, verify := range []bool{false, true} {
+		garbage := e.addNode(t, "garbage")
+		res, err := RunGC(ctx, bs, e.pn, nil, WithPhantomKeys(true), WithVerifyBeforeDelete(verify))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Errors) != 0 {
+			t.Fatalf("verify %t: expected no errors, got %v", verify, res.Errors)
+		}
+		if len(res.PhantomKeys) != 1 || res.PhantomKeys[0] != phantom {
+			t.Fatalf("verify %t: expected %s as a phantom key, got %v", verify, phantom, res.PhantomKeys)
+		}
+		if res.BlocksRemoved != 1 || e.has(t, garbage) {
+			t.Fatalf("verify %t: expected the garbage block alone to be removed, got %d", verify, res.BlocksRemoved)
+		}
+	}
+}
+
+// buildLevels stores a balanced tree and returns its nodes grouped by depth
+func buildLevels(t testing.TB, e *testEnv, prefix string, depth, fanout int) [][]*dag.Node {
+	if depth == 0 {
+		return [][]*dag.Node{{e.addNode(t, prefix)}}
+	}
+
+	levels := make([][]*dag.Node, depth+1)
+	var children []*dag.Node
+	for i := 0; i < fanout; i++ {
+		sub := buildLevels(t, e, fmt.Sprintf("%s-%d", prefix, i), depth-1, fanout)
+		children = append(children, sub[0][0])
+		for d, nds := range sub {
+			levels[d+1] = append(levels[d+1], nds...)
+		}
+	}
+	levels[0] = []*dag.Node{e.addNode(t, prefix, children...)}
+	return levels
+}
+
+func TestDescendantsDepth(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	levels := buildLevels(t, e, "root", 3, 2)
+	roots := []*cid.Cid{levels[0][0].Cid()}
+
+	for maxDepth := 0; maxDepth <= 4; maxDepth++ {
+		set := key.NewKeySet()
+		if err := DescendantsDepth(ctx, e.dserv, set, roots, false, maxDepth); err != nil {
+			t.Fatal(err)
+		}
+		var exp int
+		for d, nds := range levels {
+			marked := maxDepth <= 0 || d <= maxDepth
+			if marked {
+				exp += len(nds)
+			}
+			for _, nd := range nds {
+				if set.Has(nd.Key()) != marked {
+					t.Fatalf("max depth %d: node at depth %d marked: %t", maxDepth, d, !marked)
+				}
+			}
+		}
+		if n := len(set.Keys()); n != exp {
+			t.Fatalf("max depth %d: expected %d marked nodes, got %d", maxDepth, exp, n)
+		}
+	}
+}
+
+func TestDescendantsDepthRevisitsShallower(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	// a -> b -> c -> d -> f, and x -> c
+	f := e.addNode(t, "f")
+	d := e.addNode(t, "d", f)
+	c := e.addNode(t, "c", d)
+	b := e.addNode(t, "b", c)
+	a := e.addNode(t, "a", b)
+	x := e.addNode(t, "x", c)
+
+	set := key.NewKeySet()
+	err := DescendantsDepth(ctx, e.dserv, set, []*cid.Cid{a.Cid(), x.Cid()}, false, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, nd := range []*dag.Node{a, b, c, x, d} {
+		if !set.Has(nd.Key()) {
+			t.Fatalf("expected %s to be marked", nd.Data())
+		}
+	}
+	if set.Has(f.Key()) {
+		t.Fatal("node at depth 3 was marked")
+	}
+}
+
+func TestColoredSetIncompleteRoots(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	missing := dag.NodeWithData([]byte("missing"))
+	present := e.addNode(t, "present")
+	broken := e.addNode(t, "broken", present, missing)
+	complete := e.addNode(t, "complete", present)
+
+	set, incomplete, err := ColoredSet(ctx, e.pn, e.dserv, []*cid.Cid{broken.Cid(), complete.Cid()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !set.Has(present.Key()) || !set.Has(complete.Key()) {
+		t.Fatal("reachable blocks were not marked")
+	}
+	if len(incomplete) != 1 || !incomplete[0].Cid.Equals(broken.Cid()) || incomplete[0].Err == nil {
+		t.Fatalf("expected only the broken root to be incomplete, got %v", incomplete)
+	}
+
+	out, results, err := GCWithResult(ctx, e.bs, e.pn, []*cid.Cid{broken.Cid()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	if res := <-results; len(res.IncompleteRoots) != 1 {
+		t.Fatalf("expected the incomplete root in the result, got %v", res.IncompleteRoots)
+	}
+}
+
+func TestGCWithSizes(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	sizes := make(map[key.Key]int64)
+	for i := 0; i < 5; i++ {
+		nd := e.addNode(t, strings.Repeat("x", i*10))
+		sizes[nd.Key()] = int64(len(nd.RawData()))
+	}
+
+	out, results, err := GCWithSizes(ctx, e.bs, e.pn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for d := range out {
+		if d.Size != sizes[d.Key] {
+			t.Fatalf("expected size %d for %s, got %d", sizes[d.Key], d.Key, d.Size)
+		}
+		total += d.Size
+		delete(sizes, d.Key)
+	}
+	if len(sizes) != 0 {
+		t.Fatalf("%d blocks were not reported", len(sizes))
+	}
+	if res := <-results; res.BytesFreed != uint64(total) {
+		t.Fatalf("expected %d bytes freed, got %d", total, res.BytesFreed)
+	}
+}
+
+func TestEstimateReclaimable(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	pinned := e.addNode(t, "pinned")
+	if err := e.pn.Pin(ctx, pinned, true); err != nil {
+		t.Fatal(err)
+	}
+	var expBytes int64
+	for i := 0; i < 10; i++ {
+		nd := e.addNode(t, fmt.Sprintf("garbage %d", i))
+		expBytes += int64(len(nd.RawData()))
+	}
+
+	blocks, bytes, err := EstimateReclaimable(ctx, e.bs, e.pn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocks != 10 || bytes != expBytes {
+		t.Fatalf("expected 10 blocks and %d bytes, got %d and %d", expBytes, blocks, bytes)
+	}
+
+	out, results, err := GCWithResult(ctx, e.bs, e.pn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	if res := <-results; int64(res.BlocksRemoved) != blocks || int64(res.BytesFreed) != bytes {
+		t.Fatalf("estimate of %d blocks and %d bytes, GC removed %d and %d", blocks, bytes, res.BlocksRemoved, res.BytesFreed)
+	}
+}
+
+func TestGCOutputBuffer(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	for i := 0; i < 20; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+
+	deletions, results, err := GCWithSizes(ctx, e.bs, e.pn, nil,
+		WithOutputBuffer(5), WithDeleteBatchSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the sweep fills the buffer and then waits for the reader
+	deadline := time.Now().Add(time.Second)
+	for len(deletions) < 5 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := len(deletions); n != 5 {
+		t.Fatalf("expected 5 buffered deletions, got %d", n)
+	}
+	select {
+	case <-results:
+		t.Fatal("sweep finished without its output being read")
+	default:
+	}
+
+	var n int
+	for range deletions {
+		n++
+	}
+	if n != 20 {
+		t.Fatalf("expected 20 removed blocks, got %d", n)
+	}
+}
+
+func TestMarkAndSweep(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	root, tree := buildTree(t, e, "pinned", 2, 2)
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+	garbage := e.addNode(t, "garbage")
+
+	marked, err := Mark(ctx, e.pn, e.dserv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, nd := range tree {
+		if !marked.Has(nd.Key()) {
+			t.Fatal("pinned block was not marked")
+		}
+	}
+
+	out, err := Sweep(ctx, e.bs, marked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := drain(out)
+	if len(removed) != 1 || removed[0] != garbage.Key() {
+		t.Fatalf("expected only the garbage block to be removed, got %v", removed)
+	}
+	for _, nd := range tree {
+		if !e.has(t, nd) {
+			t.Fatal("pinned block was removed")
+		}
+	}
+	assertUnlocked(t, e)
+}
+
+func TestMarkTakesNoLock(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	pinned := e.addNode(t, "pinned")
+	if err := e.pn.Pin(ctx, pinned, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// marking would wait forever if it needed the lock held here
+	unlocker := e.bs.GCLock()
+	defer unlocker.Unlock()
+	marked, err := Mark(ctx, e.pn, e.dserv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !marked.Has(pinned.Key()) {
+		t.Fatal("pinned block was not marked")
+	}
+}
+
+func TestGCCollectMarkedOnly(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	root, tree := buildTree(t, e, "pinned", 2, 2)
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+	kept := e.addNode(t, "best effort")
+	garbage := e.addNode(t, "garbage")
+
+	// a collection holds the blockstore meanwhile
+	unlocker := e.bs.GCLock()
+	marked, err := GCCollectMarkedOnly(ctx, e.pn, e.dserv, []*cid.Cid{kept.Cid()})
+	unlocker.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, nd := range append(tree, kept) {
+		if !marked.Has(nd.Key()) {
+			t.Fatalf("live block %s was not marked", nd.Key())
+		}
+	}
+	if marked.Has(garbage.Key()) {
+		t.Fatal("garbage was marked")
+	}
+	if !e.has(t, garbage) {
+		t.Fatal("collecting the marked set removed a block")
+	}
+}
+
+// truncatingBlockstore stops listing keys after the first n, reporting err
+type truncatingBlockstore struct {
+	bstore.GCBlockstore
+	n   int
+	err error
+}
+
+func (bs truncatingBlockstore) AllKeysChanErr(ctx context.Context) (<-chan key.Key, func() error, error) {
+	keys, err := bs.GCBlockstore.AllKeysChan(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	out := make(chan key.Key, bs.n)
+	for i := 0; i < bs.n; i++ {
+		out <- <-keys
+	}
+	close(out)
+	return out, func() error { return bs.err }, nil
+}
+
+func TestGCReportsTruncatedListing(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	for i := 0; i < 10; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+
+	lerr := errors.New("listing failed")
+	bs := truncatingBlockstore{GCBlockstore: e.bs, n: 4, err: lerr}
+	out, results, err := GCWithResult(ctx, bs, e.pn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(drain(out)); n != 4 {
+		t.Fatalf("expected 4 removed blocks, got %d", n)
+	}
+	res := <-results
+	if len(res.Errors) != 1 {
+		t.Fatalf("expected one error, got %v", res.Errors)
+	}
+	if kerr, ok := res.Errors[0].(*KeyListError); !ok || kerr.Err != lerr {
+		t.Fatalf("expected a KeyListError, got %v", res.Errors[0])
+	}
+}
+
+// corruptBlockstore returns the wrong data for the blocks in bad
+type corruptBlockstore struct {
+	bstore.GCBlockstore
+	bad map[key.Key]bool
+}
+
+func (bs corruptBlockstore) Get(k key.Key) (blocks.Block, error) {
+	if bs.bad[k] {
+		return blocks.NewBlockWithHash([]byte("corrupt"), mh.Multihash(k))
+	}
+	return bs.GCBlockstore.Get(k)
+}
+
+func TestGCVerifyBeforeDelete(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	bad := e.addNode(t, "bad")
+	for i := 0; i < 5; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+
+	bs := corruptBlockstore{GCBlockstore: e.bs, bad: map[key.Key]bool{bad.Key(): true}}
+	out, results, err := GCWithResult(ctx, bs, e.pn, nil, WithVerifyBeforeDelete(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(drain(out)); n != 5 {
+		t.Fatalf("expected 5 removed blocks, got %d", n)
+	}
+	res := <-results
+	if len(res.Errors) != 1 {
+		t.Fatalf("expected one error, got %v", res.Errors)
+	}
+	if serr, ok := res.Errors[0].(*SweepError); !ok || serr.Key != bad.Key() || serr.Err != ErrCorruptBlock {
+		t.Fatalf("unexpected error: %v", res.Errors[0])
+	}
+	if !e.has(t, bad) {
+		t.Fatal("corrupt block was removed")
+	}
+}
+
+func BenchmarkSweepVerify(b *testing.B) {
+	for _, verify := range []bool{false, true} {
+		b.Run(fmt.Sprintf("verify-%t", verify), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				e := newTestEnv()
+				for j := 0; j < 1000; j++ {
+					e.addNode(b, fmt.Sprintf("garbage %d %s", j, strings.Repeat("x", 4096)))
+				}
+				b.StartTimer()
+
+				out, err := GCWith(context.Background(), e.bs, e.pn, nil, WithVerifyBeforeDelete(verify))
+				if err != nil {
+					b.Fatal(err)
+				}
+				drain(out)
+			}
+		})
+	}
+}
+
+// brokenDAGService fails to fetch every node with err
+type brokenDAGService struct {
+	dag.DAGService
+	err error
+}
+
+func (ds brokenDAGService) Get(context.Context, *cid.Cid) (*dag.Node, error) {
+	return nil, ds.err
+}
+
+func TestDescendantsPinIncomplete(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	root, tree := buildTree(t, e, "pinned", 2, 2)
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+	leaf := tree[0]
+	if err := e.bs.DeleteBlock(leaf.Key()); err != nil {
+		t.Fatal(err)
+	}
+	garbage := e.addNode(t, "garbage")
+
+	for _, n := range []int{1, 4} {
+		_, _, err := ColoredSet(ctx, e.pn, e.dserv, nil, WithMarkConcurrency(n))
+		perr, ok := err.(*ErrPinIncomplete)
+		if !ok {
+			t.Fatalf("concurrency %d: expected an incomplete pin, got %v", n, err)
+		}
+		if !perr.Root.Equals(root.Cid()) || !perr.Missing.Equals(leaf.Cid()) {
+			t.Fatalf("concurrency %d: expected %s missing below %s, got %s", n, leaf.Cid(), root.Cid(), perr)
+		}
+	}
+
+	if _, err := GC(ctx, e.bs, e.pn, nil); err == nil {
+		t.Fatal("expected GC to fail on the incomplete pin")
+	}
+	if !e.has(t, garbage) {
+		t.Fatal("GC removed blocks despite the incomplete pin")
+	}
+
+	ioErr := errors.New("disk on fire")
+	set := key.NewKeySet()
+	if err := Descendants(ctx, brokenDAGService{e.dserv, ioErr}, set, []*cid.Cid{root.Cid()}, false); err != ioErr {
+		t.Fatalf("expected the fetch error to be returned as is, got %v", err)
+	}
+}
+
+func TestGCExtraRoots(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	root, tree := buildTree(t, e, "mfs", 2, 2)
+	garbage := e.addNode(t, "garbage")
+
+	calls := 0
+	provider := func(context.Context) ([]*cid.Cid, error) {
+		calls++
+		return []*cid.Cid{root.Cid()}, nil
+	}
+	out, err := GCWith(ctx, e.bs, e.pn, nil, WithExtraRoots(provider))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(drain(out)); n != 1 {
+		t.Fatalf("expected 1 removed block, got %d", n)
+	}
+	if calls != 1 {
+		t.Fatalf("expected the provider to be called once, got %d", calls)
+	}
+	for _, nd := range tree {
+		if !e.has(t, nd) {
+			t.Fatal("block below an extra root was removed")
+		}
+	}
+	if e.has(t, garbage) {
+		t.Fatal("garbage block was not removed")
+	}
+
+	failing := func(context.Context) ([]*cid.Cid, error) {
+		return nil, errors.New("no mfs")
+	}
+	if _, err := GCWith(ctx, e.bs, e.pn, nil, WithExtraRoots(failing)); err == nil {
+		t.Fatal("expected GC to fail when the provider does")
+	}
+
+	if err := e.bs.DeleteBlock(tree[0].Key()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GCWith(ctx, e.bs, e.pn, nil, WithExtraRoots(provider)); err == nil {
+		t.Fatal("expected GC to fail on an incomplete extra root")
+	} else if _, ok := err.(*ErrPinIncomplete); !ok {
+		t.Fatalf("expected an incomplete pin, got %v", err)
+	}
+}
+
+func TestGCMFSRoot(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	file := e.addNode(t, "file only in mfs")
+	dir := e.addNode(t, "mfs root", e.addNode(t, "mfs dir", file))
+	garbage := e.addNode(t, "garbage")
+
+	out, err := GCWith(ctx, e.bs, e.pn, nil, WithMFSRoot(dir.Cid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	if !e.has(t, file) || !e.has(t, dir) {
+		t.Fatal("file in mfs was removed")
+	}
+	if e.has(t, garbage) {
+		t.Fatal("garbage block was not removed")
+	}
+
+	if err := e.bs.DeleteBlock(dir.Key()); err != nil {
+		t.Fatal(err)
+	}
+	_, err = GCWith(ctx, e.bs, e.pn, nil, WithMFSRoot(dir.Cid()))
+	if perr, ok := err.(*ErrPinIncomplete); !ok || !perr.Missing.Equals(dir.Cid()) {
+		t.Fatalf("expected the missing mfs root to fail GC, got %v", err)
+	}
+	if !e.has(t, file) {
+		t.Fatal("file in mfs was removed when its root went missing")
+	}
+}
+
+func TestGCResultDurations(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	root, _ := buildTree(t, e, "pinned", 2, 2)
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+
+	unlocker := e.bs.GCLock()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		unlocker.Unlock()
+	}()
+	out, results, err := GCWithResult(ctx, e.bs, e.pn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	res := <-results
+	if res.LockWaitDuration < 40*time.Millisecond {
+		t.Fatalf("expected the lock wait to be recorded, got %s", res.LockWaitDuration)
+	}
+	if res.MarkDuration <= 0 || res.SweepDuration <= 0 {
+		t.Fatalf("expected phase durations, got mark %s, sweep %s", res.MarkDuration, res.SweepDuration)
+	}
+
+	// a cancelled sweep still reports how long it ran
+	for i := 0; i < 3; i++ {
+		e.addNode(t, fmt.Sprintf("more garbage %d", i))
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	out, results, err = GCWithResult(cctx, e.bs, e.pn, nil, WithDeletionRate(1), WithDeleteBatchSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-out
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	drain(out)
+	res = <-results
+	if res.MarkDuration <= 0 || res.SweepDuration < 10*time.Millisecond {
+		t.Fatalf("expected phase durations after cancel, got mark %s, sweep %s", res.MarkDuration, res.SweepDuration)
+	}
+}
+
+// listingBlockstore hides the optional listing interfaces of the blockstore
+type listingBlockstore struct {
+	bstore.GCBlockstore
+}
+
+func TestGCPrefix(t *testing.T) {
+	ctx := context.Background()
+
+	for _, plain := range []bool{false, true} {
+		e := newTestEnv()
+		var nodes []*dag.Node
+		for i := 0; i < 100; i++ {
+			nodes = append(nodes, e.addNode(t, fmt.Sprintf("node %d", i)))
+		}
+		if err := e.pn.Pin(ctx, nodes[0], false); err != nil {
+			t.Fatal(err)
+		}
+
+		prefix := nodes[0].Key().DsKey().String()[:5]
+		expect := make(map[key.Key]bool)
+		for _, nd := range nodes[1:] {
+			if strings.HasPrefix(nd.Key().DsKey().String(), prefix) {
+				expect[nd.Key()] = true
+			}
+		}
+		if len(expect) == 0 || len(expect) == len(nodes)-1 {
+			t.Fatalf("prefix %s should match some of the blocks, matched %d", prefix, len(expect))
+		}
+
+		var bs bstore.GCBlockstore = e.bs
+		if plain {
+			bs = &listingBlockstore{e.bs}
+		}
+		out, results, err := GCPrefix(ctx, bs, e.pn, nil, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		removed := drain(out)
+		if res := <-results; len(res.Errors) != 0 {
+			t.Fatalf("unexpected errors: %v", res.Errors)
+		}
+
+		if len(removed) != len(expect) {
+			t.Fatalf("expected %d removed blocks, got %d", len(expect), len(removed))
+		}
+		for _, k := range removed {
+			if !expect[k] {
+				t.Fatalf("removed %s, which is pinned or outside the prefix", k)
+			}
+		}
+		if !e.has(t, nodes[0]) {
+			t.Fatal("pinned block under the prefix was removed")
+		}
+		for _, nd := range nodes[1:] {
+			if !expect[nd.Key()] && !e.has(t, nd) {
+				t.Fatal("block outside the prefix was removed")
+			}
+		}
+	}
+}
+
+// stampedBlockstore reports the write times in written, and an hour ago for
+// any other block
+type stampedBlockstore struct {
+	bstore.GCBlockstore
+	written map[key.Key]time.Time
+}
+
+func (bs *stampedBlockstore) WriteTime(k key.Key) (time.Time, error) {
+	if t, ok := bs.written[k]; ok {
+		return t, nil
+	}
+	return time.Now().Add(-time.Hour), nil
+}
+
+func TestGCMinBlockAge(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	old := e.addNode(t, "old garbage")
+	young := e.addNode(t, "young garbage")
+	bs := &stampedBlockstore{
+		GCBlockstore: e.bs,
+		written:      map[key.Key]time.Time{young.Key(): time.Now()},
+	}
+
+	out, err := GCWith(ctx, bs, e.pn, nil, WithMinBlockAge(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(drain(out)); n != 1 {
+		t.Fatalf("expected 1 removed block, got %d", n)
+	}
+	if e.has(t, old) {
+		t.Fatal("old garbage block was not removed")
+	}
+	if !e.has(t, young) {
+		t.Fatal("recently written block was removed")
+	}
+
+	// without write times the option does nothing
+	out, err = GCWith(ctx, e.bs, e.pn, nil, WithMinBlockAge(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(drain(out)); n != 1 {
+		t.Fatalf("expected 1 removed block, got %d", n)
+	}
+	if e.has(t, young) {
+		t.Fatal("expected the minimum age to be ignored")
+	}
+}
+
+func TestDescendantsDedupRoots(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	root := e.addNode(t, "root", e.addNode(t, "child"))
+	v1 := cid.NewCidV1(cid.Raw, root.Cid().Hash())
+
+	ds := &countingDAGService{DAGService: e.dserv}
+	set := key.NewKeySet()
+	if err := Descendants(ctx, ds, set, []*cid.Cid{root.Cid(), root.Cid(), v1}, false); err != nil {
+		t.Fatal(err)
+	}
+	if ds.gets != 2 {
+		t.Fatalf("expected the root and its child to be fetched once, got %d fetches", ds.gets)
+	}
+	if len(set.Keys()) != 2 {
+		t.Fatalf("expected 2 marked keys, got %d", len(set.Keys()))
+	}
+}
+
+// countedBlockstore reports count as its number of blocks, and records
+// whether its keys were listed
+type countedBlockstore struct {
+	bstore.GCBlockstore
+	count  int
+	listed bool
+}
+
+func (bs *countedBlockstore) BlockCount() (int, error) {
+	return bs.count, nil
+}
+
+func (bs *countedBlockstore) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
+	bs.listed = true
+	return bs.GCBlockstore.AllKeysChan(ctx)
+}
+
+func TestGCSkipSweepIfClean(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	root := e.addNode(t, "root", e.addNode(t, "child"))
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+
+	bs := &countedBlockstore{GCBlockstore: e.bs, count: 2}
+	out, results, err := GCWithResult(ctx, bs, e.pn, nil, WithSkipSweepIfClean(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	if res := <-results; !res.SweepSkipped || res.BlocksRemoved != 0 {
+		t.Fatalf("expected the sweep to be skipped, got %+v", res)
+	}
+	if bs.listed {
+		t.Fatal("keys were listed for a skipped sweep")
+	}
+
+	garbage := e.addNode(t, "garbage")
+	bs = &countedBlockstore{GCBlockstore: e.bs, count: 3}
+	out, results, err = GCWithResult(ctx, bs, e.pn, nil, WithSkipSweepIfClean(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	if res := <-results; res.SweepSkipped || res.BlocksRemoved != 1 {
+		t.Fatalf("expected the garbage block to be swept, got %+v", res)
+	}
+	if e.has(t, garbage) {
+		t.Fatal("garbage block was not removed")
+	}
+}
+
+// panickingBlockstore panics when asked to delete the block panicKey
+type panickingBlockstore struct {
+	bstore.GCBlockstore
+	panicKey key.Key
+}
+
+func (bs *panickingBlockstore) DeleteBlock(k key.Key) error {
+	if k == bs.panicKey {
+		panic("delete exploded")
+	}
+	return bs.GCBlockstore.DeleteBlock(k)
+}
+
+func TestGCSweepPanic(t *testing.T) {
+	ctx := context.Background()
+	for _, n := range []int{1, 4} {
+		e := newTestEnv()
+		var bad *dag.Node
+		for i := 0; i < 20; i++ {
+			nd := e.addNode(t, fmt.Sprintf("garbage %d", i))
+			if i == 10 {
+				bad = nd
+			}
+		}
+
+		bs := &panickingBlockstore{GCBlockstore: e.bs, panicKey: bad.Key()}
+		out, results, err := GCWithResult(ctx, bs, e.pn, nil, WithSweepConcurrency(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		drain(out)
+		res := <-results
+		if len(res.Errors) != 1 {
+			t.Fatalf("expected one error, got %v", res.Errors)
+		}
+		perr, ok := res.Errors[0].(*SweepPanicError)
+		if !ok || perr.Value != "delete exploded" || len(perr.Stack) == 0 {
+			t.Fatalf("expected the panic as an error, got %v", res.Errors[0])
+		}
+		if !e.has(t, bad) {
+			t.Fatal("block that panicked was removed")
+		}
+
+		// the lock was released, so another run can go ahead
+		out, err = GC(ctx, e.bs, e.pn, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		drain(out)
+		if e.has(t, bad) {
+			t.Fatal("garbage block was not removed by the next run")
+		}
+	}
+}
+
+func TestGCWithDAGService(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	root, pinned := buildTree(t, e, "pinned", 2, 2)
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+	garbage := e.addNode(t, "garbage")
+
+	ds := &countingDAGService{DAGService: e.dserv}
+	out, err := GCWith(ctx, e.bs, e.pn, nil, WithDAGService(ds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	if ds.gets == 0 {
+		t.Fatal("the given DAG service was not used for marking")
+	}
+	for _, nd := range pinned {
+		if !e.has(t, nd) {
+			t.Fatalf("pinned block %s was removed", nd.Key())
+		}
+	}
+	if e.has(t, garbage) {
+		t.Fatal("garbage block was not removed")
+	}
+}
+
+func TestRunGC(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	root, pinned := buildTree(t, e, "pinned", 2, 2)
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+
+	res, err := RunGC(ctx, e.bs, e.pn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.BlocksRemoved != 5 || res.BytesFreed == 0 {
+		t.Fatalf("expected 5 blocks removed, got %+v", res)
+	}
+	for _, nd := range pinned {
+		if !e.has(t, nd) {
+			t.Fatalf("pinned block %s was removed", nd.Key())
+		}
+	}
+
+	// sweep errors come back as the error
+	garbage := e.addNode(t, "more garbage")
+	fbs := &failingBlockstore{GCBlockstore: e.bs, fail: map[key.Key]bool{garbage.Key(): true}}
+	res, err = RunGC(ctx, fbs, e.pn, nil)
+	if serr, ok := err.(*SweepError); !ok || serr.Key != garbage.Key() {
+		t.Fatalf("expected a sweep error for the failing block, got %v", err)
+	}
+	if len(res.Errors) != 1 {
+		t.Fatalf("expected the error in the result, got %v", res.Errors)
+	}
+}
+
+// cancellingDAGService cancels a context on the first node read through it
+type cancellingDAGService struct {
+	dag.DAGService
+	cancel func()
+}
+
+func (ds *cancellingDAGService) Get(ctx context.Context, c *cid.Cid) (*dag.Node, error) {
+	ds.cancel()
+	return nil, ctx.Err()
+}
+
+// cancellingBlockstore cancels a context on the first block deleted
+type cancellingBlockstore struct {
+	bstore.GCBlockstore
+	cancel func()
+}
+
+func (bs *cancellingBlockstore) DeleteBlock(k key.Key) error {
+	bs.cancel()
+	return bs.GCBlockstore.DeleteBlock(k)
+}
+
+func TestGCCompletionReason(t *testing.T) {
+	e := newTestEnv()
+	root, _ := buildTree(t, e, "pinned", 2, 2)
+	if err := e.pn.Pin(context.Background(), root, true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+
+	t.Run("mark", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ds := &cancellingDAGService{DAGService: e.dserv, cancel: cancel}
+		res, err := RunGC(ctx, e.bs, e.pn, nil, WithDAGService(ds))
+		if err == nil || res.Reason != ReasonCancelled {
+			t.Fatalf("expected a cancelled run, got %s and %v", res.Reason, err)
+		}
+	})
+
+	t.Run("sweep", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		bs := &cancellingBlockstore{GCBlockstore: e.bs, cancel: cancel}
+		res, err := RunGC(ctx, bs, e.pn, nil)
+		if err != context.Canceled || res.Reason != ReasonCancelled {
+			t.Fatalf("expected a cancelled run, got %s and %v", res.Reason, err)
+		}
+		if res.BlocksRemoved == 0 || res.BlocksRemoved >= 50 {
+			t.Fatalf("expected the sweep to stop part way, removed %d", res.BlocksRemoved)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		garbage := e.addNode(t, "failing garbage")
+		fbs := &failingBlockstore{GCBlockstore: e.bs, fail: map[key.Key]bool{garbage.Key(): true}}
+		res, err := RunGC(context.Background(), fbs, e.pn, nil)
+		if err == nil || res.Reason != ReasonError {
+			t.Fatalf("expected a failed run, got %s and %v", res.Reason, err)
+		}
+	})
+
+	t.Run("completed", func(t *testing.T) {
+		res, err := RunGC(context.Background(), e.bs, e.pn, nil)
+		if err != nil || res.Reason != ReasonCompleted {
+			t.Fatalf("expected a completed run, got %s and %v", res.Reason, err)
+		}
+	})
+}
+
+func TestGCDeadline(t *testing.T) {
+	e := newTestEnv()
+	var garbage []*dag.Node
+	for i := 0; i < 50; i++ {
+		garbage = append(garbage, e.addNode(t, fmt.Sprintf("garbage %d", i)))
+	}
+
+	// at 200 blocks a second the sweep needs 250ms, well past the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	res, err := RunGC(ctx, e.bs, e.pn, nil, WithDeletionRate(200), WithDeleteBatchSize(10))
+	if err != nil {
+		t.Fatalf("expected a clean stop at the deadline, got %v", err)
+	}
+	if res.Reason != ReasonDeadline || len(res.Errors) != 0 {
+		t.Fatalf("expected ReasonDeadline and no errors, got %s and %v", res.Reason, res.Errors)
+	}
+	if res.BlocksRemoved == 0 || res.BlocksRemoved >= len(garbage) {
+		t.Fatalf("expected the sweep to stop part way, removed %d", res.BlocksRemoved)
+	}
+
+	// the queued batch was removed, and counted
+	removed := 0
+	for _, nd := range garbage {
+		if !e.has(t, nd) {
+			removed++
+		}
+	}
+	if removed != res.BlocksRemoved {
+		t.Fatalf("result counts %d removed blocks, the store is missing %d", res.BlocksRemoved, removed)
+	}
+	assertUnlocked(t, e)
+}
+
+func TestDryRunSharesPinLock(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	for i := 0; i < 3; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+
+	// an add in progress holds the pin lock; neither a dry run nor an
+	// estimate may wait for it
+	unlocker := e.bs.PinLock()
+	defer unlocker.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		out, err := GCDryRun(ctx, e.bs, e.pn, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if n := len(drain(out)); n != 3 {
+			t.Errorf("expected 3 candidates, got %d", n)
+		}
+		if blocks, _, err := EstimateReclaimable(ctx, e.bs, e.pn, nil); err != nil || blocks != 3 {
+			t.Errorf("expected 3 reclaimable blocks, got %d and %v", blocks, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dry run waited for the pin lock")
+	}
+}
+
+func TestGCResultDeleteBatchSize(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	for i := 0; i < 5; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+
+	// the blockstore batches, bounded by the deletion rate
+	bs := &batchCountingBlockstore{GCBlockstore: e.bs}
+	res, err := RunGC(ctx, bs, e.pn, nil, WithDeleteBatchSize(32), WithDeletionRate(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.DeleteBatchSize != 32 {
+		t.Fatalf("expected a batch size of 32, got %d", res.DeleteBatchSize)
+	}
+
+	// a blockstore that can't batch is swept one block at a time
+	for i := 0; i < 5; i++ {
+		e.addNode(t, fmt.Sprintf("more garbage %d", i))
+	}
+	res, err = RunGC(ctx, &failingBlockstore{GCBlockstore: e.bs}, e.pn, nil, WithDeleteBatchSize(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.DeleteBatchSize != 1 {
+		t.Fatalf("expected a batch size of 1, got %d", res.DeleteBatchSize)
+	}
+}
+
+func TestGCCommitEvery(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	for i := 0; i < 10; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+
+	bs := &batchCountingBlockstore{GCBlockstore: e.bs}
+	res, err := RunGC(ctx, bs, e.pn, nil, WithCommitEvery(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.DeleteBatchSize != 4 {
+		t.Fatalf("expected a commit interval of 4, got %d", res.DeleteBatchSize)
+	}
+	if fmt.Sprint(bs.batches) != "[4 4 2]" {
+		t.Fatalf("expected commits of 4, 4 and 2 blocks, got %v", bs.batches)
+	}
+}
+
+// duplicatingBlockstore lists every key twice and counts the deletes of
+// each block
+type duplicatingBlockstore struct {
+	bstore.GCBlockstore
+
+	mu      sync.Mutex
+	deletes map[key.Key]int
+}
+
+func (bs *duplicatingBlockstore) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
+	keys, err := bs.GCBlockstore.AllKeysChan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan key.Key)
+	go func() {
+		defer close(out)
+		for k := range keys {
+			for i := 0; i < 2; i++ {
+				select {
+				case out <- k:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (bs *duplicatingBlockstore) DeleteBlock(k key.Key) error {
+	bs.mu.Lock()
+	bs.deletes[k]++
+	bs.mu.Unlock()
+	return bs.GCBlockstore.DeleteBlock(k)
+}
+
+func TestGCDuplicateKeys(t *testing.T) {
+	ctx := context.Background()
+	for _, n := range []int{1, 4} {
+		e := newTestEnv()
+		pinned := e.addNode(t, "pinned")
+		if err := e.pn.Pin(ctx, pinned, false); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 20; i++ {
+			e.addNode(t, fmt.Sprintf("garbage %d", i))
+		}
+		bs := &duplicatingBlockstore{GCBlockstore: e.bs, deletes: make(map[key.Key]int)}
+
+		out, err := GCDryRun(ctx, bs, e.pn, nil, WithSweepConcurrency(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if candidates := drain(out); len(candidates) != 20 {
+			t.Fatalf("expected 20 candidates, got %d", len(candidates))
+		}
+
+		out, results, err := GCWithResult(ctx, bs, e.pn, nil, WithSweepConcurrency(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		removed := drain(out)
+		res := <-results
+		if len(res.Errors) != 0 {
+			t.Fatalf("unexpected errors: %v", res.Errors)
+		}
+		emitted := make(map[key.Key]bool)
+		for _, k := range removed {
+			if emitted[k] {
+				t.Fatalf("%s was emitted twice", k)
+			}
+			emitted[k] = true
+		}
+		if len(removed) != 20 || res.BlocksRemoved != 20 {
+			t.Fatalf("expected 20 removed blocks, got %d emitted and %d counted", len(removed), res.BlocksRemoved)
+		}
+		for k, d := range bs.deletes {
+			if d != 1 {
+				t.Fatalf("%s was deleted %d times", k, d)
+			}
+		}
+	}
+}
+
+func TestGCMaxDeletions(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	pinned := e.addNode(t, "pinned")
+	if err := e.pn.Pin(ctx, pinned, false); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 25; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+
+	for _, c := range []struct {
+		removed, remaining int
+		reason             CompletionReason
+	}{
+		{removed: 10, remaining: 15, reason: ReasonLimited},
+		{removed: 10, remaining: 5, reason: ReasonLimited},
+		{removed: 5, remaining: 0, reason: ReasonCompleted},
+	} {
+		res, err := RunGC(ctx, e.bs, e.pn, nil, WithMaxDeletions(10), WithDeleteBatchSize(4), WithSweepConcurrency(4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.BlocksRemoved != c.removed || res.RemainingBlocks != c.remaining || res.Reason != c.reason {
+			t.Fatalf("expected %d removed, %d remaining and %s, got %d, %d and %s",
+				c.removed, c.remaining, c.reason, res.BlocksRemoved, res.RemainingBlocks, res.Reason)
+		}
+	}
+	if !e.has(t, pinned) {
+		t.Fatal("pinned block was removed")
+	}
+
+	// the lock was released after each limited run
+	if res, err := RunGC(ctx, e.bs, e.pn, nil); err != nil || res.BlocksRemoved != 0 {
+		t.Fatalf("expected nothing left to remove, got %+v and %v", res, err)
+	}
+}
+
+// graphDAGService serves nodes that need not hash to the CIDs they are
+// served under, as a corrupt or crafted store could. next, if set, makes up
+// a node for any CID it doesn't hold.
+type graphDAGService struct {
+	dag.DAGService
+	nodes map[key.Key]*dag.Node
+	next  func(c *cid.Cid) *dag.Node
+}
+
+func (ds *graphDAGService) Get(ctx context.Context, c *cid.Cid) (*dag.Node, error) {
+	if nd, ok := ds.nodes[key.Key(c.Hash())]; ok {
+		return nd, nil
+	}
+	if ds.next != nil {
+		return ds.next(c), nil
+	}
+	return nil, dag.ErrNotFound
+}
+
+// linkTo returns a node with data that links to every one of cids
+func linkTo(data string, cids ...*cid.Cid) *dag.Node {
+	nd := dag.NodeWithData([]byte(data))
+	for _, c := range cids {
+		nd.Links = append(nd.Links, &dag.Link{Hash: c.Hash()})
+	}
+	return nd
+}
+
+func TestDescendantsCycle(t *testing.T) {
+	ctx := context.Background()
+	a := dag.NodeWithData([]byte("a")).Cid()
+	b := dag.NodeWithData([]byte("b")).Cid()
+	ds := &graphDAGService{nodes: map[key.Key]*dag.Node{
+		key.Key(a.Hash()): linkTo("a", b, a),
+		key.Key(b.Hash()): linkTo("b", a),
+	}}
+
+	bloom, err := NewBloomKeySet(100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, set := range []key.KeySet{key.NewKeySet(), bloom} {
+		done := make(chan error, 1)
+		go func() {
+			done <- Descendants(ctx, ds, set, []*cid.Cid{a}, false)
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("walking a cycle did not end")
+		}
+		if !set.Has(key.Key(a.Hash())) || !set.Has(key.Key(b.Hash())) {
+			t.Fatal("nodes of the cycle were not marked")
+		}
+	}
+}
+
+func TestMaxVisitedNodes(t *testing.T) {
+	e := newTestEnv()
+	root := dag.NodeWithData([]byte("root")).Cid()
+	// every node links to a new one, so the DAG never ends
+	ds := &graphDAGService{DAGService: e.dserv, nodes: map[key.Key]*dag.Node{}, next: func(c *cid.Cid) *dag.Node {
+		return linkTo(c.String(), dag.NodeWithData([]byte(c.String())).Cid())
+	}}
+	pn := fixedPinner{Pinner: e.pn, recursive: []*cid.Cid{root}}
+
+	for _, n := range []int{1, 4} {
+		_, _, err := ColoredSet(context.Background(), pn, ds, nil, WithMaxVisitedNodes(100), WithMarkConcurrency(n))
+		if err != ErrTraversalLimit {
+			t.Fatalf("expected ErrTraversalLimit, got %v", err)
+		}
+	}
+
+	// a limit above the size of the DAG changes nothing
+	tree, nodes := buildTree(t, e, "pinned", 2, 2)
+	pn = fixedPinner{Pinner: e.pn, recursive: []*cid.Cid{tree.Cid()}}
+	set, _, err := ColoredSet(context.Background(), pn, e.dserv, nil, WithMaxVisitedNodes(len(nodes)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(set.Keys()); n != len(nodes) {
+		t.Fatalf("expected %d marked nodes, got %d", len(nodes), n)
+	}
+}
+
+// deafBlockstore lists its keys without watching the context, and cancels a
+// context on the first delete
+type deafBlockstore struct {
+	bstore.GCBlockstore
+	cancel func()
+}
+
+func (bs *deafBlockstore) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
+	keys, err := bs.GCBlockstore.AllKeysChan(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan key.Key)
+	go func() {
+		defer close(out)
+		for k := range keys {
+			out <- k
+		}
+	}()
+	return out, nil
+}
+
+func (bs *deafBlockstore) DeleteBlock(k key.Key) error {
+	bs.cancel()
+	return bs.GCBlockstore.DeleteBlock(k)
+}
+
+func TestGCCancelReleasesKeyListing(t *testing.T) {
+	e := newTestEnv()
+	for i := 0; i < 50; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+	for _, prefix := range []string{"", "/"} {
+		ctx, cancel := context.WithCancel(context.Background())
+		bs := &deafBlockstore{GCBlockstore: e.bs, cancel: cancel}
+		before := runtime.NumGoroutine()
+
+		out, results, err := GCPrefix(ctx, bs, e.pn, nil, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range out {
+		}
+		res := <-results
+		if res.Reason != ReasonCancelled {
+			t.Fatalf("expected the run to be cancelled, got %s", res.Reason)
+		}
+		if res.BlocksRemoved == 0 || res.BlocksRemoved == 50 {
+			t.Fatalf("expected the run to stop part way, removed %d blocks", res.BlocksRemoved)
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for runtime.NumGoroutine() > before {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d goroutines left running after the run", runtime.NumGoroutine()-before)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestGCApprove(t *testing.T) {
+	ctx := context.Background()
+	for _, opts := range [][]GCOption{nil, {WithSweepConcurrency(4)}, {WithVerifyBeforeDelete(true)}} {
+		e := newTestEnv()
+		sizes := make(map[key.Key]int64)
+		var kept []*dag.Node
+		for i := 0; i < 10; i++ {
+			nd := e.addNode(t, fmt.Sprintf("garbage %d", i))
+			size, err := blockSize(e.bs, nd.Key())
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes[nd.Key()] = int64(size)
+			if i%2 == 0 {
+				kept = append(kept, nd)
+			}
+		}
+		retain := make(map[key.Key]bool)
+		for _, nd := range kept {
+			retain[nd.Key()] = true
+		}
+
+		var mu sync.Mutex
+		asked := 0
+		approve := func(k key.Key, size int64) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			asked++
+			if size != sizes[k] {
+				t.Errorf("asked about %s with size %d, expected %d", k, size, sizes[k])
+			}
+			return !retain[k]
+		}
+
+		res, err := RunGC(ctx, e.bs, e.pn, nil, append(opts, WithApprove(approve))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if asked != 10 || res.BlocksRemoved != 5 || res.RetainedByPolicy != 5 {
+			t.Fatalf("asked %d times, removed %d and retained %d blocks", asked, res.BlocksRemoved, res.RetainedByPolicy)
+		}
+		for _, nd := range kept {
+			if !e.has(t, nd) {
+				t.Fatalf("block %s removed against the policy", nd.Key())
+			}
+		}
+	}
+}
+
+func TestGCHashFunctions(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	// the same node stored under sha2-256, sha2-512 and sha1
+	nd := e.addNode(t, "same content")
+	data, err := nd.EncodeProtobuf(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(code int) *cid.Cid {
+		h, err := mh.Sum(data, code, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blk, err := blocks.NewBlockWithHash(data, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.bs.Put(blk); err != nil {
+			t.Fatal(err)
+		}
+		return cid.NewCidV1(cid.Protobuf, h)
+	}
+	sha512 := put(mh.SHA2_512)
+	sha1 := put(mh.SHA1)
+
+	// a block stored under a raw CID, pinned under a dag-pb one
+	rawBlk := blocks.NewBlock([]byte("raw content"))
+	if err := e.bs.Put(rawBlk); err != nil {
+		t.Fatal(err)
+	}
+	asProtobuf := cid.NewCidV1(cid.Protobuf, rawBlk.Multihash())
+
+	if err := e.pn.Pin(ctx, nd, true); err != nil {
+		t.Fatal(err)
+	}
+	e.pn.PinWithMode(sha512, pin.Direct)
+	e.pn.PinWithMode(asProtobuf, pin.Direct)
+
+	res, err := RunGC(ctx, e.bs, e.pn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.BlocksRemoved != 1 {
+		t.Fatalf("expected only the unpinned sha1 copy removed, got %d blocks", res.BlocksRemoved)
+	}
+	for _, c := range []*cid.Cid{nd.Cid(), sha512, asProtobuf} {
+		if has, err := e.bs.Has(key.Key(c.Hash())); err != nil || !has {
+			t.Fatalf("pinned block %s was removed", c)
+		}
+	}
+	if has, _ := e.bs.Has(key.Key(sha1.Hash())); has {
+		t.Fatal("the unpinned sha1 copy was kept")
+	}
+}
+
+func TestGCOnDelete(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	for i := 0; i < 10; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+
+	// the hook sees every block before it is sent out
+	var hooked []key.Key
+	onDelete := func(k key.Key) error {
+		if has, _ := e.bs.Has(k); has {
+			t.Errorf("hook called for %s before it was removed", k)
+		}
+		hooked = append(hooked, k)
+		return nil
+	}
+	out, results, err := GCWithResult(ctx, e.bs, e.pn, nil, WithOnDelete(onDelete))
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := drain(out)
+	<-results
+	if fmt.Sprint(hooked) != fmt.Sprint(removed) {
+		t.Fatalf("expected the hook called for %v in order, got %v", removed, hooked)
+	}
+
+	// a failing hook stops the run, unless it continues on errors
+	errHook := errors.New("index unavailable")
+	failing := func(key.Key) error { return errHook }
+	for _, c := range []struct {
+		opts    []GCOption
+		removed int
+	}{
+		{[]GCOption{WithDeleteBatchSize(1)}, 1},
+		{[]GCOption{ContinueOnError()}, 5},
+	} {
+		for i := 0; i < 5; i++ {
+			e.addNode(t, fmt.Sprintf("more garbage %d", i))
+		}
+		res, err := RunGC(ctx, e.bs, e.pn, nil, append(c.opts, WithOnDelete(failing))...)
+		if err == nil {
+			t.Fatal("expected the run to fail")
+		}
+		if res.BlocksRemoved != c.removed || len(res.Errors) != c.removed {
+			t.Fatalf("expected %d blocks removed and as many errors, got %d and %v", c.removed, res.BlocksRemoved, res.Errors)
+		}
+		for _, err := range res.Errors {
+			if herr, ok := err.(*OnDeleteError); !ok || herr.Err != errHook {
+				t.Fatalf("expected hook errors, got %v", err)
+			}
+		}
+		// what the first run left behind goes with the second
+		RunGC(ctx, e.bs, e.pn, nil)
+	}
+}
+
+func TestGCNilPinner(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	child := e.addNode(t, "child")
+	kept := e.addNode(t, "kept", child)
+	extra := e.addNode(t, "extra")
+	for i := 0; i < 5; i++ {
+		e.addNode(t, fmt.Sprintf("cached %d", i))
+	}
+	extraRoots := func(context.Context) ([]*cid.Cid, error) {
+		return []*cid.Cid{extra.Cid()}, nil
+	}
+
+	live, err := IsLive(ctx, nil, e.dserv, []*cid.Cid{kept.Cid()}, child.Cid())
+	if err != nil || !live {
+		t.Fatalf("expected the child of a root to be live, got %v, %v", live, err)
+	}
+	if roots := AllPinnedRoots(nil); len(roots) != 0 {
+		t.Fatalf("expected no pinned roots, got %v", roots)
+	}
+
+	res, err := RunGC(ctx, e.bs, nil, []*cid.Cid{kept.Cid()}, WithExtraRoots(extraRoots), WithStaleCheck(true), WithPinRecheck())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.BlocksRemoved != 5 {
+		t.Fatalf("expected the 5 unprotected blocks removed, got %d", res.BlocksRemoved)
+	}
+	for _, nd := range []*dag.Node{kept, child, extra} {
+		if !e.has(t, nd) {
+			t.Fatalf("protected block %s was removed", nd.Key())
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Package gctest provides an in-memory GCBlockstore for testing code that
+// runs garbage collections.
+package gctest
+
+import (
+	"sync"
+	"sync/atomic"
+
+	blocks "github.com/ipfs/go-ipfs/blocks"
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+)
+
+// MemBlockstore is a GCBlockstore holding its blocks in a map. It reports
+// block sizes and counts through blockstore.Sizer and blockstore.BlockCounter,
+// so that the size dependent options of gc can be exercised.
+//
+// The hooks are read without locking, so they should be set before the
+// blockstore is used.
+type MemBlockstore struct {
+	// DeleteHook, if set, is called before a block is deleted. If it returns
+	// an error the block is kept and DeleteBlock fails with that error.
+	DeleteHook func(key.Key) error
+
+	// SizeHook, if set, gives the size GetSize reports for a block in place
+	// of the length of its data
+	SizeHook func(key.Key) (int, error)
+
+	mu     sync.Mutex
+	blocks map[key.Key]blocks.Block
+
+	lk    sync.RWMutex
+	gcreq int32
+}
+
+var _ bstore.GCBlockstore = (*MemBlockstore)(nil)
+var _ bstore.Sizer = (*MemBlockstore)(nil)
+var _ bstore.BlockCounter = (*MemBlockstore)(nil)
+
+// NewMemBlockstore returns an empty MemBlockstore
+func NewMemBlockstore() *MemBlockstore {
+	return &MemBlockstore{blocks: make(map[key.Key]blocks.Block)}
+}
+
+func (bs *MemBlockstore) Get(k key.Key) (blocks.Block, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b, ok := bs.blocks[k]
+	if !ok {
+		return nil, bstore.ErrNotFound
+	}
+	return b, nil
+}
+
+func (bs *MemBlockstore) Put(b blocks.Block) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.blocks[b.Key()] = b
+	return nil
+}
+
+func (bs *MemBlockstore) PutMany(bl []blocks.Block) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	for _, b := range bl {
+		bs.blocks[b.Key()] = b
+	}
+	return nil
+}
+
+func (bs *MemBlockstore) Has(k key.Key) (bool, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	_, ok := bs.blocks[k]
+	return ok, nil
+}
+
+func (bs *MemBlockstore) DeleteBlock(k key.Key) error {
+	if bs.DeleteHook != nil {
+		if err := bs.DeleteHook(k); err != nil {
+			return err
+		}
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if _, ok := bs.blocks[k]; !ok {
+		return bstore.ErrNotFound
+	}
+	delete(bs.blocks, k)
+	return nil
+}
+
+// AllKeysChan lists the keys held when it is called
+func (bs *MemBlockstore) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
+	bs.mu.Lock()
+	keys := make([]key.Key, 0, len(bs.blocks))
+	for k := range bs.blocks {
+		keys = append(keys, k)
+	}
+	bs.mu.Unlock()
+
+	out := make(chan key.Key)
+	go func() {
+		defer close(out)
+		for _, k := range keys {
+			select {
+			case out <- k:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (bs *MemBlockstore) GetSize(k key.Key) (int, error) {
+	if bs.SizeHook != nil {
+		return bs.SizeHook(k)
+	}
+	b, err := bs.Get(k)
+	if err != nil {
+		return 0, err
+	}
+	return len(b.RawData()), nil
+}
+
+func (bs *MemBlockstore) BlockCount() (int, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return len(bs.blocks), nil
+}
+
+func (bs *MemBlockstore) GCLock() bstore.Unlocker {
+	atomic.AddInt32(&bs.gcreq, 1)
+	bs.lk.Lock()
+	atomic.AddInt32(&bs.gcreq, -1)
+	return unlocker(bs.lk.Unlock)
+}
+
+func (bs *MemBlockstore) PinLock() bstore.Unlocker {
+	bs.lk.RLock()
+	return unlocker(bs.lk.RUnlock)
+}
+
+func (bs *MemBlockstore) GCRequested() bool {
+	return atomic.LoadInt32(&bs.gcreq) > 0
+}
+
+type unlocker func()
+
+func (u unlocker) Unlock() {
+	u()
+}
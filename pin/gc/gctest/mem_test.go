@@ -0,0 +1,71 @@
+package gctest
+
+import (
+	"errors"
+	"testing"
+
+	bserv "github.com/ipfs/go-ipfs/blockservice"
+	offline "github.com/ipfs/go-ipfs/exchange/offline"
+	dag "github.com/ipfs/go-ipfs/merkledag"
+	pin "github.com/ipfs/go-ipfs/pin"
+	gc "github.com/ipfs/go-ipfs/pin/gc"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	ds "gx/ipfs/QmbzuUusHqaLLoNTDEVLcSF6vZDHZDLPC7p4bztRvvkXxU/go-datastore"
+	dssync "gx/ipfs/QmbzuUusHqaLLoNTDEVLcSF6vZDHZDLPC7p4bztRvvkXxU/go-datastore/sync"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+)
+
+func TestMemBlockstoreGC(t *testing.T) {
+	ctx := context.Background()
+	bs := NewMemBlockstore()
+	dserv := dag.NewDAGService(bserv.New(bs, offline.Exchange(bs)))
+	pn := pin.NewPinner(dssync.MutexWrap(ds.NewMapDatastore()), dserv, dserv)
+
+	add := func(data string) *dag.Node {
+		nd := dag.NodeWithData([]byte(data))
+		if _, err := dserv.Add(nd); err != nil {
+			t.Fatal(err)
+		}
+		return nd
+	}
+	pinned := add("pinned")
+	if err := pn.Pin(ctx, pinned, false); err != nil {
+		t.Fatal(err)
+	}
+	kept, gone := add("kept"), add("gone")
+
+	errKept := errors.New("kept")
+	bs.DeleteHook = func(k key.Key) error {
+		if k == kept.Key() {
+			return errKept
+		}
+		return nil
+	}
+	bs.SizeHook = func(key.Key) (int, error) {
+		return 100, nil
+	}
+
+	out, results, err := gc.GCWithResult(ctx, bs, pn, nil, gc.ContinueOnError())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range out {
+	}
+	res := <-results
+
+	if res.BlocksRemoved != 1 || res.BytesFreed != 100 {
+		t.Fatalf("expected one block of 100 bytes removed, got %+v", res)
+	}
+	if len(res.Errors) != 1 {
+		t.Fatalf("expected one error, got %v", res.Errors)
+	}
+	if serr, ok := res.Errors[0].(*gc.SweepError); !ok || serr.Key != kept.Key() || serr.Err != errKept {
+		t.Fatalf("expected the hook's error for the kept block, got %v", res.Errors[0])
+	}
+	for nd, exp := range map[*dag.Node]bool{pinned: true, kept: true, gone: false} {
+		if has, _ := bs.Has(nd.Key()); has != exp {
+			t.Fatalf("block %s: expected present %t, got %t", nd.Key(), exp, has)
+		}
+	}
+}
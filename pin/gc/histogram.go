@@ -0,0 +1,57 @@
+package gc
+
+import (
+	"sort"
+)
+
+// SizeHistogram counts the blocks removed by size. Counts[i] is the number
+// of blocks of at most Bounds[i] bytes that are larger than the bound before
+// it, and the last count is for the blocks larger than every bound.
+type SizeHistogram struct {
+	Bounds []int64
+	Counts []int
+	// Unknown is the number of blocks whose size could not be found out
+	Unknown int
+}
+
+// powerOfTwoBounds are the default histogram bounds, from 1 byte to 16MiB
+func powerOfTwoBounds() []int64 {
+	bounds := make([]int64, 25)
+	for i := range bounds {
+		bounds[i] = 1 << uint(i)
+	}
+	return bounds
+}
+
+func newSizeHistogram(bounds []int64) *SizeHistogram {
+	return &SizeHistogram{
+		Bounds: bounds,
+		Counts: make([]int, len(bounds)+1),
+	}
+}
+
+// add counts a block of the given size, or of unknown size if negative
+func (h *SizeHistogram) add(size int64) {
+	if size < 0 {
+		h.Unknown++
+		return
+	}
+	i := sort.Search(len(h.Bounds), func(i int) bool {
+		return h.Bounds[i] >= size
+	})
+	h.Counts[i]++
+}
+
+// merge adds the counts of o, which has the same bounds, to h
+func (h *SizeHistogram) merge(o *SizeHistogram) {
+	for i, n := range o.Counts {
+		h.Counts[i] += n
+	}
+	h.Unknown += o.Unknown
+}
+
+type int64s []int64
+
+func (s int64s) Len() int           { return len(s) }
+func (s int64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s int64s) Less(i, j int) bool { return s[i] < s[j] }
@@ -0,0 +1,79 @@
+package gc
+
+import (
+	"strings"
+	"testing"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+)
+
+func TestGCSizeHistogram(t *testing.T) {
+	ctx := context.Background()
+
+	for _, concurrency := range []int{1, 4} {
+		e := newTestEnv()
+		sizes := make(map[int64]int)
+		for _, n := range []int{10, 20, 100, 1000, 5000} {
+			nd := e.addNode(t, strings.Repeat("x", n))
+			sizes[int64(len(nd.RawData()))]++
+		}
+
+		out, results, err := GCWithResult(ctx, e.bs, e.pn, nil,
+			WithSizeHistogramBounds(4096, 64), WithSweepConcurrency(concurrency))
+		if err != nil {
+			t.Fatal(err)
+		}
+		drain(out)
+		h := (<-results).SizeHistogram
+		if h == nil {
+			t.Fatal("expected a size histogram")
+		}
+		if len(h.Bounds) != 2 || h.Bounds[0] != 64 || h.Bounds[1] != 4096 {
+			t.Fatalf("expected sorted bounds, got %v", h.Bounds)
+		}
+
+		expect := make([]int, 3)
+		for size, n := range sizes {
+			switch {
+			case size <= 64:
+				expect[0] += n
+			case size <= 4096:
+				expect[1] += n
+			default:
+				expect[2] += n
+			}
+		}
+		for i := range expect {
+			if h.Counts[i] != expect[i] {
+				t.Fatalf("expected counts %v, got %v", expect, h.Counts)
+			}
+		}
+	}
+}
+
+func TestSizeHistogramPowerOfTwo(t *testing.T) {
+	h := newSizeHistogram(powerOfTwoBounds())
+	for _, size := range []int64{0, 1, 2, 3, 1 << 20, 1<<24 + 1, -1} {
+		h.add(size)
+	}
+	expect := map[int]int{0: 2, 1: 1, 2: 1, 20: 1, 25: 1}
+	for i, n := range h.Counts {
+		if n != expect[i] {
+			t.Fatalf("bucket %d: expected %d blocks, got %d", i, expect[i], n)
+		}
+	}
+	if h.Unknown != 1 {
+		t.Fatalf("expected 1 block of unknown size, got %d", h.Unknown)
+	}
+
+	e := newTestEnv()
+	e.addNode(t, "garbage")
+	out, results, err := GCWithResult(context.Background(), e.bs, e.pn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	if res := <-results; res.SizeHistogram != nil {
+		t.Fatal("expected no histogram unless asked for")
+	}
+}
@@ -0,0 +1,55 @@
+package gc
+
+import (
+	"encoding/json"
+	"io"
+
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// deletionJSON is the line StreamGCJSON writes for a removed block
+type deletionJSON struct {
+	Cid  string `json:"cid"`
+	Size int64  `json:"size"`
+}
+
+// flusher is implemented by writers that buffer, like bufio.Writer
+type flusher interface {
+	Flush() error
+}
+
+// httpFlusher is implemented by writers like http.ResponseWriter
+type httpFlusher interface {
+	Flush()
+}
+
+// StreamGCJSON writes a JSON object per line to w for every deletion read
+// from out, such as {"cid":"Qm...","size":123}, as they come from
+// GCWithSizes. The size is -1 when it could not be found out. A writer that
+// buffers is flushed after each line, so that a reader on the other end of
+// a pipe sees the deletions as they are made.
+//
+// On a write error StreamGCJSON returns at once and stops reading out. The
+// sweep blocks once nothing reads its output, so the caller should then
+// cancel the context of the run.
+func StreamGCJSON(w io.Writer, out <-chan GCDeletion) error {
+	enc := json.NewEncoder(w)
+	for d := range out {
+		line := deletionJSON{
+			Cid:  cid.NewCidV0(d.Key.ToMultihash()).String(),
+			Size: d.Size,
+		}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+		switch f := w.(type) {
+		case flusher:
+			if err := f.Flush(); err != nil {
+				return err
+			}
+		case httpFlusher:
+			f.Flush()
+		}
+	}
+	return nil
+}
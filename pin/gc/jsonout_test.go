@@ -0,0 +1,84 @@
+package gc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+func TestStreamGCJSON(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	sizes := make(map[key.Key]int64)
+	for i := 0; i < 5; i++ {
+		nd := e.addNode(t, fmt.Sprintf("garbage %d", i))
+		n, err := blockSize(e.bs, nd.Key())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[nd.Key()] = int64(n)
+	}
+
+	out, results, err := GCWithSizes(ctx, e.bs, e.pn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	if err := StreamGCJSON(bw, out); err != nil {
+		t.Fatal(err)
+	}
+	<-results
+	if bw.Buffered() != 0 {
+		t.Fatal("the output was not flushed")
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 5 {
+		t.Fatalf("expected 5 lines, got %q", buf.String())
+	}
+	for _, l := range lines {
+		var d struct {
+			Cid  string
+			Size int64
+		}
+		if err := json.Unmarshal(l, &d); err != nil {
+			t.Fatalf("line %q: %s", l, err)
+		}
+		c, err := cid.Decode(d.Cid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size, ok := sizes[key.Key(c.Hash())]; !ok || size != d.Size {
+			t.Fatalf("unexpected line %q", l)
+		}
+	}
+}
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+var errWrite = errors.New("write failed")
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errWrite }
+
+func TestStreamGCJSONWriteError(t *testing.T) {
+	out := make(chan GCDeletion, 3)
+	for i := 0; i < 3; i++ {
+		out <- GCDeletion{Key: key.Key(fmt.Sprint(i)), Size: 1}
+	}
+	close(out)
+	if err := StreamGCJSON(failingWriter{}, out); err != errWrite {
+		t.Fatalf("expected the write error, got %v", err)
+	}
+	if len(out) != 2 {
+		t.Fatalf("expected the rest of the deletions left unread, %d left", len(out))
+	}
+}
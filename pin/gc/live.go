@@ -0,0 +1,132 @@
+package gc
+
+import (
+	dag "github.com/ipfs/go-ipfs/merkledag"
+	pin "github.com/ipfs/go-ipfs/pin"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// IsLive reports whether target would survive garbage collection, that is
+// whether it is reachable from the pins or the best-effort roots. The mark
+// phase is run to find out, unless a set built earlier is passed in through
+// WithMarkedSet. A set created by NewBloomKeySet may report blocks as live
+// that aren't.
+func IsLive(ctx context.Context, pn pin.Pinner, ds dag.DAGService, bestEffortRoots []*cid.Cid, target *cid.Cid, opts ...GCOption) (bool, error) {
+	o := newGCOptions(opts)
+	if o.marked != nil {
+		if err := o.marked.current(pn); err != nil {
+			return false, err
+		}
+		return o.marked.Contains(target), nil
+	}
+
+	set, _, err := ColoredSet(ctx, pn, ds, bestEffortRoots, opts...)
+	if err != nil {
+		return false, err
+	}
+	defer closeKeySet(set)
+	return set.Has(key.Key(target.Hash())), nil
+}
+
+// LivePath explains why target is live. It returns a chain of blocks that
+// starts at a pin or a best-effort root and ends at target, each linking to
+// the next, or nil if target isn't reachable. A direct pin or a root that is
+// the target itself gives a chain of one.
+func LivePath(ctx context.Context, pn pin.Pinner, ds dag.DAGService, bestEffortRoots []*cid.Cid, target *cid.Cid) ([]*cid.Cid, error) {
+	pn = pinsOf(pn)
+	tk := key.Key(target.Hash())
+	for _, c := range pn.DirectKeys() {
+		if key.Key(c.Hash()) == tk {
+			return []*cid.Cid{c}, nil
+		}
+	}
+
+	f := &pathFinder{
+		ds:      ds,
+		target:  tk,
+		parents: make(map[key.Key]*cid.Cid),
+	}
+	for _, roots := range []struct {
+		cids       []*cid.Cid
+		bestEffort bool
+	}{
+		{pn.RecursiveKeys(), false},
+		{bestEffortRoots, true},
+		{pn.InternalPins(), false},
+	} {
+		path, err := f.find(ctx, roots.cids, roots.bestEffort)
+		if err != nil || path != nil {
+			return path, err
+		}
+	}
+	return nil, nil
+}
+
+// pathFinder walks DAGs looking for target, remembering the parent of every
+// node it reaches. A node reached once is not walked again, as its subgraph
+// is already known not to hold the target.
+type pathFinder struct {
+	ds      dag.DAGService
+	target  key.Key
+	parents map[key.Key]*cid.Cid
+}
+
+func (f *pathFinder) find(ctx context.Context, roots []*cid.Cid, bestEffort bool) ([]*cid.Cid, error) {
+	for _, root := range roots {
+		rk := key.Key(root.Hash())
+		if rk == f.target {
+			return []*cid.Cid{root}, nil
+		}
+		if _, seen := f.parents[rk]; seen {
+			continue
+		}
+		f.parents[rk] = nil
+
+		nd, err := f.ds.Get(ctx, root)
+		if err != nil {
+			if bestEffort && err == dag.ErrNotFound {
+				continue
+			}
+			return nil, err
+		}
+
+		var found *cid.Cid
+		err = dag.EnumerateChildrenParents(ctx, f.ds, nd, func(parent, c *cid.Cid) bool {
+			k := key.Key(c.Hash())
+			if _, seen := f.parents[k]; seen || found != nil {
+				return false
+			}
+			f.parents[k] = parent
+			if k == f.target {
+				found = c
+				return false
+			}
+			return true
+		}, bestEffort)
+		if err != nil {
+			return nil, err
+		}
+		if found != nil {
+			return f.path(found), nil
+		}
+	}
+	return nil, nil
+}
+
+// path follows the recorded parents from c up to the root it was reached from
+func (f *pathFinder) path(c *cid.Cid) []*cid.Cid {
+	var rev []*cid.Cid
+	for c != nil {
+		rev = append(rev, c)
+		c = f.parents[key.Key(c.Hash())]
+	}
+
+	path := make([]*cid.Cid, len(rev))
+	for i, c := range rev {
+		path[len(rev)-1-i] = c
+	}
+	return path
+}
@@ -0,0 +1,121 @@
+package gc
+
+import (
+	"testing"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+func checkPath(t *testing.T, e *testEnv, path []*cid.Cid, from, to *dag.Node) {
+	if len(path) == 0 {
+		t.Fatalf("no path to %s", to.Cid())
+	}
+	if !path[0].Equals(from.Cid()) || !path[len(path)-1].Equals(to.Cid()) {
+		t.Fatalf("path %v doesn't lead from %s to %s", path, from.Cid(), to.Cid())
+	}
+	for i := 1; i < len(path); i++ {
+		nd, err := e.dserv.Get(context.Background(), path[i-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		linked := false
+		for _, l := range nd.Links {
+			if cid.NewCidV0(l.Hash).Equals(path[i]) {
+				linked = true
+			}
+		}
+		if !linked {
+			t.Fatalf("%s doesn't link to %s", path[i-1], path[i])
+		}
+	}
+}
+
+func TestIsLive(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	root, tree := buildTree(t, e, "pinned", 3, 2)
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+	direct := e.addNode(t, "direct")
+	if err := e.pn.Pin(ctx, direct, false); err != nil {
+		t.Fatal(err)
+	}
+	bestEffort, kept := buildTree(t, e, "best effort", 1, 2)
+	garbage := e.addNode(t, "garbage")
+	roots := []*cid.Cid{bestEffort.Cid()}
+
+	leaf := tree[0]
+	for _, c := range []struct {
+		nd   *dag.Node
+		live bool
+	}{{leaf, true}, {direct, true}, {kept[0], true}, {garbage, false}} {
+		live, err := IsLive(ctx, e.pn, e.dserv, roots, c.nd.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if live != c.live {
+			t.Fatalf("expected live %t for %q, got %t", c.live, c.nd.Data(), live)
+		}
+	}
+
+	path, err := LivePath(ctx, e.pn, e.dserv, roots, leaf.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(path) != 4 {
+		t.Fatalf("expected a path of 4 blocks, got %v", path)
+	}
+	checkPath(t, e, path, root, leaf)
+
+	path, err = LivePath(ctx, e.pn, e.dserv, roots, kept[0].Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPath(t, e, path, bestEffort, kept[0])
+
+	path, err = LivePath(ctx, e.pn, e.dserv, roots, direct.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPath(t, e, path, direct, direct)
+
+	path, err = LivePath(ctx, e.pn, e.dserv, roots, garbage.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != nil {
+		t.Fatalf("expected no path to garbage, got %v", path)
+	}
+}
+
+func TestIsLiveWithMarkedSet(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	pinned := e.addNode(t, "pinned")
+	if err := e.pn.Pin(ctx, pinned, true); err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildMarkedSet(ctx, e.pn, e.dserv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	live, err := IsLive(ctx, e.pn, e.dserv, nil, pinned.Cid(), WithMarkedSet(m))
+	if err != nil || !live {
+		t.Fatalf("expected pinned block to be live, got %t, %v", live, err)
+	}
+
+	if err := e.pn.Pin(ctx, e.addNode(t, "new pin"), true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IsLive(ctx, e.pn, e.dserv, nil, pinned.Cid(), WithMarkedSet(m)); err != ErrStaleMarkedSet {
+		t.Fatalf("expected ErrStaleMarkedSet, got %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package gc
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+	pin "github.com/ipfs/go-ipfs/pin"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// ErrGCLockTimeout is returned when the GC lock could not be taken in time
+var ErrGCLockTimeout = errors.New("gc: timed out waiting for the GC lock")
+
+// GCWithLockTimeout is like GCWithResult, but gives up with ErrGCLockTimeout
+// if the GC lock can't be taken within timeout, or with the context's error
+// if ctx is done first.
+func GCWithLockTimeout(ctx context.Context, bs bstore.GCBlockstore, pn pin.Pinner, bestEffortRoots []*cid.Cid, timeout time.Duration, opts ...GCOption) (<-chan key.Key, <-chan GCResult, error) {
+	done, err := startGC(bs)
+	if err != nil {
+		return nil, nil, err
+	}
+	o := newGCOptions(opts)
+	start := time.Now()
+	unlocker, err := gcLockTimeout(ctx, bs, timeout)
+	if err != nil {
+		done()
+		return nil, nil, err
+	}
+	o.lockWait = time.Since(start)
+	unlocker = checkGCLock(bs, unlocker, o)
+	unlocker = &runningUnlocker{Unlocker: yieldable(bs, unlocker, o), done: done}
+	deletions, results, err := runGC(ctx, bs, unlocker, pn, bestEffortRoots, o)
+	return keysOf(ctx, deletions, results, err)
+}
+
+// gcLockTimeout takes the GC lock of bs, waiting at most timeout for it.
+//
+// The blockstore lock can't be given up on once requested, so the request
+// is left to finish in the background and the lock is released as soon as it
+// is taken. Until then, new pin locks wait behind it as they would during a
+// normal GC.
+func gcLockTimeout(ctx context.Context, bs bstore.GCBlockstore, timeout time.Duration) (bstore.Unlocker, error) {
+	locked := make(chan bstore.Unlocker, 1)
+	go func() {
+		locked <- bs.GCLock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case unlocker := <-locked:
+		return unlocker, nil
+	case <-timer.C:
+		go releaseLock(locked)
+		return nil, ErrGCLockTimeout
+	case <-ctx.Done():
+		go releaseLock(locked)
+		return nil, ctx.Err()
+	}
+}
+
+// releaseLock unlocks the lock sent on locked once it is granted
+func releaseLock(locked <-chan bstore.Unlocker) {
+	(<-locked).Unlock()
+}
+
+// checkGCLock checks in the background that the pin lock of bs waits for the
+// GC lock it was given the unlocker of, and warns if it doesn't: a blockstore
+// whose locks do nothing lets the blocks of an add be swept before they are
+// pinned. The check is skipped under WithSingleWriter.
+func checkGCLock(bs bstore.GCBlockstore, unlocker bstore.Unlocker, o *gcOptions) bstore.Unlocker {
+	if o.singleWriter {
+		return unlocker
+	}
+	u := &checkedUnlocker{Unlocker: unlocker}
+	go func() {
+		pl := bs.PinLock()
+		unguarded := atomic.LoadInt32(&u.released) == 0
+		if unguarded {
+			o.log.Warning("the blockstore granted a pin lock while the GC lock was held, blocks written during the sweep may be removed; use WithSingleWriter if nothing writes to it")
+		}
+		pl.Unlock()
+		gcLockChecked(bs, unguarded)
+	}()
+	return u
+}
+
+// gcLockChecked is called once checkGCLock is done checking the locks of bs,
+// telling whether the pin lock was granted while the GC lock was held
+var gcLockChecked = func(bs bstore.GCBlockstore, unguarded bool) {}
+
+// checkedUnlocker is a GC lock checked by checkGCLock
+type checkedUnlocker struct {
+	bstore.Unlocker
+	// released is set once the lock is given up, before the pin lock can
+	// be granted
+	released int32
+}
+
+func (u *checkedUnlocker) Unlock() {
+	atomic.StoreInt32(&u.released, 1)
+	u.Unlocker.Unlock()
+}
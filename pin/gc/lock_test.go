@@ -0,0 +1,154 @@
+package gc
+
+import (
+	"testing"
+	"time"
+
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+	dag "github.com/ipfs/go-ipfs/merkledag"
+	pin "github.com/ipfs/go-ipfs/pin"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+func TestGCWithLockTimeout(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	e.addNode(t, "garbage")
+
+	unlocker := e.bs.PinLock()
+	_, _, err := GCWithLockTimeout(ctx, e.bs, e.pn, nil, 20*time.Millisecond)
+	if err != ErrGCLockTimeout {
+		t.Fatalf("expected ErrGCLockTimeout, got %v", err)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, err = GCWithLockTimeout(cctx, e.bs, e.pn, nil, time.Minute)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	unlocker.Unlock()
+
+	// the abandoned lock requests must not keep the lock
+	out, results, err := GCWithLockTimeout(ctx, e.bs, e.pn, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	if res := <-results; res.BlocksRemoved != 1 {
+		t.Fatalf("expected 1 removed block, got %d", res.BlocksRemoved)
+	}
+}
+
+// brokenPinner pins a block that isn't in the blockstore, or panics when
+// asked for its recursive pins
+type brokenPinner struct {
+	pin.Pinner
+	panics bool
+}
+
+func (p brokenPinner) RecursiveKeys() []*cid.Cid {
+	if p.panics {
+		panic("broken pinner")
+	}
+	return []*cid.Cid{dag.NodeWithData([]byte("missing")).Cid()}
+}
+
+// assertUnlocked fails if the GC lock of e can't be taken
+func assertUnlocked(t *testing.T, e *testEnv) {
+	unlocker, err := gcLockTimeout(context.Background(), e.bs, time.Second)
+	if err != nil {
+		t.Fatal("GC lock was not released")
+	}
+	unlocker.Unlock()
+}
+
+func TestGCReleasesLockOnMarkError(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	if _, err := GC(ctx, e.bs, brokenPinner{Pinner: e.pn}, nil); err == nil {
+		t.Fatal("expected the mark phase to fail")
+	}
+	assertUnlocked(t, e)
+
+	if _, err := GCDryRun(ctx, e.bs, brokenPinner{Pinner: e.pn}, nil); err == nil {
+		t.Fatal("expected the mark phase to fail")
+	}
+	assertUnlocked(t, e)
+}
+
+func TestGCReleasesLockOnMarkPanic(t *testing.T) {
+	e := newTestEnv()
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected the mark phase to panic")
+			}
+		}()
+		GC(context.Background(), e.bs, brokenPinner{Pinner: e.pn, panics: true}, nil)
+	}()
+	assertUnlocked(t, e)
+}
+
+// noLockBlockstore has locks that do nothing
+type noLockBlockstore struct {
+	bstore.GCBlockstore
+}
+
+func (noLockBlockstore) GCLock() bstore.Unlocker  { return noUnlock{} }
+func (noLockBlockstore) PinLock() bstore.Unlocker { return noUnlock{} }
+
+type noUnlock struct{}
+
+func (noUnlock) Unlock() {}
+
+func TestCheckGCLock(t *testing.T) {
+	e := newTestEnv()
+	type check struct {
+		bs        bstore.GCBlockstore
+		unguarded bool
+	}
+	cases := []check{
+		{e.bs, false},
+		{noLockBlockstore{GCBlockstore: e.bs}, true},
+	}
+	checks := make(chan check, 1)
+	defer func(f func(bstore.GCBlockstore, bool)) { gcLockChecked = f }(gcLockChecked)
+	gcLockChecked = func(bs bstore.GCBlockstore, unguarded bool) {
+		// the runs of other tests may still be checking their own locks
+		for _, c := range cases {
+			if bs == c.bs {
+				checks <- check{bs, unguarded}
+			}
+		}
+	}
+
+	for _, c := range cases {
+		u := checkGCLock(c.bs, c.bs.GCLock(), newGCOptions(nil))
+		var got check
+		if c.unguarded {
+			got = <-checks
+			u.Unlock()
+		} else {
+			select {
+			case <-checks:
+				t.Fatal("pin lock granted while the GC lock was held")
+			case <-time.After(20 * time.Millisecond):
+			}
+			u.Unlock()
+			got = <-checks
+		}
+		if got != c {
+			t.Fatalf("expected unguarded %t, got %t", c.unguarded, got.unguarded)
+		}
+	}
+
+	bs := noLockBlockstore{GCBlockstore: e.bs}
+	if _, ok := checkGCLock(bs, bs.GCLock(), newGCOptions([]GCOption{WithSingleWriter(true)})).(*checkedUnlocker); ok {
+		t.Fatal("GC lock checked despite WithSingleWriter")
+	}
+}
@@ -0,0 +1,249 @@
+package gc
+
+import (
+	"sync"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// markRoots marks the descendants of roots as set by the options: with
+// WithMarkConcurrency nodes are fetched by a pool of workers whatever root
+// they are below, and otherwise WithMarkRootConcurrency walks that many roots
+// at once, each serially.
+func markRoots(ctx context.Context, ds dag.DAGService, set key.KeySet, roots []*cid.Cid, o *gcOptions) error {
+	if o.markConcurrency <= 1 && o.markRootConcurrency > 1 && !isProbabilistic(set) {
+		return markRootsConcurrently(ctx, ds, set, roots, o.markRootConcurrency)
+	}
+	return markDescendants(ctx, ds, set, roots, false, o.markConcurrency, o.markQueueSize)
+}
+
+// markRootsConcurrently walks up to n of roots at once, like Descendants
+// would walk each of them. The walks share set, checking and marking a node
+// under one lock so that a subgraph reached from several roots is walked by
+// one of them only.
+func markRootsConcurrently(ctx context.Context, ds dag.DAGService, set key.KeySet, roots []*cid.Cid, n int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	shared := &lockedKeySet{KeySet: set}
+	// seen marks k if it isn't yet, so that descendRoot's own Add is a
+	// no-op and the walk goes on only for the first to reach it
+	seen := func(k key.Key) bool {
+		shared.mu.Lock()
+		defer shared.mu.Unlock()
+		if set.Has(k) {
+			return true
+		}
+		set.Add(k)
+		return false
+	}
+
+	todo := make(chan *cid.Cid)
+	go func() {
+		defer close(todo)
+		for _, c := range uniqueRoots(roots, make(map[key.Key]bool)) {
+			select {
+			case todo <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range todo {
+				if err := descendRoot(ctx, ds, shared, seen, c, false); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					cancel()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// markDescendants marks the descendants of roots like Descendants, with up
+// to concurrency nodes being fetched at once and, if queueSize is more than
+// zero, at most that many nodes waiting to be. Probabilistic sets are always
+// walked serially, as telling a walked subgraph from a false positive relies
+// on the order of the walk.
+func markDescendants(ctx context.Context, ds dag.DAGService, set key.KeySet, roots []*cid.Cid, bestEffort bool, concurrency, queueSize int) error {
+	if concurrency <= 1 || isProbabilistic(set) {
+		return Descendants(ctx, ds, set, roots, bestEffort)
+	}
+
+	ctx, span := startSpan(ctx, "gc.descendants")
+	defer span.Finish()
+	span.SetTag("roots", len(roots))
+
+	w := &markWalk{
+		ctx:        ctx,
+		ds:         ds,
+		set:        set,
+		bestEffort: bestEffort,
+		queueSize:  queueSize,
+	}
+	w.cond = sync.NewCond(&w.mu)
+
+	// like Descendants, the roots are walked even if already marked, but
+	// only once each
+	for _, c := range uniqueRoots(roots, make(map[key.Key]bool)) {
+		set.Add(key.Key(c.Hash()))
+		w.todo = append(w.todo, markItem{c: c, root: c})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.work()
+		}()
+	}
+	wg.Wait()
+	return w.err
+}
+
+// markWalk is the state shared by the workers of a concurrent walk. mu
+// guards the set as well as the queue, so that checking whether a node was
+// seen and marking it happen at once and no subgraph is walked twice.
+//
+// The links of a fetched node are queued as there is room for them: a node
+// with more links than the queue holds stays in parents until all of them
+// are, so that the queue stays bounded without a worker ever waiting on it.
+type markWalk struct {
+	ctx        context.Context
+	ds         dag.DAGService
+	set        key.KeySet
+	bestEffort bool
+	// queueSize bounds todo, zero or less leaves it unbounded
+	queueSize int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	todo    []markItem
+	parents []markParent
+	// active is the number of nodes being fetched, whose children may
+	// still be queued
+	active int
+	err    error
+}
+
+// markItem is a node to fetch and the root it was reached from
+type markItem struct {
+	c    *cid.Cid
+	root *cid.Cid
+}
+
+// markParent is a fetched node whose links from next on are yet to be
+// queued
+type markParent struct {
+	nd   *dag.Node
+	next int
+	root *cid.Cid
+}
+
+// next returns the next node to fetch, or false once the walk is over
+func (w *markWalk) next() (markItem, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.fill()
+	for len(w.todo) == 0 && w.active > 0 && w.err == nil {
+		w.cond.Wait()
+		w.fill()
+	}
+	if len(w.todo) == 0 || w.err != nil {
+		return markItem{}, false
+	}
+	it := w.todo[len(w.todo)-1]
+	w.todo = w.todo[:len(w.todo)-1]
+	w.active++
+	return it, true
+}
+
+// done queues the unseen children of a fetched node, or records the error
+// that ends the walk
+func (w *markWalk) done(it markItem, nd *dag.Node, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.active--
+	defer w.cond.Broadcast()
+
+	if err != nil {
+		if w.err == nil {
+			w.err = err
+		}
+		return
+	}
+	if nd == nil || len(nd.Links) == 0 {
+		return
+	}
+	w.parents = append(w.parents, markParent{nd: nd, root: it.root})
+	w.fill()
+}
+
+// fill queues the unseen links of the parents while there is room, the
+// latest parent first so that the walk goes depth first and few parents
+// are held at once
+func (w *markWalk) fill() {
+	for len(w.parents) > 0 {
+		if w.queueSize > 0 && len(w.todo) >= w.queueSize {
+			return
+		}
+		p := &w.parents[len(w.parents)-1]
+		lnk := p.nd.Links[p.next]
+		p.next++
+		root := p.root
+		if p.next == len(p.nd.Links) {
+			w.parents[len(w.parents)-1] = markParent{}
+			w.parents = w.parents[:len(w.parents)-1]
+		}
+
+		c := cid.NewCidV0(lnk.Hash)
+		k := key.Key(c.Hash())
+		if w.set.Has(k) {
+			continue
+		}
+		w.set.Add(k)
+		w.todo = append(w.todo, markItem{c: c, root: root})
+	}
+}
+
+func (w *markWalk) work() {
+	for {
+		it, ok := w.next()
+		if !ok {
+			return
+		}
+		nd, err := w.ds.Get(w.ctx, it.c)
+		if err == dag.ErrNotFound {
+			if w.bestEffort {
+				nd, err = nil, nil
+			} else {
+				err = &ErrPinIncomplete{Root: it.root, Missing: it.c}
+			}
+		}
+		if err == nil {
+			err = w.ctx.Err()
+		}
+		w.done(it, nd, err)
+	}
+}
@@ -0,0 +1,295 @@
+package gc
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// slowDAGService takes latency to fetch each node and counts the fetches of
+// every node
+type slowDAGService struct {
+	dag.DAGService
+	latency time.Duration
+
+	mu   sync.Mutex
+	gets map[key.Key]int
+}
+
+func (ds *slowDAGService) Get(ctx context.Context, c *cid.Cid) (*dag.Node, error) {
+	ds.mu.Lock()
+	ds.gets[key.Key(c.Hash())]++
+	ds.mu.Unlock()
+	time.Sleep(ds.latency)
+	return ds.DAGService.Get(ctx, c)
+}
+
+func TestMarkConcurrency(t *testing.T) {
+	ctx := context.Background()
+	e, bestEffort := sharedEnv(t, 10)
+
+	serial, _, err := ColoredSet(ctx, e.pn, e.dserv, bestEffort)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds := &slowDAGService{DAGService: e.dserv, gets: make(map[key.Key]int)}
+	set, _, err := ColoredSet(ctx, e.pn, ds, bestEffort, WithMarkConcurrency(8), WithNodeCacheSize(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(set.Keys()) != len(serial.Keys()) {
+		t.Fatalf("expected %d marked keys, got %d", len(serial.Keys()), len(set.Keys()))
+	}
+	for _, k := range serial.Keys() {
+		if !set.Has(k) {
+			t.Fatalf("%s was not marked", k)
+		}
+	}
+	for k, n := range ds.gets {
+		if n > 1 {
+			t.Fatalf("%s was fetched %d times", k, n)
+		}
+	}
+}
+
+func BenchmarkMarkConcurrency(b *testing.B) {
+	e, bestEffort := sharedEnv(b, 10)
+	ds := &slowDAGService{DAGService: e.dserv, latency: time.Millisecond, gets: make(map[key.Key]int)}
+
+	for _, n := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, _, err := ColoredSet(context.Background(), e.pn, ds, bestEffort, WithMarkConcurrency(n))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// inflightDAGService takes latency to fetch each node and records the most
+// fetches that were going on at once, and the fetches of every node
+type inflightDAGService struct {
+	dag.DAGService
+	latency time.Duration
+
+	mu       sync.Mutex
+	inflight int
+	max      int
+	gets     map[key.Key]int
+}
+
+func (ds *inflightDAGService) Get(ctx context.Context, c *cid.Cid) (*dag.Node, error) {
+	ds.mu.Lock()
+	ds.gets[key.Key(c.Hash())]++
+	if ds.inflight++; ds.inflight > ds.max {
+		ds.max = ds.inflight
+	}
+	ds.mu.Unlock()
+	time.Sleep(ds.latency)
+	ds.mu.Lock()
+	ds.inflight--
+	ds.mu.Unlock()
+	return ds.DAGService.Get(ctx, c)
+}
+
+func TestMarkRootConcurrency(t *testing.T) {
+	ctx := context.Background()
+	e, bestEffort := sharedEnv(t, 12)
+
+	serial, _, err := ColoredSet(ctx, e.pn, e.dserv, bestEffort)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds := &inflightDAGService{DAGService: e.dserv, latency: time.Millisecond, gets: make(map[key.Key]int)}
+	set, _, err := ColoredSet(ctx, e.pn, ds, bestEffort, WithMarkRootConcurrency(3), WithNodeCacheSize(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(set.Keys()) != len(serial.Keys()) {
+		t.Fatalf("expected %d marked keys, got %d", len(serial.Keys()), len(set.Keys()))
+	}
+	for _, k := range serial.Keys() {
+		if !set.Has(k) {
+			t.Fatalf("%s was not marked", k)
+		}
+	}
+	// the subtree shared by every root is walked once
+	for k, n := range ds.gets {
+		if n > 1 {
+			t.Fatalf("%s was fetched %d times", k, n)
+		}
+	}
+	if ds.max > 3 {
+		t.Fatalf("%d roots were walked at once with a limit of 3", ds.max)
+	}
+	if ds.max < 2 {
+		t.Fatal("the roots were walked one at a time")
+	}
+}
+
+// BenchmarkMarkIndependentPins marks many small pins that share nothing, the
+// case where the roots themselves are the work to spread
+func BenchmarkMarkIndependentPins(b *testing.B) {
+	ctx := context.Background()
+	e := newTestEnv()
+	for i := 0; i < 10000; i++ {
+		root := e.addNode(b, fmt.Sprintf("root %d", i), e.addNode(b, fmt.Sprintf("leaf %d", i)))
+		if err := e.pn.Pin(ctx, root, true); err != nil {
+			b.Fatal(err)
+		}
+	}
+	ds := &slowDAGService{DAGService: e.dserv, latency: 100 * time.Microsecond, gets: make(map[key.Key]int)}
+
+	for _, n := range []int{1, 16, 64} {
+		b.Run(fmt.Sprintf("workers-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, _, err := ColoredSet(ctx, e.pn, ds, nil, WithMarkConcurrency(n), WithNodeCacheSize(0))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("roots-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, _, err := ColoredSet(ctx, e.pn, ds, nil, WithMarkRootConcurrency(n), WithNodeCacheSize(0))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// queueWatch tracks how many marked nodes have not been fetched yet, which is
+// the length of the queue of a concurrent walk, and the most there ever were
+type queueWatch struct {
+	mu      sync.Mutex
+	waiting int
+	max     int
+}
+
+func (q *queueWatch) add(n int) {
+	q.mu.Lock()
+	q.waiting += n
+	if q.waiting > q.max {
+		q.max = q.waiting
+	}
+	q.mu.Unlock()
+}
+
+// queuedSet counts the marked nodes as waiting
+type queuedSet struct {
+	key.KeySet
+	q *queueWatch
+}
+
+func (s queuedSet) Add(k key.Key) {
+	s.q.add(1)
+	s.KeySet.Add(k)
+}
+
+// fetchedDAG counts the fetched nodes as no longer waiting
+type fetchedDAG struct {
+	dag.DAGService
+	q *queueWatch
+}
+
+func (ds fetchedDAG) Get(ctx context.Context, c *cid.Cid) (*dag.Node, error) {
+	ds.q.add(-1)
+	return ds.DAGService.Get(ctx, c)
+}
+
+// wideDirectory pins a directory-like node with n leaves
+func wideDirectory(t testing.TB, e *testEnv, n int) *dag.Node {
+	dir := dag.NodeWithData([]byte("dir"))
+	for i := 0; i < n; i++ {
+		if err := dir.AddNodeLink(fmt.Sprintf("entry-%d", i), e.addNode(t, fmt.Sprintf("leaf %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := e.dserv.Add(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.pn.Pin(context.Background(), dir, true); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestMarkQueueSize(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	dir := wideDirectory(t, e, 500)
+
+	// the queue holds fewer nodes than the directory has entries, and
+	// fewer than the workers
+	for _, workers := range []int{4, 16} {
+		q := &queueWatch{}
+		set := queuedSet{KeySet: key.NewKeySet(), q: q}
+		err := markDescendants(ctx, fetchedDAG{DAGService: e.dserv, q: q}, set, []*cid.Cid{dir.Cid()}, false, workers, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(set.Keys()); n != 501 {
+			t.Fatalf("expected 501 marked nodes, got %d", n)
+		}
+		// the workers each hold one node taken off the queue
+		if q.max > 8+workers {
+			t.Fatalf("%d nodes were waiting at once with a queue of 8", q.max)
+		}
+	}
+}
+
+// BenchmarkMarkWideDirectory marks a single directory with many entries, and
+// logs the peak heap in use while doing it
+func BenchmarkMarkWideDirectory(b *testing.B) {
+	e := newTestEnv()
+	dir := wideDirectory(b, e, 20000)
+
+	for _, size := range []int{0, 64} {
+		b.Run(fmt.Sprintf("queue-%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			var peak uint64
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				var ms runtime.MemStats
+				for {
+					runtime.ReadMemStats(&ms)
+					if ms.HeapInuse > peak {
+						peak = ms.HeapInuse
+					}
+					select {
+					case <-stop:
+						return
+					case <-time.After(time.Millisecond):
+					}
+				}
+			}()
+			for i := 0; i < b.N; i++ {
+				err := markDescendants(context.Background(), e.dserv, key.NewKeySet(), []*cid.Cid{dir.Cid()}, false, 16, size)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			close(stop)
+			<-done
+			b.Logf("peak heap in use: %d bytes", peak)
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package gc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+	pin "github.com/ipfs/go-ipfs/pin"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// ErrStaleMarkedSet is returned when a MarkedSet is passed to GC after the
+// pins it was built from have changed
+var ErrStaleMarkedSet = errors.New("gc: pins changed since the marked set was built")
+
+// MarkedSet holds the result of the mark phase: every block that must
+// survive garbage collection. It can be queried any number of times and
+// passed to several runs through WithMarkedSet, so that a dry run and the
+// real sweep share a single walk of the DAG.
+type MarkedSet struct {
+	set        *countingKeySet
+	pins       string
+	incomplete []IncompleteRoot
+	roots      MarkRoots
+
+	// protectors is only built with WithProtectorIndex
+	protectors protectorIndex
+}
+
+// BuildMarkedSet runs the mark phase and returns its result. The options
+// that affect the mark phase, like WithKeySetFactory and WithProgress, are
+// honoured. The caller should Close the set once done with it.
+func BuildMarkedSet(ctx context.Context, pn pin.Pinner, ds dag.DAGService, bestEffortRoots []*cid.Cid, opts ...GCOption) (*MarkedSet, error) {
+	o := newGCOptions(opts)
+	return buildMarkedSet(ctx, pn, ds, bestEffortRoots, o, newProgressReporter(o))
+}
+
+func buildMarkedSet(ctx context.Context, pn pin.Pinner, ds dag.DAGService, bestEffortRoots []*cid.Cid, o *gcOptions, p *progressReporter) (*MarkedSet, error) {
+	pn = o.pinsFor(pn)
+	if o.markPreCount {
+		start := time.Now()
+		n, err := countMarkNodes(ctx, pn, ds, bestEffortRoots, o)
+		if err != nil {
+			return nil, err
+		}
+		o.metrics.PhaseFinished(PhaseMarkCount, time.Since(start))
+		p.setMarkTotal(n)
+	}
+
+	set, err := o.newKeySet()
+	if err != nil {
+		return nil, err
+	}
+	m := &MarkedSet{
+		set:  &countingKeySet{KeySet: set, progress: p},
+		pins: pinsDigest(pn),
+	}
+	res, err := colorSet(ctx, pn, ds, m.set, bestEffortRoots, o)
+	m.incomplete = res.incomplete
+	m.roots = res.roots
+	if err == nil {
+		err = keySetErr(set)
+	}
+	if err == nil && o.protectorIndex {
+		m.protectors, err = buildProtectorIndex(ctx, pn, newNodeCache(ds, o.nodeCacheSize), bestEffortRoots, res.extraRoots, o.retain, o.bestEffortInternal)
+	}
+	if err != nil {
+		closeKeySet(set)
+		return nil, err
+	}
+	return m, nil
+}
+
+// Contains reports whether the block c was marked. A set created by
+// NewBloomKeySet may report blocks that weren't marked, never the opposite.
+func (m *MarkedSet) Contains(c *cid.Cid) bool {
+	return m.set.Has(key.Key(c.Hash()))
+}
+
+// Len returns the number of marked blocks
+func (m *MarkedSet) Len() int {
+	return m.set.Len()
+}
+
+// Keys returns the keys of the marked blocks. Sets that can't enumerate
+// their contents, like the bloom filter set, return nil.
+func (m *MarkedSet) Keys() []key.Key {
+	return m.set.Keys()
+}
+
+// IncompleteRoots returns the best-effort roots that could not be walked
+// completely
+func (m *MarkedSet) IncompleteRoots() []IncompleteRoot {
+	return m.incomplete
+}
+
+// Roots returns the roots the set was marked from. Sets passed in already
+// built don't know them, and return none; sets loaded from a checkpoint only
+// know the roots ResumeGC marked again, not the pins.
+func (m *MarkedSet) Roots() MarkRoots {
+	return m.roots
+}
+
+// Err returns the error recorded by the underlying set, if any
+func (m *MarkedSet) Err() error {
+	return keySetErr(m.set.KeySet)
+}
+
+// Close releases the resources held by the underlying set
+func (m *MarkedSet) Close() error {
+	if c, ok := m.set.KeySet.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// current returns ErrStaleMarkedSet if the pins of pn changed since m was
+// built
+func (m *MarkedSet) current(pn pin.Pinner) error {
+	pn = pinsOf(pn)
+	if pinsDigest(pn) != m.pins {
+		return ErrStaleMarkedSet
+	}
+	return nil
+}
+
+// covers returns ErrStaleMarkedSet if a pin of pn is not kept by m: a
+// recursive or internal pin that was not walked, or a direct pin that was
+// not marked. Pins removed since m was built don't matter.
+func (m *MarkedSet) covers(pn pin.Pinner, l *runLogger) error {
+	walked := make(map[key.Key]bool)
+	for _, cids := range [][]*cid.Cid{m.roots.Recursive, m.roots.Internal, m.roots.Extra} {
+		for _, c := range cids {
+			walked[key.Key(c.Hash())] = true
+		}
+	}
+	if m.roots.MFS != nil {
+		walked[key.Key(m.roots.MFS.Hash())] = true
+	}
+
+	for _, cids := range [][]*cid.Cid{pn.RecursiveKeys(), pn.InternalPins()} {
+		for _, c := range cids {
+			if !walked[key.Key(c.Hash())] {
+				l.Warningf("%s was pinned after marking", c)
+				return ErrStaleMarkedSet
+			}
+		}
+	}
+	for _, c := range pn.DirectKeys() {
+		if !m.Contains(c) {
+			l.Warningf("%s was pinned after marking", c)
+			return ErrStaleMarkedSet
+		}
+	}
+	return nil
+}
+
+// pinsDigest describes the pins of pn, so that a change to them can be
+// spotted later on
+func pinsDigest(pn pin.Pinner) string {
+	var parts []string
+	for _, cids := range [][]*cid.Cid{pn.RecursiveKeys(), pn.DirectKeys(), pn.InternalPins()} {
+		ks := make([]string, len(cids))
+		for i, c := range cids {
+			ks[i] = c.KeyString()
+		}
+		sort.Strings(ks)
+		parts = append(parts, fmt.Sprintf("%d:%s", len(ks), strings.Join(ks, "")))
+	}
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,203 @@
+package gc
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	pin "github.com/ipfs/go-ipfs/pin"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+func TestMarkedSetReuse(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	root, tree := buildTree(t, e, "pinned", 2, 2)
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+	garbage := e.addNode(t, "garbage")
+
+	m, err := BuildMarkedSet(ctx, e.pn, e.dserv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	for _, nd := range tree {
+		if !m.Contains(nd.Cid()) {
+			t.Fatal("pinned block was not marked")
+		}
+	}
+	if m.Contains(garbage.Cid()) {
+		t.Fatal("garbage block was marked")
+	}
+	if m.Len() != len(m.Keys()) || m.Len() < len(tree) {
+		t.Fatalf("unexpected marked set size %d", m.Len())
+	}
+
+	dry, err := GCDryRun(ctx, e.bs, e.pn, nil, WithMarkedSet(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates := drain(dry)
+
+	out, err := GCWith(ctx, e.bs, e.pn, nil, WithMarkedSet(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := drain(out)
+
+	sort.Sort(key.KeySlice(candidates))
+	sort.Sort(key.KeySlice(removed))
+	if len(removed) != 1 || removed[0] != garbage.Key() || len(candidates) != 1 || candidates[0] != removed[0] {
+		t.Fatalf("dry run reported %v, sweep removed %v", candidates, removed)
+	}
+	if !m.Contains(root.Cid()) {
+		t.Fatal("marked set was closed by GC")
+	}
+}
+
+func TestMarkedSetStale(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	m, err := BuildMarkedSet(ctx, e.pn, e.dserv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	nd := e.addNode(t, "pinned later")
+	if err := e.pn.Pin(ctx, nd, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GCDryRun(ctx, e.bs, e.pn, nil, WithMarkedSet(m)); err != ErrStaleMarkedSet {
+		t.Fatalf("expected ErrStaleMarkedSet, got %v", err)
+	}
+}
+
+func TestOnMark(t *testing.T) {
+	ctx := context.Background()
+	e, bestEffort := sharedEnv(t, 5)
+
+	for _, n := range []int{1, 4} {
+		var mu sync.Mutex
+		calls := make(map[key.Key]int)
+		onMark := WithOnMark(func(k key.Key) {
+			mu.Lock()
+			calls[k]++
+			mu.Unlock()
+		})
+
+		set, _, err := ColoredSet(ctx, e.pn, e.dserv, bestEffort, onMark, WithMarkConcurrency(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := set.Keys()
+		if len(calls) != len(keys) {
+			t.Fatalf("concurrency %d: expected a call for each of %d keys, got %d", n, len(keys), len(calls))
+		}
+		for _, k := range keys {
+			if calls[k] != 1 {
+				t.Fatalf("concurrency %d: %s reported %d times", n, k, calls[k])
+			}
+		}
+	}
+}
+
+// latePinner reports an extra pin once the mark phase is over, like a pin
+// made without taking the pin lock. It learns of the end of the phase as the
+// Metrics of the run.
+type latePinner struct {
+	pin.Pinner
+	NopMetrics
+	recursive, direct *cid.Cid
+
+	mu     sync.Mutex
+	marked bool
+}
+
+func (p *latePinner) PhaseFinished(phase GCPhase, d time.Duration) {
+	if phase == PhaseMark {
+		p.mu.Lock()
+		p.marked = true
+		p.mu.Unlock()
+	}
+}
+
+func (p *latePinner) late(pins []*cid.Cid, c *cid.Cid) []*cid.Cid {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.marked && c != nil {
+		pins = append(pins, c)
+	}
+	return pins
+}
+
+func (p *latePinner) RecursiveKeys() []*cid.Cid {
+	return p.late(p.Pinner.RecursiveKeys(), p.recursive)
+}
+
+func (p *latePinner) DirectKeys() []*cid.Cid {
+	return p.late(p.Pinner.DirectKeys(), p.direct)
+}
+
+func TestGCStaleCheck(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	pinned := e.addNode(t, "pinned")
+	if err := e.pn.Pin(ctx, pinned, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, recursive := range []bool{true, false} {
+		late := e.addNode(t, "late")
+		pn := &latePinner{Pinner: e.pn}
+		if recursive {
+			pn.recursive = late.Cid()
+		} else {
+			pn.direct = late.Cid()
+		}
+
+		_, err := RunGC(ctx, e.bs, pn, nil, WithStaleCheck(true), WithMetrics(pn))
+		if err != ErrStaleMarkedSet {
+			t.Fatalf("expected ErrStaleMarkedSet, got %v", err)
+		}
+		if !e.has(t, late) {
+			t.Fatal("block pinned during marking was removed")
+		}
+
+		// without the check the late pin is lost
+		pn = &latePinner{Pinner: e.pn, recursive: pn.recursive, direct: pn.direct}
+		if _, err := RunGC(ctx, e.bs, pn, nil, WithMetrics(pn)); err != nil {
+			t.Fatal(err)
+		}
+		if e.has(t, late) {
+			t.Fatal("expected the late pin to go unnoticed without the check")
+		}
+	}
+
+	// pins removed while marking don't fail the check
+	unpinned := e.addNode(t, "unpinned")
+	if err := e.pn.Pin(ctx, unpinned, true); err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildMarkedSet(ctx, e.pn, e.dserv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if err := e.pn.Unpin(ctx, unpinned.Cid(), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.covers(e.pn, newRunLogger(nil)); err != nil {
+		t.Fatalf("unexpected error after an unpin: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package gc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	mh "gx/ipfs/QmYf7ng2hG5XBtJA3tN34DQ2GUN5HNksEw1rLDkmr6vGku/go-multihash"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+)
+
+// markedSetMagic starts every marked set written by WriteMarkedSet, and is
+// followed by the version of the format
+const markedSetMagic = "ipfs-gc-marked\n"
+
+// markedSetVersion is the version of the format written by WriteMarkedSet.
+// Version 1 is the header followed by every key as a uvarint length and the
+// bytes of its multihash, up to the end of the stream.
+const markedSetVersion = 1
+
+// maxMarkedKeyLen is the longest key ReadMarkedSet accepts, so that a corrupt
+// length doesn't make it allocate without bound
+const maxMarkedKeyLen = 1 << 10
+
+// ErrBadMarkedSet is returned by ReadMarkedSet for data that wasn't written
+// by WriteMarkedSet
+var ErrBadMarkedSet = errors.New("gc: not a marked set")
+
+// WriteMarkedSet writes the keys of s to w in a compact format that
+// ReadMarkedSet reads back, so that a marked set can be inspected or kept
+// for a later Sweep. Keys are written one at a time as they are listed. Sets
+// that can't list their keys, like the bloom filter set, give
+// ErrProbabilisticSet.
+func WriteMarkedSet(w io.Writer, s key.KeySet) error {
+	keys, err := exactKeys(s)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(markedSetMagic); err != nil {
+		return err
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, markedSetVersion)
+	if _, err := bw.Write(buf[:n]); err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		n := binary.PutUvarint(buf, uint64(len(k)))
+		if _, err := bw.Write(buf[:n]); err != nil {
+			return err
+		}
+		if _, err := bw.WriteString(string(k)); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadMarkedSet reads a set written by WriteMarkedSet, one key at a time, into
+// a new in-memory set. Data in another format gives ErrBadMarkedSet, and a
+// later version of the format than this one knows gives an error saying so.
+func ReadMarkedSet(r io.Reader) (key.KeySet, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(markedSetMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != markedSetMagic {
+		return nil, ErrBadMarkedSet
+	}
+	version, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, ErrBadMarkedSet
+	}
+	if version != markedSetVersion {
+		return nil, fmt.Errorf("%s: unknown version %d", ErrBadMarkedSet, version)
+	}
+
+	set := key.NewKeySet()
+	buf := make([]byte, maxMarkedKeyLen)
+	for {
+		n, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return set, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 || n > maxMarkedKeyLen {
+			return nil, fmt.Errorf("%s: bad key length %d", ErrBadMarkedSet, n)
+		}
+		if _, err := io.ReadFull(br, buf[:n]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if _, err := mh.Cast(buf[:n]); err != nil {
+			return nil, fmt.Errorf("%s: %s", ErrBadMarkedSet, err)
+		}
+		set.Add(key.Key(buf[:n]))
+	}
+}
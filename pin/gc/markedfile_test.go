@@ -0,0 +1,93 @@
+package gc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+)
+
+func TestMarkedSetRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	root, tree := buildTree(t, e, "pinned", 2, 3)
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+	garbage := e.addNode(t, "garbage")
+
+	marked, _, err := ColoredSet(ctx, e.pn, e.dserv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteMarkedSet(&buf, marked); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadMarkedSet(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read.Keys()) != len(marked.Keys()) {
+		t.Fatalf("expected %d keys, read %d", len(marked.Keys()), len(read.Keys()))
+	}
+	for _, k := range marked.Keys() {
+		if !read.Has(k) {
+			t.Fatalf("key %s was lost", k)
+		}
+	}
+
+	out, err := Sweep(ctx, e.bs, read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(drain(out)); n != 1 {
+		t.Fatalf("expected 1 removed block, got %d", n)
+	}
+	if e.has(t, garbage) {
+		t.Fatal("garbage block was not removed")
+	}
+	for _, nd := range tree {
+		if !e.has(t, nd) {
+			t.Fatal("marked block was removed")
+		}
+	}
+}
+
+func TestReadMarkedSetErrors(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteMarkedSet(&buf, keySetOf(string(dag.NodeWithData([]byte("a")).Key()))); err != nil {
+		t.Fatal(err)
+	}
+	valid := buf.Bytes()
+
+	if _, err := ReadMarkedSet(strings.NewReader("not a marked set")); err != ErrBadMarkedSet {
+		t.Fatalf("expected ErrBadMarkedSet, got %v", err)
+	}
+
+	future := append([]byte(markedSetMagic), 2)
+	if _, err := ReadMarkedSet(bytes.NewReader(future)); err == nil || !strings.Contains(err.Error(), "version 2") {
+		t.Fatalf("expected an unknown version error, got %v", err)
+	}
+
+	if _, err := ReadMarkedSet(bytes.NewReader(valid[:len(valid)-1])); err == nil {
+		t.Fatal("expected a truncated set to fail")
+	}
+
+	bad := append([]byte(markedSetMagic), markedSetVersion, 3, 'a', 'b', 'c')
+	if _, err := ReadMarkedSet(bytes.NewReader(bad)); err == nil {
+		t.Fatal("expected a key that isn't a multihash to fail")
+	}
+
+	bloom, err := NewBloomKeySet(10, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteMarkedSet(&buf, bloom); err != ErrProbabilisticSet {
+		t.Fatalf("expected ErrProbabilisticSet, got %v", err)
+	}
+}
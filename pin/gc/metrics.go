@@ -0,0 +1,29 @@
+package gc
+
+import (
+	"time"
+)
+
+// Metrics receives the counts of garbage collection runs, for callers that
+// export them to a metrics system. Its methods may be called from several
+// goroutines at once and must not block.
+type Metrics interface {
+	// BlockDeleted is called for every block removed, with its size in
+	// bytes, or -1 if the size is unknown
+	BlockDeleted(size int64)
+
+	// PhaseFinished is called at the end of the mark phase and of the
+	// sweep, with the time the phase took
+	PhaseFinished(phase GCPhase, d time.Duration)
+
+	// RunFinished is called once the sweep of a run is over, with the time
+	// the whole run took and its result
+	RunFinished(d time.Duration, res GCResult)
+}
+
+// NopMetrics is the Metrics used when none is given, it discards everything
+type NopMetrics struct{}
+
+func (NopMetrics) BlockDeleted(int64)                   {}
+func (NopMetrics) PhaseFinished(GCPhase, time.Duration) {}
+func (NopMetrics) RunFinished(time.Duration, GCResult)  {}
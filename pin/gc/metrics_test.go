@@ -0,0 +1,117 @@
+package gc
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+)
+
+// countingMetrics keeps the totals of the runs it is given
+type countingMetrics struct {
+	mu      sync.Mutex
+	deleted int
+	bytes   int64
+	phases  []GCPhase
+	runs    int
+	last    GCResult
+}
+
+func (m *countingMetrics) BlockDeleted(size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleted++
+	m.bytes += size
+}
+
+func (m *countingMetrics) PhaseFinished(phase GCPhase, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.phases = append(m.phases, phase)
+}
+
+func (m *countingMetrics) RunFinished(d time.Duration, res GCResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.runs++
+	m.last = res
+}
+
+func TestGCMetrics(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	pinned := e.addNode(t, "pinned")
+	if err := e.pn.Pin(ctx, pinned, false); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+
+	m := &countingMetrics{}
+	out, results, err := GCWithResult(ctx, e.bs, e.pn, nil, WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	res := <-results
+
+	if m.deleted != 5 || uint64(m.bytes) != res.BytesFreed {
+		t.Fatalf("expected 5 blocks and %d bytes, got %d blocks and %d bytes", res.BytesFreed, m.deleted, m.bytes)
+	}
+	if len(m.phases) != 2 || m.phases[0] != PhaseMark || m.phases[1] != PhaseSweep {
+		t.Fatalf("expected the mark and sweep phases, got %v", m.phases)
+	}
+	if m.runs != 1 || m.last.BlocksRemoved != 5 {
+		t.Fatalf("expected one run removing 5 blocks, got %d runs and %+v", m.runs, m.last)
+	}
+}
+
+// expvarMetrics keeps the GC totals in expvar counters. A daemon would
+// publish them with expvar.Publish under names like
+// go_ipfs_gc_blocks_deleted_total.
+type expvarMetrics struct {
+	deleted  expvar.Int
+	freed    expvar.Int
+	runs     expvar.Int
+	duration expvar.Float
+}
+
+func (m *expvarMetrics) BlockDeleted(size int64) {
+	m.deleted.Add(1)
+	if size > 0 {
+		m.freed.Add(size)
+	}
+}
+
+func (m *expvarMetrics) PhaseFinished(GCPhase, time.Duration) {}
+
+func (m *expvarMetrics) RunFinished(d time.Duration, res GCResult) {
+	m.runs.Add(1)
+	m.duration.Add(d.Seconds())
+}
+
+func ExampleWithMetrics() {
+	e := newTestEnv()
+	e.dserv.Add(dag.NodeWithData([]byte("garbage")))
+
+	metrics := &expvarMetrics{}
+	out, err := GCWith(context.Background(), e.bs, e.pn, nil, WithMetrics(metrics))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for range out {
+	}
+	fmt.Println("runs:", metrics.runs.String())
+	fmt.Println("blocks deleted:", metrics.deleted.String())
+	// Output:
+	// runs: 1
+	// blocks deleted: 1
+}
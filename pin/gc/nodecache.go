@@ -0,0 +1,47 @@
+package gc
+
+import (
+	dag "github.com/ipfs/go-ipfs/merkledag"
+
+	lru "gx/ipfs/QmVYxfoJQiZijTgPNHCHgHELvQpbsJNTg6Crmc3dQkj3yy/golang-lru"
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// DefaultNodeCacheSize is the number of DAG nodes kept around during the
+// mark phase
+const DefaultNodeCacheSize = 1024
+
+// nodeCache is a DAGService that keeps the most recently fetched nodes that
+// have links, so that the walks of the mark phase don't fetch a subgraph
+// shared by several roots over and over. Leaves are not cached, they hold
+// most of the data and there is nothing below them to walk.
+type nodeCache struct {
+	dag.DAGService
+	cache *lru.Cache
+}
+
+// newNodeCache wraps ds in a cache of the given size. A size of zero or less
+// returns ds unchanged.
+func newNodeCache(ds dag.DAGService, size int) dag.DAGService {
+	if size <= 0 {
+		return ds
+	}
+	cache, err := lru.New(size)
+	if err != nil {
+		log.Debugf("Error creating the node cache: %s", err)
+		return ds
+	}
+	return &nodeCache{DAGService: ds, cache: cache}
+}
+
+func (n *nodeCache) Get(ctx context.Context, c *cid.Cid) (*dag.Node, error) {
+	if nd, ok := n.cache.Get(c.KeyString()); ok {
+		return nd.(*dag.Node), nil
+	}
+	nd, err := n.DAGService.Get(ctx, c)
+	if err == nil && len(nd.Links) > 0 {
+		n.cache.Add(c.KeyString(), nd)
+	}
+	return nd, err
+}
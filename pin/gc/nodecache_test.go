@@ -0,0 +1,84 @@
+package gc
+
+import (
+	"fmt"
+	"testing"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// countingDAGService counts the nodes fetched through it
+type countingDAGService struct {
+	dag.DAGService
+	gets int
+}
+
+func (ds *countingDAGService) Get(ctx context.Context, c *cid.Cid) (*dag.Node, error) {
+	ds.gets++
+	return ds.DAGService.Get(ctx, c)
+}
+
+// sharedEnv pins n roots that all link to one shared subgraph, and returns a
+// best-effort root that links to it as well
+func sharedEnv(t testing.TB, n int) (*testEnv, []*cid.Cid) {
+	ctx := context.Background()
+	e := newTestEnv()
+	shared, _ := buildTree(t, e, "shared", 3, 4)
+	for i := 0; i < n; i++ {
+		root := e.addNode(t, fmt.Sprintf("root %d", i), shared)
+		if err := e.pn.Pin(ctx, root, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := e.addNode(t, "files", shared)
+	return e, []*cid.Cid{files.Cid()}
+}
+
+func TestNodeCacheSavesFetches(t *testing.T) {
+	ctx := context.Background()
+	e, bestEffort := sharedEnv(t, 5)
+	newBloom := WithKeySetFactory(func() (key.KeySet, error) {
+		return NewBloomKeySet(1000, 0.001)
+	})
+
+	gets := make(map[int]int)
+	for _, size := range []int{0, DefaultNodeCacheSize} {
+		ds := &countingDAGService{DAGService: e.dserv}
+		set, _, err := ColoredSet(ctx, e.pn, ds, bestEffort, newBloom, WithNodeCacheSize(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range e.pn.RecursiveKeys() {
+			if !set.Has(key.Key(k.Hash())) {
+				t.Fatal("pinned root was not marked")
+			}
+		}
+		gets[size] = ds.gets
+	}
+
+	if gets[DefaultNodeCacheSize] >= gets[0] {
+		t.Fatalf("expected the cache to save fetches, got %d with it and %d without", gets[DefaultNodeCacheSize], gets[0])
+	}
+}
+
+func BenchmarkMarkSharedSubgraph(b *testing.B) {
+	e, bestEffort := sharedEnv(b, 50)
+	newBloom := WithKeySetFactory(func() (key.KeySet, error) {
+		return NewBloomKeySet(10000, 0.001)
+	})
+
+	for _, size := range []int{0, DefaultNodeCacheSize} {
+		b.Run(fmt.Sprintf("cache-%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, _, err := ColoredSet(context.Background(), e.pn, e.dserv, bestEffort, newBloom, WithNodeCacheSize(size))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
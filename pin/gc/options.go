@@ -0,0 +1,860 @@
+package gc
+
+import (
+	"io"
+	"sort"
+	"time"
+
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+	exchange "github.com/ipfs/go-ipfs/exchange"
+	dag "github.com/ipfs/go-ipfs/merkledag"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	ds "gx/ipfs/QmbzuUusHqaLLoNTDEVLcSF6vZDHZDLPC7p4bztRvvkXxU/go-datastore"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// GCOption configures optional behaviour of a garbage collection run. The
+// entry points of the package take options last, GCWith being GC with
+// options, so new behaviour comes as a new With function and the signatures
+// stay as they are. Options apply in order, a later one overriding an
+// earlier one that sets the same thing, and a run given none behaves like
+// the plain mark and sweep.
+type GCOption func(*gcOptions)
+
+// DefaultDeleteBatchSize is the number of blocks deleted at once when the
+// blockstore supports batched deletes
+const DefaultDeleteBatchSize = 128
+
+type gcOptions struct {
+	// newKeySet creates the set used to hold the marked keys
+	newKeySet func() (key.KeySet, error)
+
+	// extraRoots gives roots to mark besides the pins, if set
+	extraRoots func(context.Context) ([]*cid.Cid, error)
+	// carRoots is a CAR file whose header roots are marked like extra roots
+	carRoots io.Reader
+
+	// mfsRoot is the root of the mutable filesystem, if set
+	mfsRoot *cid.Cid
+
+	// onMark is called with every newly marked key, if set
+	onMark func(key.Key)
+
+	// markConcurrency is the number of nodes fetched at once while marking
+	markConcurrency int
+	// markRootConcurrency is the number of roots walked at once while
+	// marking, when markConcurrency doesn't spread the nodes already
+	markRootConcurrency int
+	// markQueueSize bounds the nodes waiting to be fetched by concurrent
+	// marking, zero leaves it unbounded
+	markQueueSize int
+
+	// prefetchWindow is the number of DAG nodes fetched ahead of the walk
+	prefetchWindow int
+
+	// fetchMissing fetches the blocks missing during marking, if set, each
+	// within fetchTimeout
+	fetchMissing exchange.Interface
+	fetchTimeout time.Duration
+
+	// dagService, if set, is used to read nodes while marking instead of one
+	// built on the blockstore
+	dagService dag.DAGService
+
+	// logFields are added to every log line of the run
+	logFields map[string]interface{}
+	// log logs the lines of the run
+	log *runLogger
+
+	// maxVisitedNodes bounds the number of nodes read while marking
+	maxVisitedNodes int
+
+	// markGetTimeout bounds every read of a node while marking
+	markGetTimeout time.Duration
+
+	// nodeCacheSize is the number of DAG nodes cached during the mark phase
+	nodeCacheSize int
+
+	// marked replaces the mark phase with a set built beforehand
+	marked *MarkedSet
+
+	// deleteBatchSize is the maximum number of blocks deleted in one batch
+	deleteBatchSize int
+
+	// sweepConcurrency is the number of workers deleting blocks
+	sweepConcurrency int
+
+	// sizeWorkers is the number of workers looking up block sizes ahead of
+	// the sweep
+	sizeWorkers int
+
+	// deletionRate is the maximum number of blocks deleted per second, zero
+	// doesn't limit it
+	deletionRate int
+
+	// continueOnError keeps sweeping after a block fails to be removed
+	continueOnError bool
+
+	// errorSink is called with every error hit while sweeping
+	errorSink func(error)
+
+	// events receives the events of the run, if set
+	events chan<- GCEvent
+
+	// metrics receives the counts of the run
+	metrics Metrics
+
+	// targetBytes ends the sweep once that many bytes have been freed, zero
+	// sweeps everything
+	targetBytes uint64
+
+	// staleCheck checks that the marked set still covers the pins before
+	// sweeping
+	staleCheck bool
+
+	// maxDeletions ends the sweep once that many blocks have been removed,
+	// zero sweeps everything
+	maxDeletions int
+
+	// yieldEvery is the number of blocks the sweep looks at before giving
+	// up the GC lock for a moment, zero never yields
+	yieldEvery int
+	// yield is the GC lock of the run when it yields
+	yield *yieldingLock
+	// control pauses and resumes the sweep, if set
+	control <-chan GCControl
+	// singleWriter skips checking that the GC lock holds off pin locks
+	singleWriter bool
+
+	// keyPrefix limits the sweep to the keys starting with it, empty sweeps
+	// every key
+	keyPrefix string
+	// startCursor is where the key listing starts, for blockstores that
+	// take a cursor
+	startCursor string
+	// subtree limits the sweep to the blocks below it, if set
+	subtree *cid.Cid
+	// keySource gives the keys to sweep instead of the blockstore listing,
+	// if set
+	keySource <-chan key.Key
+	// unrepaired are the pins RepairAndGC could not complete, for the
+	// result
+	unrepaired []DanglingPin
+
+	// progress receives progress updates, if set
+	progress chan<- GCProgress
+	// progressTotal is the number of blocks reported as the total
+	progressTotal int64
+	// progressPreCount counts the blocks before sweeping when the total
+	// isn't known
+	progressPreCount bool
+	// markPreCount counts the nodes to mark before marking them
+	markPreCount bool
+	// bestEffortInternal walks the internal pins like best-effort roots
+	bestEffortInternal bool
+	// pinTypes are the kinds of pins marked, all of them if nil
+	pinTypes *pinTypes
+	// retain are blocks marked without walking their links
+	retain []*cid.Cid
+
+	// protect shields unmarked blocks from deletion
+	protect func(key.Key) bool
+	// onDelete is called after each block is removed, if set
+	onDelete func(key.Key) error
+	// approve is asked before each unmarked block is removed, if set
+	approve func(key.Key, int64) bool
+
+	// deletionOrder is the order unmarked blocks are removed in
+	deletionOrder DeletionOrder
+
+	// skipSweepIfClean skips the sweep when the blockstore holds no more
+	// blocks than were marked
+	skipSweepIfClean bool
+
+	// histogramBounds are the bounds of the size histogram of the removed
+	// blocks, nil if none is kept
+	histogramBounds []int64
+
+	// minBlockAge keeps unmarked blocks written less than that long ago
+	minBlockAge time.Duration
+
+	// pinRecheck marks pins made after the mark phase before deleting
+	pinRecheck bool
+
+	// outputBuffer is the buffer size of the output channel
+	outputBuffer int
+
+	// verify rehashes every block before deleting it
+	verify bool
+	// phantomKeys records the listed keys whose block can't be found
+	phantomKeys bool
+
+	// quarantine receives a copy of every block before it is deleted
+	quarantine bstore.Blockstore
+
+	// protectorIndex records the roots every marked block is reached from
+	protectorIndex bool
+
+	// checkpoint receives the marked set and the sweep cursor, if set
+	checkpoint ds.Datastore
+
+	// dryRun reports the keys that would be removed without deleting them
+	dryRun bool
+	// sizeDryRun looks up the size of the blocks reported by a dry run
+	sizeDryRun bool
+	// sizesUnused is set when the caller only reads the removed keys, so
+	// that sizes are only looked up when the run itself needs them
+	sizesUnused bool
+
+	// lockWait and markDuration are the times taken so far, for the result
+	lockWait     time.Duration
+	markDuration time.Duration
+}
+
+func newGCOptions(opts []GCOption) *gcOptions {
+	o := &gcOptions{
+		newKeySet: func() (key.KeySet, error) {
+			return key.NewKeySet(), nil
+		},
+		deleteBatchSize: DefaultDeleteBatchSize,
+		nodeCacheSize:   DefaultNodeCacheSize,
+		metrics:         NopMetrics{},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	o.log = newRunLogger(o.logFields)
+	return o
+}
+
+// WithKeySetFactory makes the mark phase store the marked keys in a set
+// created by newSet instead of the default in-memory key.KeySet. A new set
+// is requested for every run. If the set implements io.Closer, GC closes it
+// once the run is over; sets returned by ColoredSet are left for the caller
+// to close.
+func WithKeySetFactory(newSet func() (key.KeySet, error)) GCOption {
+	return func(o *gcOptions) {
+		o.newKeySet = newSet
+	}
+}
+
+// WithDeleteBatchSize sets the maximum number of blocks removed in a single
+// batch when the blockstore implements blockstore.BatchDeleter. Blockstores
+// that don't are always swept one block at a time. A size of 1 or less
+// disables batching. The size used is reported in GCResult.DeleteBatchSize.
+func WithDeleteBatchSize(n int) GCOption {
+	return func(o *gcOptions) {
+		o.deleteBatchSize = n
+	}
+}
+
+// WithCommitEvery makes the sweep commit its deletions to a batching
+// datastore every n removed blocks. Each batch is committed at once, so this
+// is WithDeleteBatchSize under the name of what it tunes: a smaller interval
+// bounds the deletions lost if the process dies mid-batch, a larger one
+// makes the sweep faster. The queued blocks are committed at the end of the
+// sweep and when it is cancelled, and the interval used is reported in
+// GCResult.DeleteBatchSize.
+func WithCommitEvery(n int) GCOption {
+	return WithDeleteBatchSize(n)
+}
+
+// WithSweepConcurrency makes the sweep phase delete blocks from n workers
+// reading from the blockstore's key channel. Removed keys are then sent on
+// the output channel in no particular order. The GC lock is held until every
+// worker is done. A value of 1 or less sweeps serially, which is the default.
+func WithSweepConcurrency(n int) GCOption {
+	return func(o *gcOptions) {
+		o.sweepConcurrency = n
+	}
+}
+
+// WithSizePrefetch makes the sweep look up the sizes of the blocks it is
+// about to remove with the given number of workers, ahead of the sweepers,
+// rather than one block at a time as it gets to them. This helps with
+// storage that is slow to answer but copes with several reads at once. It
+// only applies when the sweep reads the sizes: not for dry runs, except
+// EstimateReclaimable, nor when it reads the blocks themselves. Zero or less,
+// the default, disables it.
+func WithSizePrefetch(workers int) GCOption {
+	return func(o *gcOptions) {
+		o.sizeWorkers = workers
+	}
+}
+
+// WithDeletionRate limits the sweep to removing blocksPerSecond blocks per
+// second, so that a large collection doesn't starve other users of the disk.
+// The limit applies to the run as a whole, whatever the sweep concurrency,
+// and batches of deletions are made no larger than a second's worth. If the
+// context is cancelled while the sweep waits, the blocks it was waiting to
+// delete are kept; if its deadline passes, they are removed. A rate of zero
+// or less removes the limit, which is the default.
+func WithDeletionRate(blocksPerSecond int) GCOption {
+	return func(o *gcOptions) {
+		o.deletionRate = blocksPerSecond
+	}
+}
+
+// WithExtraRoots makes the mark phase keep the DAGs below the roots returned
+// by provider, like the MFS root or other roots the embedder tracks outside
+// the pinner. The provider is called once per run, after the recursive pins
+// are marked. Unlike best-effort roots, the extra roots must be complete: a
+// missing block fails the run with an *ErrPinIncomplete, and an error from
+// the provider fails it as well.
+func WithExtraRoots(provider func(ctx context.Context) ([]*cid.Cid, error)) GCOption {
+	return func(o *gcOptions) {
+		o.extraRoots = provider
+	}
+}
+
+// WithRootsFromCAR makes the mark phase keep the DAGs below the roots listed
+// in the header of the CAR file read from r, as kept by pinning services
+// that record their roots as a CAR manifest. Only the header is read; the
+// blocks in the file are ignored. The roots are treated like those of
+// WithExtraRoots: a missing block fails the run, and so does a header that
+// can't be read.
+func WithRootsFromCAR(r io.Reader) GCOption {
+	return func(o *gcOptions) {
+		o.carRoots = r
+	}
+}
+
+// WithMFSRoot makes the mark phase keep everything below root, the root of
+// the mutable filesystem, so that files only reachable from MFS survive.
+// The MFS DAG must be complete: a missing block fails the run with an
+// *ErrPinIncomplete instead of letting the rest of it be collected. An MFS
+// that links to content that was never fetched should be passed as a
+// best-effort root instead.
+func WithMFSRoot(root *cid.Cid) GCOption {
+	return func(o *gcOptions) {
+		o.mfsRoot = root
+	}
+}
+
+// WithPinTypes makes the mark phase honour only the kinds of pins that are
+// set, to find out what the others protect: a GC that ignores direct pins
+// removes the blocks only direct pins keep. It is meant for diagnosis, with
+// a dry run, as a real run removes pinned blocks for good and one without
+// internal pins loses the pinner's own state. Every run that leaves a kind
+// out logs a warning saying so. By default all three are honoured.
+func WithPinTypes(recursive, direct, internal bool) GCOption {
+	return func(o *gcOptions) {
+		o.pinTypes = &pinTypes{recursive: recursive, direct: direct, internal: internal}
+		if recursive && direct && internal {
+			o.pinTypes = nil
+		}
+	}
+}
+
+// WithRetainList marks the blocks of cids, so that GC never removes them,
+// as a cheaper alternative to WithProtectFunc for a list that is known in
+// advance. Only those exact blocks are kept, like direct pins, and not the
+// blocks they link to: roots to keep with their descendants are given as
+// best-effort roots or with WithExtraRoots. Blocks that are marked anyway
+// are only counted once. Each call replaces the list of the previous one.
+func WithRetainList(cids []*cid.Cid) GCOption {
+	return func(o *gcOptions) {
+		o.retain = cids
+	}
+}
+
+// WithOnMark calls onMark with every key added to the marked set, once per
+// key, while the mark phase runs. It is called from the walk itself, so it
+// must be cheap and must not block, or it holds up marking and with it the
+// GC lock. With WithMarkConcurrency it is called from several goroutines, but
+// never concurrently. A bloom filter set may mistake a new key for a marked
+// one, in which case onMark isn't called for it.
+func WithOnMark(onMark func(key.Key)) GCOption {
+	return func(o *gcOptions) {
+		o.onMark = onMark
+	}
+}
+
+// WithMarkConcurrency lets the mark phase fetch up to n DAG nodes at once,
+// which helps when fetching a node is slow, as with a datastore on the
+// network. The workers share one queue holding the roots as well as the
+// nodes found below them, so independent pins are walked in parallel too.
+// The marked set is only used under a lock, so a subgraph shared by several
+// roots is still walked once at most. Bloom filter sets are always marked
+// serially. A value of 1 or less marks serially, which is the default.
+func WithMarkConcurrency(n int) GCOption {
+	return func(o *gcOptions) {
+		o.markConcurrency = n
+	}
+}
+
+// WithMarkRootConcurrency makes the mark phase walk up to n pins and other
+// roots at once, each of them serially, which suits many small pins that
+// share little. The walks mark into one set under a lock, so a subgraph
+// reached from several roots is still walked once. WithMarkConcurrency, which
+// spreads the nodes of every root over its workers, takes precedence, and
+// best-effort roots and bloom filter sets are always walked one root at a
+// time. A value of 1 or less, the default, walks the roots one by one.
+func WithMarkRootConcurrency(n int) GCOption {
+	return func(o *gcOptions) {
+		o.markRootConcurrency = n
+	}
+}
+
+// WithMarkQueueSize bounds the queue of WithMarkConcurrency to n nodes. The
+// links of a node are queued as the workers make room for them, so a node
+// with more links than that, like a directory with millions of entries, is
+// walked a part at a time instead of having all of them queued at once. It
+// has no effect on serial marking, which only holds the path to the node
+// being read. A value of zero or less, the default, leaves the queue
+// unbounded.
+func WithMarkQueueSize(n int) GCOption {
+	return func(o *gcOptions) {
+		o.markQueueSize = n
+	}
+}
+
+// WithPrefetch makes the mark phase fetch the children of every node in
+// the background while the walk goes on, keeping up to window nodes fetched
+// ahead. This helps with storage that is slow to answer but copes with
+// several reads at once. A failed prefetch is ignored, the node is fetched
+// again when the walk reaches it. A window of zero or less, the default,
+// disables prefetching.
+func WithPrefetch(window int) GCOption {
+	return func(o *gcOptions) {
+		o.prefetchWindow = window
+	}
+}
+
+// WithFetchMissing makes the mark phase of GC fetch through ex the blocks of
+// pins and best-effort roots that aren't stored locally, instead of failing
+// with an *ErrPinIncomplete. Whether the fetched blocks are then stored
+// depends on the exchange; bitswap stores them. A block that can't be
+// fetched within timeout is treated as missing.
+//
+// GC holds the GC lock while it fetches, so adds are blocked for as long as
+// the fetches take. Without a timeout (zero or less) a single unreachable
+// block makes GC hang until its context is cancelled.
+func WithFetchMissing(ex exchange.Interface, timeout time.Duration) GCOption {
+	return func(o *gcOptions) {
+		o.fetchMissing = ex
+		o.fetchTimeout = timeout
+	}
+}
+
+// WithDAGService makes GC read the nodes it marks from ds rather than from a
+// DAG service it builds on the blockstore, so that a service with warm
+// caches or instrumentation can be reused. ds should read from the same
+// blockstore that is swept. It takes precedence over WithFetchMissing, whose
+// exchange is then not used; ds decides where missing blocks come from.
+func WithDAGService(ds dag.DAGService) GCOption {
+	return func(o *gcOptions) {
+		o.dagService = ds
+	}
+}
+
+// ContinueOnError makes the sweep carry on with the next block when a block
+// can't be removed, instead of ending the run. Every failure is recorded in
+// GCResult.Errors as a *SweepError holding the key of the block.
+func ContinueOnError() GCOption {
+	return func(o *gcOptions) {
+		o.continueOnError = true
+	}
+}
+
+// WithErrorSink makes GC call sink with every error hit while sweeping, as
+// soon as it happens. With WithSweepConcurrency, sink may be called from
+// several goroutines at once.
+func WithErrorSink(sink func(error)) GCOption {
+	return func(o *gcOptions) {
+		o.errorSink = sink
+	}
+}
+
+// WithEventSink makes GC send a GCEvent on ch at every step of the run, for
+// callers that feed their own telemetry. Unlike progress updates, events are
+// waited for until ch is ready or the context is done, so ch must be read
+// for as long as the run lasts, and buffering it keeps a slow reader from
+// holding up the sweep. ch is not closed by GC.
+func WithEventSink(ch chan<- GCEvent) GCOption {
+	return func(o *gcOptions) {
+		o.events = ch
+	}
+}
+
+// WithMetrics makes GC report the blocks it removes and the time its phases
+// take to m, as they happen. A nil m reports nothing.
+func WithMetrics(m Metrics) GCOption {
+	return func(o *gcOptions) {
+		if m == nil {
+			m = NopMetrics{}
+		}
+		o.metrics = m
+	}
+}
+
+// WithMarkedSet makes GC sweep against m instead of running the mark phase
+// again. GC fails with ErrStaleMarkedSet if the pins changed since m was
+// built. Blocks reachable only from best-effort roots that changed in the
+// meantime are not protected, so m should be built right before it is used.
+// m is not closed by GC.
+func WithMarkedSet(m *MarkedSet) GCOption {
+	return func(o *gcOptions) {
+		o.marked = m
+	}
+}
+
+// WithProgress makes GC send progress updates on ch during the run. Updates
+// are dropped rather than waited for when ch isn't ready, so a slow reader
+// never holds up GC, and ch should be buffered to see most of them. ch is
+// not closed by GC.
+func WithProgress(ch chan<- GCProgress) GCOption {
+	return func(o *gcOptions) {
+		o.progress = ch
+	}
+}
+
+// WithTotalBlocks sets the number of blocks in the blockstore, as reported
+// in the Total field of the progress updates, for datastores that keep a
+// count of their objects. Percent is then accurate without listing the keys
+// twice: the total given here is used even if WithProgressPreCount is set.
+func WithTotalBlocks(n int64) GCOption {
+	return func(o *gcOptions) {
+		o.progressTotal = n
+	}
+}
+
+// WithProgressTotal is WithTotalBlocks for a total held in an int
+func WithProgressTotal(n int) GCOption {
+	return WithTotalBlocks(int64(n))
+}
+
+// WithProgressPreCount makes GC count the blocks in the blockstore before the
+// sweep when no total was given, so that progress updates carry a total. This
+// lists all the keys one extra time.
+func WithProgressPreCount() GCOption {
+	return func(o *gcOptions) {
+		o.progressPreCount = true
+	}
+}
+
+// WithMarkPreCount makes the mark phase first count the nodes below the pins
+// and best-effort roots, so that progress updates carry a MarkTotal for the
+// mark phase as well. The count reads every node to mark one extra time,
+// which roughly doubles the cost of marking a large DAG; it is off by
+// default. Its time is reported to Metrics as PhaseMarkCount and is part of
+// GCResult.MarkDuration.
+func WithMarkPreCount() GCOption {
+	return func(o *gcOptions) {
+		o.markPreCount = true
+	}
+}
+
+// WithProtectFunc makes GC keep any unmarked block for which protect returns
+// true. It is only called for blocks that are not in the marked set, but that
+// is once per candidate, so it must be fast. With WithSweepConcurrency it may
+// be called from several goroutines at once.
+func WithProtectFunc(protect func(key.Key) bool) GCOption {
+	return func(o *gcOptions) {
+		o.protect = protect
+	}
+}
+
+// WithApprove makes the sweep ask approve before removing each unmarked
+// block, passing its size, or -1 if it can't be read. A block it refuses is
+// kept and counted in GCResult.RetainedByPolicy. Unlike WithProtectFunc it is
+// meant for confirming deletions by hand or against an audit policy: it is
+// called once per candidate, after the other checks, and the sweeper that
+// called it waits for the answer while the GC lock is held. With a sweep
+// concurrency above one it is called from several goroutines at once, and
+// must be safe for that. Dry runs don't call it.
+func WithApprove(approve func(k key.Key, size int64) bool) GCOption {
+	return func(o *gcOptions) {
+		o.approve = approve
+	}
+}
+
+// WithOnDelete makes the sweep call onDelete with the key of every block
+// once it is removed, before the key is sent on the output channel, so that
+// an index of the blocks kept elsewhere can be updated in step. A failure is
+// reported as an *OnDeleteError and stops the run, unless ContinueOnError is
+// given; the rest of a batch already removed is still handed to the hook.
+// The sweeper waits for the hook while the GC lock is held, so a slow hook
+// slows the whole sweep down. With a sweep concurrency above one it is
+// called from several goroutines at once.
+func WithOnDelete(onDelete func(key.Key) error) GCOption {
+	return func(o *gcOptions) {
+		o.onDelete = onDelete
+	}
+}
+
+// WithNodeCacheSize sets how many DAG nodes with links are cached while
+// marking, so that subgraphs reachable from several roots are fetched once.
+// It defaults to DefaultNodeCacheSize. A size of zero or less disables the
+// cache.
+func WithNodeCacheSize(n int) GCOption {
+	return func(o *gcOptions) {
+		o.nodeCacheSize = n
+	}
+}
+
+// WithPinRecheck makes GC look for pins made since the mark phase started,
+// and mark them, before the sweep and again before every batch of deletions.
+//
+// GC holds the GC lock for the whole run, and code that adds blocks and then
+// pins them is expected to hold the pin lock while doing so, which keeps it
+// from running alongside GC. The recheck is for pinners that don't take the
+// pin lock. It narrows the window in which such a pin can lose blocks to the
+// deletion of a single batch, but can't close it, so a smaller
+// WithDeleteBatchSize gives more protection. Each recheck lists all the pins.
+func WithPinRecheck() GCOption {
+	return func(o *gcOptions) {
+		o.pinRecheck = true
+	}
+}
+
+// DeletionOrder is the order in which the sweep removes unmarked blocks
+type DeletionOrder int
+
+const (
+	// ListOrder removes blocks in the order the blockstore lists them
+	ListOrder DeletionOrder = iota
+	// LargestFirst removes the largest blocks first
+	LargestFirst
+)
+
+// WithDeletionOrder sets the order in which unmarked blocks are removed, so
+// that a sweep cut short has freed as much space as it could. LargestFirst
+// lists every key and reads the size of each unmarked block before removing
+// any, which holds all the candidates in memory. It needs a blockstore that
+// implements blockstore.Sizer, otherwise blocks are removed in list order.
+// GCToTarget always removes the largest blocks first.
+func WithDeletionOrder(order DeletionOrder) GCOption {
+	return func(o *gcOptions) {
+		o.deletionOrder = order
+	}
+}
+
+// WithSkipSweepIfClean makes GC skip the sweep when the blockstore holds no
+// more blocks than the mark phase marked, as then there's nothing to remove.
+// It needs a blockstore that implements blockstore.BlockCounter and has no
+// effect otherwise. The count has to be trustworthy: one that is too low, or
+// marked blocks that are missing from the blockstore, can make GC skip a
+// sweep that had garbage to remove. That garbage stays until a later run, no
+// block that should be kept is ever removed because of this. A skipped sweep
+// is reported in GCResult.SweepSkipped.
+func WithSkipSweepIfClean(enabled bool) GCOption {
+	return func(o *gcOptions) {
+		o.skipSweepIfClean = enabled
+	}
+}
+
+// WithMarkGetTimeout bounds the time the mark phase waits for each node it
+// reads, so that a stalled datastore can't hang GC. A node under a
+// best-effort root that takes longer is skipped like a missing one, leaving
+// the root incomplete, while one under a pin makes GC fail with
+// ErrMarkTimeout. A read that times out is left to finish in the background.
+func WithMarkGetTimeout(d time.Duration) GCOption {
+	return func(o *gcOptions) {
+		o.markGetTimeout = d
+	}
+}
+
+// WithBestEffortInternalPins makes the mark phase walk the internal pins,
+// the blocks the pinner keeps its own state in, like best-effort roots:
+// missing blocks below them are skipped with a warning and the pin is
+// reported in GCResult.IncompleteRoots, instead of GC failing with an
+// *ErrPinIncomplete. It is meant for recovering a damaged pinner: the
+// blocks only linked from below the missing ones are removed.
+func WithBestEffortInternalPins(enabled bool) GCOption {
+	return func(o *gcOptions) {
+		o.bestEffortInternal = enabled
+	}
+}
+
+// WithSizeHistogram makes GC count the blocks it removes by size, in
+// GCResult.SizeHistogram, with power-of-two buckets from 1 byte to 16MiB.
+func WithSizeHistogram(enabled bool) GCOption {
+	return func(o *gcOptions) {
+		o.histogramBounds = nil
+		if enabled {
+			o.histogramBounds = powerOfTwoBounds()
+		}
+	}
+}
+
+// WithSizeHistogramBounds is like WithSizeHistogram, with buckets bounded by
+// the given sizes in bytes instead
+func WithSizeHistogramBounds(bounds ...int64) GCOption {
+	return func(o *gcOptions) {
+		sorted := append([]int64{}, bounds...)
+		sort.Sort(int64s(sorted))
+		o.histogramBounds = sorted
+	}
+}
+
+// WithMinBlockAge makes GC keep unmarked blocks that were written less than
+// d ago, as they are likely about to be pinned or added again. The age of a
+// block is only known if the blockstore implements blockstore.Timestamper;
+// otherwise the option has no effect and a warning is logged. A block whose
+// write time can't be read is kept.
+func WithMinBlockAge(d time.Duration) GCOption {
+	return func(o *gcOptions) {
+		o.minBlockAge = d
+	}
+}
+
+// WithCooperativeYield makes the sweep give up the GC lock every everyN
+// blocks it looks at and take it again, so that adds waiting on the pin lock
+// can go through instead of waiting for the whole sweep. Pins made while the
+// lock was given up are marked before the sweep goes on, as with
+// WithPinRecheck, so blocks they reach are kept. The sweep runs serially and
+// takes longer in exchange for the lower latency of adds. Dry runs, which
+// don't hold the GC lock, never yield.
+func WithCooperativeYield(everyN int) GCOption {
+	return func(o *gcOptions) {
+		if everyN < 0 {
+			everyN = 0
+		}
+		o.yieldEvery = everyN
+	}
+}
+
+// WithSingleWriter, when enabled, skips the check that the pin lock of the
+// blockstore waits for its GC lock, and the warning given when it doesn't, for
+// embedders whose blockstore locks do nothing because nothing else writes to
+// it while GC runs.
+func WithSingleWriter(enabled bool) GCOption {
+	return func(o *gcOptions) {
+		o.singleWriter = enabled
+	}
+}
+
+// WithControl lets the sweep be paused and resumed by sending Pause and
+// Resume on control, for instance to make way for a more urgent request.
+// While paused no block is removed and the sweep keeps the GC lock, unless
+// it yields with WithCooperativeYield: then the blocks already queued are
+// deleted and the lock is given up for the pause, and the pins made in the
+// meantime are marked on resume. Cancelling the context ends a paused run
+// at once. The channel is only read while the sweep runs; closing it
+// resumes the sweep for good.
+func WithControl(control <-chan GCControl) GCOption {
+	return func(o *gcOptions) {
+		o.control = control
+	}
+}
+
+// WithOutputBuffer lets the sweep get up to n removed keys ahead of the
+// reader of the output channel. Once that many are waiting the sweep blocks
+// until they are read, no key is ever dropped. The output is unbuffered by
+// default.
+func WithOutputBuffer(n int) GCOption {
+	return func(o *gcOptions) {
+		if n < 0 {
+			n = 0
+		}
+		o.outputBuffer = n
+	}
+}
+
+// WithVerifyBeforeDelete makes GC read every block it is about to remove and
+// check that its data hashes to its key, with the hash function named in the
+// key. Blocks that don't match are left in place and reported as a
+// *SweepError wrapping ErrCorruptBlock, without ending the run. This reads
+// every garbage block in full, so it makes the sweep much slower.
+func WithVerifyBeforeDelete(enabled bool) GCOption {
+	return func(o *gcOptions) {
+		o.verify = enabled
+	}
+}
+
+// WithStartCursor starts the sweep after cursor in the key listing, as
+// returned in GCResult.Cursor by an earlier run, so that a store can be
+// collected a part at a time, for instance with WithMaxDeletions. It needs a
+// blockstore implementing blockstore.CursorKeyLister; with any other the
+// option is ignored, with a warning, and every key is swept. An empty cursor
+// starts from the first key.
+func WithStartCursor(cursor string) GCOption {
+	return func(o *gcOptions) {
+		o.startCursor = cursor
+	}
+}
+
+// WithPhantomKeys makes the sweep record in GCResult.PhantomKeys the keys
+// the blockstore lists but can't find the block of, which points at an index
+// out of step with the data. A key is found out when reading its block under
+// WithVerifyBeforeDelete or GCWithQuarantine fails, or when its deletion does,
+// with a not-found error. It is then only recorded, as neither a removed
+// block nor an error, and nothing is repaired.
+func WithPhantomKeys(enabled bool) GCOption {
+	return func(o *gcOptions) {
+		o.phantomKeys = enabled
+	}
+}
+
+// WithCheckpoint saves the marked set to store once the mark phase is done,
+// and every so often the last block removed by the sweep, so that a run that
+// is interrupted can be finished by ResumeGC without marking again. The
+// checkpoint is removed once the sweep completes without errors. Any
+// previous checkpoint in store is replaced. The marked set must be able to
+// list its keys, which the bloom filter set can't.
+func WithCheckpoint(store ds.Datastore) GCOption {
+	return func(o *gcOptions) {
+		o.checkpoint = store
+	}
+}
+
+// WithProtectorIndex makes BuildMarkedSet record, for every marked block,
+// the pins and best-effort roots it is reachable from, as returned by
+// MarkedSet.Protectors. The DAG below each root is walked on its own, so a
+// subgraph shared by many roots is walked many times, and the index holds
+// an entry for every marked block whatever the kind of set. A run given the
+// option also reports the blocks shared by several roots in
+// GCResult.SharedBlocks. It is off by default.
+func WithProtectorIndex(enabled bool) GCOption {
+	return func(o *gcOptions) {
+		o.protectorIndex = enabled
+	}
+}
+
+// WithMaxDeletions makes the sweep stop once it has removed n blocks, so
+// that a single run never churns through more than that. The rest of the
+// keys are still listed, without removing anything, to count the unmarked
+// blocks left in GCResult.RemainingBlocks, and the run ends with
+// ReasonLimited if there are any. Like GCToTarget the sweep then runs
+// serially. Zero or less, the default, sets no limit.
+func WithMaxDeletions(n int) GCOption {
+	return func(o *gcOptions) {
+		o.maxDeletions = n
+	}
+}
+
+// WithStaleCheck, when enabled, lists the pins again once marking is over
+// and refuses to sweep, failing with ErrStaleMarkedSet, if one of them is not
+// covered by the marked set. This guards against pins made without taking
+// the pin lock, which GC would otherwise not wait for. Pins removed in the
+// meantime don't fail the check. It costs a second listing of the pins, and
+// doesn't apply to sets passed with WithMarkedSet, which must match the pins
+// exactly anyway. WithPinRecheck marks late pins instead of refusing.
+func WithStaleCheck(enabled bool) GCOption {
+	return func(o *gcOptions) {
+		o.staleCheck = enabled
+	}
+}
+
+// WithMaxVisitedNodes makes the mark phase fail with ErrTraversalLimit once
+// it has read more than n nodes, bounding the work a crafted or corrupt DAG
+// can cause, for instance with WithFetchMissing. The count covers every walk
+// of the run, so n should comfortably exceed the size of everything pinned.
+// Zero or less, the default, sets no limit.
+func WithMaxVisitedNodes(n int) GCOption {
+	return func(o *gcOptions) {
+		o.maxVisitedNodes = n
+	}
+}
+
+// WithLogFields adds fields to every log line of the run, after its ID and
+// phase, such as the reason it was started. They are also sent along with
+// the event logged once the run is over.
+func WithLogFields(fields map[string]interface{}) GCOption {
+	return func(o *gcOptions) {
+		o.logFields = fields
+	}
+}
@@ -0,0 +1,130 @@
+package gc
+
+import (
+	"container/list"
+	"sync"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// prefetcher is a DAGService that starts fetching the children of every
+// node it returns, so that the walk finds them ready when it gets to them.
+// At most window nodes are fetched ahead; once the window is full the oldest
+// are dropped, as a depth-first walk needs the most recent ones first.
+//
+// A failed prefetch is never returned: the node is fetched again when it is
+// asked for, so errors, and missing blocks under best-effort roots, are seen
+// exactly as without prefetching.
+type prefetcher struct {
+	dag.DAGService
+	ctx    context.Context
+	window int
+
+	mu      sync.Mutex
+	pending map[string]*prefetch
+	order   *list.List
+}
+
+type prefetch struct {
+	done   chan struct{}
+	nd     *dag.Node
+	err    error
+	cancel context.CancelFunc
+	elem   *list.Element
+}
+
+// newPrefetcher wraps ds in a prefetcher with the given window, fetching in
+// the background until ctx is done. A window of zero or less returns ds
+// unchanged.
+func newPrefetcher(ctx context.Context, ds dag.DAGService, window int) dag.DAGService {
+	if window <= 0 {
+		return ds
+	}
+	return &prefetcher{
+		DAGService: ds,
+		ctx:        ctx,
+		window:     window,
+		pending:    make(map[string]*prefetch),
+		order:      list.New(),
+	}
+}
+
+func (p *prefetcher) Get(ctx context.Context, c *cid.Cid) (*dag.Node, error) {
+	nd, ok := p.take(ctx, c)
+	if !ok {
+		var err error
+		nd, err = p.DAGService.Get(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, lnk := range nd.Links {
+		p.start(cid.NewCidV0(lnk.Hash))
+	}
+	return nd, nil
+}
+
+// take returns the prefetched node for c, if it was prefetched successfully
+func (p *prefetcher) take(ctx context.Context, c *cid.Cid) (*dag.Node, bool) {
+	p.mu.Lock()
+	f, ok := p.pending[c.KeyString()]
+	if ok {
+		p.remove(c.KeyString(), f)
+	}
+	p.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	select {
+	case <-f.done:
+		return f.nd, f.err == nil
+	case <-ctx.Done():
+		f.cancel()
+		return nil, false
+	}
+}
+
+// start fetches c in the background, dropping the oldest prefetch if the
+// window is full
+func (p *prefetcher) start(c *cid.Cid) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	k := c.KeyString()
+	if _, ok := p.pending[k]; ok {
+		return
+	}
+	if p.ctx.Err() != nil {
+		return
+	}
+	if len(p.pending) >= p.window {
+		old := p.order.Front().Value.(string)
+		f := p.pending[old]
+		f.cancel()
+		p.remove(old, f)
+	}
+
+	ctx, cancel := context.WithCancel(p.ctx)
+	f := &prefetch{
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+	f.elem = p.order.PushBack(k)
+	p.pending[k] = f
+
+	go func() {
+		defer cancel()
+		f.nd, f.err = p.DAGService.Get(ctx, c)
+		close(f.done)
+	}()
+}
+
+func (p *prefetcher) remove(k string, f *prefetch) {
+	delete(p.pending, k)
+	p.order.Remove(f.elem)
+}
@@ -0,0 +1,61 @@
+package gc
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+)
+
+func TestPrefetch(t *testing.T) {
+	ctx := context.Background()
+	e, bestEffort := sharedEnv(t, 10)
+
+	missing := dag.NodeWithData([]byte("missing"))
+	broken := e.addNode(t, "broken", e.addNode(t, "present"), missing)
+	roots := append(bestEffort, broken.Cid())
+
+	serial, _, err := ColoredSet(ctx, e.pn, e.dserv, roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, window := range []int{1, 4, 64} {
+		ds := &slowDAGService{DAGService: e.dserv, gets: make(map[key.Key]int)}
+		set, incomplete, err := ColoredSet(ctx, e.pn, ds, roots, WithPrefetch(window))
+		if err != nil {
+			t.Fatalf("window %d: %s", window, err)
+		}
+		if len(set.Keys()) != len(serial.Keys()) {
+			t.Fatalf("window %d: expected %d marked keys, got %d", window, len(serial.Keys()), len(set.Keys()))
+		}
+		for _, k := range serial.Keys() {
+			if !set.Has(k) {
+				t.Fatalf("window %d: %s was not marked", window, k)
+			}
+		}
+		if len(incomplete) != 1 || !incomplete[0].Cid.Equals(broken.Cid()) {
+			t.Fatalf("window %d: expected the broken root to be incomplete, got %v", window, incomplete)
+		}
+	}
+}
+
+func BenchmarkPrefetch(b *testing.B) {
+	e, bestEffort := sharedEnv(b, 10)
+	ds := &slowDAGService{DAGService: e.dserv, latency: time.Millisecond, gets: make(map[key.Key]int)}
+
+	for _, window := range []int{0, 4, 64} {
+		b.Run(fmt.Sprintf("window-%d", window), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, _, err := ColoredSet(context.Background(), e.pn, ds, bestEffort, WithPrefetch(window))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
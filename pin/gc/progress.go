@@ -0,0 +1,255 @@
+package gc
+
+import (
+	"sync/atomic"
+	"time"
+
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+	dag "github.com/ipfs/go-ipfs/merkledag"
+	pin "github.com/ipfs/go-ipfs/pin"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// GCPhase is the phase a garbage collection run is in
+type GCPhase int
+
+const (
+	// PhaseMark is the walk of the pinned DAGs
+	PhaseMark GCPhase = iota
+	// PhaseSweep is the deletion of unmarked blocks
+	PhaseSweep
+	// PhaseMarkCount is the count of the nodes to mark made before the mark
+	// phase with WithMarkPreCount. It is only reported to Metrics, progress
+	// updates show it as part of the mark phase.
+	PhaseMarkCount
+)
+
+func (p GCPhase) String() string {
+	switch p {
+	case PhaseMark:
+		return "marking"
+	case PhaseSweep:
+		return "sweeping"
+	case PhaseMarkCount:
+		return "counting"
+	default:
+		return "unknown"
+	}
+}
+
+// GCProgress describes how far a garbage collection run has got
+type GCProgress struct {
+	Phase GCPhase
+	// Scanned is the number of blocks marked during the mark phase, and the
+	// number of blocks looked at during the sweep
+	Scanned int
+	// Deleted is the number of blocks removed so far
+	Deleted int
+	// Total is the number of blocks in the blockstore, or zero if unknown
+	Total int64
+	// MarkTotal is the number of nodes the mark phase is expected to mark,
+	// as counted with WithMarkPreCount, or zero if unknown
+	MarkTotal int
+	// DeletionRate is the number of blocks removed per second since the
+	// sweep started, which WithDeletionRate keeps below its limit
+	DeletionRate float64
+}
+
+// MarkPercent returns how much of the mark phase is done, or -1 if its total
+// is not known
+func (p GCProgress) MarkPercent() float64 {
+	if p.Phase != PhaseMark || p.MarkTotal <= 0 {
+		return -1
+	}
+	if p.Scanned >= p.MarkTotal {
+		return 100
+	}
+	return float64(p.Scanned) * 100 / float64(p.MarkTotal)
+}
+
+// Percent returns how much of the sweep is done, or -1 if the total is not
+// known
+func (p GCProgress) Percent() float64 {
+	if p.Phase != PhaseSweep || p.Total <= 0 {
+		return -1
+	}
+	if int64(p.Scanned) >= p.Total {
+		return 100
+	}
+	return float64(p.Scanned) * 100 / float64(p.Total)
+}
+
+// progressInterval is the number of blocks between two progress updates
+const progressInterval = 128
+
+// progressReporter sends progress updates without ever blocking the run. A
+// nil reporter discards them.
+type progressReporter struct {
+	ch        chan<- GCProgress
+	total     int64
+	markTotal int64
+
+	phase   int32
+	scanned int64
+	deleted int64
+
+	// sweepStart is when the sweep started, in Unix nanoseconds
+	sweepStart int64
+}
+
+func newProgressReporter(o *gcOptions) *progressReporter {
+	if o.progress == nil {
+		return nil
+	}
+	return &progressReporter{ch: o.progress, total: o.progressTotal}
+}
+
+func (p *progressReporter) send() {
+	u := GCProgress{
+		Phase:   GCPhase(atomic.LoadInt32(&p.phase)),
+		Scanned: int(atomic.LoadInt64(&p.scanned)),
+		Deleted: int(atomic.LoadInt64(&p.deleted)),
+		Total:   atomic.LoadInt64(&p.total),
+
+		MarkTotal: int(atomic.LoadInt64(&p.markTotal)),
+	}
+	if start := atomic.LoadInt64(&p.sweepStart); start != 0 {
+		if d := time.Since(time.Unix(0, start)); d > 0 {
+			u.DeletionRate = float64(u.Deleted) / d.Seconds()
+		}
+	}
+	select {
+	case p.ch <- u:
+	default:
+	}
+}
+
+// setMarkTotal records the number of nodes the mark phase will mark
+func (p *progressReporter) setMarkTotal(n int) {
+	if p == nil {
+		return
+	}
+	atomic.StoreInt64(&p.markTotal, int64(n))
+	p.send()
+}
+
+// marked records a newly marked block
+func (p *progressReporter) marked() {
+	if p == nil {
+		return
+	}
+	if atomic.AddInt64(&p.scanned, 1)%progressInterval == 0 {
+		p.send()
+	}
+}
+
+// startSweep reports the end of the mark phase and resets the counters for
+// the sweep. If the total is not known yet and countKeys is set, the blocks
+// under prefix are counted first.
+func (p *progressReporter) startSweep(ctx context.Context, bs bstore.Blockstore, prefix string, countKeys bool) {
+	if p == nil {
+		return
+	}
+	p.send()
+
+	if countKeys && p.total == 0 {
+		keys, _, err := bstore.AllKeysChanPrefix(ctx, bs, prefix)
+		if err != nil {
+			log.Debugf("Error counting blocks for progress: %s", err)
+		} else {
+			var n int64
+			for range keys {
+				n++
+			}
+			atomic.StoreInt64(&p.total, n)
+		}
+	}
+
+	atomic.StoreInt64(&p.scanned, 0)
+	atomic.StoreInt64(&p.sweepStart, time.Now().UnixNano())
+	atomic.StoreInt32(&p.phase, int32(PhaseSweep))
+	p.send()
+}
+
+// scannedKey records a block looked at by the sweep
+func (p *progressReporter) scannedKey() {
+	if p == nil {
+		return
+	}
+	if atomic.AddInt64(&p.scanned, 1)%progressInterval == 0 {
+		p.send()
+	}
+}
+
+// deletedKey records a removed block
+func (p *progressReporter) deletedKey() {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.deleted, 1)
+}
+
+// finish sends the last update of the run
+func (p *progressReporter) finish() {
+	if p == nil {
+		return
+	}
+	p.send()
+}
+
+// countMarkNodes counts the nodes below the pins and the best-effort roots
+// of pn, each once, by walking their links. Missing blocks below the
+// best-effort roots are skipped. The MFS root is counted, but the roots of
+// WithExtraRoots and WithRootsFromCAR are only read by the mark phase, and
+// are not.
+func countMarkNodes(ctx context.Context, pn pin.Pinner, ds dag.DAGService, bestEffortRoots []*cid.Cid, o *gcOptions) (int, error) {
+	seen := make(map[key.Key]struct{})
+	visit := func(c *cid.Cid) bool {
+		k := key.Key(c.Hash())
+		if _, ok := seen[k]; ok {
+			return false
+		}
+		seen[k] = struct{}{}
+		return true
+	}
+
+	var recursive []*cid.Cid
+	recursive = append(recursive, pn.RecursiveKeys()...)
+	if o.mfsRoot != nil {
+		recursive = append(recursive, o.mfsRoot)
+	}
+	for _, roots := range []struct {
+		cids       []*cid.Cid
+		bestEffort bool
+	}{
+		{recursive, false},
+		{pn.InternalPins(), o.bestEffortInternal},
+		{bestEffortRoots, true},
+	} {
+		for _, c := range roots.cids {
+			if !visit(c) {
+				continue
+			}
+			nd, err := ds.Get(ctx, c)
+			if err != nil {
+				if roots.bestEffort && err == dag.ErrNotFound {
+					continue
+				}
+				return 0, err
+			}
+			if err := dag.EnumerateChildren(ctx, ds, nd, visit, roots.bestEffort); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	for _, cids := range [][]*cid.Cid{pn.DirectKeys(), o.retain} {
+		for _, c := range cids {
+			visit(c)
+		}
+	}
+	return len(seen), nil
+}
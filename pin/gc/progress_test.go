@@ -0,0 +1,214 @@
+package gc
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+func TestGCProgress(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	root, tree := buildTree(t, e, "pinned", 2, 3)
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+	total := len(tree) + 300
+
+	progress := make(chan GCProgress, 100)
+	out, err := GCWith(ctx, e.bs, e.pn, nil, WithProgress(progress), WithProgressPreCount())
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	close(progress)
+
+	var updates []GCProgress
+	for u := range progress {
+		updates = append(updates, u)
+	}
+	if len(updates) == 0 || updates[0].Phase != PhaseMark {
+		t.Fatalf("expected a mark phase update first, got %v", updates)
+	}
+	last := updates[len(updates)-1]
+	if last.DeletionRate <= 0 {
+		t.Fatalf("expected a deletion rate, got %f", last.DeletionRate)
+	}
+	exp := GCProgress{Phase: PhaseSweep, Scanned: total, Deleted: 300, Total: int64(total), DeletionRate: last.DeletionRate}
+	if last != exp {
+		t.Fatalf("expected last update %+v, got %+v", exp, last)
+	}
+	if last.Percent() != 100 {
+		t.Fatalf("expected 100%%, got %f", last.Percent())
+	}
+}
+
+func TestGCProgressNeverBlocks(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	for i := 0; i < 300; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+
+	// nobody reads from the channel
+	out, err := GCWith(ctx, e.bs, e.pn, nil, WithProgress(make(chan GCProgress)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(drain(out)); n != 300 {
+		t.Fatalf("expected 300 removed blocks, got %d", n)
+	}
+}
+
+func TestGCMarkPreCount(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	root, tree := buildTree(t, e, "pinned", 2, 3)
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+	direct := e.addNode(t, "direct")
+	if err := e.pn.Pin(ctx, direct, false); err != nil {
+		t.Fatal(err)
+	}
+	// the best-effort root shares a node with the pin
+	bestEffort := e.addNode(t, "best effort", tree[1])
+	for i := 0; i < 10; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+
+	progress := make(chan GCProgress, 100)
+	metrics := &countingMetrics{}
+	m, err := BuildMarkedSet(ctx, e.pn, e.dserv, []*cid.Cid{bestEffort.Cid()},
+		WithProgress(progress), WithMarkPreCount(), WithMetrics(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	close(progress)
+
+	var marking []GCProgress
+	for u := range progress {
+		if u.Phase == PhaseMark {
+			marking = append(marking, u)
+		}
+	}
+	if len(marking) == 0 {
+		t.Fatal("expected mark phase updates")
+	}
+	for _, u := range marking {
+		if u.MarkTotal != m.Len() {
+			t.Fatalf("expected a mark total of %d, got %+v", m.Len(), u)
+		}
+	}
+	if p := marking[len(marking)-1].MarkPercent(); p < 0 {
+		t.Fatalf("expected a mark percentage, got %f", p)
+	}
+	if len(metrics.phases) == 0 || metrics.phases[0] != PhaseMarkCount {
+		t.Fatalf("expected the count reported to the metrics, got %v", metrics.phases)
+	}
+
+	// without the option the mark phase has no total
+	progress = make(chan GCProgress, 100)
+	plain, err := BuildMarkedSet(ctx, e.pn, e.dserv, nil, WithProgress(progress))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	close(progress)
+	for u := range progress {
+		if u.MarkTotal != 0 || u.MarkPercent() != -1 {
+			t.Fatalf("unexpected mark total without a pre-count: %+v", u)
+		}
+	}
+}
+
+// listCountingBlockstore counts how often its keys are listed
+type listCountingBlockstore struct {
+	bstore.GCBlockstore
+
+	mu sync.Mutex
+	n  int
+}
+
+func (bs *listCountingBlockstore) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
+	bs.mu.Lock()
+	bs.n++
+	bs.mu.Unlock()
+	return bs.GCBlockstore.AllKeysChan(ctx)
+}
+
+func (bs *listCountingBlockstore) listings() int {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.n
+}
+
+func TestGCProgressTotalBeatsPreCount(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	for i := 0; i < 10; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+	bs := &listCountingBlockstore{GCBlockstore: e.bs}
+
+	progress := make(chan GCProgress, 100)
+	out, err := GCWith(ctx, bs, e.pn, nil, WithProgress(progress), WithProgressPreCount(), WithProgressTotal(40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	close(progress)
+
+	for u := range progress {
+		if u.Total != 40 {
+			t.Fatalf("expected the given total in every update, got %+v", u)
+		}
+	}
+	if n := bs.listings(); n != 1 {
+		t.Fatalf("expected the keys listed once, got %d listings", n)
+	}
+}
+
+func TestGCTotalBlocks(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	e.addNode(t, "garbage")
+
+	// more blocks than an int32 holds
+	const total = int64(1) << 33
+	progress := make(chan GCProgress, 100)
+	out, err := GCWith(ctx, e.bs, e.pn, nil, WithProgress(progress), WithTotalBlocks(total))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	close(progress)
+
+	swept := false
+	for u := range progress {
+		if u.Total != total {
+			t.Fatalf("expected a total of %d in every update, got %+v", total, u)
+		}
+		if u.Phase == PhaseSweep {
+			swept = true
+			if p := u.Percent(); p < 0 || p >= 1 {
+				t.Fatalf("expected a small sweep percentage, got %f", p)
+			}
+		}
+	}
+	if !swept {
+		t.Fatal("no sweep progress")
+	}
+}
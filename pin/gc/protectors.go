@@ -0,0 +1,123 @@
+package gc
+
+import (
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+	dag "github.com/ipfs/go-ipfs/merkledag"
+	pin "github.com/ipfs/go-ipfs/pin"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// protectorIndex maps every marked key to the roots it was reached from
+type protectorIndex map[key.Key][]*cid.Cid
+
+// Protectors returns the pins and other roots from which k is
+// reachable, the roots in the set included. It returns nil for keys that
+// aren't marked, and for every key unless the set was built with
+// WithProtectorIndex.
+func (m *MarkedSet) Protectors(k key.Key) []*cid.Cid {
+	return m.protectors[k]
+}
+
+// SharedBlockStats describes the marked blocks that more than one root
+// reaches, which tells how much the pins deduplicate
+type SharedBlockStats struct {
+	// Blocks is the number of marked blocks reachable from two roots or more
+	Blocks int
+	// Bytes is the combined size of those blocks
+	Bytes uint64
+}
+
+// sharedStats counts the blocks of bs with more than one protector. A block
+// whose size can't be read is counted without its size.
+func (idx protectorIndex) sharedStats(bs bstore.Blockstore, l *runLogger) *SharedBlockStats {
+	stats := &SharedBlockStats{}
+	for k, roots := range idx {
+		if len(roots) < 2 {
+			continue
+		}
+		stats.Blocks++
+		n, err := blockSize(bs, k)
+		if err != nil {
+			l.Debugf("error reading size of shared block %s: %s", k, err)
+			continue
+		}
+		stats.Bytes += n
+	}
+	return stats
+}
+
+// buildProtectorIndex walks the DAG below every root separately, so that a
+// block shared by several roots is recorded for each of them. This costs a
+// walk of the whole shared subgraph for every root that reaches it. Direct
+// pins and retained blocks protect only themselves.
+//
+// The internal pins come last and, as in the mark phase, only reach the
+// blocks no other root did: the pin sets link to every pinned block, which
+// would otherwise make them protectors of everything. Each block below them
+// is recorded for the first internal pin that reaches it.
+func buildProtectorIndex(ctx context.Context, pn pin.Pinner, ds dag.DAGService, bestEffortRoots, extraRoots, retained []*cid.Cid, bestEffortInternal bool) (protectorIndex, error) {
+	idx := make(protectorIndex)
+	done := make(map[key.Key]struct{})
+	for _, roots := range []struct {
+		cids       []*cid.Cid
+		bestEffort bool
+		recursive  bool
+		internal   bool
+	}{
+		{pn.RecursiveKeys(), false, true, false},
+		{extraRoots, false, true, false},
+		{bestEffortRoots, true, true, false},
+		{pn.DirectKeys(), false, false, false},
+		{retained, false, false, false},
+		{pn.InternalPins(), bestEffortInternal, true, true},
+	} {
+		for _, root := range roots.cids {
+			rk := key.Key(root.Hash())
+			if _, ok := done[rk]; ok {
+				continue
+			}
+			done[rk] = struct{}{}
+			if _, ok := idx[rk]; ok && roots.internal {
+				continue
+			}
+
+			idx[rk] = append(idx[rk], root)
+			if !roots.recursive {
+				continue
+			}
+			if err := idx.walk(ctx, ds, root, roots.bestEffort, roots.internal); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return idx, nil
+}
+
+// walk records root as a protector of everything below it. With onlyNew it
+// doesn't go into the blocks already recorded.
+func (idx protectorIndex) walk(ctx context.Context, ds dag.DAGService, root *cid.Cid, bestEffort, onlyNew bool) error {
+	nd, err := ds.Get(ctx, root)
+	if err != nil {
+		if bestEffort && err == dag.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+
+	seen := map[key.Key]struct{}{key.Key(root.Hash()): {}}
+	return dag.EnumerateChildren(ctx, ds, nd, func(c *cid.Cid) bool {
+		k := key.Key(c.Hash())
+		if _, ok := seen[k]; ok {
+			return false
+		}
+		if _, ok := idx[k]; ok && onlyNew {
+			return false
+		}
+		seen[k] = struct{}{}
+		idx[k] = append(idx[k], root)
+		return true
+	}, bestEffort)
+}
@@ -0,0 +1,147 @@
+package gc
+
+import (
+	"testing"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+func sameCids(a, b []*cid.Cid) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, c := range a {
+		found := false
+		for _, d := range b {
+			if c.Equals(d) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMarkedSetProtectors(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	// a diamond: top links to left and right, which both link to bottom
+	bottom := e.addNode(t, "bottom")
+	left := e.addNode(t, "left", bottom)
+	right := e.addNode(t, "right", bottom)
+	top := e.addNode(t, "top", left, right)
+	directChild := e.addNode(t, "direct child")
+	direct := e.addNode(t, "direct", directChild)
+
+	if err := e.pn.Pin(ctx, left, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.pn.Pin(ctx, right, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.pn.Pin(ctx, direct, false); err != nil {
+		t.Fatal(err)
+	}
+	// the pin sets saved by Flush link to every pinned block
+	if err := e.pn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	roots := []*cid.Cid{top.Cid()}
+
+	m, err := BuildMarkedSet(ctx, e.pn, e.dserv, roots, WithProtectorIndex(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	for _, c := range []struct {
+		name string
+		k    *cid.Cid
+		exp  []*cid.Cid
+	}{
+		{"bottom", bottom.Cid(), []*cid.Cid{left.Cid(), right.Cid(), top.Cid()}},
+		{"left", left.Cid(), []*cid.Cid{left.Cid(), top.Cid()}},
+		{"top", top.Cid(), []*cid.Cid{top.Cid()}},
+		{"direct", direct.Cid(), []*cid.Cid{direct.Cid()}},
+		{"direct child", directChild.Cid(), nil},
+	} {
+		if got := m.Protectors(key.Key(c.k.Hash())); !sameCids(got, c.exp) {
+			t.Fatalf("expected %s to be protected by %v, got %v", c.name, c.exp, got)
+		}
+	}
+
+	plain, err := BuildMarkedSet(ctx, e.pn, e.dserv, roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if got := plain.Protectors(key.Key(bottom.Cid().Hash())); got != nil {
+		t.Fatalf("expected no index without WithProtectorIndex, got %v", got)
+	}
+}
+
+func TestGCResultSharedBlocks(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	// bottom is reached from both pins
+	bottom := e.addNode(t, "bottom")
+	left := e.addNode(t, "left", bottom)
+	right := e.addNode(t, "right", bottom)
+	e.addNode(t, "garbage")
+	for _, nd := range []*dag.Node{left, right} {
+		if err := e.pn.Pin(ctx, nd, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := RunGC(ctx, e.bs, e.pn, nil, WithProtectorIndex(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := blockSize(e.bs, bottom.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.SharedBlocks == nil || res.SharedBlocks.Blocks != 1 || res.SharedBlocks.Bytes != size {
+		t.Fatalf("expected the bottom block of %d bytes as shared, got %+v", size, res.SharedBlocks)
+	}
+
+	res, err = RunGC(ctx, e.bs, e.pn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.SharedBlocks != nil {
+		t.Fatalf("expected no shared block stats without the index, got %+v", res.SharedBlocks)
+	}
+}
+
+func TestGCResultSharedBlocksFlushed(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	root, _ := buildTree(t, e, "pinned", 2, 2)
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+	// the pin sets link to the pinned root, which a single pin doesn't
+	// make shared
+	if err := e.pn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := RunGC(ctx, e.bs, e.pn, nil, WithProtectorIndex(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.SharedBlocks == nil || res.SharedBlocks.Blocks != 0 {
+		t.Fatalf("expected no shared blocks with a single pin, got %+v", res.SharedBlocks)
+	}
+}
@@ -0,0 +1,110 @@
+package gc
+
+import (
+	"fmt"
+
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+	pin "github.com/ipfs/go-ipfs/pin"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// QuarantineError is reported for a block that was kept because it could not
+// be copied into the quarantine
+type QuarantineError struct {
+	Err error
+}
+
+func (e *QuarantineError) Error() string {
+	return fmt.Sprintf("copying block to quarantine: %s", e.Err)
+}
+
+// GCWithQuarantine works like GCWithResult, but every block is written to
+// quarantine before it is deleted from bs, so that an unwanted collection
+// can be undone with RestoreQuarantine. A block is only deleted once its
+// copy has been stored; if storing it fails, the block is kept and a
+// *SweepError wrapping a *QuarantineError is reported.
+//
+// The quarantine should be a separate blockstore, or at least one that bs
+// does not list, or the quarantined blocks would be collected again.
+func GCWithQuarantine(ctx context.Context, bs bstore.GCBlockstore, quarantine bstore.Blockstore, pn pin.Pinner, bestEffortRoots []*cid.Cid, opts ...GCOption) (<-chan key.Key, <-chan GCResult, error) {
+	o := newGCOptions(opts)
+	o.quarantine = quarantine
+	unlocker, err := gcLock(bs, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	deletions, results, err := runGC(ctx, bs, unlocker, pn, bestEffortRoots, o)
+	return keysOf(ctx, deletions, results, err)
+}
+
+// PurgeQuarantine permanently deletes every block in quarantine and returns
+// how many were removed.
+func PurgeQuarantine(ctx context.Context, quarantine bstore.Blockstore) (int, error) {
+	keys, err := quarantineKeys(ctx, quarantine)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, k := range keys {
+		if err := quarantine.DeleteBlock(k); err != nil && err != bstore.ErrNotFound {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// RestoreQuarantine moves every block in quarantine back into bs and returns
+// how many were restored. A block is only removed from the quarantine once
+// it has been written to bs. Restored blocks are not pinned, so they are
+// collected again by the next GC unless they are pinned first.
+func RestoreQuarantine(ctx context.Context, quarantine, bs bstore.Blockstore) (int, error) {
+	keys, err := quarantineKeys(ctx, quarantine)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, k := range keys {
+		blk, err := quarantine.Get(k)
+		if err == bstore.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		if err := bs.Put(blk); err != nil {
+			return n, err
+		}
+		if err := quarantine.DeleteBlock(k); err != nil && err != bstore.ErrNotFound {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// quarantineKeys lists the keys in quarantine up front, so that the
+// quarantine isn't modified while it is being listed
+func quarantineKeys(ctx context.Context, quarantine bstore.Blockstore) ([]key.Key, error) {
+	keychan, keysErr, err := bstore.AllKeysChanErr(ctx, quarantine)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []key.Key
+	for k := range keychan {
+		keys = append(keys, k)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := keysErr(); err != nil {
+		return nil, fmt.Errorf("listing quarantined blocks: %s", err)
+	}
+	return keys, nil
+}
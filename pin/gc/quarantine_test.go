@@ -0,0 +1,120 @@
+package gc
+
+import (
+	"testing"
+
+	blocks "github.com/ipfs/go-ipfs/blocks"
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+	dag "github.com/ipfs/go-ipfs/merkledag"
+	gctest "github.com/ipfs/go-ipfs/pin/gc/gctest"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+)
+
+// failingPutBlockstore refuses to store any block
+type failingPutBlockstore struct {
+	bstore.Blockstore
+}
+
+func (bs failingPutBlockstore) Put(blocks.Block) error {
+	return errDeleteFailed
+}
+
+func TestGCWithQuarantine(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	q := gctest.NewMemBlockstore()
+
+	pinned := e.addNode(t, "pinned")
+	garbage := []*dag.Node{e.addNode(t, "garbage 1"), e.addNode(t, "garbage 2")}
+	if err := e.pn.Pin(ctx, pinned, true); err != nil {
+		t.Fatal(err)
+	}
+
+	out, results, err := GCWithQuarantine(ctx, e.bs, q, e.pn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(drain(out)); n != 2 {
+		t.Fatalf("expected 2 removed blocks, got %d", n)
+	}
+	if err := (<-results).Err(); err != nil {
+		t.Fatal(err)
+	}
+	for _, nd := range garbage {
+		if e.has(t, nd) {
+			t.Fatal("garbage block was not removed")
+		}
+		if has, _ := q.Has(nd.Key()); !has {
+			t.Fatal("removed block is not in quarantine")
+		}
+	}
+	if has, _ := q.Has(pinned.Key()); has {
+		t.Fatal("pinned block was quarantined")
+	}
+
+	n, err := RestoreQuarantine(ctx, q, e.bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 restored blocks, got %d", n)
+	}
+	for _, nd := range garbage {
+		if !e.has(t, nd) {
+			t.Fatal("block was not restored")
+		}
+		if has, _ := q.Has(nd.Key()); has {
+			t.Fatal("restored block is still in quarantine")
+		}
+	}
+
+	out, _, err = GCWithQuarantine(ctx, e.bs, q, e.pn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+
+	n, err = PurgeQuarantine(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 purged blocks, got %d", n)
+	}
+	keys, err := q.AllKeysChan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left := drain(keys); len(left) != 0 {
+		t.Fatalf("quarantine still holds %d blocks", len(left))
+	}
+}
+
+func TestGCWithQuarantineKeepsBlocksOnFailure(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	nd := e.addNode(t, "garbage")
+
+	out, results, err := GCWithQuarantine(ctx, e.bs, failingPutBlockstore{gctest.NewMemBlockstore()}, e.pn, nil, ContinueOnError())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(drain(out)); n != 0 {
+		t.Fatalf("expected no removed blocks, got %d", n)
+	}
+	res := <-results
+	if len(res.Errors) != 1 {
+		t.Fatalf("expected one error, got %v", res.Errors)
+	}
+	serr, ok := res.Errors[0].(*SweepError)
+	if !ok || serr.Key != nd.Key() {
+		t.Fatalf("unexpected error: %v", res.Errors[0])
+	}
+	if _, ok := serr.Err.(*QuarantineError); !ok {
+		t.Fatalf("expected a quarantine error, got %v", serr.Err)
+	}
+	if !e.has(t, nd) {
+		t.Fatal("block was removed although it wasn't quarantined")
+	}
+}
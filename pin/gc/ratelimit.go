@@ -0,0 +1,57 @@
+package gc
+
+import (
+	"sync"
+	"time"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+)
+
+// tokenBucket limits how many blocks are deleted per second. It holds at
+// most one token, so deletions are spread out evenly rather than bunched up
+// at the start of every second. A nil bucket doesn't limit anything.
+type tokenBucket struct {
+	mu       sync.Mutex
+	interval time.Duration
+	// next is when the next token becomes available
+	next time.Time
+}
+
+func newTokenBucket(perSecond int) *tokenBucket {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &tokenBucket{interval: time.Second / time.Duration(perSecond)}
+}
+
+// wait blocks until n tokens have been taken, or ctx is done while waiting. The tokens are
+// reserved before waiting, so concurrent callers queue up behind each other.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	if b == nil || n <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	if b.next.Before(now) {
+		b.next = now
+	}
+	// the first token is available at next, each further one an interval
+	// later
+	at := b.next.Add(time.Duration(n-1) * b.interval)
+	b.next = at.Add(b.interval)
+	b.mu.Unlock()
+
+	d := at.Sub(now)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,64 @@
+package gc
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+)
+
+func TestGCDeletionRate(t *testing.T) {
+	e := newTestEnv()
+	for i := 0; i < 11; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+
+	progress := make(chan GCProgress, 16)
+	start := time.Now()
+	out, err := GCWith(context.Background(), e.bs, e.pn, nil, WithDeletionRate(50), WithProgress(progress))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(drain(out)); n != 11 {
+		t.Fatalf("expected 11 removed blocks, got %d", n)
+	}
+
+	// the first block goes straight away, the other ten 20ms apart
+	if d := time.Since(start); d < 180*time.Millisecond {
+		t.Fatalf("sweep took %s, expected at least 200ms", d)
+	}
+	close(progress)
+	var last GCProgress
+	for u := range progress {
+		last = u
+	}
+	if last.DeletionRate <= 0 || last.DeletionRate > 60 {
+		t.Fatalf("unexpected deletion rate %f", last.DeletionRate)
+	}
+}
+
+func TestGCDeletionRateCancel(t *testing.T) {
+	e := newTestEnv()
+	for i := 0; i < 5; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	out, results, err := GCWithResult(ctx, e.bs, e.pn, nil, WithDeletionRate(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-out
+	cancel()
+
+	select {
+	case res := <-results:
+		if res.BlocksRemoved != 1 {
+			t.Fatalf("expected 1 removed block, got %d", res.BlocksRemoved)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("throttled sweep did not stop on cancel")
+	}
+	drain(out)
+}
@@ -0,0 +1,74 @@
+package gc
+
+import (
+	"sync"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+	pin "github.com/ipfs/go-ipfs/pin"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// pinRecheck folds pins made after the mark phase started into the marked
+// set
+type pinRecheck struct {
+	pn pin.Pinner
+	ds dag.DAGService
+
+	log       *runLogger
+	mu        sync.Mutex
+	recursive map[key.Key]bool
+	direct    map[key.Key]bool
+}
+
+// newPinRecheck remembers the current pins of pn, later calls to run mark
+// the pins added since
+func newPinRecheck(pn pin.Pinner, ds dag.DAGService, l *runLogger) *pinRecheck {
+	r := &pinRecheck{
+		pn:        pn,
+		ds:        ds,
+		log:       l,
+		recursive: make(map[key.Key]bool),
+		direct:    make(map[key.Key]bool),
+	}
+	newPins(r.recursive, pn.RecursiveKeys())
+	newPins(r.recursive, pn.InternalPins())
+	newPins(r.direct, pn.DirectKeys())
+	return r
+}
+
+// newPins returns the cids that are not in known, and adds them to it
+func newPins(known map[key.Key]bool, cids []*cid.Cid) []*cid.Cid {
+	var out []*cid.Cid
+	for _, c := range cids {
+		k := key.Key(c.Hash())
+		if !known[k] {
+			known[k] = true
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// run marks the pins added since the last run in gcs
+func (r *pinRecheck) run(ctx context.Context, gcs key.KeySet) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	recursive := newPins(r.recursive, r.pn.RecursiveKeys())
+	recursive = append(recursive, newPins(r.recursive, r.pn.InternalPins())...)
+	if len(recursive) > 0 {
+		r.log.Debugf("marking %d roots pinned since the mark phase", len(recursive))
+	}
+	err := Descendants(ctx, r.ds, gcs, recursive, false)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range newPins(r.direct, r.pn.DirectKeys()) {
+		gcs.Add(key.Key(c.Hash()))
+	}
+	return nil
+}
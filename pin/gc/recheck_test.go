@@ -0,0 +1,140 @@
+package gc
+
+import (
+	"fmt"
+	"testing"
+
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+)
+
+// racingPinBlockstore lists the blocks in last after all the others, and
+// pins root during the first batch of deletions, the way a pinner that
+// doesn't take the pin lock could
+type racingPinBlockstore struct {
+	bstore.GCBlockstore
+	last   map[key.Key]bool
+	pinned bool
+	pin    func()
+}
+
+func (bs *racingPinBlockstore) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
+	keys, err := bs.GCBlockstore.AllKeysChan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var first, last []key.Key
+	for k := range keys {
+		if bs.last[k] {
+			last = append(last, k)
+		} else {
+			first = append(first, k)
+		}
+	}
+	out := make(chan key.Key, len(first)+len(last))
+	for _, k := range append(first, last...) {
+		out <- k
+	}
+	close(out)
+	return out, nil
+}
+
+func (bs *racingPinBlockstore) DeleteBlocks(ks []key.Key) error {
+	if !bs.pinned {
+		bs.pinned = true
+		bs.pin()
+	}
+	return bs.GCBlockstore.(bstore.BatchDeleter).DeleteBlocks(ks)
+}
+
+func TestGCPinRecheck(t *testing.T) {
+	ctx := context.Background()
+
+	for _, recheck := range []bool{false, true} {
+		e := newTestEnv()
+		for i := 0; i < 100; i++ {
+			e.addNode(t, fmt.Sprintf("garbage %d", i))
+		}
+		child := e.addNode(t, "child")
+		root := e.addNode(t, "root", child)
+
+		bs := &racingPinBlockstore{
+			GCBlockstore: e.bs,
+			last:         map[key.Key]bool{root.Key(): true, child.Key(): true},
+			pin: func() {
+				if err := e.pn.Pin(ctx, root, true); err != nil {
+					t.Fatal(err)
+				}
+			},
+		}
+		opts := []GCOption{WithDeleteBatchSize(16)}
+		if recheck {
+			opts = append(opts, WithPinRecheck())
+		}
+		out, results, err := GCWithResult(ctx, bs, e.pn, nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		drain(out)
+		res := <-results
+
+		kept := e.has(t, root) && e.has(t, child)
+		if recheck && !kept {
+			t.Fatal("blocks pinned during the sweep were removed")
+		}
+		if !recheck && kept {
+			t.Fatal("expected the late pin to be missed without a recheck")
+		}
+		if recheck && res.BlocksRemoved != 100 {
+			t.Fatalf("expected 100 removed blocks, got %d", res.BlocksRemoved)
+		}
+	}
+}
+
+func TestGCPinRecheckFalsePositives(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	for i := 0; i < 100; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+	root, pinned := buildTree(t, e, "late", 2, 3)
+
+	last := make(map[key.Key]bool)
+	for _, nd := range pinned {
+		last[nd.Key()] = true
+	}
+	bs := &racingPinBlockstore{
+		GCBlockstore: e.bs,
+		last:         last,
+		pin: func() {
+			if err := e.pn.Pin(ctx, root, true); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+	// the children of the late root look marked already, so a recheck that
+	// prunes on Has would skip everything below them
+	fp := make(map[key.Key]bool)
+	for _, lnk := range root.Links {
+		fp[key.Key(lnk.Hash)] = true
+	}
+	keySet := func() (key.KeySet, error) {
+		return &falsePositiveSet{KeySet: key.NewKeySet(), fp: fp}, nil
+	}
+
+	out, results, err := GCWithResult(ctx, bs, e.pn, nil, WithDeleteBatchSize(16), WithPinRecheck(), WithKeySetFactory(keySet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	if res := <-results; len(res.Errors) != 0 {
+		t.Fatalf("unexpected errors: %v", res.Errors)
+	}
+	for _, nd := range pinned {
+		if !e.has(t, nd) {
+			t.Fatalf("block %s pinned during the sweep was removed", nd.Key())
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package gc
+
+import (
+	"time"
+
+	blocks "github.com/ipfs/go-ipfs/blocks"
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+	bserv "github.com/ipfs/go-ipfs/blockservice"
+	exchange "github.com/ipfs/go-ipfs/exchange"
+	offline "github.com/ipfs/go-ipfs/exchange/offline"
+	dag "github.com/ipfs/go-ipfs/merkledag"
+	pin "github.com/ipfs/go-ipfs/pin"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// RepairAndGC fetches through ex the missing blocks of the pins, storing them
+// in bs, then collects like GCWithResult. A block that can't be fetched
+// within timeout is given up on; zero or less waits as long as ctx allows.
+//
+// A pin that can't be completed doesn't stop the run with an
+// *ErrPinIncomplete: it is listed in the UnrepairedPins of the result and
+// marked as far as its blocks are stored, like a best-effort root, or only
+// its root if it is a direct pin, and the rest of the blockstore is swept.
+// The stored blocks below a missing block can't be reached from the pin and
+// can't be told from garbage, so they are removed, and have to be fetched
+// again along with the missing block for the pin to be complete.
+//
+// The fetches happen before the GC lock is taken, under the pin lock, so that
+// adds go on while the network is slow.
+func RepairAndGC(ctx context.Context, bs bstore.GCBlockstore, pn pin.Pinner, bestEffortRoots []*cid.Cid, ex exchange.Interface, timeout time.Duration, opts ...GCOption) (<-chan key.Key, <-chan GCResult, error) {
+	o := newGCOptions(opts)
+	pn = o.pinsFor(pn)
+
+	unlocker := bs.PinLock()
+	o.unrepaired = repairPins(ctx, bs, pn, ex, timeout, o.log)
+	unlocker.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(o.unrepaired) > 0 {
+		// the pins would fail the mark phase, so their blocks are kept
+		// without them
+		skip := make(map[key.Key]bool)
+		bestEffortRoots = append([]*cid.Cid(nil), bestEffortRoots...)
+		for _, d := range o.unrepaired {
+			skip[key.Key(d.Root.Hash())] = true
+			rootLost := d.Missing != nil && d.Missing.Equals(d.Root)
+			if d.Recursive && !rootLost {
+				bestEffortRoots = append(bestEffortRoots, d.Root)
+			} else {
+				o.retain = append(o.retain, d.Root)
+			}
+		}
+		pn = unrepairedPins{Pinner: pn, skip: skip}
+	}
+
+	gcUnlocker, err := gcLock(bs, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	deletions, results, err := runGC(ctx, bs, gcUnlocker, pn, bestEffortRoots, o)
+	return keysOf(ctx, deletions, results, err)
+}
+
+// repairPins fetches the missing blocks of the dangling pins of pn, and
+// returns the pins that are still dangling afterwards
+func repairPins(ctx context.Context, bs bstore.Blockstore, pn pin.Pinner, ex exchange.Interface, timeout time.Duration, l *runLogger) []DanglingPin {
+	local := dag.NewDAGService(bserv.New(bs, offline.Exchange(bs)))
+	dangling := VerifyPins(ctx, pn, local)
+	if len(dangling) == 0 {
+		return nil
+	}
+
+	remote := newFetchTimeout(dag.NewDAGService(bserv.New(bs, &storingExchange{Interface: ex, bs: bs})), timeout, l)
+	var failed []DanglingPin
+	for _, d := range dangling {
+		var err error
+		if d.Recursive {
+			err = Descendants(ctx, remote, key.NewKeySet(), []*cid.Cid{d.Root}, false)
+		} else {
+			_, err = remote.Get(ctx, d.Root)
+			if err == dag.ErrNotFound {
+				err = &ErrPinIncomplete{Root: d.Root, Missing: d.Root}
+			}
+		}
+		if ctx.Err() != nil {
+			return failed
+		}
+		if err != nil {
+			failed = append(failed, danglingPin(d.Root, d.Recursive, err))
+			continue
+		}
+		l.Infof("repaired pin %s", d.Root)
+	}
+	return failed
+}
+
+// storingExchange stores the blocks it gets, as the blockservice leaves that
+// to the exchange and not every exchange does it
+type storingExchange struct {
+	exchange.Interface
+	bs bstore.Blockstore
+}
+
+func (ex *storingExchange) GetBlock(ctx context.Context, k key.Key) (blocks.Block, error) {
+	b, err := ex.Interface.GetBlock(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	if err := ex.bs.Put(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// unrepairedPins hides the pins in skip, which the run can't mark
+type unrepairedPins struct {
+	pin.Pinner
+	skip map[key.Key]bool
+}
+
+func (p unrepairedPins) RecursiveKeys() []*cid.Cid {
+	return p.filter(p.Pinner.RecursiveKeys())
+}
+
+func (p unrepairedPins) DirectKeys() []*cid.Cid {
+	return p.filter(p.Pinner.DirectKeys())
+}
+
+func (p unrepairedPins) filter(cids []*cid.Cid) []*cid.Cid {
+	var out []*cid.Cid
+	for _, c := range cids {
+		if !p.skip[key.Key(c.Hash())] {
+			out = append(out, c)
+		}
+	}
+	return out
+}
@@ -0,0 +1,160 @@
+package gc
+
+import (
+	"testing"
+	"time"
+
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+	dag "github.com/ipfs/go-ipfs/merkledag"
+	gctest "github.com/ipfs/go-ipfs/pin/gc/gctest"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+)
+
+// moveToRemote deletes nd from the local blockstore, keeping a copy in
+// remote if it is given
+func moveToRemote(t *testing.T, e *testEnv, remote bstore.Blockstore, nd *dag.Node) {
+	blk, err := e.bs.Get(nd.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote != nil {
+		if err := remote.Put(blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.bs.DeleteBlock(nd.Key()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepairAndGC(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	remote := gctest.NewMemBlockstore()
+
+	// fixable has an inner node the network has, broken one it doesn't
+	fixable, fixableTree := buildTree(t, e, "fixable", 2, 2)
+	broken, brokenTree := buildTree(t, e, "broken", 2, 2)
+	lostRoot := e.addNode(t, "lost root", e.addNode(t, "kept child"))
+	for _, nd := range []*dag.Node{fixable, broken, lostRoot} {
+		if err := e.pn.Pin(ctx, nd, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lostDirect := e.addNode(t, "lost direct")
+	if err := e.pn.Pin(ctx, lostDirect, false); err != nil {
+		t.Fatal(err)
+	}
+	moveToRemote(t, e, remote, fixableTree[2])
+	// the first two blocks of a tree are the children of the third
+	lost := brokenTree[2]
+	for _, nd := range []*dag.Node{lost, lostRoot, lostDirect} {
+		moveToRemote(t, e, nil, nd)
+	}
+	garbage := e.addNode(t, "garbage")
+
+	if _, err := GC(ctx, e.bs, e.pn, nil); err == nil {
+		t.Fatal("expected GC to fail on the incomplete pins")
+	}
+
+	out, results, err := RepairAndGC(ctx, e.bs, e.pn, nil, &remoteExchange{remote: remote}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	res := <-results
+	if err := res.Err(); err != nil {
+		t.Fatal(err)
+	}
+	// the broken pins don't hold up the sweep
+	if res.SweepSkipped || e.has(t, garbage) {
+		t.Fatal("garbage block was not removed")
+	}
+
+	exp := map[string]*dag.Node{
+		broken.Cid().String():     lost,
+		lostRoot.Cid().String():   lostRoot,
+		lostDirect.Cid().String(): lostDirect,
+	}
+	if len(res.UnrepairedPins) != len(exp) {
+		t.Fatalf("expected %d unrepaired pins, got %v", len(exp), res.UnrepairedPins)
+	}
+	for _, d := range res.UnrepairedPins {
+		missing, ok := exp[d.Root.String()]
+		if !ok {
+			t.Fatalf("%s reported as unrepaired", d.Root)
+		}
+		if d.Missing == nil || !d.Missing.Equals(missing.Cid()) {
+			t.Fatalf("expected %s missing below %s, got %+v", missing.Cid(), d.Root, d)
+		}
+	}
+
+	for _, nd := range fixableTree {
+		if !e.has(t, nd) {
+			t.Fatal("block of the repaired pin is missing")
+		}
+	}
+	// what is left of the broken tree past the lost node is kept, the
+	// children of the lost node can't be reached and are not
+	for _, nd := range brokenTree[3:] {
+		if !e.has(t, nd) {
+			t.Fatalf("reachable block %s of the unrepaired pin was removed", nd.Key())
+		}
+	}
+
+	// once the broken pins are gone the repaired one is collected around
+	for _, nd := range []*dag.Node{broken, lostRoot} {
+		if err := e.pn.Unpin(ctx, nd.Cid(), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.pn.Unpin(ctx, lostDirect.Cid(), false); err != nil {
+		t.Fatal(err)
+	}
+	out, results, err = RepairAndGC(ctx, e.bs, e.pn, nil, &remoteExchange{remote: remote}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	if res := <-results; res.SweepSkipped || len(res.UnrepairedPins) != 0 {
+		t.Fatalf("expected a full sweep, got %+v", res)
+	}
+	for _, nd := range brokenTree[3:] {
+		if e.has(t, nd) {
+			t.Fatal("block of the unpinned tree was not removed")
+		}
+	}
+	for _, nd := range fixableTree {
+		if !e.has(t, nd) {
+			t.Fatal("block of the repaired pin was removed")
+		}
+	}
+}
+
+func TestRepairAndGCTimeout(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	root, tree := buildTree(t, e, "pinned", 1, 2)
+	if err := e.pn.Pin(ctx, root, true); err != nil {
+		t.Fatal(err)
+	}
+	moveToRemote(t, e, gctest.NewMemBlockstore(), tree[0])
+
+	start := time.Now()
+	out, results, err := RepairAndGC(ctx, e.bs, e.pn, nil, &remoteExchange{hang: true}, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("repair took %s to give up on the fetch", d)
+	}
+	if res := <-results; len(res.UnrepairedPins) != 1 {
+		t.Fatalf("expected the pin to stay unrepaired, got %v", res.UnrepairedPins)
+	}
+	if !e.has(t, root) || !e.has(t, tree[1]) {
+		t.Fatal("stored block of the unrepaired pin was removed")
+	}
+}
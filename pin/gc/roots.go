@@ -0,0 +1,150 @@
+package gc
+
+import (
+	"strings"
+
+	pin "github.com/ipfs/go-ipfs/pin"
+
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// PinnedRoot is a root the mark phase starts from, along with the way it is
+// pinned
+type PinnedRoot struct {
+	Cid *cid.Cid
+	// Type is pin.Recursive, pin.Direct or pin.Internal
+	Type pin.PinMode
+}
+
+// MarkRoots are the roots a mark phase walked from, by where they came from.
+// A root may be listed under several of them.
+type MarkRoots struct {
+	Recursive []*cid.Cid
+	Direct    []*cid.Cid
+	Internal  []*cid.Cid
+	// Extra are the roots given by the WithExtraRoots provider
+	Extra []*cid.Cid
+	// MFS is the root given with WithMFSRoot, or nil
+	MFS        *cid.Cid
+	BestEffort []*cid.Cid
+	// Retained are the blocks given with WithRetainList, kept without
+	// their descendants
+	Retained []*cid.Cid
+}
+
+// noPins stands in for a nil Pinner. It has no pins, so only the roots
+// given to the run keep blocks.
+type noPins struct {
+	pin.Pinner
+}
+
+func (noPins) RecursiveKeys() []*cid.Cid { return nil }
+func (noPins) DirectKeys() []*cid.Cid    { return nil }
+func (noPins) InternalPins() []*cid.Cid  { return nil }
+
+// pinsOf returns pn, or a Pinner without any pins if pn is nil
+func pinsOf(pn pin.Pinner) pin.Pinner {
+	if pn == nil {
+		return noPins{}
+	}
+	return pn
+}
+
+// pinTypes tells which kinds of pins a run honours
+type pinTypes struct {
+	recursive, direct, internal bool
+}
+
+// skipped names the kinds of pins left out, or is empty if none are
+func (t *pinTypes) skipped() string {
+	if t == nil {
+		return ""
+	}
+	var names []string
+	for _, c := range []struct {
+		name string
+		on   bool
+	}{
+		{"recursive", t.recursive},
+		{"direct", t.direct},
+		{"internal", t.internal},
+	} {
+		if !c.on {
+			names = append(names, c.name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// somePins hides the kinds of pins that a run leaves out
+type somePins struct {
+	pin.Pinner
+	types pinTypes
+}
+
+func (p somePins) RecursiveKeys() []*cid.Cid {
+	if !p.types.recursive {
+		return nil
+	}
+	return p.Pinner.RecursiveKeys()
+}
+
+func (p somePins) DirectKeys() []*cid.Cid {
+	if !p.types.direct {
+		return nil
+	}
+	return p.Pinner.DirectKeys()
+}
+
+func (p somePins) InternalPins() []*cid.Cid {
+	if !p.types.internal {
+		return nil
+	}
+	return p.Pinner.InternalPins()
+}
+
+// pinsFor returns the pins of pn that the run honours, see pinsOf and
+// WithPinTypes
+func (o *gcOptions) pinsFor(pn pin.Pinner) pin.Pinner {
+	pn = pinsOf(pn)
+	if o.pinTypes == nil {
+		return pn
+	}
+	if _, ok := pn.(somePins); ok {
+		return pn
+	}
+	return somePins{Pinner: pn, types: *o.pinTypes}
+}
+
+// AllPinnedRoots returns the recursive, direct and internal pins of pn, the
+// roots GC keeps, in that order. A block pinned in more than one way is only
+// listed once, with the first of those types, as a recursive pin also keeps
+// the block itself.
+func AllPinnedRoots(pn pin.Pinner) []PinnedRoot {
+	pn = pinsOf(pn)
+	seen := make(map[key.Key]bool)
+	var out []PinnedRoot
+	for _, pins := range []struct {
+		cids []*cid.Cid
+		mode pin.PinMode
+	}{
+		{pn.RecursiveKeys(), pin.Recursive},
+		{pn.DirectKeys(), pin.Direct},
+		{pn.InternalPins(), pin.Internal},
+	} {
+		for _, c := range uniqueRoots(pins.cids, seen) {
+			out = append(out, PinnedRoot{Cid: c, Type: pins.mode})
+		}
+	}
+	return out
+}
+
+// InternalRoots returns the roots of the blocks pn keeps for itself, such as
+// the DAGs that store its pin sets. These are not pins of the user, but GC
+// must keep everything below them, recursively, like a recursive pin: a
+// live set built without them lets the pinner's own state be collected,
+// and the pins are lost on the next load.
+func InternalRoots(pn pin.Pinner) []*cid.Cid {
+	return pinsOf(pn).InternalPins()
+}
@@ -0,0 +1,211 @@
+package gc
+
+import (
+	"testing"
+
+	pin "github.com/ipfs/go-ipfs/pin"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// fixedPinner reports the pins it was made with
+type fixedPinner struct {
+	pin.Pinner
+	recursive, direct, internal []*cid.Cid
+}
+
+func (p fixedPinner) RecursiveKeys() []*cid.Cid { return p.recursive }
+func (p fixedPinner) DirectKeys() []*cid.Cid    { return p.direct }
+func (p fixedPinner) InternalPins() []*cid.Cid  { return p.internal }
+
+func TestAllPinnedRoots(t *testing.T) {
+	e := newTestEnv()
+	rec := e.addNode(t, "recursive").Cid()
+	direct := e.addNode(t, "direct").Cid()
+	internal := e.addNode(t, "internal").Cid()
+
+	pn := fixedPinner{
+		Pinner:    e.pn,
+		recursive: []*cid.Cid{rec, rec},
+		direct:    []*cid.Cid{direct, cid.NewCidV1(cid.Raw, rec.Hash())},
+		internal:  []*cid.Cid{internal, direct},
+	}
+	roots := AllPinnedRoots(pn)
+
+	expect := []PinnedRoot{
+		{Cid: rec, Type: pin.Recursive},
+		{Cid: direct, Type: pin.Direct},
+		{Cid: internal, Type: pin.Internal},
+	}
+	if len(roots) != len(expect) {
+		t.Fatalf("expected %d roots, got %v", len(expect), roots)
+	}
+	for i, r := range roots {
+		if !r.Cid.Equals(expect[i].Cid) || r.Type != expect[i].Type {
+			t.Fatalf("root %d: expected %v, got %v", i, expect[i], r)
+		}
+	}
+}
+
+func TestGCResultMarkRoots(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	rec := e.addNode(t, "recursive")
+	direct := e.addNode(t, "direct")
+	if err := e.pn.Pin(ctx, rec, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.pn.Pin(ctx, direct, false); err != nil {
+		t.Fatal(err)
+	}
+	extra := e.addNode(t, "extra").Cid()
+	mfs := e.addNode(t, "mfs").Cid()
+	bestEffort := e.addNode(t, "best effort").Cid()
+
+	res, err := RunGC(ctx, e.bs, e.pn, []*cid.Cid{bestEffort},
+		WithExtraRoots(func(context.Context) ([]*cid.Cid, error) {
+			return []*cid.Cid{extra}, nil
+		}),
+		WithMFSRoot(mfs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := res.MarkRoots
+	for name, c := range map[string]struct {
+		got []*cid.Cid
+		exp *cid.Cid
+	}{
+		"recursive":   {roots.Recursive, rec.Cid()},
+		"direct":      {roots.Direct, direct.Cid()},
+		"extra":       {roots.Extra, extra},
+		"mfs":         {[]*cid.Cid{roots.MFS}, mfs},
+		"best-effort": {roots.BestEffort, bestEffort},
+	} {
+		if len(c.got) != 1 || c.got[0] == nil || !c.got[0].Equals(c.exp) {
+			t.Fatalf("%s roots: expected %s, got %v", name, c.exp, c.got)
+		}
+	}
+}
+
+func TestInternalRoots(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	if err := e.pn.Pin(ctx, e.addNode(t, "pinned"), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.pn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	roots := InternalRoots(e.pn)
+	if len(roots) == 0 {
+		t.Fatal("expected the pinner to keep internal roots once flushed")
+	}
+	if !sameCids(roots, e.pn.InternalPins()) {
+		t.Fatalf("expected the internal pins, got %v", roots)
+	}
+
+	// a live set built from them keeps the pinner's state like GC does
+	live, _, err := ColoredSet(ctx, e.pn, e.dserv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom := key.NewKeySet()
+	if err := Descendants(ctx, e.dserv, custom, roots, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range custom.Keys() {
+		if !live.Has(k) {
+			t.Fatalf("internal block %s is not kept by GC", k)
+		}
+	}
+}
+
+func TestGCBestEffortInternalPins(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	// an internal pin whose first inner node is gone, with its children
+	// still stored
+	internal, tree := buildTree(t, e, "internal", 2, 2)
+	lost := tree[2]
+	if err := e.bs.DeleteBlock(lost.Key()); err != nil {
+		t.Fatal(err)
+	}
+	garbage := e.addNode(t, "garbage")
+	pn := fixedPinner{Pinner: e.pn, internal: []*cid.Cid{internal.Cid()}}
+
+	_, err := RunGC(ctx, e.bs, pn, nil)
+	if perr, ok := err.(*ErrPinIncomplete); !ok || !perr.Missing.Equals(lost.Cid()) {
+		t.Fatalf("expected GC to stop on the missing internal block, got %v", err)
+	}
+	if !e.has(t, garbage) {
+		t.Fatal("strict GC removed a block")
+	}
+
+	res, err := RunGC(ctx, e.bs, pn, nil, WithBestEffortInternalPins(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.IncompleteRoots) != 1 || !res.IncompleteRoots[0].Cid.Equals(internal.Cid()) {
+		t.Fatalf("expected the internal pin to be reported incomplete, got %v", res.IncompleteRoots)
+	}
+	// garbage and the two children of the lost node
+	if res.BlocksRemoved != 3 || e.has(t, garbage) {
+		t.Fatalf("expected 3 blocks removed, garbage included, got %d", res.BlocksRemoved)
+	}
+	for _, nd := range tree[3:] {
+		if !e.has(t, nd) {
+			t.Fatal("reachable block of the internal pin was removed")
+		}
+	}
+}
+
+func TestGCPinTypes(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	leaf := e.addNode(t, "leaf")
+	recursive := e.addNode(t, "recursive", leaf)
+	direct := e.addNode(t, "direct")
+	if err := e.pn.Pin(ctx, recursive, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.pn.Pin(ctx, direct, false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name    string
+		opts    []GCOption
+		removed []key.Key
+	}{
+		{"all", nil, nil},
+		{"all given", []GCOption{WithPinTypes(true, true, true)}, nil},
+		{"no direct", []GCOption{WithPinTypes(true, false, true)}, []key.Key{direct.Key()}},
+		{"no recursive", []GCOption{WithPinTypes(false, true, true)}, []key.Key{leaf.Key(), recursive.Key()}},
+	} {
+		out, err := GCDryRun(ctx, e.bs, e.pn, nil, c.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		removed := key.NewKeySet()
+		for _, k := range drain(out) {
+			removed.Add(k)
+		}
+		if len(removed.Keys()) != len(c.removed) {
+			t.Fatalf("%s: expected %v to go, got %v", c.name, c.removed, removed.Keys())
+		}
+		for _, k := range c.removed {
+			if !removed.Has(k) {
+				t.Fatalf("%s: expected %s to go, got %v", c.name, k, removed.Keys())
+			}
+		}
+	}
+	if !e.has(t, direct) || !e.has(t, leaf) {
+		t.Fatal("dry run removed blocks")
+	}
+}
@@ -0,0 +1,129 @@
+package gc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	humanize "gx/ipfs/QmPSBJL4momYnE7DcUyk2DVhD6rH488ZmHBGLbxNdhU44K/go-humanize"
+	logging "gx/ipfs/QmSpJByNKFX1sCsHBEp3R73FL4NF6FnQTEGyNAXHm2GS52/go-log"
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+)
+
+// lastRunID is the ID given to the latest run of the process
+var lastRunID uint64
+
+// runLogger logs on behalf of a single run. Every line is prefixed with the
+// ID of the run, the phase it is in and the fields given with WithLogFields,
+// so that the lines of runs going on at once can be told apart.
+type runLogger struct {
+	id     uint64
+	fields logging.LoggableMap
+	// prefix holds the run ID and the caller's fields, formatted once
+	prefix string
+	phase  int32
+}
+
+func newRunLogger(fields map[string]interface{}) *runLogger {
+	l := &runLogger{
+		id:     atomic.AddUint64(&lastRunID, 1),
+		fields: make(logging.LoggableMap, len(fields)+1),
+	}
+	for k, v := range fields {
+		l.fields[k] = v
+	}
+	l.fields["run_id"] = l.id
+
+	names := make([]string, 0, len(fields))
+	for k := range fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	parts := []string{fmt.Sprintf("run_id=%d", l.id)}
+	for _, k := range names {
+		parts = append(parts, fmt.Sprintf("%s=%v", k, fields[k]))
+	}
+	l.prefix = strings.Join(parts, " ")
+	return l
+}
+
+// setPhase records the phase the run is in for the lines that follow
+func (l *runLogger) setPhase(p GCPhase) {
+	atomic.StoreInt32(&l.phase, int32(p))
+}
+
+// line prefixes msg with the fields of the run
+func (l *runLogger) line(msg string) string {
+	return fmt.Sprintf("gc[%s phase=%s]: %s", l.prefix, GCPhase(atomic.LoadInt32(&l.phase)), msg)
+}
+
+func (l *runLogger) Debug(msg string) {
+	log.Debug(l.line(msg))
+}
+
+func (l *runLogger) Debugf(format string, args ...interface{}) {
+	log.Debug(l.line(fmt.Sprintf(format, args...)))
+}
+
+func (l *runLogger) Infof(format string, args ...interface{}) {
+	log.Info(l.line(fmt.Sprintf(format, args...)))
+}
+
+func (l *runLogger) Warning(msg string) {
+	log.Warning(l.line(msg))
+}
+
+func (l *runLogger) Warningf(format string, args ...interface{}) {
+	log.Warning(l.line(fmt.Sprintf(format, args...)))
+}
+
+func (l *runLogger) Errorf(format string, args ...interface{}) {
+	log.Error(l.line(fmt.Sprintf(format, args...)))
+}
+
+// finished logs the end of the run in a single summary line, and sends it
+// as an event with the fields of the run and its totals. The totals of a run
+// that was cancelled or failed are those reached so far.
+func (l *runLogger) finished(ctx context.Context, res GCResult) {
+	switch res.Reason {
+	case ReasonCompleted, ReasonLimited, ReasonDeadline:
+		l.Infof("run finished: %s", summary(res))
+	default:
+		l.Warningf("run finished: %s", summary(res))
+	}
+
+	ev := make(logging.LoggableMap, len(l.fields)+4)
+	for k, v := range l.fields {
+		ev[k] = v
+	}
+	ev["reason"] = res.Reason.String()
+	ev["blocks_deleted"] = res.BlocksRemoved
+	ev["bytes_freed"] = res.BytesFreed
+	ev["errors"] = len(res.Errors)
+	log.Event(ctx, "gcRunFinished", ev)
+}
+
+// failed ends a run that stopped with err before it could sweep
+func (l *runLogger) failed(ctx context.Context, err error, res GCResult) {
+	res.Reason = ReasonError
+	if ctx.Err() != nil {
+		res.Reason = cancelReason(ctx)
+	}
+	res.Errors = append(res.Errors, err)
+	l.finished(ctx, res)
+}
+
+// summary formats the totals of res as key=value pairs, with the sizes and
+// the duration in a readable form
+func summary(res GCResult) string {
+	freed := strings.Replace(humanize.IBytes(res.BytesFreed), " ", "", -1)
+	d := res.LockWaitDuration + res.MarkDuration + res.SweepDuration
+	line := fmt.Sprintf("deleted=%d freed=%s marked=%d duration=%s reason=%s",
+		res.BlocksRemoved, freed, res.MarkedCount, d-d%time.Millisecond, res.Reason)
+	if err := res.Err(); err != nil {
+		line += fmt.Sprintf(" errors=%d err=%q", len(res.Errors), err.Error())
+	}
+	return line
+}
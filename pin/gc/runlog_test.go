@@ -0,0 +1,49 @@
+package gc
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunLoggerFields(t *testing.T) {
+	a := newGCOptions([]GCOption{WithLogFields(map[string]interface{}{"trigger": "timer", "node": "a"})}).log
+	b := newGCOptions(nil).log
+	if a.id == b.id {
+		t.Fatalf("two runs share the ID %d", a.id)
+	}
+
+	line := a.line("x")
+	if !strings.HasPrefix(line, "gc[run_id=") || !strings.Contains(line, " node=a trigger=timer phase=marking]: x") {
+		t.Fatalf("unexpected log line %q", line)
+	}
+	a.setPhase(PhaseSweep)
+	if line := a.line("x"); !strings.Contains(line, "phase=sweeping]") {
+		t.Fatalf("phase not updated in %q", line)
+	}
+	if a.fields["run_id"] != a.id || a.fields["trigger"] != "timer" {
+		t.Fatalf("unexpected event fields %v", a.fields)
+	}
+}
+
+func TestRunSummary(t *testing.T) {
+	res := GCResult{
+		BlocksRemoved: 40231,
+		BytesFreed:    1395864371,
+		MarkedCount:   910233,
+		MarkDuration:  12 * time.Second,
+		SweepDuration: 30*time.Second + 1234567,
+		Reason:        ReasonCompleted,
+	}
+	exp := "deleted=40231 freed=1.3GiB marked=910233 duration=42.001s reason=completed"
+	if s := summary(res); s != exp {
+		t.Fatalf("expected %q, got %q", exp, s)
+	}
+
+	res.Reason = ReasonError
+	res.Errors = []error{errors.New("disk on fire")}
+	if s := summary(res); !strings.HasSuffix(s, ` reason=error errors=1 err="disk on fire"`) {
+		t.Fatalf("unexpected summary of a failed run %q", s)
+	}
+}
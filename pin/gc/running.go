@@ -0,0 +1,99 @@
+package gc
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+)
+
+// ErrGCInProgress is returned when a garbage collection is started on a
+// blockstore that already has one running
+var ErrGCInProgress = errors.New("gc: a garbage collection is already running on this blockstore")
+
+// running holds the blockstores that have a collection in progress
+var running = struct {
+	sync.Mutex
+	bs map[interface{}]struct{}
+}{bs: make(map[interface{}]struct{})}
+
+// IsGCRunning reports whether a garbage collection that removes blocks,
+// rather than a dry run, is in progress on bs.
+func IsGCRunning(bs bstore.GCBlockstore) bool {
+	k, ok := runningKey(bs)
+	if !ok {
+		return false
+	}
+	running.Lock()
+	defer running.Unlock()
+	_, ok = running.bs[k]
+	return ok
+}
+
+// startGC records that a collection is running on bs, and returns the
+// function that records its end. Blockstores that can't be told apart, the
+// ones with a type that can't be compared, are not tracked.
+func startGC(bs bstore.GCBlockstore) (func(), error) {
+	k, ok := runningKey(bs)
+	if !ok {
+		return func() {}, nil
+	}
+
+	running.Lock()
+	defer running.Unlock()
+	if _, ok := running.bs[k]; ok {
+		return nil, ErrGCInProgress
+	}
+	running.bs[k] = struct{}{}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			running.Lock()
+			delete(running.bs, k)
+			running.Unlock()
+		})
+	}, nil
+}
+
+func runningKey(bs bstore.GCBlockstore) (interface{}, bool) {
+	if bs == nil || !reflect.TypeOf(bs).Comparable() {
+		return nil, false
+	}
+	return bs, true
+}
+
+// gcLock takes the GC lock of bs for a collection, failing with
+// ErrGCInProgress instead of waiting if another collection holds it. The
+// time spent waiting is recorded in o.
+func gcLock(bs bstore.GCBlockstore, o *gcOptions) (bstore.Unlocker, error) {
+	done, err := startGC(bs)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	unlocker := yieldable(bs, checkGCLock(bs, bs.GCLock(), o), o)
+	o.lockWait = time.Since(start)
+	return &runningUnlocker{Unlocker: unlocker, done: done}, nil
+}
+
+// pinLock takes the pin lock of bs, recording the time spent waiting in o
+func pinLock(bs bstore.GCBlockstore, o *gcOptions) bstore.Unlocker {
+	start := time.Now()
+	unlocker := bs.PinLock()
+	o.lockWait = time.Since(start)
+	return unlocker
+}
+
+// runningUnlocker releases the GC lock and marks the collection as over
+type runningUnlocker struct {
+	bstore.Unlocker
+	done func()
+}
+
+func (u *runningUnlocker) Unlock() {
+	u.Unlocker.Unlock()
+	u.done()
+}
@@ -0,0 +1,46 @@
+package gc
+
+import (
+	"testing"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+)
+
+func TestGCInProgress(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	e.addNode(t, "garbage 1")
+	e.addNode(t, "garbage 2")
+
+	if IsGCRunning(e.bs) {
+		t.Fatal("no GC should be running yet")
+	}
+
+	// the first run waits for its output to be read
+	out, err := GCWith(ctx, e.bs, e.pn, nil, WithDeleteBatchSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsGCRunning(e.bs) {
+		t.Fatal("expected a GC to be running")
+	}
+	if _, err := GC(ctx, e.bs, e.pn, nil); err != ErrGCInProgress {
+		t.Fatalf("expected ErrGCInProgress, got %v", err)
+	}
+	if _, _, err := GCWithLockTimeout(ctx, e.bs, e.pn, nil, 0); err != ErrGCInProgress {
+		t.Fatalf("expected ErrGCInProgress, got %v", err)
+	}
+
+	if n := len(drain(out)); n != 2 {
+		t.Fatalf("expected 2 removed blocks, got %d", n)
+	}
+	if IsGCRunning(e.bs) {
+		t.Fatal("GC still reported as running after it ended")
+	}
+
+	out, err = GC(ctx, e.bs, e.pn, nil)
+	if err != nil {
+		t.Fatalf("expected a new GC to start once the first ended, got %v", err)
+	}
+	drain(out)
+}
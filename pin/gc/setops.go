@@ -0,0 +1,147 @@
+package gc
+
+import (
+	"errors"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+)
+
+// ErrProbabilisticSet is returned by the set operations for a set, like the
+// one from NewBloomKeySet, that can't list its keys or may report keys it
+// doesn't hold
+var ErrProbabilisticSet = errors.New("gc: set operations need sets that hold exact keys")
+
+// Union returns a new set holding the keys of both a and b
+func Union(a, b key.KeySet) (key.KeySet, error) {
+	out := key.NewKeySet()
+	for _, set := range []key.KeySet{a, b} {
+		keys, err := exactKeys(set)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			out.Add(k)
+		}
+	}
+	return out, nil
+}
+
+// Intersection returns a new set holding the keys that are in both a and b
+func Intersection(a, b key.KeySet) (key.KeySet, error) {
+	return filterKeys(a, b, true)
+}
+
+// Difference returns a new set holding the keys of a that are not in b. With
+// the sets ColoredSet returned before and after unpinning something,
+// Difference(before, after) holds the blocks that became collectable.
+func Difference(a, b key.KeySet) (key.KeySet, error) {
+	return filterKeys(a, b, false)
+}
+
+// filterKeys returns the keys of a for which b.Has returns in
+func filterKeys(a, b key.KeySet, in bool) (key.KeySet, error) {
+	if isProbabilistic(b) {
+		return nil, ErrProbabilisticSet
+	}
+	keys, err := exactKeys(a)
+	if err != nil {
+		return nil, err
+	}
+
+	out := key.NewKeySet()
+	for _, k := range keys {
+		if b.Has(k) == in {
+			out.Add(k)
+		}
+	}
+	if err := keySetErr(b); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// exactKeys lists the keys of set, failing for sets that can't
+func exactKeys(set key.KeySet) ([]key.Key, error) {
+	if isProbabilistic(set) {
+		return nil, ErrProbabilisticSet
+	}
+	keys := set.Keys()
+	if err := keySetErr(set); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// KeysChan sends the keys of set, like the one ColoredSet returns, on the
+// returned channel, which is closed once they have all been sent or ctx is
+// done. Sets from NewDiskKeySet are streamed without gathering every key in
+// memory first; other sets are listed with their Keys method. Once the
+// channel is closed, the returned function gives the error that cut the
+// listing short, if any. The set must not change while it is listed.
+func KeysChan(ctx context.Context, set key.KeySet) (<-chan key.Key, func() error, error) {
+	if isProbabilistic(set) {
+		return nil, nil, ErrProbabilisticSet
+	}
+	keysErr := func() error { return keySetErr(set) }
+	if ds, ok := set.(*diskKeySet); ok {
+		return ds.keysChan(ctx), keysErr, nil
+	}
+
+	keys := set.Keys()
+	out := make(chan key.Key)
+	go func() {
+		defer close(out)
+		for _, k := range keys {
+			select {
+			case out <- k:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, keysErr, nil
+}
+
+// DiffMarkedSets compares the marked sets of two runs, as kept with
+// WriteMarkedSet and read back with ReadMarkedSet. added holds the keys of
+// cur that were not in prev, the blocks that became protected, and removed
+// the keys of prev that are no longer in cur, the blocks that became
+// collectable, typically after an unpin. Each set is streamed with KeysChan
+// and looked up in the other, so that only the differences are gathered in
+// memory.
+func DiffMarkedSets(prev, cur key.KeySet) (added, removed []key.Key, err error) {
+	if isProbabilistic(prev) || isProbabilistic(cur) {
+		return nil, nil, ErrProbabilisticSet
+	}
+	added, err = keysNotIn(cur, prev)
+	if err != nil {
+		return nil, nil, err
+	}
+	removed, err = keysNotIn(prev, cur)
+	if err != nil {
+		return nil, nil, err
+	}
+	return added, removed, nil
+}
+
+// keysNotIn returns the keys of a that b doesn't have
+func keysNotIn(a, b key.KeySet) ([]key.Key, error) {
+	keys, keysErr, err := KeysChan(context.Background(), a)
+	if err != nil {
+		return nil, err
+	}
+	var out []key.Key
+	for k := range keys {
+		if !b.Has(k) {
+			out = append(out, k)
+		}
+	}
+	if err := keysErr(); err != nil {
+		return nil, err
+	}
+	if err := keySetErr(b); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,272 @@
+package gc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"testing"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+)
+
+func keySetOf(keys ...string) key.KeySet {
+	set := key.NewKeySet()
+	for _, k := range keys {
+		set.Add(key.Key(k))
+	}
+	return set
+}
+
+func sortedKeys(set key.KeySet) []string {
+	var out []string
+	for _, k := range set.Keys() {
+		out = append(out, string(k))
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestSetOperations(t *testing.T) {
+	cases := []struct {
+		name         string
+		a, b         key.KeySet
+		union        []string
+		intersection []string
+		difference   []string
+	}{
+		{
+			name:       "disjoint",
+			a:          keySetOf("a", "b"),
+			b:          keySetOf("c"),
+			union:      []string{"a", "b", "c"},
+			difference: []string{"a", "b"},
+		},
+		{
+			name:         "subset",
+			a:            keySetOf("a", "b", "c"),
+			b:            keySetOf("b"),
+			union:        []string{"a", "b", "c"},
+			intersection: []string{"b"},
+			difference:   []string{"a", "c"},
+		},
+		{
+			name:         "superset",
+			a:            keySetOf("b"),
+			b:            keySetOf("a", "b", "c"),
+			union:        []string{"a", "b", "c"},
+			intersection: []string{"b"},
+		},
+		{
+			name:         "identical",
+			a:            keySetOf("a", "b"),
+			b:            keySetOf("a", "b"),
+			union:        []string{"a", "b"},
+			intersection: []string{"a", "b"},
+		},
+		{
+			name: "empty",
+			a:    keySetOf(),
+			b:    keySetOf(),
+		},
+	}
+
+	for _, c := range cases {
+		for _, op := range []struct {
+			name   string
+			f      func(a, b key.KeySet) (key.KeySet, error)
+			expect []string
+		}{
+			{"union", Union, c.union},
+			{"intersection", Intersection, c.intersection},
+			{"difference", Difference, c.difference},
+		} {
+			set, err := op.f(c.a, c.b)
+			if err != nil {
+				t.Fatalf("%s of %s sets: %s", op.name, c.name, err)
+			}
+			got := sortedKeys(set)
+			if len(got) != len(op.expect) {
+				t.Fatalf("%s of %s sets: expected %v, got %v", op.name, c.name, op.expect, got)
+			}
+			for i := range got {
+				if got[i] != op.expect[i] {
+					t.Fatalf("%s of %s sets: expected %v, got %v", op.name, c.name, op.expect, got)
+				}
+			}
+		}
+	}
+}
+
+func TestSetOperationsBloom(t *testing.T) {
+	bloom, err := NewBloomKeySet(100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []func(a, b key.KeySet) (key.KeySet, error){Union, Intersection, Difference} {
+		if _, err := f(keySetOf("a"), bloom); err != ErrProbabilisticSet {
+			t.Fatalf("expected ErrProbabilisticSet, got %v", err)
+		}
+		if _, err := f(bloom, keySetOf("a")); err != ErrProbabilisticSet {
+			t.Fatalf("expected ErrProbabilisticSet, got %v", err)
+		}
+	}
+}
+
+func TestDifferenceAfterUnpin(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	shared := e.addNode(t, "shared")
+	kept := e.addNode(t, "kept", shared)
+	unpinned := e.addNode(t, "unpinned", shared, e.addNode(t, "only unpinned"))
+	for _, nd := range []*dag.Node{kept, unpinned} {
+		if err := e.pn.Pin(ctx, nd, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before, _, err := ColoredSet(ctx, e.pn, e.dserv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.pn.Unpin(ctx, unpinned.Cid(), true); err != nil {
+		t.Fatal(err)
+	}
+	after, _, err := ColoredSet(ctx, e.pn, e.dserv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	freed, err := Difference(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(freed.Keys()); n != 2 || !freed.Has(unpinned.Key()) {
+		t.Fatalf("expected the unpinned root and its own child, got %v", freed.Keys())
+	}
+	if freed.Has(shared.Key()) {
+		t.Fatal("block still reachable from a pin reported as collectable")
+	}
+}
+
+func TestKeysChan(t *testing.T) {
+	ctx := context.Background()
+	disk, err := NewDiskKeySet("", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.(io.Closer).Close()
+
+	for _, set := range []key.KeySet{key.NewKeySet(), disk} {
+		for i := 0; i < 100; i++ {
+			set.Add(dag.NodeWithData([]byte(fmt.Sprint(i))).Key())
+		}
+
+		keys, keysErr, err := KeysChan(ctx, set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed := key.NewKeySet()
+		for k := range keys {
+			listed.Add(k)
+		}
+		if err := keysErr(); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(sortedKeys(listed)) != fmt.Sprint(sortedKeys(set)) {
+			t.Fatalf("listed %d keys, expected %d", len(listed.Keys()), len(set.Keys()))
+		}
+
+		// the listing stops with the context
+		cctx, cancel := context.WithCancel(ctx)
+		keys, _, err = KeysChan(cctx, set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-keys
+		cancel()
+		n := 0
+		for range keys {
+			n++
+		}
+		if n > 1 {
+			t.Fatalf("%d keys sent after cancelling", n)
+		}
+	}
+
+	bloom, err := NewBloomKeySet(100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := KeysChan(ctx, bloom); err != ErrProbabilisticSet {
+		t.Fatalf("expected ErrProbabilisticSet, got %v", err)
+	}
+}
+
+func TestDiffMarkedSets(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	kept := e.addNode(t, "kept")
+	unpinned := e.addNode(t, "unpinned", e.addNode(t, "only unpinned"))
+	if err := e.pn.Pin(ctx, kept, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.pn.Pin(ctx, unpinned, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// yesterday's set goes through the serialized form, as it would be kept
+	marked, _, err := ColoredSet(ctx, e.pn, e.dserv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteMarkedSet(&buf, marked); err != nil {
+		t.Fatal(err)
+	}
+	prev, err := ReadMarkedSet(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.pn.Unpin(ctx, unpinned.Cid(), true); err != nil {
+		t.Fatal(err)
+	}
+	pinned := e.addNode(t, "newly pinned")
+	if err := e.pn.Pin(ctx, pinned, true); err != nil {
+		t.Fatal(err)
+	}
+	disk, err := NewDiskKeySet("", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.(io.Closer).Close()
+	cur, _, err := ColoredSet(ctx, e.pn, e.dserv, nil, WithKeySetFactory(func() (key.KeySet, error) { return disk, nil }))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	added, removed, err := DiffMarkedSets(prev, cur)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 || added[0] != pinned.Key() {
+		t.Fatalf("expected the new pin added, got %v", added)
+	}
+	if len(removed) != 2 || !keySetOf(string(removed[0]), string(removed[1])).Has(unpinned.Key()) {
+		t.Fatalf("expected the unpinned root and its child removed, got %v", removed)
+	}
+
+	bloom, err := NewBloomKeySet(100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DiffMarkedSets(prev, bloom); err != ErrProbabilisticSet {
+		t.Fatalf("expected ErrProbabilisticSet, got %v", err)
+	}
+}
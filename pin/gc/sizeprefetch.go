@@ -0,0 +1,131 @@
+package gc
+
+import (
+	"sync"
+
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+)
+
+// sizePrefetcher looks up the sizes of the unmarked keys on their way to the
+// sweepers, with a pool of workers, so that a sweeper finds the size ready
+// instead of waiting on the blockstore for every block.
+//
+// A key is passed on as soon as its lookup is handed to the workers, and at
+// most as many keys as there are workers wait between the listing and the
+// sweepers, so the lookups stay just ahead of the sweep.
+type sizePrefetcher struct {
+	bs   bstore.Blockstore
+	gcs  key.KeySet
+	jobs chan *sizeFetch
+	out  chan key.Key
+
+	mu    sync.Mutex
+	sizes map[key.Key]*sizeFetch
+}
+
+type sizeFetch struct {
+	k    key.Key
+	done chan struct{}
+	size int64
+}
+
+// prefetchSizes passes on the keys of keychan, looking up the sizes of the
+// unmarked ones with the given number of workers until ctx is done. gcs must
+// be safe for concurrent use.
+func prefetchSizes(ctx context.Context, keychan <-chan key.Key, bs bstore.Blockstore, gcs key.KeySet, workers int, l *runLogger) *sizePrefetcher {
+	p := &sizePrefetcher{
+		bs:    bs,
+		gcs:   gcs,
+		jobs:  make(chan *sizeFetch, workers),
+		out:   make(chan key.Key, workers),
+		sizes: make(map[key.Key]*sizeFetch),
+	}
+	for i := 0; i < workers; i++ {
+		go p.work(ctx, l)
+	}
+	go p.forward(ctx, keychan)
+	return p
+}
+
+// forward hands the lookups of the unmarked keys to the workers and passes
+// every key on
+func (p *sizePrefetcher) forward(ctx context.Context, keychan <-chan key.Key) {
+	defer close(p.out)
+	defer close(p.jobs)
+	for {
+		select {
+		case k, ok := <-keychan:
+			if !ok {
+				return
+			}
+			if !p.gcs.Has(k) {
+				if f := p.start(k); f != nil {
+					select {
+					case p.jobs <- f:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			select {
+			case p.out <- k:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// start records a lookup for k, or returns nil if one is already waiting
+func (p *sizePrefetcher) start(k key.Key) *sizeFetch {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.sizes[k]; ok {
+		return nil
+	}
+	f := &sizeFetch{k: k, done: make(chan struct{}), size: -1}
+	p.sizes[k] = f
+	return f
+}
+
+func (p *sizePrefetcher) work(ctx context.Context, l *runLogger) {
+	for f := range p.jobs {
+		if ctx.Err() == nil {
+			if n, err := blockSize(p.bs, f.k); err != nil {
+				l.Debugf("error reading size of block %s: %s", f.k, err)
+			} else {
+				f.size = int64(n)
+			}
+		}
+		close(f.done)
+	}
+}
+
+// take removes the lookup of k, if there is one. Every key read from out is
+// taken, so that the lookups don't pile up.
+func (p *sizePrefetcher) take(k key.Key) *sizeFetch {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f := p.sizes[k]
+	delete(p.sizes, k)
+	return f
+}
+
+// wait returns the size looked up by f, or -1 if it couldn't be read or ctx
+// is done first
+func (f *sizeFetch) wait(ctx context.Context) int64 {
+	select {
+	case <-f.done:
+		return f.size
+	case <-ctx.Done():
+		return -1
+	}
+}
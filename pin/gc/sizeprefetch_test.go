@@ -0,0 +1,94 @@
+package gc
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+)
+
+// slowSizer answers size lookups after a delay, like a datastore across the
+// network, and records how many were answered at once
+type slowSizer struct {
+	bstore.GCBlockstore
+	latency time.Duration
+
+	mu      sync.Mutex
+	running int
+	max     int
+}
+
+func (bs *slowSizer) GetSize(k key.Key) (int, error) {
+	bs.mu.Lock()
+	bs.running++
+	if bs.running > bs.max {
+		bs.max = bs.running
+	}
+	bs.mu.Unlock()
+	defer func() {
+		bs.mu.Lock()
+		bs.running--
+		bs.mu.Unlock()
+	}()
+
+	time.Sleep(bs.latency)
+	blk, err := bs.Get(k)
+	if err != nil {
+		return 0, err
+	}
+	return len(blk.RawData()), nil
+}
+
+func TestGCSizePrefetch(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	pinned := e.addNode(t, "pinned")
+	if err := e.pn.Pin(ctx, pinned, true); err != nil {
+		t.Fatal(err)
+	}
+	var size uint64
+	for i := 0; i < 40; i++ {
+		size += uint64(len(e.addNode(t, fmt.Sprintf("garbage %d", i)).RawData()))
+	}
+	bs := &slowSizer{GCBlockstore: e.bs, latency: time.Millisecond}
+
+	res, err := RunGC(ctx, bs, e.pn, nil, WithSizePrefetch(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.BlocksRemoved != 40 || res.BytesFreed != size {
+		t.Fatalf("expected 40 blocks and %d bytes removed, got %d and %d", size, res.BlocksRemoved, res.BytesFreed)
+	}
+	if bs.max < 2 {
+		t.Fatal("sizes were looked up one at a time")
+	}
+	if !e.has(t, pinned) {
+		t.Fatal("pinned block was removed")
+	}
+}
+
+// BenchmarkSizePrefetch estimates the reclaimable space of a store whose
+// size lookups each take 100µs, looking the sizes up as the sweep gets to
+// them and with workers ahead of it
+func BenchmarkSizePrefetch(b *testing.B) {
+	e := newTestEnv()
+	for i := 0; i < 2000; i++ {
+		e.addNode(b, fmt.Sprintf("garbage %d", i))
+	}
+	bs := &slowSizer{GCBlockstore: e.bs, latency: 100 * time.Microsecond}
+
+	for _, n := range []int{0, 4, 16} {
+		b.Run(fmt.Sprintf("workers-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, _, err := EstimateReclaimable(context.Background(), bs, e.pn, nil, WithSizePrefetch(n)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package gc
+
+import (
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+	bserv "github.com/ipfs/go-ipfs/blockservice"
+	offline "github.com/ipfs/go-ipfs/exchange/offline"
+	dag "github.com/ipfs/go-ipfs/merkledag"
+	pin "github.com/ipfs/go-ipfs/pin"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// GCSubtree works like GCWithResult, but only removes target and the blocks
+// below it, instead of listing every key of the blockstore. Every pin is
+// still marked, so a block of the subtree that a pin or a best-effort root
+// reaches is kept, however it is shared. Blocks of the subtree that are not
+// in the blockstore are skipped, as are the links below them.
+func GCSubtree(ctx context.Context, bs bstore.GCBlockstore, pn pin.Pinner, bestEffortRoots []*cid.Cid, target *cid.Cid, opts ...GCOption) (<-chan key.Key, <-chan GCResult, error) {
+	o := newGCOptions(opts)
+	o.subtree = target
+	unlocker, err := gcLock(bs, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	deletions, results, err := runGC(ctx, bs, unlocker, pn, bestEffortRoots, o)
+	return keysOf(ctx, deletions, results, err)
+}
+
+// listSubtree lists the unmarked blocks of bs below and including root, as
+// far as they are in bs. A marked node is not walked: the blocks below it
+// are marked too unless it is a direct pin or on the retain list, in which
+// case unmarked blocks below it are left alone rather than listed. The whole
+// subtree is read before any key is handed out, as the sweep would
+// otherwise delete nodes whose links are yet to be followed.
+func listSubtree(ctx context.Context, bs bstore.Blockstore, marked key.KeySet, root *cid.Cid) (<-chan key.Key, func() error, error) {
+	ds := &readRecorder{DAGService: dag.NewDAGService(bserv.New(bs, offline.Exchange(bs)))}
+
+	seen := make(map[key.Key]struct{})
+	visit := func(c *cid.Cid) bool {
+		k := key.Key(c.Hash())
+		if _, ok := seen[k]; ok || marked.Has(k) {
+			return false
+		}
+		seen[k] = struct{}{}
+		return true
+	}
+
+	if visit(root) {
+		nd, err := ds.Get(ctx, root)
+		switch err {
+		case nil:
+			if err := dag.EnumerateChildren(ctx, ds, nd, visit, true); err != nil {
+				return nil, nil, err
+			}
+		case dag.ErrNotFound:
+		default:
+			return nil, nil, err
+		}
+	}
+
+	out := make(chan key.Key, len(ds.keys))
+	for _, k := range ds.keys {
+		out <- k
+	}
+	close(out)
+	return out, func() error { return nil }, nil
+}
+
+// readRecorder is a DAGService that records the keys of the nodes it read,
+// leaving out the missing ones
+type readRecorder struct {
+	dag.DAGService
+	keys []key.Key
+}
+
+func (r *readRecorder) Get(ctx context.Context, c *cid.Cid) (*dag.Node, error) {
+	nd, err := r.DAGService.Get(ctx, c)
+	if err == nil {
+		r.keys = append(r.keys, key.Key(c.Hash()))
+	}
+	return nd, err
+}
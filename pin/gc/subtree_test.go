@@ -0,0 +1,61 @@
+package gc
+
+import (
+	"testing"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+)
+
+func TestGCSubtree(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	shared := e.addNode(t, "shared")
+	pinned := e.addNode(t, "pinned", shared)
+	if err := e.pn.Pin(ctx, pinned, true); err != nil {
+		t.Fatal(err)
+	}
+	below := e.addNode(t, "below")
+	own := e.addNode(t, "own", below)
+	target := e.addNode(t, "target", own, shared)
+	elsewhere := e.addNode(t, "elsewhere")
+
+	out, results, err := GCSubtree(ctx, e.bs, e.pn, nil, target.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := drain(out)
+	res := <-results
+	if len(res.Errors) != 0 {
+		t.Fatalf("unexpected errors: %v", res.Errors)
+	}
+	if len(removed) != 3 || res.BlocksRemoved != 3 {
+		t.Fatalf("expected the 3 unshared blocks of the subtree removed, got %d", len(removed))
+	}
+	for _, nd := range []*dag.Node{target, own, below} {
+		if e.has(t, nd) {
+			t.Fatalf("block %s of the subtree was kept", nd.Key())
+		}
+	}
+	for _, nd := range []*dag.Node{shared, pinned, elsewhere} {
+		if !e.has(t, nd) {
+			t.Fatalf("block %s outside the subtree or pinned was removed", nd.Key())
+		}
+	}
+
+	// a pinned target, or one already removed, removes nothing
+	for _, nd := range []*dag.Node{pinned, target} {
+		out, results, err := GCSubtree(ctx, e.bs, e.pn, nil, nd.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed := drain(out); len(removed) != 0 {
+			t.Fatalf("removed %d blocks below %s", len(removed), nd.Key())
+		}
+		if res := <-results; len(res.Errors) != 0 {
+			t.Fatalf("unexpected errors: %v", res.Errors)
+		}
+	}
+}
@@ -0,0 +1,824 @@
+package gc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-ipfs/blocks"
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+
+	mh "gx/ipfs/QmYf7ng2hG5XBtJA3tN34DQ2GUN5HNksEw1rLDkmr6vGku/go-multihash"
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	ds "gx/ipfs/QmbzuUusHqaLLoNTDEVLcSF6vZDHZDLPC7p4bztRvvkXxU/go-datastore"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+)
+
+// SweepError is the error reported for a block that could not be removed
+type SweepError struct {
+	Key key.Key
+	Err error
+}
+
+func (e *SweepError) Error() string {
+	return fmt.Sprintf("could not remove block %s: %s", e.Key, e.Err)
+}
+
+// OnDeleteError is the error reported when the WithOnDelete hook failed for
+// a block. The block itself was removed.
+type OnDeleteError struct {
+	Key key.Key
+	Err error
+}
+
+func (e *OnDeleteError) Error() string {
+	return fmt.Sprintf("removed block %s, but the delete hook failed: %s", e.Key, e.Err)
+}
+
+// SweepPanicError is reported when the sweep panicked, most likely inside
+// the blockstore. The sweep stopped at that point, so some garbage may
+// remain.
+type SweepPanicError struct {
+	// Value is the value the sweep panicked with
+	Value interface{}
+	// Stack is the stack trace of the panicking goroutine
+	Stack []byte
+}
+
+func (e *SweepPanicError) Error() string {
+	return fmt.Sprintf("the sweep panicked: %v", e.Value)
+}
+
+// newPanicError records the stack trace of a panic recovered with value v
+func newPanicError(v interface{}, l *runLogger) *SweepPanicError {
+	err := &SweepPanicError{Value: v, Stack: debug.Stack()}
+	l.Errorf("%s\n%s", err, err.Stack)
+	return err
+}
+
+// pendingDelete is a key queued for deletion along with its block size, or
+// -1 if the size is unknown
+type pendingDelete struct {
+	key  key.Key
+	size int64
+}
+
+// sweepEnv is the state shared by the sweepers of a run
+type sweepEnv struct {
+	ctx    context.Context
+	bs     bstore.GCBlockstore
+	gcs    key.KeySet
+	output chan<- GCDeletion
+	o      *gcOptions
+	p      *progressReporter
+
+	// recheck marks pins made since the mark phase, if enabled
+	recheck *pinRecheck
+
+	// limiter paces the deletions, if a deletion rate is set
+	limiter *tokenBucket
+
+	// times gives the write times of blocks when a minimum age is set
+	times bstore.Timestamper
+
+	// gate holds the sweepers back while the run is paused, if a control
+	// channel was given
+	gate *pauseGate
+
+	// seen holds the unmarked keys already handled, as some datastores
+	// list a key twice while they compact
+	seenMu sync.Mutex
+	seen   key.KeySet
+
+	// cursor follows the keys taken from the listing, if it takes a cursor
+	cursor *listCursor
+
+	// sizes looks up the sizes of the keys ahead of the sweepers, if enabled
+	sizes *sizePrefetcher
+
+	// stopped is closed once any sweeper hits an error
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func newSweepEnv(ctx context.Context, bs bstore.GCBlockstore, gcs key.KeySet, output chan<- GCDeletion, o *gcOptions, p *progressReporter, recheck *pinRecheck) *sweepEnv {
+	var times bstore.Timestamper
+	if o.minBlockAge > 0 {
+		var ok bool
+		if times, ok = bs.(bstore.Timestamper); !ok {
+			o.log.Warning("the blockstore doesn't record block write times, ignoring the minimum block age")
+		}
+	}
+	return &sweepEnv{
+		ctx:     ctx,
+		bs:      bs,
+		gcs:     gcs,
+		output:  output,
+		o:       o,
+		p:       p,
+		recheck: recheck,
+		limiter: newTokenBucket(o.deletionRate),
+		times:   times,
+		gate:    newPauseGate(o.control),
+		seen:    newSeenSet(gcs),
+		stopped: make(chan struct{}),
+	}
+}
+
+// newSeenSet returns the set for the unmarked keys handled by the sweep. As
+// there may be far more garbage than marked blocks, it spills to disk like
+// gcs when that is a disk backed set.
+func newSeenSet(gcs key.KeySet) key.KeySet {
+	if c, ok := gcs.(*countingKeySet); ok {
+		gcs = c.KeySet
+	}
+	if d, ok := gcs.(*diskKeySet); ok {
+		seen, err := NewDiskKeySet(d.parent, d.memLimit)
+		if err == nil {
+			return seen
+		}
+	}
+	return key.NewKeySet()
+}
+
+// firstSeen reports whether k is listed for the first time in the run, and
+// records it. A disk backed set that fails reports every key as seen, so
+// the sweep stops removing blocks rather than remove one twice.
+func (e *sweepEnv) firstSeen(k key.Key) bool {
+	e.seenMu.Lock()
+	defer e.seenMu.Unlock()
+	if e.seen.Has(k) {
+		return false
+	}
+	e.seen.Add(k)
+	return true
+}
+
+// closeSeen releases the set of handled keys once the sweep is over
+func (e *sweepEnv) closeSeen() {
+	if err := keySetErr(e.seen); err != nil {
+		e.o.log.Warningf("error recording the swept keys, garbage was left: %s", err)
+	}
+	closeKeySet(e.seen)
+}
+
+// stop makes every sweeper of the run stop
+func (e *sweepEnv) stop() {
+	e.stopOnce.Do(func() { close(e.stopped) })
+}
+
+// sweeper removes the blocks that are not in the marked set
+type sweeper struct {
+	*sweepEnv
+
+	batchSize    int
+	pending      []pendingDelete
+	pendingBytes uint64
+
+	// sinceCursor is the number of blocks removed since the sweep cursor
+	// was last saved
+	sinceCursor int
+
+	// sinceYield is the number of blocks looked at since the GC lock was
+	// last given up
+	sinceYield int
+
+	// fetch is the size lookup of the key being handled, if it was
+	// prefetched
+	fetch *sizeFetch
+
+	res GCResult
+}
+
+func newSweeper(env *sweepEnv) *sweeper {
+	s := &sweeper{
+		sweepEnv:  env,
+		batchSize: 1,
+	}
+	if _, ok := env.bs.(bstore.BatchDeleter); ok && env.o.deleteBatchSize > 1 {
+		s.batchSize = env.o.deleteBatchSize
+	}
+	if r := env.o.deletionRate; r > 0 && s.batchSize > r {
+		s.batchSize = r
+	}
+	if !env.o.dryRun {
+		s.res.DeleteBatchSize = s.batchSize
+	}
+	if env.o.histogramBounds != nil {
+		s.res.SizeHistogram = newSizeHistogram(env.o.histogramBounds)
+	}
+	return s
+}
+
+// sweep removes every key read from keychan that is not in the marked set
+// and sends it on the output channel, adding the totals to res. With a sweep
+// concurrency above one the keys are handed out to that many sweepers, so
+// they are sent in no particular order.
+func sweep(env *sweepEnv, keychan <-chan key.Key, res *GCResult) {
+	defer env.gate.stop()
+	o := env.o
+	n := o.sweepConcurrency
+	// a sweep towards a target or limit runs serially so that it stops as
+	// soon as enough has been removed, and a yielding sweep so that the lock
+	// is only given up between batches
+	if o.targetBytes > 0 || o.maxDeletions > 0 || o.yield != nil {
+		n = 1
+	}
+	prefetch := o.sizeWorkers > 0 && readsSizes(o)
+	if n > 1 || env.recheck != nil || prefetch {
+		// the marked set is not safe for concurrent use, and the recheck
+		// adds to it while the sweepers read it
+		env.gcs = &lockedKeySet{KeySet: env.gcs}
+	}
+
+	if env.recheck != nil {
+		if err := env.recheck.run(env.ctx, env.gcs); err != nil {
+			res.Errors = append(res.Errors, err)
+			return
+		}
+	}
+
+	if o.targetBytes > 0 || o.deletionOrder == LargestFirst {
+		if sz, ok := env.bs.(bstore.Sizer); ok {
+			keychan = largestFirst(keychan, env.gcs, sz, o.log)
+			// the keys are no longer taken in list order
+			env.cursor = nil
+		} else if o.targetBytes == 0 {
+			o.log.Warning("the blockstore can't report block sizes, removing blocks in list order")
+		}
+	}
+
+	if prefetch {
+		ctx, cancel := context.WithCancel(env.ctx)
+		defer cancel()
+		env.sizes = prefetchSizes(ctx, keychan, env.bs, env.gcs, o.sizeWorkers, o.log)
+		keychan = env.sizes.out
+	}
+
+	if n <= 1 {
+		s := newSweeper(env)
+		s.run(keychan)
+		res.add(s.res)
+		return
+	}
+
+	sweepers := make([]*sweeper, n)
+	var wg sync.WaitGroup
+	for i := range sweepers {
+		s := newSweeper(env)
+		sweepers[i] = s
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.run(keychan)
+		}()
+	}
+	wg.Wait()
+
+	for _, s := range sweepers {
+		res.add(s.res)
+	}
+}
+
+// run sweeps the keys read from keychan until it is closed, the context is
+// done, or an error aborts the sweep
+func (s *sweeper) run(keychan <-chan key.Key) {
+	// a panic stops every sweeper, whether or not the run continues on
+	// errors, as the blockstore can't be trusted past it
+	defer func() {
+		if r := recover(); r != nil {
+			s.report(newPanicError(r, s.o.log))
+			s.stop()
+		}
+	}()
+	// queued keys were found to be garbage while holding the lock, so they are
+	// deleted even when the sweep is cut short
+	defer s.flush()
+
+	for {
+		select {
+		case k, ok := <-keychan:
+			if !ok {
+				s.cursor.ended()
+				return
+			}
+			s.cursor.took(k)
+			s.fetch = s.sizes.take(k)
+			s.p.scannedKey()
+			if !s.waitWhilePaused() {
+				return
+			}
+			if !s.maybeYield() {
+				return
+			}
+			if s.gcs.Has(k) {
+				continue
+			}
+			// only unmarked keys are remembered, marked ones are
+			// never removed however often they are listed
+			if !s.firstSeen(k) {
+				continue
+			}
+			if s.o.protect != nil && s.o.protect(k) {
+				continue
+			}
+			if s.tooYoung(k) {
+				continue
+			}
+			if !s.collect(k) {
+				return
+			}
+			if s.reachedTarget() {
+				if s.o.maxDeletions > 0 {
+					s.countRemaining(keychan)
+				}
+				return
+			}
+		case <-s.stopped:
+			return
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// tooYoung reports whether k was written too recently to be removed
+func (s *sweeper) tooYoung(k key.Key) bool {
+	if s.times == nil {
+		return false
+	}
+	t, err := s.times.WriteTime(k)
+	if err != nil {
+		s.o.log.Debugf("error reading write time of block %s: %s", k, err)
+		return true
+	}
+	return time.Since(t) < s.o.minBlockAge
+}
+
+// collect handles a key that is not in the marked set. It returns false if
+// the sweep should stop.
+func (s *sweeper) collect(k key.Key) bool {
+	if s.o.dryRun {
+		size := int64(-1)
+		if s.o.sizeDryRun {
+			size = s.size(k)
+		}
+		return s.emit(pendingDelete{key: k, size: size})
+	}
+
+	if s.o.verify || s.o.quarantine != nil {
+		// the approval comes first so that a retained block is not
+		// copied into the quarantine
+		if s.o.approve != nil && !s.approved(k, s.size(k)) {
+			return true
+		}
+		n, err := s.prepare(k)
+		if err != nil {
+			if s.phantom(k, err) {
+				return true
+			}
+			s.o.log.Warningf("not removing block %s: %s", k, err)
+			s.report(&SweepError{Key: k, Err: err})
+			return true
+		}
+		return s.queue(k, int64(n))
+	}
+
+	size := int64(-1)
+	if sizesNeeded(s.o) || isSizer(s.bs) {
+		size = s.size(k)
+	}
+	if !s.approved(k, size) {
+		return true
+	}
+	return s.queue(k, size)
+}
+
+// size returns the size of the block stored under k, or -1 if it can't be
+// read
+func (s *sweeper) size(k key.Key) int64 {
+	if f := s.fetch; f != nil && f.k == k {
+		s.fetch = nil
+		return f.wait(s.ctx)
+	}
+	n, err := blockSize(s.bs, k)
+	if err != nil {
+		s.o.log.Debugf("error reading size of block %s: %s", k, err)
+		return -1
+	}
+	return int64(n)
+}
+
+// readsSizes reports whether the sweep looks up the size of the blocks it
+// removes, rather than having it from reading the block or not needing it
+func readsSizes(o *gcOptions) bool {
+	if o.dryRun {
+		return o.sizeDryRun
+	}
+	return (!(o.verify || o.quarantine != nil) && sizesNeeded(o)) || o.approve != nil
+}
+
+// sizesNeeded reports whether anything reads the size of the removed blocks:
+// the caller through the result, or the options of the run. Without a Sizer
+// a size costs a read of the block, not worth it for a plain GC.
+func sizesNeeded(o *gcOptions) bool {
+	if !o.sizesUnused || o.targetBytes > 0 || o.approve != nil {
+		return true
+	}
+	if o.events != nil || o.histogramBounds != nil {
+		return true
+	}
+	_, nop := o.metrics.(NopMetrics)
+	return !nop
+}
+
+// isSizer reports whether bs gives block sizes without reading the blocks
+func isSizer(bs bstore.Blockstore) bool {
+	_, ok := bs.(bstore.Sizer)
+	return ok
+}
+
+// approved reports whether the approval callback, if any, lets k be
+// removed, counting the blocks it retains
+func (s *sweeper) approved(k key.Key, size int64) bool {
+	if s.o.approve == nil || s.o.approve(k, size) {
+		return true
+	}
+	s.o.log.Debugf("block %s retained by policy", k)
+	s.res.RetainedByPolicy++
+	return false
+}
+
+// queue adds k to the blocks to delete, flushing them once there are enough.
+// It returns false if the sweep should stop.
+func (s *sweeper) queue(k key.Key, size int64) bool {
+	s.pending = append(s.pending, pendingDelete{key: k, size: size})
+	if size > 0 {
+		s.pendingBytes += uint64(size)
+	}
+	if len(s.pending) < s.batchSize && !s.reachedTarget() {
+		return true
+	}
+	return s.flush()
+}
+
+// reachedTarget reports whether the queued and deleted blocks add up to the
+// target of the run in bytes, or to its maximum number of deletions, if it
+// has either
+func (s *sweeper) reachedTarget() bool {
+	if t := s.o.targetBytes; t > 0 && s.res.BytesFreed+s.pendingBytes >= t {
+		return true
+	}
+	m := s.o.maxDeletions
+	return m > 0 && s.res.BlocksRemoved+len(s.pending) >= m
+}
+
+// countRemaining counts the unmarked keys left in keychan, without removing
+// them, once the sweep reached its maximum number of deletions
+func (s *sweeper) countRemaining(keychan <-chan key.Key) {
+	for {
+		select {
+		case k, ok := <-keychan:
+			if !ok {
+				return
+			}
+			if s.gcs.Has(k) || !s.firstSeen(k) {
+				continue
+			}
+			if s.o.protect != nil && s.o.protect(k) {
+				continue
+			}
+			s.res.RemainingBlocks++
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// flush deletes the queued keys and sends them on the output channel. It
+// returns false if the sweep should stop.
+func (s *sweeper) flush() bool {
+	if len(s.pending) == 0 {
+		return true
+	}
+	pending := s.pending
+	s.pending = nil
+	s.pendingBytes = 0
+
+	if s.recheck != nil {
+		if err := s.recheck.run(s.ctx, s.gcs); err != nil {
+			s.fail(err)
+			s.stop()
+			return false
+		}
+		pending = s.unmarked(pending)
+		if len(pending) == 0 {
+			return true
+		}
+	}
+
+	// a cancelled sweep leaves the keys waiting for their turn, one that
+	// ran out of time removes them to stop cleanly
+	err := s.limiter.wait(s.ctx, len(pending))
+	if err != nil && err != context.DeadlineExceeded {
+		return false
+	}
+	ok := err == nil
+
+	if len(pending) == 1 {
+		return s.deleteOne(pending[0]) && ok
+	}
+
+	keys := make([]key.Key, len(pending))
+	for i, p := range pending {
+		keys[i] = p.key
+	}
+	if err := s.bs.(bstore.BatchDeleter).DeleteBlocks(keys); err != nil {
+		s.o.log.Warningf("error removing a batch of %d blocks, retrying one at a time: %s", len(keys), err)
+		// find out which key failed by removing whatever is left one at a
+		// time, so that the error reported names it
+		return s.retry(pending) && ok
+	}
+
+	// account for the whole batch first, so the totals stay correct if the
+	// context is cancelled while the keys are being sent
+	for _, p := range pending {
+		if !s.deleted(p) {
+			ok = false
+		}
+	}
+	for _, p := range pending {
+		if !s.emit(p) {
+			return false
+		}
+	}
+	return ok
+}
+
+// maybeYield gives up the GC lock for a moment once the run has looked at
+// enough blocks since the last time, deleting the queued blocks first. Pins
+// made in the meantime are marked once the lock is back. It returns false if
+// the sweep should stop.
+func (s *sweeper) maybeYield() bool {
+	if s.o.yield == nil {
+		return true
+	}
+	if s.sinceYield++; s.sinceYield < s.o.yieldEvery {
+		return true
+	}
+	s.sinceYield = 0
+	if !s.flush() {
+		return false
+	}
+
+	s.o.yield.yield()
+	if err := s.recheck.run(s.ctx, s.gcs); err != nil {
+		s.fail(err)
+		s.stop()
+		return false
+	}
+	return s.ctx.Err() == nil
+}
+
+// unmarked returns the pending deletes that are not in the marked set
+func (s *sweeper) unmarked(pending []pendingDelete) []pendingDelete {
+	out := pending[:0]
+	for _, p := range pending {
+		if !s.gcs.Has(p.key) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// deleteOne removes a single block. It returns false if the sweep should
+// stop.
+func (s *sweeper) deleteOne(p pendingDelete) bool {
+	err := s.bs.DeleteBlock(p.key)
+	if err != nil {
+		if s.phantom(p.key, err) {
+			return true
+		}
+		s.o.log.Warningf("error removing block %s: %s", p.key, err)
+		s.fail(&SweepError{Key: p.key, Err: err})
+		return s.o.continueOnError
+	}
+	ok := s.deleted(p)
+	return s.emit(p) && ok
+}
+
+// retry deletes the keys of a failed batch one by one, stopping at the first
+// failure unless the run continues on errors. Blocks that the batch removed
+// before failing are counted as deleted.
+func (s *sweeper) retry(pending []pendingDelete) bool {
+	ok := true
+	for _, p := range pending {
+		has, err := s.bs.Has(p.key)
+		if err == nil && !has {
+			if !s.deleted(p) {
+				ok = false
+			}
+			if !s.emit(p) {
+				return false
+			}
+			continue
+		}
+		// once stopped, the rest of the batch is only checked for blocks
+		// it removed
+		if ok && !s.deleteOne(p) {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// phantom records k as a phantom key if the run records them and err says
+// that its block is not there. It returns false for any other error, which
+// is then handled as usual.
+func (s *sweeper) phantom(k key.Key, err error) bool {
+	if !s.o.phantomKeys || (err != bstore.ErrNotFound && err != ds.ErrNotFound) {
+		return false
+	}
+	s.o.log.Warningf("block %s was listed but can't be found", k)
+	s.res.PhantomKeys = append(s.res.PhantomKeys, k)
+	return true
+}
+
+// report records a sweep error
+func (s *sweeper) report(err error) {
+	s.res.Errors = append(s.res.Errors, err)
+	if s.o.errorSink != nil {
+		s.o.errorSink(err)
+	}
+	sendEvent(s.ctx, s.o, errorEvent(err))
+}
+
+// fail records a sweep error, and stops every sweeper unless the run
+// continues on errors
+func (s *sweeper) fail(err error) {
+	s.report(err)
+	if !s.o.continueOnError {
+		s.stop()
+	}
+}
+
+// deleted accounts for a removed block and calls the delete hook. It returns
+// false if the hook failed and the sweep should stop.
+func (s *sweeper) deleted(p pendingDelete) bool {
+	s.p.deletedKey()
+	s.o.metrics.BlockDeleted(p.size)
+	sendEvent(s.ctx, s.o, BlockDeleted{Key: p.key, Size: p.size})
+	s.res.BlocksRemoved++
+	if p.size > 0 {
+		s.res.BytesFreed += uint64(p.size)
+	}
+	if s.res.SizeHistogram != nil {
+		s.res.SizeHistogram.add(p.size)
+	}
+	if s.o.checkpoint != nil && s.cursor != nil {
+		if s.sinceCursor++; s.sinceCursor >= cursorInterval {
+			saveCursor(s.o.checkpoint, s.cursor.String(), s.o.log)
+			s.sinceCursor = 0
+		}
+	}
+	if s.o.onDelete != nil {
+		if err := s.o.onDelete(p.key); err != nil {
+			s.o.log.Warningf("delete hook failed for block %s: %s", p.key, err)
+			s.fail(&OnDeleteError{Key: p.key, Err: err})
+			return s.o.continueOnError
+		}
+	}
+	return true
+}
+
+// emit sends p on the output channel, it returns false if the context is
+// done first
+func (s *sweeper) emit(p pendingDelete) bool {
+	select {
+	case s.output <- GCDeletion{Key: p.key, Size: p.size}:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+// add merges the sweep totals of r into res
+func (res *GCResult) add(r GCResult) {
+	res.BlocksRemoved += r.BlocksRemoved
+	res.BytesFreed += r.BytesFreed
+	res.Errors = append(res.Errors, r.Errors...)
+	res.RemainingBlocks += r.RemainingBlocks
+	res.RetainedByPolicy += r.RetainedByPolicy
+	res.PhantomKeys = append(res.PhantomKeys, r.PhantomKeys...)
+	if r.DeleteBatchSize > res.DeleteBatchSize {
+		res.DeleteBatchSize = r.DeleteBatchSize
+	}
+	if r.SizeHistogram != nil {
+		if res.SizeHistogram == nil {
+			res.SizeHistogram = newSizeHistogram(r.SizeHistogram.Bounds)
+		}
+		res.SizeHistogram.merge(r.SizeHistogram)
+	}
+}
+
+// lockedKeySet guards a KeySet shared by several sweepers
+type lockedKeySet struct {
+	key.KeySet
+	mu sync.Mutex
+}
+
+func (s *lockedKeySet) Has(k key.Key) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.KeySet.Has(k)
+}
+
+func (s *lockedKeySet) Add(k key.Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.KeySet.Add(k)
+}
+
+func (s *lockedKeySet) probabilistic() bool {
+	return isProbabilistic(s.KeySet)
+}
+
+// largestFirst reads every unmarked key from keychan and returns a channel
+// that yields them from the largest block to the smallest
+func largestFirst(keychan <-chan key.Key, gcs key.KeySet, sz bstore.Sizer, l *runLogger) <-chan key.Key {
+	var blocks []pendingDelete
+	for k := range keychan {
+		if gcs.Has(k) {
+			continue
+		}
+		n, err := sz.GetSize(k)
+		if err != nil {
+			l.Debugf("error reading size of block %s: %s", k, err)
+			n = -1
+		}
+		blocks = append(blocks, pendingDelete{key: k, size: int64(n)})
+	}
+	sort.Sort(bySizeDesc(blocks))
+
+	out := make(chan key.Key, len(blocks))
+	for _, b := range blocks {
+		out <- b.key
+	}
+	close(out)
+	return out
+}
+
+type bySizeDesc []pendingDelete
+
+func (b bySizeDesc) Len() int           { return len(b) }
+func (b bySizeDesc) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b bySizeDesc) Less(i, j int) bool { return b[i].size > b[j].size }
+
+// ErrCorruptBlock is reported for a block whose data doesn't match its key
+var ErrCorruptBlock = errors.New("gc: block data does not match its hash")
+
+// prepare reads the block for k ahead of its deletion, checking it against
+// its hash and copying it into the quarantine as configured, and returns its
+// size. An error means the block must be kept.
+func (s *sweeper) prepare(k key.Key) (int, error) {
+	blk, err := s.bs.Get(k)
+	if err == bstore.ErrHashMismatch {
+		return 0, ErrCorruptBlock
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if s.o.verify {
+		if err := verifyBlock(k, blk); err != nil {
+			return 0, err
+		}
+	}
+	if s.o.quarantine != nil {
+		if err := s.o.quarantine.Put(blk); err != nil {
+			return 0, &QuarantineError{Err: err}
+		}
+	}
+	return len(blk.RawData()), nil
+}
+
+// verifyBlock checks that the data of blk hashes to k, using the hash
+// function named in k
+func verifyBlock(k key.Key, blk blocks.Block) error {
+	dec, err := mh.Decode([]byte(k))
+	if err != nil {
+		return err
+	}
+	sum, err := mh.Sum(blk.RawData(), dec.Code, dec.Length)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, []byte(k)) {
+		return ErrCorruptBlock
+	}
+	return nil
+}
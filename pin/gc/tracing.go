@@ -0,0 +1,50 @@
+package gc
+
+import (
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+)
+
+// Tracer creates the spans garbage collection is traced with, so that any
+// tracing backend can be plugged in. It is passed down in the context, see
+// ContextWithTracer; without one nothing is traced.
+//
+// The mark phase gets a "gc.mark" span, with a "gc.descendants" span for
+// every root walked below it, and the sweep a "gc.sweep" span that records
+// the blocks it removed. A mark phase with WithMarkConcurrency walks its
+// roots together, under a single "gc.descendants" span.
+type Tracer interface {
+	// StartSpan starts a span named name, as a child of the span carried
+	// by ctx if there is one, and returns a context carrying the new span
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is an operation being traced
+type Span interface {
+	// SetTag records an attribute of the operation
+	SetTag(key string, value interface{})
+	// Finish ends the operation
+	Finish()
+}
+
+type tracerKey struct{}
+
+// ContextWithTracer returns a copy of ctx that makes the functions of this
+// package it is passed to trace their work with t
+func ContextWithTracer(ctx context.Context, t Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+// startSpan starts a span with the tracer carried by ctx, or a span that
+// records nothing if there is none
+func startSpan(ctx context.Context, name string) (context.Context, Span) {
+	t, ok := ctx.Value(tracerKey{}).(Tracer)
+	if !ok || t == nil {
+		return ctx, nopSpan{}
+	}
+	return t.StartSpan(ctx, name)
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetTag(string, interface{}) {}
+func (nopSpan) Finish()                    {}
@@ -0,0 +1,84 @@
+package gc
+
+import (
+	"sync"
+	"testing"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+)
+
+type spanKey struct{}
+
+// recordingTracer keeps every span it starts
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	name     string
+	parent   string
+	tags     map[string]interface{}
+	finished bool
+}
+
+func (t *recordingTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	s := &recordedSpan{name: name, tags: make(map[string]interface{})}
+	if p, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+		s.parent = p.name
+	}
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *recordedSpan) SetTag(key string, value interface{}) { s.tags[key] = value }
+func (s *recordedSpan) Finish()                              { s.finished = true }
+
+func TestGCTracing(t *testing.T) {
+	e := newTestEnv()
+	root := e.addNode(t, "root", e.addNode(t, "child"))
+	other := e.addNode(t, "other")
+	ctx := context.Background()
+	for _, nd := range []*dag.Node{root, other} {
+		if err := e.pn.Pin(ctx, nd, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.addNode(t, "garbage")
+
+	tr := &recordingTracer{}
+	out, results, err := GCWithResult(ContextWithTracer(ctx, tr), e.bs, e.pn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	<-results
+
+	count := make(map[string]int)
+	for _, s := range tr.spans {
+		if !s.finished {
+			t.Fatalf("span %s was not finished", s.name)
+		}
+		count[s.name]++
+		switch s.name {
+		case "gc.mark", "gc.sweep":
+			if s.parent != "" {
+				t.Fatalf("expected %s to start from the incoming context, its parent is %s", s.name, s.parent)
+			}
+		case "gc.descendants":
+			if s.parent != "gc.mark" || s.tags["root"] == nil {
+				t.Fatalf("expected a root span below the mark span, got %+v", s)
+			}
+		}
+		if s.name == "gc.sweep" && s.tags["blocks_deleted"] != 1 {
+			t.Fatalf("expected the sweep span to record 1 deleted block, got %v", s.tags["blocks_deleted"])
+		}
+	}
+	if count["gc.mark"] != 1 || count["gc.sweep"] != 1 || count["gc.descendants"] != 2 {
+		t.Fatalf("unexpected spans %v", count)
+	}
+}
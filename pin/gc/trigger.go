@@ -0,0 +1,30 @@
+package gc
+
+import (
+	"errors"
+
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+)
+
+// ErrSpaceUnknown is returned by ShouldGC when the blockstore can't report
+// how much space it uses
+var ErrSpaceUnknown = errors.New("gc: the blockstore does not report its space usage")
+
+// ShouldGC reports whether bs uses more than watermark percent of the space it
+// may use, so that a scheduler can run GC once it does. It returns
+// ErrSpaceUnknown if bs doesn't implement blockstore.SpaceReporter or reports
+// no total.
+func ShouldGC(bs bstore.Blockstore, watermark int) (bool, error) {
+	sr, ok := bs.(bstore.SpaceReporter)
+	if !ok {
+		return false, ErrSpaceUnknown
+	}
+	used, total, err := sr.SpaceUsage()
+	if err != nil {
+		return false, err
+	}
+	if total == 0 {
+		return false, ErrSpaceUnknown
+	}
+	return used*100 > total*uint64(watermark), nil
+}
@@ -0,0 +1,53 @@
+package gc
+
+import (
+	"errors"
+	"testing"
+
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+)
+
+// spaceBlockstore reports fixed space usage
+type spaceBlockstore struct {
+	bstore.GCBlockstore
+	used, total uint64
+	err         error
+}
+
+func (bs *spaceBlockstore) SpaceUsage() (uint64, uint64, error) {
+	return bs.used, bs.total, bs.err
+}
+
+func TestShouldGC(t *testing.T) {
+	e := newTestEnv()
+	if _, err := ShouldGC(e.bs, 90); err != ErrSpaceUnknown {
+		t.Fatalf("expected ErrSpaceUnknown, got %v", err)
+	}
+
+	for _, c := range []struct {
+		used, total uint64
+		should      bool
+	}{
+		{used: 50, total: 100, should: false},
+		{used: 90, total: 100, should: false},
+		{used: 91, total: 100, should: true},
+		{used: 200, total: 100, should: true},
+	} {
+		bs := &spaceBlockstore{GCBlockstore: e.bs, used: c.used, total: c.total}
+		should, err := ShouldGC(bs, 90)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if should != c.should {
+			t.Fatalf("%d of %d used: expected %t, got %t", c.used, c.total, c.should, should)
+		}
+	}
+
+	if _, err := ShouldGC(&spaceBlockstore{GCBlockstore: e.bs, used: 10}, 90); err != ErrSpaceUnknown {
+		t.Fatalf("expected ErrSpaceUnknown without a total, got %v", err)
+	}
+	errUsage := errors.New("usage")
+	if _, err := ShouldGC(&spaceBlockstore{GCBlockstore: e.bs, err: errUsage}, 90); err != errUsage {
+		t.Fatalf("expected the usage error, got %v", err)
+	}
+}
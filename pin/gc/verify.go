@@ -0,0 +1,201 @@
+package gc
+
+import (
+	"fmt"
+
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+	dag "github.com/ipfs/go-ipfs/merkledag"
+	pin "github.com/ipfs/go-ipfs/pin"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+// DanglingPin is a pin whose DAG can't be fully resolved
+type DanglingPin struct {
+	// Root is the pinned block
+	Root *cid.Cid
+	// Recursive tells recursive pins from direct ones
+	Recursive bool
+	// Missing is the first block found missing, Root itself if the root is
+	// gone. It is nil if the walk failed for another reason.
+	Missing *cid.Cid
+	// Err is the error that stopped the walk
+	Err error
+}
+
+// VerifyPins checks that the blocks of every recursive pin, and the block of
+// every direct pin, can be fetched from ds, and returns the pins that can't
+// be fully resolved. Such pins make GC fail with an *ErrPinIncomplete.
+// Nothing is modified. The check stops early, with the pins found so far,
+// if ctx is cancelled.
+func VerifyPins(ctx context.Context, pn pin.Pinner, ds dag.DAGService) []DanglingPin {
+	pn = pinsOf(pn)
+	ds = newNodeCache(ds, DefaultNodeCacheSize)
+
+	var dangling []DanglingPin
+	// blocks below a complete pin need not be walked again. Blocks below a
+	// dangling one must, as the missing block may be under them.
+	complete := key.NewKeySet()
+	for _, root := range pn.RecursiveKeys() {
+		walked := &unionKeySet{KeySet: key.NewKeySet(), known: complete}
+		err := Descendants(ctx, ds, walked, []*cid.Cid{root}, false)
+		if ctx.Err() != nil {
+			return dangling
+		}
+		if err != nil {
+			dangling = append(dangling, danglingPin(root, true, err))
+			continue
+		}
+		for _, k := range walked.Keys() {
+			complete.Add(k)
+		}
+	}
+
+	for _, root := range pn.DirectKeys() {
+		_, err := ds.Get(ctx, root)
+		if ctx.Err() != nil {
+			return dangling
+		}
+		if err == dag.ErrNotFound {
+			err = &ErrPinIncomplete{Root: root, Missing: root}
+		}
+		if err != nil {
+			dangling = append(dangling, danglingPin(root, false, err))
+		}
+	}
+	return dangling
+}
+
+// PinCoverage tells how much of the DAG of a pin is stored
+type PinCoverage struct {
+	// Root is the pinned block
+	Root *cid.Cid
+	// Type is pin.Recursive or pin.Direct
+	Type pin.PinMode
+	// BlocksFound is the number of blocks of the pin that were found, the
+	// root included. Blocks only linked from below a missing block can't
+	// be reached, and are not counted.
+	BlocksFound int
+	// Complete is set when no block of the pin is missing
+	Complete bool
+	// Err is an error other than a missing block that stopped the walk
+	Err error
+}
+
+// PinCoverageReport walks the DAG of every recursive pin, and the block of
+// every direct pin, through ds and reports how many of their blocks were
+// found and whether they are complete, as a check of what GC will keep.
+// Unlike VerifyPins the walk goes on past missing blocks, counting all that
+// can be reached. Nothing is modified. The report stops early, with the pins
+// walked so far, if ctx is cancelled.
+func PinCoverageReport(ctx context.Context, pn pin.Pinner, ds dag.DAGService) []PinCoverage {
+	pn = pinsOf(pn)
+	ds = newNodeCache(ds, DefaultNodeCacheSize)
+
+	var report []PinCoverage
+	for _, root := range pn.RecursiveKeys() {
+		cov := pinCoverage(ctx, ds, root, pin.Recursive)
+		if ctx.Err() != nil {
+			return report
+		}
+		report = append(report, cov)
+	}
+	for _, root := range pn.DirectKeys() {
+		cov := pinCoverage(ctx, ds, root, pin.Direct)
+		if ctx.Err() != nil {
+			return report
+		}
+		report = append(report, cov)
+	}
+	return report
+}
+
+// pinCoverage counts the stored blocks of the pin of root
+func pinCoverage(ctx context.Context, ds dag.DAGService, root *cid.Cid, mode pin.PinMode) PinCoverage {
+	cov := PinCoverage{Root: root, Type: mode}
+	rec := &missingRecorder{DAGService: ds}
+	set := &countingKeySet{KeySet: key.NewKeySet()}
+
+	var err error
+	if mode == pin.Recursive {
+		// a missing root fails the walk even when best-effort, and is
+		// recorded all the same
+		err = Descendants(ctx, rec, set, []*cid.Cid{root}, true)
+	} else {
+		set.Add(key.Key(root.Hash()))
+		_, err = rec.Get(ctx, root)
+	}
+	if err != nil && len(rec.missing) == 0 {
+		cov.Err = err
+		return cov
+	}
+	// missing blocks are marked before they are looked for
+	cov.BlocksFound = set.Len() - len(rec.missing)
+	cov.Complete = err == nil && len(rec.missing) == 0
+	return cov
+}
+
+// ErrMissingRoots is returned by GC before marking when the blocks of some
+// recursive or direct pins are not in the blockstore, listing all of them
+// at once rather than stopping on the first
+type ErrMissingRoots struct {
+	// Missing are the pins whose block is missing
+	Missing []*cid.Cid
+	// Pins is the number of pins that were checked
+	Pins int
+}
+
+func (e *ErrMissingRoots) Error() string {
+	return fmt.Sprintf("%d of %d pins are missing their root block, first: %s", len(e.Missing), e.Pins, e.Missing[0])
+}
+
+// checkPinnedRoots returns an *ErrMissingRoots if the block of a recursive
+// or direct pin of pn is not in bs. Only the roots are looked up, the
+// blocks below them are checked by the walk.
+func checkPinnedRoots(bs bstore.Blockstore, pn pin.Pinner, l *runLogger) error {
+	seen := make(map[key.Key]bool)
+	var missing []*cid.Cid
+	for _, cids := range [][]*cid.Cid{pn.RecursiveKeys(), pn.DirectKeys()} {
+		for _, c := range cids {
+			k := key.Key(c.Hash())
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			has, err := bs.Has(k)
+			if err != nil {
+				return err
+			}
+			if !has {
+				l.Warningf("block of pin %s is missing", c)
+				missing = append(missing, c)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return &ErrMissingRoots{Missing: missing, Pins: len(seen)}
+	}
+	return nil
+}
+
+func danglingPin(root *cid.Cid, recursive bool, err error) DanglingPin {
+	log.Warningf("gc: pin %s can't be resolved: %s", root, err)
+	d := DanglingPin{Root: root, Recursive: recursive, Err: err}
+	if perr, ok := err.(*ErrPinIncomplete); ok {
+		d.Missing = perr.Missing
+	}
+	return d
+}
+
+// unionKeySet adds keys to its own set, and reports as present the keys of
+// either set
+type unionKeySet struct {
+	key.KeySet
+	known key.KeySet
+}
+
+func (s *unionKeySet) Has(k key.Key) bool {
+	return s.KeySet.Has(k) || s.known.Has(k)
+}
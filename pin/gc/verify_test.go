@@ -0,0 +1,164 @@
+package gc
+
+import (
+	"fmt"
+	"testing"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+	pin "github.com/ipfs/go-ipfs/pin"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	cid "gx/ipfs/QmfSc2xehWmWLnwwYR91Y8QF4xdASypTFVknutoKQS3GHp/go-cid"
+)
+
+func TestVerifyPins(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	// complete shares a subtree with brokenLeaf, which also links to a
+	// missing leaf
+	lost := e.addNode(t, "lost leaf")
+	shared := e.addNode(t, "shared", e.addNode(t, "shared leaf"))
+	complete := e.addNode(t, "complete", shared)
+	brokenLeaf := e.addNode(t, "broken leaf", shared, lost)
+	brokenRoot := e.addNode(t, "broken root", e.addNode(t, "child"))
+	direct := e.addNode(t, "direct")
+	lostDirect := e.addNode(t, "lost direct")
+
+	for _, nd := range []*dag.Node{complete, brokenLeaf, brokenRoot} {
+		if err := e.pn.Pin(ctx, nd, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, nd := range []*dag.Node{direct, lostDirect} {
+		if err := e.pn.Pin(ctx, nd, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, nd := range []*dag.Node{lost, brokenRoot, lostDirect} {
+		if err := e.bs.DeleteBlock(nd.Key()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exp := map[string]*dag.Node{
+		brokenLeaf.Cid().String(): lost,
+		brokenRoot.Cid().String(): brokenRoot,
+		lostDirect.Cid().String(): lostDirect,
+	}
+	dangling := VerifyPins(ctx, e.pn, e.dserv)
+	if len(dangling) != len(exp) {
+		t.Fatalf("expected %d dangling pins, got %v", len(exp), dangling)
+	}
+	for _, d := range dangling {
+		missing, ok := exp[d.Root.String()]
+		if !ok {
+			t.Fatalf("%s reported as dangling", d.Root)
+		}
+		if d.Missing == nil || !d.Missing.Equals(missing.Cid()) {
+			t.Fatalf("expected %s missing below %s, got %v", missing.Cid(), d.Root, d.Missing)
+		}
+		if d.Recursive != (d.Root.String() != lostDirect.Cid().String()) {
+			t.Fatalf("wrong pin kind for %s", d.Root)
+		}
+	}
+
+	if !e.has(t, complete) || !e.has(t, shared) {
+		t.Fatal("VerifyPins removed blocks")
+	}
+}
+
+func TestGCMissingRoots(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	var lost []*cid.Cid
+	for i := 0; i < 5; i++ {
+		nd := e.addNode(t, fmt.Sprintf("pin %d", i))
+		if err := e.pn.Pin(ctx, nd, i%2 == 0); err != nil {
+			t.Fatal(err)
+		}
+		// one recursive and one direct pin lose their block
+		if i < 2 {
+			if err := e.bs.DeleteBlock(nd.Key()); err != nil {
+				t.Fatal(err)
+			}
+			lost = append(lost, nd.Cid())
+		}
+	}
+	garbage := e.addNode(t, "garbage")
+
+	_, err := RunGC(ctx, e.bs, e.pn, nil)
+	merr, ok := err.(*ErrMissingRoots)
+	if !ok {
+		t.Fatalf("expected the missing roots to be listed, got %v", err)
+	}
+	if merr.Pins != 5 || !sameCids(merr.Missing, lost) {
+		t.Fatalf("expected %v missing of 5 pins, got %v of %d", lost, merr.Missing, merr.Pins)
+	}
+	if !e.has(t, garbage) {
+		t.Fatal("GC removed blocks despite the missing roots")
+	}
+
+	if err := e.pn.Unpin(ctx, lost[0], true); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.pn.Unpin(ctx, lost[1], false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RunGC(ctx, e.bs, e.pn, nil); err != nil {
+		t.Fatal(err)
+	}
+	if e.has(t, garbage) {
+		t.Fatal("garbage block was not removed")
+	}
+}
+
+func TestPinCoverageReport(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+
+	lost := e.addNode(t, "lost leaf")
+	complete := e.addNode(t, "complete", e.addNode(t, "leaf a"), e.addNode(t, "leaf b"))
+	partial := e.addNode(t, "partial", e.addNode(t, "kept leaf"), lost)
+	lostRoot := e.addNode(t, "lost root", e.addNode(t, "child"))
+	direct := e.addNode(t, "direct")
+	lostDirect := e.addNode(t, "lost direct")
+
+	for _, nd := range []*dag.Node{complete, partial, lostRoot} {
+		if err := e.pn.Pin(ctx, nd, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, nd := range []*dag.Node{direct, lostDirect} {
+		if err := e.pn.Pin(ctx, nd, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, nd := range []*dag.Node{lost, lostRoot, lostDirect} {
+		if err := e.bs.DeleteBlock(nd.Key()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exp := map[string]PinCoverage{
+		complete.Cid().String():   {Type: pin.Recursive, BlocksFound: 3, Complete: true},
+		partial.Cid().String():    {Type: pin.Recursive, BlocksFound: 2},
+		lostRoot.Cid().String():   {Type: pin.Recursive, BlocksFound: 0},
+		direct.Cid().String():     {Type: pin.Direct, BlocksFound: 1, Complete: true},
+		lostDirect.Cid().String(): {Type: pin.Direct, BlocksFound: 0},
+	}
+	report := PinCoverageReport(ctx, e.pn, e.dserv)
+	if len(report) != len(exp) {
+		t.Fatalf("expected %d pins in the report, got %v", len(exp), report)
+	}
+	for _, cov := range report {
+		want, ok := exp[cov.Root.String()]
+		if !ok {
+			t.Fatalf("unexpected pin %s in the report", cov.Root)
+		}
+		if cov.Type != want.Type || cov.BlocksFound != want.BlocksFound || cov.Complete != want.Complete || cov.Err != nil {
+			t.Fatalf("pin %s: expected %+v, got %+v", cov.Root, want, cov)
+		}
+	}
+}
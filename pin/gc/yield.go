@@ -0,0 +1,48 @@
+package gc
+
+import (
+	"sync"
+
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+)
+
+// yieldingLock holds the GC lock of a blockstore and can give it up for a
+// moment, letting the pinners queued behind it through before taking it
+// again
+type yieldingLock struct {
+	bs bstore.GCBlockstore
+
+	mu   sync.Mutex
+	held bstore.Unlocker
+}
+
+// yieldable wraps the GC lock of bs in a yieldingLock recorded in o if the
+// run was asked to yield, and returns it unchanged otherwise
+func yieldable(bs bstore.GCBlockstore, unlocker bstore.Unlocker, o *gcOptions) bstore.Unlocker {
+	if o.yieldEvery <= 0 || o.dryRun {
+		return unlocker
+	}
+	o.yield = &yieldingLock{bs: bs, held: unlocker}
+	return o.yield
+}
+
+// yield releases the GC lock and waits to take it again. Pin locks requested
+// while it was held are granted in between.
+func (l *yieldingLock) yield() {
+	l.yieldUntil(func() {})
+}
+
+// yieldUntil releases the GC lock until wait returns, then takes it again
+func (l *yieldingLock) yieldUntil(wait func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.held.Unlock()
+	wait()
+	l.held = l.bs.GCLock()
+}
+
+func (l *yieldingLock) Unlock() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.held.Unlock()
+}
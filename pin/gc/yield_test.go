@@ -0,0 +1,138 @@
+package gc
+
+import (
+	"fmt"
+	"testing"
+
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+
+	context "gx/ipfs/QmZy2y8t9zQH2a1b8q2ZSLKp17ATuJoCNxxyMFG5qFExpt/go-net/context"
+	key "gx/ipfs/Qmce4Y4zg3sYr7xKM5UueS67vhNni6EeWgCRnb7MbLJMew/go-key"
+)
+
+// queuedPinBlockstore lists the blocks in last after all the others, and
+// pins root under the pin lock the first time the GC lock is given up, the
+// way an add queued behind the sweep would
+type queuedPinBlockstore struct {
+	*racingPinBlockstore
+	locks int
+}
+
+func (bs *queuedPinBlockstore) GCLock() bstore.Unlocker {
+	bs.locks++
+	if bs.locks == 2 {
+		u := bs.PinLock()
+		bs.pin()
+		u.Unlock()
+	}
+	return bs.GCBlockstore.GCLock()
+}
+
+func TestGCCooperativeYield(t *testing.T) {
+	ctx := context.Background()
+
+	for _, yield := range []bool{false, true} {
+		e := newTestEnv()
+		for i := 0; i < 100; i++ {
+			e.addNode(t, fmt.Sprintf("garbage %d", i))
+		}
+		child := e.addNode(t, "child")
+		root := e.addNode(t, "root", child)
+
+		bs := &queuedPinBlockstore{
+			racingPinBlockstore: &racingPinBlockstore{
+				GCBlockstore: e.bs,
+				last:         map[key.Key]bool{root.Key(): true, child.Key(): true},
+				// pinned only once the lock is given up
+				pinned: true,
+				pin: func() {
+					if err := e.pn.Pin(ctx, root, true); err != nil {
+						t.Fatal(err)
+					}
+				},
+			},
+		}
+		opts := []GCOption{WithDeleteBatchSize(16)}
+		if yield {
+			opts = append(opts, WithCooperativeYield(10))
+		}
+		out, results, err := GCWithResult(ctx, bs, e.pn, nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		drain(out)
+		res := <-results
+		if len(res.Errors) != 0 {
+			t.Fatalf("unexpected errors: %v", res.Errors)
+		}
+
+		if !yield {
+			if bs.locks != 1 {
+				t.Fatalf("expected the GC lock to be taken once, got %d", bs.locks)
+			}
+			continue
+		}
+		if bs.locks != 11 {
+			t.Fatalf("expected the GC lock to be given up 10 times, got %d", bs.locks-1)
+		}
+		if !e.has(t, root) || !e.has(t, child) {
+			t.Fatal("blocks pinned while the lock was given up were removed")
+		}
+		if res.BlocksRemoved != 100 {
+			t.Fatalf("expected 100 removed blocks, got %d", res.BlocksRemoved)
+		}
+		assertUnlocked(t, e)
+	}
+}
+
+func TestGCCooperativeYieldFalsePositives(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv()
+	for i := 0; i < 100; i++ {
+		e.addNode(t, fmt.Sprintf("garbage %d", i))
+	}
+	root, pinned := buildTree(t, e, "late", 2, 3)
+
+	last := make(map[key.Key]bool)
+	for _, nd := range pinned {
+		last[nd.Key()] = true
+	}
+	bs := &queuedPinBlockstore{
+		racingPinBlockstore: &racingPinBlockstore{
+			GCBlockstore: e.bs,
+			last:         last,
+			pinned:       true,
+			pin: func() {
+				if err := e.pn.Pin(ctx, root, true); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	// the children of the late root look marked already, so a recheck that
+	// prunes on Has would skip everything below them
+	fp := make(map[key.Key]bool)
+	for _, lnk := range root.Links {
+		fp[key.Key(lnk.Hash)] = true
+	}
+	keySet := func() (key.KeySet, error) {
+		return &falsePositiveSet{KeySet: key.NewKeySet(), fp: fp}, nil
+	}
+
+	out, results, err := GCWithResult(ctx, bs, e.pn, nil, WithDeleteBatchSize(16), WithCooperativeYield(10), WithKeySetFactory(keySet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(out)
+	if res := <-results; len(res.Errors) != 0 {
+		t.Fatalf("unexpected errors: %v", res.Errors)
+	}
+	if bs.locks < 2 {
+		t.Fatal("the GC lock was never given up")
+	}
+	for _, nd := range pinned {
+		if !e.has(t, nd) {
+			t.Fatalf("block %s pinned while the lock was given up was removed", nd.Key())
+		}
+	}
+}